@@ -0,0 +1,231 @@
+package admin
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/handle"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+var started = time.Now()
+
+// Commands 在客户端连接上拦截 proxyStatus、proxyRoutes、proxyKillConnection、proxySetFallback，
+// 由代理直接应答而不转发到后端。只允许在 admin 库上执行，且客户端需要以 Users 中的用户认证成功
+type Commands struct {
+	// Users 管理员，形如 user 或 user@db，user 只匹配 admin 库上认证的用户
+	Users []string
+	// Router 为空时 proxyRoutes 返回错误
+	Router *handle.Router
+	// Backends proxySetFallback 的 addr 只能指向其中的后端，并使用该后端的认证信息
+	Backends []handle.Upstream
+}
+
+func NewCommands(users ...string) *Commands {
+	return &Commands{Users: users}
+}
+
+type command func(ctx api.Context, cmd *protocol.Command) (protocol.Document, error)
+
+func (p *Commands) commands() map[string]command {
+	return map[string]command{
+		"proxystatus":         p.status,
+		"proxyroutes":         p.routes,
+		"proxykillconnection": p.killConnection,
+		"proxysetfallback":    p.setFallback,
+	}
+}
+
+func (p *Commands) Handle(ctx api.Context, req protocol.Message) error {
+	cmd, ok := protocol.ParseCommand(req)
+	if !ok {
+		return nil
+	}
+	fn, ok := p.commands()[strings.ToLower(cmd.Name)]
+	if !ok {
+		return nil
+	}
+	if cmd.Database != "admin" {
+		return api.Reject(req, &protocol.CommandError{
+			Code:     protocol.CodeUnauthorized,
+			CodeName: "Unauthorized",
+			Message:  fmt.Sprintf("%s may only be run against the admin database", cmd.Name),
+		})
+	}
+	if !p.authorized(ctx.Identity()) {
+		return api.Reject(req, &protocol.CommandError{
+			Code:     protocol.CodeUnauthorized,
+			CodeName: "Unauthorized",
+			Message:  fmt.Sprintf("not authorized to run %s", cmd.Name),
+		})
+	}
+	doc, err := fn(ctx, cmd)
+	if err != nil {
+		return api.Reject(req, err)
+	}
+	ctx.Logger().Info("admin command", "command", cmd.Name, "user", ctx.Identity().String())
+	return api.Respond(protocol.NewCommandReply(req, append(doc, protocol.Pair{Key: "ok", Val: float64(1)})))
+}
+
+func (p *Commands) authorized(id *api.Identity) bool {
+	if id == nil || !id.Verified {
+		return false
+	}
+	for _, it := range p.Users {
+		user, db, ok := strings.Cut(it, "@")
+		if !ok {
+			db = "admin"
+		}
+		if user == id.User && db == id.Database {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Commands) status(ctx api.Context, cmd *protocol.Command) (protocol.Document, error) {
+	clients := api.Conns("client")
+	conns := make(bson.Array, 0, len(clients))
+	for _, it := range clients {
+		conn := protocol.Document{
+			{Key: "id", Val: it.ID},
+			{Key: "peer", Val: it.Peer},
+			{Key: "user", Val: it.User},
+			{Key: "since", Val: it.Since},
+			{Key: "bytesIn", Val: it.BytesIn},
+			{Key: "bytesOut", Val: it.BytesOut},
+		}
+		if it.Op != nil {
+			conn = append(conn, protocol.Pair{Key: "op", Val: protocol.Document{
+				{Key: "command", Val: it.Op.Command},
+				{Key: "ns", Val: it.Op.Namespace},
+				{Key: "secsRunning", Val: time.Since(it.Op.Since).Seconds()},
+			}})
+		}
+		conns = append(conns, conn)
+	}
+	pools := make(bson.Array, 0)
+	for _, it := range api.Pools() {
+		stats := it.Stats()
+		pools = append(pools, protocol.Document{
+			{Key: "addr", Val: stats.Addr},
+			{Key: "capacity", Val: int64(stats.Capacity)},
+			{Key: "inUse", Val: stats.InUse},
+			{Key: "waits", Val: stats.Waits},
+			{Key: "draining", Val: stats.Draining},
+		})
+	}
+	return protocol.Document{
+		{Key: "uptime", Val: time.Since(started).Seconds()},
+		{Key: "connections", Val: protocol.Document{
+			{Key: "client", Val: int64(len(clients))},
+			{Key: "backend", Val: int64(len(api.Conns("backend")))},
+		}},
+		{Key: "clients", Val: conns},
+		{Key: "pools", Val: pools},
+		{Key: "cursors", Val: int64(len(handle.Cursors()))},
+		{Key: "fallback", Val: fallbackDocument(handle.Fallback())},
+	}, nil
+}
+
+func (p *Commands) routes(ctx api.Context, cmd *protocol.Command) (protocol.Document, error) {
+	if p.Router == nil || p.Router.Table == nil {
+		return nil, &protocol.CommandError{
+			Code:     protocol.CodeIllegalOperation,
+			CodeName: "IllegalOperation",
+			Message:  "no routing table configured",
+		}
+	}
+	routes := make(bson.Array, 0, len(p.Router.Table.Routes))
+	for _, it := range p.Router.Table.Routes {
+		routes = append(routes, protocol.Document{
+			{Key: "database", Val: it.Database.String()},
+			{Key: "collection", Val: it.Collection.String()},
+			{Key: "backend", Val: it.Backend},
+		})
+	}
+	return protocol.Document{
+		{Key: "default", Val: p.Router.Table.Default},
+		{Key: "routes", Val: routes},
+	}, nil
+}
+
+func (p *Commands) killConnection(ctx api.Context, cmd *protocol.Command) (protocol.Document, error) {
+	id, ok := tools.Number(cmd.Args[0].Val)
+	if !ok || id != float64(int64(id)) {
+		return nil, badValue("proxyKillConnection expects a connection id")
+	}
+	if int64(id) == ctx.ID() {
+		return nil, badValue("cannot kill the current connection")
+	}
+	if !api.Kill(int64(id)) {
+		return nil, badValue("connection %d not found", int64(id))
+	}
+	return protocol.Document{{Key: "killed", Val: int64(id)}}, nil
+}
+
+// setFallback 形如 {proxySetFallback: {enabled: false, addr: "host:port"}}，未给出的字段保持不变
+func (p *Commands) setFallback(ctx api.Context, cmd *protocol.Command) (protocol.Document, error) {
+	spec, ok := tools.AsDocument(cmd.Args[0].Val)
+	if !ok {
+		return nil, badValue("proxySetFallback expects a document")
+	}
+	cfg := handle.Fallback()
+	for _, it := range spec {
+		switch it.Key {
+		case "enabled":
+			switch v := it.Val.(type) {
+			case bool:
+				cfg.Enabled = v
+			case bson.Bool:
+				cfg.Enabled = bool(v)
+			default:
+				return nil, badValue("enabled must be a boolean")
+			}
+		case "addr":
+			addr, ok := tools.String(it.Val)
+			if !ok || addr == "" {
+				return nil, badValue("addr must be a non-empty string")
+			}
+			u, ok := p.backend(addr)
+			if !ok {
+				return nil, badValue("addr %q is not a configured backend", addr)
+			}
+			cfg.Addr, cfg.Username, cfg.Password, cfg.Secret = u.Addr, u.Username, u.Password, u.Secret
+		default:
+			return nil, badValue("unknown fallback option %q", it.Key)
+		}
+	}
+	handle.SetFallback(cfg)
+	return protocol.Document{{Key: "fallback", Val: fallbackDocument(cfg)}}, nil
+}
+
+// backend 按地址查找配置中的后端，回退后端的认证信息不能发往其他地址
+func (p *Commands) backend(addr string) (handle.Upstream, bool) {
+	for _, it := range p.Backends {
+		if it.Addr == addr {
+			return it, true
+		}
+	}
+	return handle.Upstream{}, false
+}
+
+// fallbackDocument 不包含认证信息
+func fallbackDocument(cfg handle.FallbackConfig) protocol.Document {
+	return protocol.Document{
+		{Key: "enabled", Val: cfg.Enabled},
+		{Key: "addr", Val: cfg.Addr},
+	}
+}
+
+func badValue(format string, args ...interface{}) error {
+	return &protocol.CommandError{
+		Code:     protocol.CodeBadValue,
+		CodeName: "BadValue",
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
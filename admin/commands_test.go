@@ -0,0 +1,88 @@
+package admin
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/handle"
+	"github.com/jjeffcaii/mongo-proxy/logging"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubContext struct {
+	api.Context
+	identity *api.Identity
+}
+
+func (p *stubContext) Identity() *api.Identity { return p.identity }
+func (p *stubContext) ID() int64               { return 1 }
+func (p *stubContext) Logger() *slog.Logger    { return logging.Default() }
+
+func newCommand(db string, args protocol.Document) protocol.Message {
+	msg := protocol.NewOpMessage()
+	msg.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 11}
+	msg.Body = append(args, protocol.Pair{Key: "$db", Val: db})
+	return msg
+}
+
+func replyOf(t *testing.T, err error) protocol.Document {
+	var res *api.Response
+	if !assert.True(t, errors.As(err, &res)) {
+		return nil
+	}
+	assert.Equal(t, int32(11), res.Reply.Header().ResponseTo)
+	doc, _ := protocol.ReplyDocument(res.Reply)
+	return doc
+}
+
+func TestCommands(t *testing.T) {
+	defer handle.SetFallback(handle.Fallback())
+	p := NewCommands("root", "ops@ops")
+	p.Backends = []handle.Upstream{{Name: "archive", Addr: "10.0.0.2:27017", Username: "archive", Password: "secret"}}
+	ctx := &stubContext{identity: &api.Identity{User: "root", Database: "admin"}}
+
+	// 未经后端确认的身份不能执行
+	status := newCommand("admin", protocol.Document{{Key: "proxyStatus", Val: int32(1)}})
+	code, _ := protocol.Load(replyOf(t, p.Handle(ctx, status)), "code")
+	assert.Equal(t, protocol.CodeUnauthorized, code)
+
+	ctx.identity.Verified = true
+	doc := replyOf(t, p.Handle(ctx, status))
+	ok, _ := protocol.Load(doc, "ok")
+	assert.Equal(t, float64(1), ok)
+	_, hasPools := protocol.Load(doc, "pools")
+	assert.True(t, hasPools)
+
+	code, _ = protocol.Load(replyOf(t, p.Handle(ctx, newCommand("app", protocol.Document{{Key: "proxyStatus", Val: int32(1)}}))), "code")
+	assert.Equal(t, protocol.CodeUnauthorized, code)
+
+	set := newCommand("admin", protocol.Document{{Key: "proxySetFallback", Val: protocol.Document{
+		{Key: "enabled", Val: false},
+		{Key: "addr", Val: "10.0.0.2:27017"},
+	}}})
+	replyOf(t, p.Handle(ctx, set))
+	assert.Equal(t, false, handle.Fallback().Enabled)
+	assert.Equal(t, "10.0.0.2:27017", handle.Fallback().Addr)
+	assert.Equal(t, "archive", handle.Fallback().Username)
+
+	// 回退后端的认证信息不能发往未配置的地址
+	set = newCommand("admin", protocol.Document{{Key: "proxySetFallback", Val: protocol.Document{{Key: "addr", Val: "evil.example.com:27017"}}}})
+	code, _ = protocol.Load(replyOf(t, p.Handle(ctx, set)), "code")
+	assert.Equal(t, protocol.CodeBadValue, code)
+	assert.Equal(t, "10.0.0.2:27017", handle.Fallback().Addr)
+
+	code, _ = protocol.Load(replyOf(t, p.Handle(ctx, newCommand("admin", protocol.Document{{Key: "proxyKillConnection", Val: "x"}}))), "code")
+	assert.Equal(t, protocol.CodeBadValue, code)
+
+	// 其他命令照常转发
+	assert.NoError(t, p.Handle(ctx, newCommand("admin", protocol.Document{{Key: "ping", Val: int32(1)}})))
+
+	ctx.identity = &api.Identity{User: "ops", Database: "ops", Verified: true}
+	replyOf(t, p.Handle(ctx, status))
+	ctx.identity = &api.Identity{User: "ops", Database: "admin", Verified: true}
+	code, _ = protocol.Load(replyOf(t, p.Handle(ctx, status)), "code")
+	assert.Equal(t, protocol.CodeUnauthorized, code)
+}
@@ -0,0 +1,217 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/handle"
+	"github.com/jjeffcaii/mongo-proxy/logging"
+	"github.com/jjeffcaii/mongo-proxy/metrics"
+)
+
+// Server 管理接口，查看连接、连接池、虚拟游标与路由表，并提供断开连接、摘除后端与重新加载配置
+type Server struct {
+	// Token 非空时请求需要携带 Authorization: Bearer <Token>，为空时只接受本机的请求
+	Token string
+	// Router 返回当前的路由器，配置重新加载后可能变化，为空或返回 nil 时 /routes 返回 404
+	Router func() *handle.Router
+	// Reload 重新加载配置，为空时 /reload 返回 501
+	Reload func() error
+	Logger *slog.Logger
+}
+
+func NewServer() *Server {
+	return &Server{Logger: logging.Default()}
+}
+
+// Handler 返回管理接口的路由
+func (p *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", p.listConnections)
+	mux.HandleFunc("DELETE /connections/{id}", p.killConnection)
+	mux.HandleFunc("GET /pools", p.listPools)
+	mux.HandleFunc("POST /pools/{addr}/drain", p.drainPool)
+	mux.HandleFunc("POST /pools/{addr}/resume", p.resumePool)
+	mux.HandleFunc("GET /cursors", p.listCursors)
+	mux.HandleFunc("GET /routes", p.listRoutes)
+	mux.HandleFunc("POST /reload", p.reload)
+	mux.Handle("GET /metrics", metrics.Handler())
+	return p.authorize(mux)
+}
+
+// ListenAndServe 在 addr 上提供管理接口，阻塞直到出错
+func (p *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, p.Handler())
+}
+
+// authorize 未配置 Token 时只接受本机的请求，/metrics 也一样
+func (p *Server) authorize(next http.Handler) http.Handler {
+	if p.Token == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !loopback(r.RemoteAddr) {
+				writeError(w, http.StatusForbidden, errors.New("a token is required for remote access"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	want := []byte("Bearer " + p.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func loopback(remote string) bool {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listConnections 默认只列出客户端连接，?side=backend 列出后端连接，?side=all 列出全部
+func (p *Server) listConnections(w http.ResponseWriter, r *http.Request) {
+	side := r.URL.Query().Get("side")
+	switch side {
+	case "":
+		side = "client"
+	case "all":
+		side = ""
+	}
+	writeJSON(w, http.StatusOK, api.Conns(side))
+}
+
+func (p *Server) killConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid connection id"))
+		return
+	}
+	if !api.Kill(id) {
+		writeError(w, http.StatusNotFound, errors.New("connection not found"))
+		return
+	}
+	p.Logger.Info("connection killed by admin", "conn", id, "remote", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Server) listPools(w http.ResponseWriter, r *http.Request) {
+	out := make([]api.PoolStats, 0)
+	for _, it := range api.Pools() {
+		out = append(out, it.Stats())
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (p *Server) drainPool(w http.ResponseWriter, r *http.Request) {
+	p.withPool(w, r, func(pool *api.Pool) {
+		pool.Drain()
+		p.Logger.Info("backend drained by admin", "addr", r.PathValue("addr"), "remote", r.RemoteAddr)
+	})
+}
+
+func (p *Server) resumePool(w http.ResponseWriter, r *http.Request) {
+	p.withPool(w, r, func(pool *api.Pool) {
+		pool.Resume()
+		p.Logger.Info("backend resumed by admin", "addr", r.PathValue("addr"), "remote", r.RemoteAddr)
+	})
+}
+
+func (p *Server) withPool(w http.ResponseWriter, r *http.Request, fn func(pool *api.Pool)) {
+	pool, ok := api.LookupPool(r.PathValue("addr"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("pool not found"))
+		return
+	}
+	fn(pool)
+	writeJSON(w, http.StatusOK, pool.Stats())
+}
+
+func (p *Server) listCursors(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, handle.Cursors())
+}
+
+type routeView struct {
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+	Backend    string `json:"backend"`
+}
+
+type backendView struct {
+	Name     string `json:"name"`
+	Addr     string `json:"addr"`
+	MaxConns int    `json:"maxConns,omitempty"`
+}
+
+type routesView struct {
+	Default  string        `json:"default"`
+	Routes   []routeView   `json:"routes"`
+	Backends []backendView `json:"backends"`
+}
+
+// listRoutes 输出路由表与后端，不包含认证信息
+func (p *Server) listRoutes(w http.ResponseWriter, r *http.Request) {
+	var router *handle.Router
+	if p.Router != nil {
+		router = p.Router()
+	}
+	if router == nil || router.Table == nil {
+		writeError(w, http.StatusNotFound, errors.New("no routing table configured"))
+		return
+	}
+	view := routesView{
+		Default:  router.Table.Default,
+		Routes:   make([]routeView, 0, len(router.Table.Routes)),
+		Backends: make([]backendView, 0, len(router.Upstreams)),
+	}
+	for _, it := range router.Table.Routes {
+		view.Routes = append(view.Routes, routeView{
+			Database:   it.Database.String(),
+			Collection: it.Collection.String(),
+			Backend:    it.Backend,
+		})
+	}
+	for _, it := range router.Upstreams {
+		view.Backends = append(view.Backends, backendView{Name: it.Name, Addr: it.Addr, MaxConns: it.MaxConns})
+	}
+	sort.Slice(view.Backends, func(i, j int) bool { return view.Backends[i].Name < view.Backends[j].Name })
+	writeJSON(w, http.StatusOK, view)
+}
+
+func (p *Server) reload(w http.ResponseWriter, r *http.Request) {
+	if p.Reload == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("reload is not configured"))
+		return
+	}
+	if err := p.Reload(); err != nil {
+		p.Logger.Error("reload configuration failed", "err", err)
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	p.Logger.Info("configuration reloaded by admin", "remote", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,94 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	addr := ln.Addr().String()
+	pool := api.SharedPool(addr, 1)
+	c, err := pool.Get()
+	assert.NoError(t, err)
+	defer c.Close()
+
+	srv := NewServer()
+	srv.Token = "s3cret"
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	do := func(method, path string, out interface{}) int {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		if out != nil {
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(out))
+		}
+		return res.StatusCode
+	}
+
+	res, err := http.Get(ts.URL + "/connections")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	var conns []api.ConnInfo
+	assert.Equal(t, http.StatusOK, do("GET", "/connections?side=backend", &conns))
+	if assert.Len(t, conns, 1) {
+		assert.Equal(t, c.ID(), conns[0].ID)
+		assert.Equal(t, addr, conns[0].Peer)
+	}
+
+	var stats api.PoolStats
+	assert.Equal(t, http.StatusOK, do("POST", "/pools/"+addr+"/drain", &stats))
+	assert.True(t, stats.Draining)
+	assert.Equal(t, int64(1), stats.InUse)
+	_, err = pool.Get()
+	assert.Equal(t, api.ErrPoolDraining, err)
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/connections/"+strconv.FormatInt(c.ID(), 10), nil))
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/connections/"+strconv.FormatInt(c.ID(), 10), nil))
+	assert.Eventually(t, func() bool { return pool.Stats().InUse == 0 }, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, http.StatusNotFound, do("GET", "/routes", nil))
+	assert.Equal(t, http.StatusNotImplemented, do("POST", "/reload", nil))
+}
+
+func TestServer_Loopback(t *testing.T) {
+	// 未配置 token 时只接受本机的请求，包括 /metrics
+	handler := NewServer().Handler()
+	for _, path := range []string{"/metrics", "/connections"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.0.2.1:40000"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code, path)
+
+		req.RemoteAddr = "127.0.0.1:40000"
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+	}
+}
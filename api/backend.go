@@ -2,16 +2,17 @@ package api
 
 import (
 	"errors"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 )
 
 type MongoBackend struct {
-	mutex *sync.Mutex
-	addr  string
-	conn  net.Conn
+	mutex  *sync.Mutex
+	addr   string
+	conn   net.Conn
+	logger *slog.Logger
 }
 
 func (p *MongoBackend) Close() error {
@@ -27,10 +28,12 @@ func (p *MongoBackend) Close() error {
 type BackendOption struct {
 }
 
-func NewBackend(addr string) *MongoBackend {
+func NewBackend(addr string, opts ...Option) *MongoBackend {
+	o := newOptions(opts)
 	return &MongoBackend{
-		mutex: &sync.Mutex{},
-		addr:  addr,
+		mutex:  &sync.Mutex{},
+		addr:   addr,
+		logger: o.logger,
 	}
 }
 
@@ -40,10 +43,10 @@ func (p *MongoBackend) NewConn() (Context, error) {
 	}
 	tcpConn, err := net.DialTimeout("tcp", p.addr, 15*time.Second)
 	if err != nil {
-		log.Println("connect backend failed:", err)
+		p.logger.Error("connect backend failed", "addr", p.addr, "err", err)
 		return nil, err
 	}
 	p.conn = tcpConn
-	ctx := newContext(tcpConn)
+	ctx := newContext(tcpConn, sideBackend, p.logger)
 	return ctx, nil
 }
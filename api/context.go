@@ -2,11 +2,18 @@ package api
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/jjeffcaii/mongo-proxy/logging"
+	"github.com/jjeffcaii/mongo-proxy/metrics"
 	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/trace"
 )
 
 type errInvalidOp struct {
@@ -17,13 +24,50 @@ func (p *errInvalidOp) Error() string {
 	return fmt.Sprintf("bad message with opcode %d", p.code)
 }
 
+const (
+	sideClient  = "client"
+	sideBackend = "backend"
+)
+
+// pendingRequest 等待响应的请求及其发送时间，span 为请求在本连接上的 Span
+type pendingRequest struct {
+	msg  protocol.Message
+	at   time.Time
+	span *trace.Span
+}
+
+// 连接 id 计数器，客户端与后端连接共用
+var connSeq atomic.Int64
+
 type implContext struct {
+	id          int64
+	side        string
+	logger      *slog.Logger
 	reqId       int32
 	conn        net.Conn
 	middlewares []Middleware
 	splicer     *splicer
 	writer      *bufio.Writer
+	wmu         sync.Mutex
 	queue       chan protocol.Message
+	readOnce    sync.Once
+	identity    atomic.Pointer[Identity]
+	responses   []ResponseMiddleware
+	taps        []Tap
+	// sent 已发出、等待响应的请求，key 为发送时分配的 RequestID；
+	// received 已收到、尚未应答的请求，只在注册了响应中间件时记录
+	pmu      sync.Mutex
+	sent     map[int32]pendingRequest
+	received map[int32]pendingRequest
+	// authenticating 代理自身正在向后端认证，此时的认证失败不计入客户端
+	authenticating atomic.Bool
+	closeOnce      sync.Once
+	onClose        func()
+	tracer         *trace.Tracer
+	created        time.Time
+	bytesIn        atomic.Int64
+	bytesOut       atomic.Int64
+	op             atomic.Pointer[CurrentOp]
 }
 
 func (p *implContext) Use(middlewares ...Middleware) Context {
@@ -35,10 +79,73 @@ func (p *implContext) Use(middlewares ...Middleware) Context {
 	return p
 }
 
+func (p *implContext) UseResponse(middlewares ...ResponseMiddleware) Context {
+	for _, it := range middlewares {
+		if it != nil {
+			p.responses = append(p.responses, it)
+		}
+	}
+	return p
+}
+
+func (p *implContext) UseTracer(tracer *trace.Tracer) Context {
+	p.tracer = tracer
+	return p
+}
+
+func (p *implContext) UseTap(taps ...Tap) Context {
+	for _, it := range taps {
+		if it != nil {
+			p.taps = append(p.taps, it)
+		}
+	}
+	return p
+}
+
+func (p *implContext) tap(direction string, bs []byte) {
+	for _, it := range p.taps {
+		it.Frame(p, direction, bs)
+	}
+}
+
+// Next 第一次调用时才开始读取连接，保证之前通过 Use、UseResponse、UseTap 注册的中间件
+// 对第一个请求就生效，注册过程也不会与读循环并发
 func (p *implContext) Next() <-chan protocol.Message {
+	p.readOnce.Do(func() {
+		go p.readLoop()
+	})
 	return p.queue
 }
 
+func (p *implContext) readLoop() {
+	for {
+		next, err := p.nextMessage()
+		if err != nil {
+			break
+		}
+		if next != nil {
+			p.queue <- next
+		}
+	}
+	close(p.queue)
+}
+
+func (p *implContext) Identity() *Identity {
+	return p.identity.Load()
+}
+
+func (p *implContext) ID() int64 {
+	return p.id
+}
+
+func (p *implContext) Logger() *slog.Logger {
+	return p.logger
+}
+
+func (p *implContext) RemoteAddr() net.Addr {
+	return p.conn.RemoteAddr()
+}
+
 func (p *implContext) SendMessage(msg protocol.Message) error {
 	h := msg.Header()
 	if h == nil {
@@ -53,6 +160,12 @@ func (p *implContext) SendMessage(msg protocol.Message) error {
 	h.ResponseTo = 0
 
 	bs, err := msg.Encode()
+	if err == nil {
+		logging.Dump(p.logger, "out", msg)
+	}
+	if err == nil && protocol.ExpectsReply(msg) {
+		p.track(p.sent, reqID, msg, p.backendSpan(msg))
+	}
 
 	h.RequestID = oldReq
 	h.ResponseTo = oldResp
@@ -63,7 +176,129 @@ func (p *implContext) SendMessage(msg protocol.Message) error {
 	return p.Send(bs)
 }
 
+func (p *implContext) Reply(msg protocol.Message) error {
+	h := msg.Header()
+	if h == nil {
+		return fmt.Errorf("nil header in %T", msg)
+	}
+	return p.reply(p.take(p.received, h.ResponseTo, msg), msg)
+}
+
+// reply 经过响应中间件后写回响应，保留其中的 ResponseTo
+func (p *implContext) reply(pending pendingRequest, msg protocol.Message) error {
+	req := pending.msg
+	if req != nil {
+		var err error
+		if msg, err = p.handleResponse(req, msg); err != nil {
+			p.finish(pending, err)
+			if err == Ignore {
+				return nil
+			}
+			return err
+		}
+	}
+	h := msg.Header()
+	if h == nil {
+		return fmt.Errorf("nil header in %T", msg)
+	}
+	h.RequestID = atomic.AddInt32(&p.reqId, 1)
+	encode := pending.span.Child("encode")
+	bs, err := msg.Encode()
+	if err == nil {
+		logging.Dump(p.logger, "out", msg)
+		err = p.Send(bs)
+	}
+	encode.SetError(err).End()
+	if err == nil && req != nil && authSucceeded(req, msg) {
+		p.verify()
+	}
+	if !p.moreToCome(msg) {
+		annotateReply(pending.span, req, msg)
+		p.finish(pending, err)
+	}
+	return err
+}
+
+// verify 后端确认认证成功后标记当前身份
+func (p *implContext) verify() {
+	id := p.identity.Load()
+	if id == nil || id.Verified {
+		return
+	}
+	verified := *id
+	verified.Verified = true
+	p.identity.CompareAndSwap(id, &verified)
+}
+
+// finish 请求已应答，清除当前操作并结束根 Span
+func (p *implContext) finish(pending pendingRequest, err error) {
+	p.op.Store(nil)
+	if pending.span == nil {
+		return
+	}
+	if err != Ignore {
+		pending.span.SetError(err)
+	}
+	pending.span.End()
+	unbindSpan(pending.msg)
+}
+
+func (p *implContext) moreToCome(msg protocol.Message) bool {
+	v, ok := msg.(*protocol.OpMessage)
+	return ok && v.FlagBits&protocol.MsgFlagMoreToCome != 0
+}
+
+// backendSpan 为发往后端的请求创建子 Span，请求不属于任何客户端 Span 时返回 nil
+func (p *implContext) backendSpan(msg protocol.Message) *trace.Span {
+	span := SpanOf(msg).Child("backend")
+	if span != nil {
+		annotate(span, msg)
+		span.SetAttribute("net.peer", p.conn.RemoteAddr().String())
+	}
+	return span
+}
+
+func (p *implContext) handleResponse(req, reply protocol.Message) (protocol.Message, error) {
+	for _, it := range p.responses {
+		next, err := it.HandleResponse(p, req, reply)
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			return nil, Ignore
+		}
+		reply = next
+	}
+	return reply, nil
+}
+
+func (p *implContext) track(m map[int32]pendingRequest, id int32, req protocol.Message, span *trace.Span) {
+	p.pmu.Lock()
+	m[id] = pendingRequest{msg: req, at: time.Now(), span: span}
+	p.pmu.Unlock()
+}
+
+// take 取出响应对应的请求，带 moreToCome 的 OP_MSG 响应之后还有后续响应，请求继续保留
+func (p *implContext) take(m map[int32]pendingRequest, id int32, reply protocol.Message) pendingRequest {
+	p.pmu.Lock()
+	defer p.pmu.Unlock()
+	req, ok := m[id]
+	if !ok {
+		return pendingRequest{}
+	}
+	if !p.moreToCome(reply) {
+		delete(m, id)
+	}
+	return req
+}
+
 func (p *implContext) Send(bs []byte) error {
+	// 中间件可能在读协程中直接应答，写操作需要串行
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	metrics.Bytes.Add(float64(len(bs)), p.side, "out")
+	p.bytesOut.Add(int64(len(bs)))
+	p.tap("out", bs)
 	_, err := p.writer.Write(bs)
 	if err != nil {
 		return err
@@ -72,98 +307,165 @@ func (p *implContext) Send(bs []byte) error {
 }
 
 func (p *implContext) Close() error {
+	p.closeOnce.Do(func() {
+		registry.Delete(p.id)
+		metrics.Connections.Dec(p.side)
+		if p.onClose != nil {
+			p.onClose()
+		}
+		p.abandon()
+	})
 	p.splicer.Close()
 	return p.conn.Close()
 }
 
+// abandon 结束连接关闭时仍在等待响应的 Span
+func (p *implContext) abandon() {
+	p.pmu.Lock()
+	defer p.pmu.Unlock()
+	for _, m := range []map[int32]pendingRequest{p.sent, p.received} {
+		for id, it := range m {
+			if it.span != nil {
+				it.span.SetError(errConnClosed).End()
+				if p.side == sideClient {
+					unbindSpan(it.msg)
+				}
+			}
+			delete(m, id)
+		}
+	}
+}
+
 func (p *implContext) nextMessage() (protocol.Message, error) {
 	var bs []byte
 	data, err := p.splicer.next()
 	if err != nil {
 		return nil, err
 	}
+	start := time.Now()
 	bs = data.Bytes()
-	var msg protocol.Message
+	metrics.Bytes.Add(float64(len(bs)), p.side, "in")
+	p.bytesIn.Add(int64(len(bs)))
+	p.tap("in", bs)
 	opcode := protocol.ParseOpCode(bs)
-	switch opcode {
-	case protocol.OpCodeReply:
-		msg = protocol.NewOpReply()
-		break
-	case protocol.OpCodeMsg:
-		msg = protocol.NewOpMsg()
-		break
-	case protocol.OpCodeUpdate:
-		msg = protocol.NewOpUpdate()
-		break
-	case protocol.OpCodeInsert:
-		msg = protocol.NewOpInsert()
-		break
-	case protocol.OpReserved:
-		// TODO: RESERVED
-		break
-	case protocol.OpCodeQuery:
-		msg = protocol.NewOpQuery()
-		break
-	case protocol.OpCodeGetMore:
-		msg = protocol.NewOpGetMore()
-		break
-	case protocol.OpCodeDel:
-		msg = protocol.NewOpDelete()
-		break
-	case protocol.OpCodeKillCursor:
-		msg = protocol.NewOpKillCursors()
-		break
-	case protocol.OpCodeCmd:
-		msg = protocol.NewOpCommand()
-		break
-	case protocol.OpCodeCmdReply:
-		msg = protocol.NewOpCommandReply()
-		break
-	default:
-		break
-	}
+	msg := protocol.NewMessage(opcode)
 	if msg == nil {
 		return nil, &errInvalidOp{opcode}
 	}
 	if err := msg.Decode(bs); err != nil {
+		p.logger.Warn("decode message failed", "opcode", opcode.String(), "err", err)
 		return nil, err
 	}
-	p.reqId = msg.Header().RequestID
+	logging.Dump(p.logger, "in", msg)
+	if id, ok := SniffIdentity(msg); ok {
+		p.identity.Store(id)
+	}
+	var span *trace.Span
+	if p.side == sideClient && !protocol.IsReply(msg) {
+		metrics.Requests.Inc(opcode.String(), commandLabel(msg))
+		span = p.requestSpan(msg, start)
+		if protocol.ExpectsReply(msg) {
+			p.begin(msg, bs)
+		}
+	}
 	// 跑中间件
+	chain := span.Child("middleware")
 	for _, it := range p.middlewares {
 		err = it.Handle(p, msg)
 		if err != nil {
 			break
 		}
 	}
+	if err != Ignore {
+		chain.SetError(err)
+	}
+	chain.End()
 	if err == Ignore {
+		span.End()
 		return nil, nil
 	}
+	var res *Response
+	if errors.As(err, &res) {
+		if res.Reply == nil {
+			span.End()
+			return nil, nil
+		}
+		return nil, p.reply(pendingRequest{msg: msg, span: span}, res.Reply)
+	}
+	if protocol.IsReply(msg) {
+		return p.correlate(msg)
+	}
+	if (len(p.responses) > 0 || span != nil || isAuth(msg)) && protocol.ExpectsReply(msg) {
+		bindSpan(msg, span)
+		p.track(p.received, msg.Header().RequestID, msg, span)
+	} else {
+		span.End()
+	}
 	if err != nil && err != EOF {
 		return nil, err
 	}
 	return msg, nil
 }
 
-func newContext(conn net.Conn) Context {
+// requestSpan 为客户端请求创建根 Span，start 为开始解码的时间，comment 中带有链路上下文时沿用
+func (p *implContext) requestSpan(msg protocol.Message, start time.Time) *trace.Span {
+	if p.tracer == nil {
+		return nil
+	}
+	parent, _ := trace.Extract(msg)
+	span := p.tracer.StartAt("mongo.request", parent, start)
+	span.ChildAt("decode", start).End()
+	annotate(span, msg)
+	span.SetAttribute("net.peer", p.conn.RemoteAddr().String())
+	return span
+}
+
+// correlate 将后端响应的 ResponseTo 还原为原始请求的 RequestID，并执行响应中间件
+func (p *implContext) correlate(msg protocol.Message) (protocol.Message, error) {
+	pending := p.take(p.sent, msg.Header().ResponseTo, msg)
+	req := pending.msg
+	if req == nil {
+		return msg, nil
+	}
+	msg.Header().ResponseTo = req.Header().RequestID
+	p.observe(pending, msg)
+	if !p.moreToCome(msg) {
+		annotateReply(pending.span, req, msg)
+		pending.span.End()
+	}
+	res, err := p.handleResponse(req, msg)
+	if err == Ignore {
+		return nil, nil
+	}
+	return res, err
+}
+
+// observe 记录后端延迟以及客户端的认证失败
+func (p *implContext) observe(pending pendingRequest, reply protocol.Message) {
+	op, _, _ := protocol.Operation(pending.msg)
+	// 命名空间来自客户端，作为标签会无限增长，只按有限的命令名区分
+	metrics.BackendLatency.Observe(time.Since(pending.at).Seconds(), p.conn.RemoteAddr().String(), commandLabel(pending.msg))
+	if logging.AuthCommands[op] && !p.authenticating.Load() && protocol.Summarize(pending.msg, reply).Code != 0 {
+		metrics.AuthFailures.Inc(sideClient)
+	}
+}
+
+func newContext(conn net.Conn, side string, logger *slog.Logger) Context {
+	metrics.Connections.Inc(side)
+	id := connSeq.Add(1)
 	ctx := &implContext{
+		id:          id,
+		side:        side,
+		logger:      logger.With("conn", id, "side", side, "peer", conn.RemoteAddr().String()),
 		conn:        conn,
 		middlewares: make([]Middleware, 0),
 		splicer:     NewSplicer(bufio.NewReader(conn)),
 		writer:      bufio.NewWriter(conn),
 		queue:       make(chan protocol.Message),
+		sent:        make(map[int32]pendingRequest),
+		received:    make(map[int32]pendingRequest),
+		created:     time.Now(),
 	}
-	go func(q chan<- protocol.Message) {
-		for {
-			next, err := ctx.nextMessage()
-			if err != nil {
-				break
-			}
-			if next != nil {
-				q <- next
-			}
-		}
-		close(q)
-	}(ctx.queue)
+	registry.Store(id, ctx)
 	return ctx
 }
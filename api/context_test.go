@@ -0,0 +1,243 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/logging"
+	"github.com/jjeffcaii/mongo-proxy/metrics"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/trace"
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordResponse struct {
+	reqs []protocol.Message
+}
+
+func (p *recordResponse) HandleResponse(ctx Context, req, reply protocol.Message) (protocol.Message, error) {
+	p.reqs = append(p.reqs, req)
+	protocol.SetReplyDocument(reply, protocol.Document{{Key: "ok", Val: float64(1)}, {Key: "seen", Val: true}})
+	return reply, nil
+}
+
+func TestCorrelateResponse(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	rec := &recordResponse{}
+	ctx := newContext(local, sideBackend, logging.Default()).UseResponse(rec)
+	defer ctx.Close()
+
+	req := protocol.NewOpMessage()
+	req.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 77}
+	req.Body = protocol.Document{{Key: "ping", Val: int32(1)}, {Key: "$db", Val: "admin"}}
+	go func() {
+		assert.NoError(t, ctx.SendMessage(req))
+	}()
+
+	// 模拟后端读取请求并应答
+	data, err := NewSplicer(bufio.NewReader(remote)).next()
+	assert.NoError(t, err)
+	sent := protocol.NewOpMessage()
+	assert.NoError(t, sent.Decode(data.Bytes()))
+	assert.NotEqual(t, int32(77), sent.Header().RequestID)
+
+	res := protocol.NewCommandReply(sent, protocol.Document{{Key: "ok", Val: float64(1)}})
+	res.Header().RequestID = 5
+	bs, err := res.Encode()
+	assert.NoError(t, err)
+	go remote.Write(bs)
+
+	reply := <-ctx.Next()
+	assert.Equal(t, int32(77), reply.Header().ResponseTo)
+	assert.Len(t, rec.reqs, 1)
+	doc, _ := protocol.ReplyDocument(reply)
+	seen, _ := protocol.Load(doc, "seen")
+	assert.Equal(t, true, seen)
+}
+
+type countMiddleware struct {
+	n int
+}
+
+func (p *countMiddleware) Handle(ctx Context, req protocol.Message) error {
+	p.n++
+	return nil
+}
+
+func TestUseBeforeNext(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	ctx := newContext(local, sideClient, logging.Default())
+	defer ctx.Close()
+
+	req := protocol.NewOpMessage()
+	req.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 1}
+	req.Body = protocol.Document{{Key: "ping", Val: int32(1)}, {Key: "$db", Val: "admin"}}
+	bs, err := req.Encode()
+	assert.NoError(t, err)
+	go remote.Write(bs)
+
+	// 客户端连上后立即发送请求，中间件注册之前不能被读走
+	time.Sleep(20 * time.Millisecond)
+	mw := &countMiddleware{}
+	ctx.Use(mw)
+	<-ctx.Next()
+	assert.Equal(t, 1, mw.n)
+}
+
+type recordTap struct {
+	mu     sync.Mutex
+	frames []string
+}
+
+func (p *recordTap) Frame(ctx Context, direction string, bs []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.frames = append(p.frames, direction)
+}
+
+func TestUseTapBeforeNext(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	ctx := newContext(local, sideClient, logging.Default())
+	defer ctx.Close()
+
+	req := protocol.NewOpMessage()
+	req.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 1}
+	req.Body = protocol.Document{{Key: "ping", Val: int32(1)}, {Key: "$db", Val: "admin"}}
+	bs, err := req.Encode()
+	assert.NoError(t, err)
+	go remote.Write(bs)
+
+	// 抓包需要包括连接上的第一个帧
+	time.Sleep(20 * time.Millisecond)
+	tap := &recordTap{}
+	ctx.UseTap(tap)
+	<-ctx.Next()
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	assert.Equal(t, []string{"in"}, tap.frames)
+}
+
+func TestTraceRequest(t *testing.T) {
+	exporter := trace.NewMemoryExporter()
+	clientLocal, clientRemote := net.Pipe()
+	defer clientRemote.Close()
+	client := newContext(clientLocal, sideClient, logging.Default()).UseTracer(trace.NewTracer(exporter))
+	defer client.Close()
+	backendLocal, backendRemote := net.Pipe()
+	defer backendRemote.Close()
+	backend := newContext(backendLocal, sideBackend, logging.Default())
+	defer backend.Close()
+
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	find := protocol.NewOpMessage()
+	find.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 9}
+	find.Body = protocol.Document{
+		{Key: "find", Val: "users"},
+		{Key: "comment", Val: "traceparent=" + parent},
+		{Key: "$db", Val: "app"},
+	}
+	bs, err := find.Encode()
+	assert.NoError(t, err)
+	go clientRemote.Write(bs)
+	req := <-client.Next()
+	// 管理接口中正在处理的请求
+	if op := client.(*implContext).Info().Op; assert.NotNil(t, op) {
+		out, err := json.Marshal(op)
+		assert.NoError(t, err)
+		assert.Contains(t, string(out), `"document":{"find":"users","comment":"traceparent=`+parent+`","$db":"app"}`)
+	}
+
+	go func() {
+		assert.NoError(t, backend.SendMessage(req))
+	}()
+	data, err := NewSplicer(bufio.NewReader(backendRemote)).next()
+	assert.NoError(t, err)
+	sent := protocol.NewOpMessage()
+	assert.NoError(t, sent.Decode(data.Bytes()))
+	res := protocol.NewCommandReply(sent, protocol.Document{
+		{Key: "cursor", Val: protocol.Document{
+			{Key: "id", Val: int64(42)},
+			{Key: "ns", Val: "app.users"},
+			{Key: "firstBatch", Val: bson.Array{}},
+		}},
+		{Key: "ok", Val: float64(1)},
+	})
+	bs, err = res.Encode()
+	assert.NoError(t, err)
+	go backendRemote.Write(bs)
+	reply := <-backend.Next()
+	// 后端延迟按命令名而不是客户端给出的命名空间区分
+	assert.NotZero(t, metrics.BackendLatency.Count(backendLocal.RemoteAddr().String(), "find"))
+
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, client.Reply(reply))
+		close(done)
+	}()
+	_, err = NewSplicer(bufio.NewReader(clientRemote)).next()
+	assert.NoError(t, err)
+	<-done
+
+	root := exporter.Find("mongo.request")
+	if assert.NotNil(t, root) {
+		sc, _ := trace.ParseTraceparent(parent)
+		assert.Equal(t, sc.TraceID, root.Context.TraceID)
+		assert.Equal(t, sc.SpanID, root.Parent)
+		assert.Equal(t, "app.users", root.Attribute("db.namespace"))
+		assert.Equal(t, int64(42), root.Attribute("db.cursor_id"))
+	}
+	for _, name := range []string{"decode", "middleware", "backend", "encode"} {
+		span := exporter.Find(name)
+		if assert.NotNil(t, span, name) {
+			assert.Equal(t, root.Context.SpanID, span.Parent, name)
+		}
+	}
+	assert.Equal(t, int64(42), exporter.Find("backend").Attribute("db.cursor_id"))
+	assert.Nil(t, SpanOf(req))
+}
+
+func TestAuthSucceeded(t *testing.T) {
+	req := protocol.NewOpMessage()
+	req.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 3}
+	req.Body = protocol.Document{{Key: "saslContinue", Val: int32(1)}, {Key: "$db", Val: "admin"}}
+	reply := func(doc protocol.Document) protocol.Message {
+		return protocol.NewCommandReply(req, doc)
+	}
+	assert.False(t, authSucceeded(req, reply(protocol.Document{{Key: "done", Val: false}, {Key: "ok", Val: float64(1)}})))
+	assert.True(t, authSucceeded(req, reply(protocol.Document{{Key: "done", Val: true}, {Key: "ok", Val: float64(1)}})))
+	assert.False(t, authSucceeded(req, reply(protocol.Document{{Key: "ok", Val: float64(0)}, {Key: "code", Val: int32(18)}})))
+
+	find := protocol.NewOpMessage()
+	find.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 4}
+	find.Body = protocol.Document{{Key: "find", Val: "users"}, {Key: "$db", Val: "admin"}}
+	assert.False(t, authSucceeded(find, reply(protocol.Document{{Key: "done", Val: true}, {Key: "ok", Val: float64(1)}})))
+}
+
+func TestSplicer_Malformed(t *testing.T) {
+	// 只有消息头的帧原样返回，由解码器报错
+	header := []byte{0x10, 0, 0, 0, 0x01, 0, 0, 0, 0, 0, 0, 0, 0xdd, 0x07, 0, 0}
+	s := NewSplicer(bufio.NewReader(bytes.NewReader(append(header, header...))))
+	for i := 0; i < 2; i++ {
+		bs, err := s.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, header, bs)
+		_, err = protocol.Decode(bs)
+		assert.Error(t, err)
+	}
+
+	for _, size := range []byte{0x0f, 0xff} {
+		bs := append([]byte{}, header...)
+		bs[0], bs[3] = size, size
+		_, err := NewSplicer(bufio.NewReader(bytes.NewReader(bs))).Next()
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/logging"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+// Identity 客户端在认证命令中声明的身份，密码由后端校验，认证失败的连接无法访问需要权限的数据
+type Identity struct {
+	User      string
+	Database  string
+	Mechanism string
+	// Verified 后端已确认认证成功，只由代理自身做授权判断时必须检查
+	Verified bool
+}
+
+func (p *Identity) String() string {
+	return p.User + "@" + p.Database
+}
+
+// SniffIdentity 从 saslStart、authenticate 以及握手中的 speculativeAuthenticate 提取用户名，
+// logout 返回 nil, true 表示身份被清除
+func SniffIdentity(msg protocol.Message) (*Identity, bool) {
+	cmd, ok := protocol.ParseCommand(msg)
+	if !ok {
+		return nil, false
+	}
+	switch strings.ToLower(cmd.Name) {
+	case "logout":
+		return nil, true
+	case "hello", "ismaster":
+		spec := tools.LookupDocument(cmd.Args, "speculativeAuthenticate")
+		if spec == nil {
+			return nil, false
+		}
+		db, _ := protocol.Load(spec, "db")
+		name, _ := tools.String(db)
+		return sniffAuth(spec, name)
+	}
+	return sniffAuth(cmd.Args, cmd.Database)
+}
+
+// authSucceeded 判断响应是否表示认证完成，SASL 需要等到 done 为 true
+func authSucceeded(req, reply protocol.Message) bool {
+	op, _, _ := protocol.Operation(req)
+	if !logging.AuthCommands[op] {
+		return false
+	}
+	doc, ok := protocol.ReplyDocument(reply)
+	if !ok || protocol.Summarize(req, reply).Code != 0 {
+		return false
+	}
+	if op == "authenticate" {
+		return true
+	}
+	done, _ := protocol.Load(doc, "done")
+	switch v := done.(type) {
+	case bool:
+		return v
+	case bson.Bool:
+		return bool(v)
+	}
+	return false
+}
+
+func sniffAuth(args protocol.Document, db string) (*Identity, bool) {
+	if len(args) == 0 {
+		return nil, false
+	}
+	v, _ := protocol.Load(args, "mechanism")
+	mechanism, _ := tools.String(v)
+	switch args[0].Key {
+	case "saslStart":
+		user := saslUser(mechanism, saslPayload(args))
+		if user == "" {
+			return nil, false
+		}
+		return &Identity{User: user, Database: db, Mechanism: mechanism}, true
+	case "authenticate":
+		v, _ := protocol.Load(args, "user")
+		user, _ := tools.String(v)
+		if user == "" {
+			return nil, false
+		}
+		return &Identity{User: user, Database: db, Mechanism: mechanism}, true
+	}
+	return nil, false
+}
+
+func saslPayload(args protocol.Document) []byte {
+	if bs := tools.LookupBinary(args, "payload"); bs != nil {
+		return bs
+	}
+	v, _ := protocol.Load(args, "payload")
+	s, _ := tools.String(v)
+	if bs, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return bs
+	}
+	return []byte(s)
+}
+
+// saslUser 解析 SCRAM 的 client-first-message 或 PLAIN 的 authzid\0authcid\0passwd
+func saslUser(mechanism string, payload []byte) string {
+	if mechanism == "PLAIN" {
+		parts := bytes.Split(payload, []byte{0})
+		if len(parts) == 3 {
+			return string(parts[1])
+		}
+		return ""
+	}
+	attrs := parseScramAttrs(payload)
+	user := attrs["n"]
+	user = strings.ReplaceAll(user, "=2C", ",")
+	user = strings.ReplaceAll(user, "=3D", "=")
+	return user
+}
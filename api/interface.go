@@ -3,16 +3,38 @@ package api
 import (
 	"errors"
 	"io"
+	"log/slog"
+	"net"
 
 	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/trace"
 )
 
+// Context 客户端或后端连接。中间件、响应中间件、Tap 与 Tracer 需要在第一次调用 Next 之前注册，
+// Next 调用后才开始读取连接
 type Context interface {
 	io.Closer
 	Use(middlewares ...Middleware) Context
+	// UseResponse 注册响应中间件，按注册顺序执行
+	UseResponse(middlewares ...ResponseMiddleware) Context
+	// UseTracer 为客户端连接上的每个请求创建 Span，nil 表示关闭追踪
+	UseTracer(tracer *trace.Tracer) Context
+	// UseTap 注册原始帧的观察者，读到的帧在解码之前、写出的帧在发送之前交给观察者。
+	// 需要在第一次调用 Next 之前注册，才能抓到连接上的全部帧
+	UseTap(taps ...Tap) Context
 	Send(bs []byte) error
 	SendMessage(msg protocol.Message) error
 	Next() <-chan protocol.Message
+	// Reply 将响应写回客户端，响应先与请求关联并经过响应中间件
+	Reply(msg protocol.Message) error
+	// Identity 返回客户端最近一次认证声明的身份，未认证时为 nil
+	Identity() *Identity
+	// RemoteAddr 返回对端地址
+	RemoteAddr() net.Addr
+	// ID 返回进程内唯一的连接 id
+	ID() int64
+	// Logger 返回附加了连接 id 的日志
+	Logger() *slog.Logger
 }
 
 // Endpoint communicate endpoint for routing messages.
@@ -24,6 +46,32 @@ type Endpoint interface {
 var EOF = io.EOF
 var Ignore = errors.New("skip message")
 
+// Response 中间件返回该错误时，implContext 直接将 Reply 发送给客户端并丢弃请求，
+// Reply 为 nil 时等同于 Ignore
+type Response struct {
+	Reply protocol.Message
+}
+
+func (p *Response) Error() string {
+	return "respond to client directly"
+}
+
+// Respond 直接以 reply 应答客户端，reply 的 ResponseTo 需要指向请求
+func Respond(reply protocol.Message) error {
+	return &Response{Reply: reply}
+}
+
+// Reject 按请求的线协议格式返回命令错误，err 为 *protocol.CommandError 时保留错误码
+func Reject(req protocol.Message, err error) error {
+	return &Response{Reply: protocol.NewErrorReply(req, err)}
+}
+
+// Tap 观察连接上的原始帧，direction 为 in 或 out。读写在不同的协程中进行，
+// 实现需要支持并发调用；bs 只在调用期间有效，需要保留时复制
+type Tap interface {
+	Frame(ctx Context, direction string, bs []byte)
+}
+
 type Authenticator interface {
 	Middleware
 	Wait() (db *string, ok bool)
@@ -33,3 +81,10 @@ type Middleware interface {
 	// Handle handle request.
 	Handle(ctx Context, req protocol.Message) error
 }
+
+// ResponseMiddleware 响应中间件，收到与请求关联后的响应，可以修改 reply 或返回新的响应，
+// 返回 Ignore 时丢弃该响应。
+// 注册在客户端连接上时作用于 Reply 写回的响应，注册在后端连接上时作用于读到的响应
+type ResponseMiddleware interface {
+	HandleResponse(ctx Context, req, reply protocol.Message) (protocol.Message, error)
+}
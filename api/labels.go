@@ -0,0 +1,39 @@
+package api
+
+import (
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/logging"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+)
+
+func isAuth(msg protocol.Message) bool {
+	op, _, _ := protocol.Operation(msg)
+	return logging.AuthCommands[op]
+}
+
+// 指标中单独统计的命令，其他命令归入 other 以限制标签数量
+var knownCommands = map[string]bool{
+	"aggregate": true, "authenticate": true, "buildinfo": true, "collstats": true,
+	"count": true, "create": true, "createindexes": true, "dbstats": true,
+	"delete": true, "distinct": true, "drop": true, "dropdatabase": true,
+	"dropindexes": true, "endsessions": true, "explain": true, "find": true,
+	"findandmodify": true, "getlasterror": true, "getmore": true, "hello": true,
+	"insert": true, "ismaster": true, "killcursors": true, "listcollections": true,
+	"listdatabases": true, "listindexes": true, "logout": true, "mapreduce": true,
+	"ping": true, "renamecollection": true, "saslcontinue": true, "saslstart": true,
+	"serverstatus": true, "update": true, "committransaction": true, "aborttransaction": true,
+}
+
+// commandLabel 返回请求在指标中的命令名，旧版 CRUD 操作为空
+func commandLabel(msg protocol.Message) string {
+	cmd, ok := protocol.ParseCommand(msg)
+	if !ok {
+		return ""
+	}
+	name := strings.ToLower(cmd.Name)
+	if knownCommands[name] {
+		return name
+	}
+	return "other"
+}
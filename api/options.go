@@ -0,0 +1,32 @@
+package api
+
+import (
+	"log/slog"
+
+	"github.com/jjeffcaii/mongo-proxy/logging"
+)
+
+type options struct {
+	logger *slog.Logger
+}
+
+// Option 代理与后端的可选配置
+type Option func(*options)
+
+// WithLogger 指定日志，连接的日志会附加连接 id 与对端地址
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{}
+	for _, it := range opts {
+		it(&o)
+	}
+	if o.logger == nil {
+		o.logger = logging.Default()
+	}
+	return o
+}
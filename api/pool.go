@@ -0,0 +1,171 @@
+package api
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/metrics"
+)
+
+var (
+	// ErrPoolTimeout 等待空闲连接超时
+	ErrPoolTimeout = errors.New("timed out waiting for a backend connection")
+	// ErrPoolDraining 后端正在摘除，不再建立新连接
+	ErrPoolDraining = errors.New("backend is draining")
+)
+
+// Pool 限制到同一个后端的并发连接数，连接关闭时归还名额
+type Pool struct {
+	addr     string
+	size     int
+	slots    chan struct{}
+	opts     []Option
+	inUse    atomic.Int64
+	waits    atomic.Int64
+	draining atomic.Bool
+	// Timeout 等待空闲名额的最长时间，为 0 时一直等待
+	Timeout time.Duration
+}
+
+// NewPool size 不大于 0 时不限制连接数，只做统计与摘除
+func NewPool(addr string, size int, opts ...Option) *Pool {
+	p := &Pool{
+		addr:    addr,
+		size:    size,
+		opts:    opts,
+		Timeout: 15 * time.Second,
+	}
+	if size > 0 {
+		p.slots = make(chan struct{}, size)
+		metrics.PoolCapacity.Set(float64(size), addr)
+	}
+	return p
+}
+
+// PoolStats 连接池的状态
+type PoolStats struct {
+	Addr     string `json:"addr"`
+	Capacity int    `json:"capacity"`
+	InUse    int64  `json:"inUse"`
+	Waits    int64  `json:"waits"`
+	Draining bool   `json:"draining"`
+}
+
+func (p *Pool) Stats() PoolStats {
+	return PoolStats{
+		Addr:     p.addr,
+		Capacity: p.size,
+		InUse:    p.inUse.Load(),
+		Waits:    p.waits.Load(),
+		Draining: p.draining.Load(),
+	}
+}
+
+// Drain 摘除后端，已建立的连接不受影响，新的 Get 返回 ErrPoolDraining
+func (p *Pool) Drain() {
+	p.draining.Store(true)
+}
+
+// Resume 恢复摘除的后端
+func (p *Pool) Resume() {
+	p.draining.Store(false)
+}
+
+// Get 获取一个名额并建立新连接
+func (p *Pool) Get() (Context, error) {
+	if p.draining.Load() {
+		return nil, ErrPoolDraining
+	}
+	if err := p.acquire(); err != nil {
+		return nil, err
+	}
+	c, err := NewBackend(p.addr, p.opts...).NewConn()
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	c.(*implContext).onClose = p.release
+	return c, nil
+}
+
+func (p *Pool) acquire() error {
+	if p.slots == nil {
+		p.inc()
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		p.inc()
+		return nil
+	default:
+	}
+	p.waits.Add(1)
+	metrics.PoolWaits.Inc(p.addr)
+	var timeout <-chan time.Time
+	if p.Timeout > 0 {
+		t := time.NewTimer(p.Timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case p.slots <- struct{}{}:
+		p.inc()
+		return nil
+	case <-timeout:
+		metrics.PoolTimeouts.Inc(p.addr)
+		return ErrPoolTimeout
+	}
+}
+
+func (p *Pool) inc() {
+	p.inUse.Add(1)
+	metrics.PoolInUse.Inc(p.addr)
+}
+
+func (p *Pool) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+	p.inUse.Add(-1)
+	metrics.PoolInUse.Dec(p.addr)
+}
+
+var (
+	poolsMu sync.Mutex
+	pools   = make(map[string]*Pool)
+)
+
+// SharedPool 返回到 addr 的共享连接池，首次调用时以 size 创建
+func SharedPool(addr string, size int, opts ...Option) *Pool {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	if p, ok := pools[addr]; ok {
+		return p
+	}
+	p := NewPool(addr, size, opts...)
+	pools[addr] = p
+	return p
+}
+
+// LookupPool 返回 addr 对应的共享连接池
+func LookupPool(addr string) (*Pool, bool) {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	p, ok := pools[addr]
+	return p, ok
+}
+
+// Pools 按地址排序返回所有共享连接池
+func Pools() []*Pool {
+	poolsMu.Lock()
+	out := make([]*Pool, 0, len(pools))
+	for _, it := range pools {
+		out = append(out, it)
+	}
+	poolsMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].addr < out[j].addr })
+	return out
+}
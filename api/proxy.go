@@ -2,47 +2,60 @@ package api
 
 import (
 	"errors"
-	"log"
+	"log/slog"
 	"net"
+	"sync"
 )
 
 // 代理
 type proxy struct {
 	addr     string
+	mu       sync.Mutex
+	preset   net.Listener
 	listener net.Listener
+	logger   *slog.Logger
 }
 
 // Serve 提供服务
 func (p *proxy) Serve(handler func(Context)) error {
+	p.mu.Lock()
 	if p.listener != nil {
+		p.mu.Unlock()
 		return errors.New("listener has been created already")
 	}
 	// 监听端口
-	listen, err := net.Listen("tcp", p.addr)
-	if err != nil {
-		return err
+	listen := p.preset
+	if listen == nil {
+		var err error
+		if listen, err = net.Listen("tcp", p.addr); err != nil {
+			p.mu.Unlock()
+			return err
+		}
 	}
+	p.listener = listen
+	p.mu.Unlock()
 	defer func(listen net.Listener) {
 		err := listen.Close()
-		if err != nil {
-			log.Println("Error closing listener: ", err)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			p.logger.Error("close listener failed", "addr", p.addr, "err", err)
 		}
 	}(listen)
-	p.listener = listen
 	for {
 		// 接受
-		conn, err := p.listener.Accept()
+		conn, err := listen.Accept()
 		if err != nil {
-			log.Println("accept connection failed:", err)
+			if !errors.Is(err, net.ErrClosed) {
+				p.logger.Error("accept connection failed", "addr", p.addr, "err", err)
+			}
 			break
 		}
 		// 处理
 		go func() {
-			ctx := newContext(conn)
+			ctx := newContext(conn, sideClient, p.logger)
 			defer func(ctx Context) {
 				err := ctx.Close()
 				if err != nil {
-					log.Println("Error closing context:", err)
+					ctx.Logger().Warn("close connection failed", "err", err)
 				}
 			}(ctx)
 			handler(ctx)
@@ -51,17 +64,44 @@ func (p *proxy) Serve(handler func(Context)) error {
 	return nil
 }
 
+// Close 停止接受新连接，已建立的连接不受影响
 func (p *proxy) Close() error {
-	if p.listener == nil {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	listen := p.listener
+	if listen == nil {
+		listen = p.preset
+	}
+	p.listener, p.preset = nil, nil
+	if listen == nil {
 		return nil
 	}
-	if err := p.listener.Close(); err != nil {
+	if err := listen.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 		return err
 	}
-	p.listener = nil
 	return nil
 }
 
-func NewProxy(addr string) Endpoint {
-	return &proxy{addr: addr}
+// Addr 返回监听的地址，未开始监听时返回 nil
+func (p *proxy) Addr() net.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.listener != nil {
+		return p.listener.Addr()
+	}
+	if p.preset != nil {
+		return p.preset.Addr()
+	}
+	return nil
+}
+
+func NewProxy(addr string, opts ...Option) Endpoint {
+	o := newOptions(opts)
+	return &proxy{addr: addr, logger: o.logger}
+}
+
+// NewListenerProxy 在已打开的 listener 上提供服务，便于调用方在启动前发现端口冲突
+func NewListenerProxy(listener net.Listener, opts ...Option) Endpoint {
+	o := newOptions(opts)
+	return &proxy{addr: listener.Addr().String(), preset: listener, logger: o.logger}
 }
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/logging"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+)
+
+// ConnInfo 连接的当前状态
+type ConnInfo struct {
+	ID       int64      `json:"id"`
+	Side     string     `json:"side"`
+	Peer     string     `json:"peer"`
+	User     string     `json:"user,omitempty"`
+	Since    time.Time  `json:"since"`
+	Age      string     `json:"age"`
+	Op       *CurrentOp `json:"op,omitempty"`
+	BytesIn  int64      `json:"bytesIn"`
+	BytesOut int64      `json:"bytesOut"`
+}
+
+// CurrentOp 客户端连接上正在等待响应的请求
+type CurrentOp struct {
+	Command   string    `json:"command"`
+	Namespace string    `json:"namespace"`
+	Since     time.Time `json:"since"`
+	// Document 隐去认证信息后的请求命令，查看时才从 raw 解码
+	Document protocol.JSONDocument `json:"document,omitempty"`
+	raw      []byte
+}
+
+var registry sync.Map // id -> *implContext
+
+func (p *implContext) Info() ConnInfo {
+	info := ConnInfo{
+		ID:       p.id,
+		Side:     p.side,
+		Peer:     p.conn.RemoteAddr().String(),
+		Since:    p.created,
+		Age:      time.Since(p.created).Round(time.Millisecond).String(),
+		Op:       currentOp(p.op.Load()),
+		BytesIn:  p.bytesIn.Load(),
+		BytesOut: p.bytesOut.Load(),
+	}
+	if id := p.Identity(); id != nil {
+		info.User = id.User
+	}
+	return info
+}
+
+// begin 记录客户端连接上正在处理的请求，raw 为请求的原始字节，之后不会再被修改
+func (p *implContext) begin(msg protocol.Message, raw []byte) {
+	if op, ns, ok := protocol.Operation(msg); ok {
+		p.op.Store(&CurrentOp{Command: op, Namespace: ns, Since: time.Now(), raw: raw})
+	}
+}
+
+// currentOp 返回带有请求命令的副本，中间件可能修改已解码的消息，所以从原始字节重新解码
+func currentOp(op *CurrentOp) *CurrentOp {
+	if op == nil {
+		return nil
+	}
+	out := *op
+	if msg, err := protocol.Decode(op.raw); err == nil {
+		if cmd, ok := protocol.ParseCommand(msg); ok {
+			out.Document = protocol.JSONDocument(logging.RedactCommand(cmd))
+		}
+	}
+	return &out
+}
+
+// Conns 按 id 返回所有打开的连接，side 为空时包括客户端与后端连接
+func Conns(side string) []ConnInfo {
+	out := make([]ConnInfo, 0)
+	registry.Range(func(_, v interface{}) bool {
+		c := v.(*implContext)
+		if side == "" || c.side == side {
+			out = append(out, c.Info())
+		}
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Kill 关闭指定的连接，连接不存在时返回 false
+func Kill(id int64) bool {
+	v, ok := registry.Load(id)
+	if !ok {
+		return false
+	}
+	v.(*implContext).Close()
+	return true
+}
@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/jjeffcaii/mongo-proxy/metrics"
 	"github.com/jjeffcaii/mongo-proxy/protocol"
 	"github.com/jjeffcaii/mongo-proxy/tools"
 	"golang.org/x/crypto/pbkdf2"
@@ -58,10 +59,10 @@ func (c *ScramSHA1Conversation) FirstMessage() (protocol.Document, error) {
 	c.step = 1
 
 	return protocol.Document{
-		{"saslStart", 1},
-		{"mechanism", "SCRAM-SHA-1"},
-		{"payload", []byte(payload)},
-		{"autoAuthorize", 1},
+		{Key: "saslStart", Val: 1},
+		{Key: "mechanism", Val: "SCRAM-SHA-1"},
+		{Key: "payload", Val: []byte(payload)},
+		{Key: "autoAuthorize", Val: 1},
 	}, nil
 }
 
@@ -186,10 +187,10 @@ func (c *ScramSHA256Conversation) FirstMessage() (protocol.Document, error) {
 	c.step = 1
 
 	return protocol.Document{
-		{"saslStart", 1},
-		{"mechanism", "SCRAM-SHA-256"},
-		{"payload", []byte(payload)},
-		{"autoAuthorize", 1},
+		{Key: "saslStart", Val: 1},
+		{Key: "mechanism", Val: "SCRAM-SHA-256"},
+		{Key: "payload", Val: []byte(payload)},
+		{Key: "autoAuthorize", Val: 1},
 	}, nil
 }
 
@@ -264,7 +265,20 @@ func parseSaslReply(reply *protocol.OpReply) (
 	return
 }
 
+// Sasl 以 SCRAM 完成后端认证，失败次数计入 mongo_proxy_auth_failures_total{side="backend"}
 func Sasl(ctx Context, username, password string) error {
+	if c, ok := ctx.(*implContext); ok {
+		c.authenticating.Store(true)
+		defer c.authenticating.Store(false)
+	}
+	err := sasl(ctx, username, password)
+	if err != nil {
+		metrics.AuthFailures.Inc(sideBackend)
+	}
+	return err
+}
+
+func sasl(ctx Context, username, password string) error {
 
 	// 1. isMaster
 	_, err := runIsMaster(ctx)
@@ -300,7 +314,6 @@ func Sasl(ctx Context, username, password string) error {
 			RequestID: 0,
 		},
 	}
-	tools.PrintOpQuery(startQuery)
 
 	if err := ctx.SendMessage(startQuery); err != nil {
 		return err
@@ -316,7 +329,6 @@ func Sasl(ctx Context, username, password string) error {
 	if !ok {
 		return fmt.Errorf("unexpected reply type: %T", msg)
 	}
-	tools.PrintOpReply(reply)
 
 	conversationID, payload, done, err := parseSaslReply(reply)
 	if err != nil {
@@ -351,7 +363,6 @@ func Sasl(ctx Context, username, password string) error {
 			},
 		}
 		RequestID++
-		tools.PrintOpQuery(continueQuery)
 
 		if err := ctx.SendMessage(continueQuery); err != nil {
 			return err
@@ -366,7 +377,6 @@ func Sasl(ctx Context, username, password string) error {
 		if !ok {
 			return fmt.Errorf("unexpected reply type: %T", msg)
 		}
-		tools.PrintOpReply(reply)
 		conversationID, payload, done, err = parseSaslReply(reply)
 		if err != nil {
 			return err
@@ -446,7 +456,6 @@ func runIsMaster(ctx Context) (protocol.Document, error) {
 	if !ok {
 		return nil, fmt.Errorf("unexpected reply type: %T", msg)
 	}
-	tools.PrintOpReply(reply)
 
 	if len(reply.Documents) == 0 {
 		return nil, errors.New("isMaster reply has no document")
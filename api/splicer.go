@@ -4,31 +4,47 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"sync/atomic"
 
 	"github.com/jjeffcaii/mongo-proxy/protocol"
 )
 
+// maxMessageSize 与服务端的 maxMessageSizeBytes 一致
+const maxMessageSize = 48000000
+
 type splicer struct {
-	isStop bool
+	// isStop 由管理接口等其他 goroutine 设置，读循环中检查
+	isStop atomic.Bool
 	wants  int
 	reader *bufio.Reader
 	buffer *bytes.Buffer
 }
 
 func (p *splicer) Close() error {
-	p.isStop = true
+	p.isStop.Store(true)
 	return nil
 }
 
+// Next 返回下一个完整的消息帧。数据不足时返回 io.EOF 并保留已读到的部分，
+// 底层 reader 有了新数据后可以继续调用
+func (p *splicer) Next() ([]byte, error) {
+	data, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
 func (p *splicer) next() (*bytes.Buffer, error) {
 	var left = p.wants - p.buffer.Len()
 	for i := 0; i < left; i++ {
-		if p.isStop {
+		if p.isStop.Load() {
 			return nil, io.EOF
 		}
 		b, err := p.reader.ReadByte()
-		if err == io.EOF || p.isStop {
+		if err == io.EOF || p.isStop.Load() {
 			return nil, io.EOF
 		}
 		if err != nil {
@@ -37,18 +53,29 @@ func (p *splicer) next() (*bytes.Buffer, error) {
 		p.buffer.WriteByte(b)
 	}
 	if p.buffer.Len() != protocol.HeaderLength {
-		old := p.buffer
-		// reset
-		p.wants = protocol.HeaderLength
-		p.buffer = &bytes.Buffer{}
-		return old, nil
+		return p.reset(), nil
 	}
 	b := p.buffer.Bytes()[0:4]
-	payloadSize := int(binary.LittleEndian.Uint32(b))
+	payloadSize := int(int32(binary.LittleEndian.Uint32(b)))
+	if payloadSize < protocol.HeaderLength || payloadSize > maxMessageSize {
+		return nil, fmt.Errorf("invalid message length %d", payloadSize)
+	}
+	// 只有消息头的帧交给解码器报错，否则会反复读取消息头
+	if payloadSize == protocol.HeaderLength {
+		return p.reset(), nil
+	}
 	p.wants += payloadSize - protocol.HeaderLength
 	return p.next()
 }
 
+// reset 返回已读到的帧并准备读取下一个消息头
+func (p *splicer) reset() *bytes.Buffer {
+	old := p.buffer
+	p.wants = protocol.HeaderLength
+	p.buffer = &bytes.Buffer{}
+	return old
+}
+
 func NewSplicer(source *bufio.Reader) *splicer {
 	return &splicer{
 		wants:  protocol.HeaderLength,
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/trace"
+)
+
+var errConnClosed = errors.New("connection closed")
+
+// 客户端请求到其 Span 的绑定，后端连接发送请求时据此创建子 Span。
+// 派生请求通过 Propagate 绑定，随根请求一起解绑
+var (
+	bmu     sync.Mutex
+	bound   = make(map[protocol.Message]*trace.Span)
+	derived = make(map[protocol.Message][]protocol.Message)
+)
+
+// SpanOf 返回请求所属的 Span，未启用追踪时为 nil
+func SpanOf(msg protocol.Message) *trace.Span {
+	bmu.Lock()
+	defer bmu.Unlock()
+	return bound[msg]
+}
+
+// Propagate 让 handler 根据客户端请求构造的新请求继承其 Span，
+// 例如分片时拆分出的子请求
+func Propagate(from, to protocol.Message) {
+	if from == to {
+		return
+	}
+	bmu.Lock()
+	defer bmu.Unlock()
+	span, ok := bound[from]
+	if !ok {
+		return
+	}
+	bound[to] = span
+	derived[from] = append(derived[from], to)
+}
+
+func bindSpan(msg protocol.Message, span *trace.Span) {
+	bmu.Lock()
+	bound[msg] = span
+	bmu.Unlock()
+}
+
+func unbindSpan(msg protocol.Message) {
+	bmu.Lock()
+	defer bmu.Unlock()
+	delete(bound, msg)
+	for _, it := range derived[msg] {
+		delete(bound, it)
+	}
+	delete(derived, msg)
+}
+
+// annotate 为 Span 设置请求的命名空间与命令
+func annotate(span *trace.Span, msg protocol.Message) {
+	if span == nil {
+		return
+	}
+	span.SetAttribute("db.system", "mongodb")
+	if op, ns, ok := protocol.Operation(msg); ok {
+		span.SetAttribute("db.operation", op)
+		span.SetAttribute("db.namespace", ns)
+	}
+}
+
+// annotateReply 为 Span 设置响应中的游标与错误
+func annotateReply(span *trace.Span, req, reply protocol.Message) {
+	if span == nil {
+		return
+	}
+	res := protocol.Summarize(req, reply)
+	if res.CursorID != 0 {
+		span.SetAttribute("db.cursor_id", res.CursorID)
+	}
+	if res.Code != 0 {
+		span.SetAttribute("db.error_code", res.Code)
+		span.SetError(errors.New(res.Error))
+	}
+}
@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+)
+
+// 握手与心跳不写审计日志
+var quietCommands = map[string]bool{
+	"hello":    true,
+	"ismaster": true,
+	"ping":     true,
+}
+
+// Auditor 为每个操作写一条审计记录，需要同时通过 Use 与 UseResponse 注册在客户端连接上。
+// 没有响应的写操作在收到请求时记录，结果未知。每个客户端连接使用独立的实例并共享同一个 Logger，
+// 连接关闭后尚未收到响应的请求随实例一起释放
+type Auditor struct {
+	logger  *Logger
+	mu      sync.Mutex
+	pending map[protocol.Message]time.Time
+}
+
+func NewAuditor(logger *Logger) *Auditor {
+	return &Auditor{logger: logger, pending: make(map[protocol.Message]time.Time)}
+}
+
+func (p *Auditor) Handle(ctx api.Context, req protocol.Message) error {
+	if !protocol.ExpectsReply(req) {
+		p.log(ctx, p.record(ctx, req, time.Now()))
+		return nil
+	}
+	p.mu.Lock()
+	p.pending[req] = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Auditor) HandleResponse(ctx api.Context, req, reply protocol.Message) (protocol.Message, error) {
+	p.mu.Lock()
+	start, ok := p.pending[req]
+	delete(p.pending, req)
+	p.mu.Unlock()
+	if !ok {
+		start = time.Now()
+	}
+	rec := p.record(ctx, req, start)
+	if rec == nil {
+		return reply, nil
+	}
+	res := protocol.Summarize(req, reply)
+	rec.Code, rec.Error = res.Code, res.Error
+	rec.Returned, rec.Affected = res.Returned, res.Affected
+	rec.LatencyUs = time.Since(start).Microseconds()
+	p.log(ctx, rec)
+	return reply, nil
+}
+
+func (p *Auditor) record(ctx api.Context, req protocol.Message, start time.Time) *Record {
+	op, ns, ok := protocol.Operation(req)
+	if !ok || quietCommands[op] {
+		return nil
+	}
+	rec := &Record{
+		Time:      start.UTC(),
+		Namespace: ns,
+		Command:   op,
+	}
+	if addr := ctx.RemoteAddr(); addr != nil {
+		rec.Client = addr.String()
+	}
+	// saslStart 中声明的用户未经后端确认，不能写入审计记录
+	if id := ctx.Identity(); id != nil && id.Verified {
+		rec.User = id.String()
+	}
+	if filter, ok := protocol.Filter(req); ok {
+		rec.Filter = tools.Shape(filter)
+	}
+	return rec
+}
+
+func (p *Auditor) log(ctx api.Context, rec *Record) {
+	if rec == nil {
+		return
+	}
+	if err := p.logger.Log(rec); err != nil {
+		ctx.Logger().Error("write audit record failed", "err", err)
+	}
+}
@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+// testContext 只实现审计用到的方法
+type testContext struct {
+	api.Context
+	id *api.Identity
+}
+
+func (p *testContext) Identity() *api.Identity {
+	return p.id
+}
+
+func (p *testContext) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
+
+func find(id int32) *protocol.OpMessage {
+	msg := protocol.NewOpMessage()
+	msg.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: id}
+	msg.Body = protocol.Document{{Key: "find", Val: "orders"}, {Key: "$db", Val: "shop"}}
+	return msg
+}
+
+func records(t *testing.T, bf *bytes.Buffer) []Record {
+	var out []Record
+	for _, line := range strings.Split(strings.TrimSpace(bf.String()), "\n") {
+		var rec Record
+		assert.NoError(t, json.Unmarshal([]byte(line), &rec))
+		out = append(out, rec)
+	}
+	return out
+}
+
+func TestAuditor_User(t *testing.T) {
+	bf := &bytes.Buffer{}
+	p := NewAuditor(NewLogger(NewWriterSink(bf)))
+	for _, ctx := range []*testContext{
+		{id: &api.Identity{User: "alice", Database: "admin", Verified: true}},
+		// 只在 saslStart 中声明、没有完成认证的用户
+		{id: &api.Identity{User: "bob", Database: "admin"}},
+	} {
+		req := find(1)
+		assert.NoError(t, p.Handle(ctx, req))
+		_, err := p.HandleResponse(ctx, req, protocol.NewCommandReply(req, protocol.Document{{Key: "ok", Val: float64(1)}}))
+		assert.NoError(t, err)
+	}
+	recs := records(t, bf)
+	if assert.Len(t, recs, 2) {
+		assert.Equal(t, "alice@admin", recs[0].User)
+		assert.Equal(t, "", recs[1].User)
+	}
+}
@@ -0,0 +1,148 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/tools"
+)
+
+// Record 一次操作的审计记录，Prev 为上一条记录的 Hash，形成哈希链。User 只记录后端确认认证成功的用户
+type Record struct {
+	Time      time.Time `json:"ts"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Namespace string    `json:"ns,omitempty"`
+	Command   string    `json:"command"`
+	Filter    string    `json:"filter,omitempty"`
+	Code      int32     `json:"code"`
+	Error     string    `json:"error,omitempty"`
+	Returned  int64     `json:"returned"`
+	Affected  int64     `json:"affected"`
+	LatencyUs int64     `json:"latencyUs"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash"`
+}
+
+// seal 计算记录的哈希，计算时 hash 字段为空字符串
+func (p *Record) seal() ([]byte, error) {
+	p.Hash = ""
+	bs, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(bs)
+	p.Hash = hex.EncodeToString(sum[:])
+	return json.Marshal(p)
+}
+
+// Sink 审计记录的输出，line 为不含换行符的一行 JSON
+type Sink interface {
+	io.Closer
+	Write(line []byte) error
+}
+
+// Chained 能够返回已写入的最后一条记录哈希的 Sink，重启后哈希链可以继续
+type Chained interface {
+	LastHash() string
+}
+
+// Logger 为记录计算哈希链后写入 Sink
+type Logger struct {
+	mu   sync.Mutex
+	sink Sink
+	prev string
+}
+
+func NewLogger(sink Sink) *Logger {
+	l := &Logger{sink: sink}
+	if c, ok := sink.(Chained); ok {
+		l.prev = c.LastHash()
+	}
+	return l
+}
+
+// Log 写入一条记录，记录的 Prev 与 Hash 会被覆盖
+func (p *Logger) Log(rec *Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rec.Prev = p.prev
+	line, err := rec.seal()
+	if err != nil {
+		return err
+	}
+	if err := p.sink.Write(line); err != nil {
+		return err
+	}
+	p.prev = rec.Hash
+	return nil
+}
+
+func (p *Logger) Close() error {
+	return p.sink.Close()
+}
+
+// Verify 校验 JSONL 审计日志的哈希链，prev 为第一条记录之前的哈希（从头开始时为空），
+// 返回最后一条记录的哈希以便校验轮转后的下一个文件
+func Verify(r io.Reader, prev string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		bs := bytes.TrimSpace(scanner.Bytes())
+		if len(bs) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(bs, &rec); err != nil {
+			return "", fmt.Errorf("line %d: %w", line, err)
+		}
+		if rec.Prev != prev {
+			return "", fmt.Errorf("line %d: chain broken, prev=%s, want %s", line, rec.Prev, prev)
+		}
+		// 将 hash 字段置空后重新计算，与写入时的输入一致
+		want := rec.Hash
+		raw := bytes.Replace(bs, []byte(`"hash":"`+want+`"`), []byte(`"hash":""`), 1)
+		sum := sha256.Sum256(raw)
+		if hex.EncodeToString(sum[:]) != want {
+			return "", fmt.Errorf("line %d: record hash mismatch", line)
+		}
+		prev = want
+	}
+	return prev, scanner.Err()
+}
+
+// VerifyFiles 从最旧的备份开始依次校验 path.N ... path.1 和 path，
+// 哈希链从第一条记录开始，任何一个文件被截断或删除都会导致校验失败
+func VerifyFiles(path string) (string, error) {
+	backups := tools.Backups(path)
+	files := make([]string, 0, len(backups)+1)
+	for i := len(backups) - 1; i >= 0; i-- {
+		files = append(files, backups[i])
+	}
+	prev := ""
+	for _, name := range append(files, path) {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) && name == path {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		prev, err = Verify(f, prev)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return prev, nil
+}
@@ -0,0 +1,108 @@
+package audit
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(path, 0)
+	assert.NoError(t, err)
+	logger := NewLogger(sink)
+	for _, it := range []string{"find", "insert", "delete"} {
+		assert.NoError(t, logger.Log(&Record{Command: it, Namespace: "shop.orders", Filter: `{"a":"?"}`}))
+	}
+	assert.NoError(t, logger.Close())
+
+	// 重新打开后哈希链继续
+	sink, err = NewFileSink(path, 0)
+	assert.NoError(t, err)
+	logger = NewLogger(sink)
+	assert.NoError(t, logger.Log(&Record{Command: "update"}))
+	assert.NoError(t, logger.Close())
+
+	bs, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	last, err := Verify(bytes.NewReader(bs), "")
+	assert.NoError(t, err)
+	assert.Equal(t, logger.prev, last)
+
+	tampered := bytes.Replace(bs, []byte(`"command":"insert"`), []byte(`"command":"find"`), 1)
+	_, err = Verify(bytes.NewReader(tampered), "")
+	assert.Error(t, err)
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(path, 300)
+	assert.NoError(t, err)
+	logger := NewLogger(sink)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, logger.Log(&Record{Command: "find"}))
+	}
+	assert.NoError(t, logger.Close())
+
+	// 轮转不删除任何文件，整条哈希链从第一条记录开始可以校验
+	n := 0
+	for _, it := range []string{path + ".1", path + ".2", path + ".3", path + ".4"} {
+		if _, err := os.Stat(it); err == nil {
+			n++
+		}
+	}
+	assert.GreaterOrEqual(t, n, 3)
+	last, err := VerifyFiles(path)
+	assert.NoError(t, err)
+	assert.Equal(t, logger.prev, last)
+
+	// 截断中间的备份或删除最旧的备份都会被发现
+	bs, err := os.ReadFile(path + ".2")
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path+".2", nil, 0600))
+	_, err = VerifyFiles(path)
+	assert.Error(t, err)
+	assert.NoError(t, os.WriteFile(path+".2", bs, 0600))
+	_, err = VerifyFiles(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Rename(path+fmt.Sprintf(".%d", n), path+".old"))
+	_, err = VerifyFiles(path)
+	assert.Error(t, err)
+}
+
+func TestRotate_Restart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(path, 0)
+	assert.NoError(t, err)
+	logger := NewLogger(sink)
+	assert.NoError(t, logger.Log(&Record{Command: "find"}))
+	assert.NoError(t, logger.Close())
+	// 轮转后、写入新记录前重启，当前文件为空
+	assert.NoError(t, os.Rename(path, path+".1"))
+	assert.NoError(t, os.WriteFile(path, nil, 0600))
+
+	sink, err = NewFileSink(path, 300)
+	assert.NoError(t, err)
+	logger = NewLogger(sink)
+	assert.NoError(t, logger.Log(&Record{Command: "insert"}))
+	assert.NoError(t, logger.Close())
+
+	old, err := os.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	last, err := Verify(bytes.NewReader(old), "")
+	assert.NoError(t, err)
+	current, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	_, err = Verify(bytes.NewReader(current), last)
+	assert.NoError(t, err)
+
+	// 最新的备份被清空时不能从更早的哈希继续
+	assert.NoError(t, os.WriteFile(path, nil, 0600))
+	assert.NoError(t, os.WriteFile(path+".1", nil, 0600))
+	_, err = NewFileSink(path, 300)
+	assert.Error(t, err)
+}
@@ -0,0 +1,146 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/jjeffcaii/mongo-proxy/tools"
+)
+
+// FileSink 按大小轮转的本地 JSONL 文件，轮转后的文件依次命名为 path.1、path.2 ...，path.1 最新。
+// 轮转从不删除审计文件，清理需要在外部归档之后进行
+type FileSink struct {
+	Path     string
+	MaxBytes int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	last string
+}
+
+// NewFileSink 打开或创建审计文件，maxBytes 为 0 时不轮转
+func NewFileSink(path string, maxBytes int64) (*FileSink, error) {
+	p := &FileSink{Path: path, MaxBytes: maxBytes}
+	last, err := lastHash(path)
+	if err != nil {
+		return nil, err
+	}
+	if backups := tools.Backups(path); last == "" && len(backups) > 0 {
+		// 轮转后重启时当前文件可能为空，哈希链接在最新的备份之后。
+		// 轮转只发生在文件非空时，空的备份说明它被截断过
+		if last, err = lastHash(backups[0]); err != nil {
+			return nil, err
+		}
+		if last == "" {
+			return nil, fmt.Errorf("%s has no audit records, the hash chain cannot be continued", backups[0])
+		}
+	}
+	p.last = last
+	if err := p.open(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *FileSink) LastHash() string {
+	return p.last
+}
+
+func (p *FileSink) Write(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.MaxBytes > 0 && p.size > 0 && p.size+int64(len(line))+1 > p.MaxBytes {
+		if err := p.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := p.file.Write(append(line, '\n'))
+	p.size += int64(n)
+	if err != nil {
+		return err
+	}
+	// 审计记录不能因为进程崩溃而丢失
+	return p.file.Sync()
+}
+
+func (p *FileSink) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.file.Close()
+}
+
+func (p *FileSink) open() error {
+	f, err := os.OpenFile(p.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	p.file, p.size = f, info.Size()
+	return nil
+}
+
+func (p *FileSink) rotate() error {
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	if err := tools.RotateFile(p.Path, 0); err != nil {
+		return err
+	}
+	return p.open()
+}
+
+// lastHash 读取已有文件最后一条记录的哈希
+func lastHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var last string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec struct {
+			Hash string `json:"hash"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &rec) == nil && rec.Hash != "" {
+			last = rec.Hash
+		}
+	}
+	return last, scanner.Err()
+}
+
+// WriterSink 写入任意 io.Writer，例如标准输出或网络连接
+type WriterSink struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: bufio.NewWriter(w)}
+}
+
+func (p *WriterSink) Write(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return p.w.Flush()
+}
+
+func (p *WriterSink) Close() error {
+	return nil
+}
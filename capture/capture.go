@@ -0,0 +1,61 @@
+package capture
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+)
+
+// Capture 将客户端连接上读写的原始帧写入抓包文件，通过 api.Context.UseTap 注册
+type Capture struct {
+	writer *Writer
+	// Sample 抓取的连接比例，取值 (0, 1]。按连接取样，选中的连接抓取全部帧，保证可以重放
+	Sample float64
+	// Redact 为 true 时隐去 SASL 载荷、密码等认证信息
+	Redact bool
+	// failed 写入失败后只记录一次日志，恢复后重新计数
+	failed atomic.Bool
+}
+
+// New 创建抓取全部连接并隐去认证信息的 Capture
+func New(w *Writer) *Capture {
+	return &Capture{writer: w, Sample: 1, Redact: true}
+}
+
+func (p *Capture) Frame(ctx api.Context, direction string, bs []byte) {
+	if !p.sampled(ctx.ID()) {
+		return
+	}
+	frame := &Frame{Conn: ctx.ID(), Time: time.Now(), Data: bs}
+	if direction == "out" {
+		frame.Direction = Out
+	}
+	if p.Redact {
+		frame.Data, frame.Redacted = redact(bs)
+	}
+	if err := p.writer.Write(frame); err != nil {
+		if !p.failed.Swap(true) {
+			ctx.Logger().Warn("write capture failed", "path", p.writer.Path, "err", err)
+		}
+		return
+	}
+	p.failed.Store(false)
+}
+
+// sampled 由连接 id 的哈希决定是否抓取，无需为每个连接保存状态
+func (p *Capture) sampled(conn int64) bool {
+	if p.Sample >= 1 {
+		return true
+	}
+	if p.Sample <= 0 {
+		return false
+	}
+	// splitmix64 让相邻的连接 id 均匀分布
+	h := uint64(conn) + 0x9e3779b97f4a7c15
+	h = (h ^ h>>30) * 0xbf58476d1ce4e5b9
+	h = (h ^ h>>27) * 0x94d049bb133111eb
+	h ^= h >> 31
+	return float64(h) < p.Sample*math.MaxUint64
+}
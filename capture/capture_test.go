@@ -0,0 +1,145 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func encode(t *testing.T, msg protocol.Message) []byte {
+	bs, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func readAll(t *testing.T, path string) []*Frame {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []*Frame
+	r := NewReader(f)
+	for {
+		frame, err := r.Next()
+		if err == io.EOF {
+			return out
+		}
+		if !assert.NoError(t, err) {
+			return out
+		}
+		out = append(out, frame)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.cap")
+	w, err := NewWriter(path, 200, 2)
+	assert.NoError(t, err)
+	now := time.Unix(0, time.Now().UnixNano())
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, w.Write(&Frame{Conn: int64(i % 2), Time: now, Direction: Direction(i % 2), Data: make([]byte, 50)}))
+	}
+	assert.NoError(t, w.Close())
+
+	files, err := Files(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path + ".2", path + ".1", path}, files)
+	frames := readAll(t, path)
+	assert.NotEmpty(t, frames)
+	assert.Equal(t, now, frames[0].Time)
+	assert.Len(t, frames[0].Data, 50)
+
+	// 已有文件继续追加
+	w, err = NewWriter(path, 0, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Write(&Frame{Conn: 9, Time: now, Direction: Out}))
+	assert.NoError(t, w.Close())
+	frames2 := readAll(t, path)
+	assert.Len(t, frames2, len(frames)+1)
+	assert.Equal(t, Out, frames2[len(frames)].Direction)
+
+	// 不完整的最后一帧
+	bs, _ := os.ReadFile(path)
+	r := NewReader(bytes.NewReader(bs[:len(bs)-1]))
+	for i := 0; i < len(frames); i++ {
+		_, err := r.Next()
+		assert.NoError(t, err)
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	assert.NoError(t, os.WriteFile(path, []byte("not a capture"), 0600))
+	_, err = NewWriter(path, 0, 0)
+	assert.ErrorIs(t, err, errMagic)
+
+	// maxBackups 为 0 时轮转保留所有备份，不会删除当前文件
+	path = filepath.Join(t.TempDir(), "all.cap")
+	w, err = NewWriter(path, 200, 0)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, w.Write(&Frame{Conn: 1, Time: now, Direction: In, Data: make([]byte, 50)}))
+	}
+	assert.NoError(t, w.Close())
+	files, err = Files(path)
+	assert.NoError(t, err)
+	assert.Len(t, files, 4)
+	total := 0
+	for _, it := range files {
+		total += len(readAll(t, it))
+	}
+	assert.Equal(t, 10, total)
+}
+
+func TestRedact(t *testing.T) {
+	sasl := protocol.NewOpMessage()
+	sasl.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 3}
+	sasl.Body = protocol.Document{
+		{Key: "saslContinue", Val: int32(1)},
+		{Key: "payload", Val: bson.Binary("c=biws,r=nonce,p=proof")},
+		{Key: "$db", Val: "admin"},
+	}
+	bs := encode(t, sasl)
+	out, redacted := redact(bs)
+	assert.True(t, redacted)
+	assert.Len(t, out, len(bs))
+	msg, err := protocol.Decode(out)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), msg.Header().RequestID)
+	payload, _ := protocol.Load(msg.(*protocol.OpMessage).Body, "payload")
+	assert.Equal(t, make(bson.Binary, 22), payload)
+
+	find := protocol.NewOpMessage()
+	find.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 4}
+	find.Body = protocol.Document{
+		{Key: "find", Val: "users"},
+		{Key: "filter", Val: protocol.Document{{Key: "key", Val: "k1"}}},
+		{Key: "$db", Val: "app"},
+	}
+	bs = encode(t, find)
+	out, redacted = redact(bs)
+	assert.False(t, redacted)
+	assert.Equal(t, bs, out)
+}
+
+func TestSample(t *testing.T) {
+	c := &Capture{Sample: 0.25}
+	n := 0
+	for i := int64(1); i <= 10000; i++ {
+		if c.sampled(i) {
+			n++
+		}
+		// 同一连接的结果不变
+		assert.Equal(t, c.sampled(i), c.sampled(i))
+	}
+	assert.InDelta(t, 2500, n, 300)
+}
@@ -0,0 +1,184 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 抓包文件以 8 字节的文件头开始，之后是连续的帧记录：
+//
+//	flags(1) | 连接 id(uvarint) | 时间(varint, Unix 纳秒) | 长度(uvarint) | 原始帧
+//
+// flags 的最低位为方向，第二位表示帧中的认证信息已隐去。
+// 轮转后的每个文件都带有文件头，可以单独读取
+var magic = []byte{'M', 'P', 'C', 'A', 'P', 0, 1, 0}
+
+const (
+	flagOut      byte = 1 << 0
+	flagRedacted byte = 1 << 1
+)
+
+// maxFrameSize 与服务端的 maxMessageSizeBytes 一致，超过时认为文件已损坏
+const maxFrameSize = 48000000
+
+var errMagic = errors.New("not a capture file")
+
+// IsCapture 判断数据是否以抓包文件头开始
+func IsCapture(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// Direction 帧的方向，In 为客户端发给代理的请求，Out 为代理写回客户端的响应
+type Direction byte
+
+const (
+	In Direction = iota
+	Out
+)
+
+func (d Direction) String() string {
+	if d == Out {
+		return "out"
+	}
+	return "in"
+}
+
+// ParseDirection 解析 in 或 out
+func ParseDirection(s string) (Direction, error) {
+	switch s {
+	case "in":
+		return In, nil
+	case "out":
+		return Out, nil
+	}
+	return In, fmt.Errorf("unknown direction %q", s)
+}
+
+// Frame 抓包文件中的一帧
+type Frame struct {
+	Conn      int64
+	Time      time.Time
+	Direction Direction
+	// Redacted 帧中的认证信息已隐去，与原始流量不再一致
+	Redacted bool
+	Data     []byte
+}
+
+func (p *Frame) append(buf []byte) []byte {
+	var flags byte
+	if p.Direction == Out {
+		flags |= flagOut
+	}
+	if p.Redacted {
+		flags |= flagRedacted
+	}
+	buf = append(buf, flags)
+	buf = binary.AppendUvarint(buf, uint64(p.Conn))
+	buf = binary.AppendVarint(buf, p.Time.UnixNano())
+	buf = binary.AppendUvarint(buf, uint64(len(p.Data)))
+	return append(buf, p.Data...)
+}
+
+// Reader 顺序读取抓包文件中的帧
+type Reader struct {
+	r      *bufio.Reader
+	header bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next 返回下一帧，文件结束时返回 io.EOF，最后一帧不完整时返回 io.ErrUnexpectedEOF
+func (p *Reader) Next() (*Frame, error) {
+	if !p.header {
+		head := make([]byte, len(magic))
+		if _, err := io.ReadFull(p.r, head); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, errMagic
+			}
+			return nil, err
+		}
+		if !bytes.Equal(head, magic) {
+			return nil, errMagic
+		}
+		p.header = true
+	}
+	flags, err := p.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := binary.ReadUvarint(p.r)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	ts, err := binary.ReadVarint(p.r)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	size, err := binary.ReadUvarint(p.r)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit", size)
+	}
+	frame := &Frame{
+		Conn:     int64(conn),
+		Time:     time.Unix(0, ts),
+		Redacted: flags&flagRedacted != 0,
+		Data:     make([]byte, size),
+	}
+	if flags&flagOut != 0 {
+		frame.Direction = Out
+	}
+	if _, err := io.ReadFull(p.r, frame.Data); err != nil {
+		return nil, unexpected(err)
+	}
+	return frame, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Files 返回 path 及其轮转文件，按写入顺序从旧到新排列
+func Files(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	backups := make(map[string]int)
+	var out []string
+	for _, it := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(it, path+"."))
+		if err != nil || n <= 0 {
+			continue
+		}
+		backups[it] = n
+		out = append(out, it)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return backups[out[i]] > backups[out[j]]
+	})
+	if _, err := os.Stat(path); err == nil {
+		out = append(out, path)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no capture files at %s", path)
+	}
+	return out, nil
+}
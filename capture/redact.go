@@ -0,0 +1,131 @@
+package capture
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/logging"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/sbunce/bson"
+)
+
+// redact 隐去帧中的认证信息。只有可能包含这些字段的帧才会解码，其余帧原样返回。
+// 被隐去的值保持类型与长度，解码失败的帧只保留消息头
+func redact(bs []byte) ([]byte, bool) {
+	if !mayContainSecret(bs) {
+		return bs, false
+	}
+	msg, err := protocol.Decode(bs)
+	if err != nil {
+		out := make([]byte, len(bs))
+		copy(out, bs[:protocol.HeaderLength])
+		return out, true
+	}
+	op, _, _ := protocol.Operation(msg)
+	r := &redactor{auth: logging.IsCredentialCommand(op)}
+	switch v := msg.(type) {
+	case *protocol.OpMessage:
+		v.Body = r.document(v.Body)
+		for i := range v.Sequences {
+			r.documents(v.Sequences[i].Documents)
+		}
+	case *protocol.OpQuery:
+		v.Query = r.document(v.Query)
+	case *protocol.OpReply:
+		r.documents(v.Documents)
+	case *protocol.OpCommand:
+		v.CommandArgs = r.document(v.CommandArgs)
+		r.documents(v.InputDocs)
+	case *protocol.OpCommandReply:
+		v.CommandReply = r.document(v.CommandReply)
+		r.documents(v.OutputDocs)
+	case *protocol.OpInsert:
+		r.documents(v.Documents)
+	case *protocol.OpUpdate:
+		v.Update = r.document(v.Update)
+	}
+	if !r.changed {
+		return bs, false
+	}
+	out, err := msg.Encode()
+	if err != nil {
+		out = make([]byte, len(bs))
+		copy(out, bs[:protocol.HeaderLength])
+	}
+	return out, true
+}
+
+// mayContainSecret 在原始字节中查找字段名，避免解码每一帧
+func mayContainSecret(bs []byte) bool {
+	// 与日志隐去相同的字段
+	for _, keys := range []map[string]bool{logging.SecretKeys, logging.AuthKeys} {
+		for key := range keys {
+			if bytes.Contains(bs, append([]byte(key), 0)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type redactor struct {
+	auth    bool
+	changed bool
+}
+
+func (p *redactor) secret(key string) bool {
+	return logging.SecretKeys[key] || p.auth && logging.AuthKeys[key]
+}
+
+func (p *redactor) documents(docs []protocol.Document) {
+	for i := range docs {
+		docs[i] = p.document(docs[i])
+	}
+}
+
+func (p *redactor) document(doc protocol.Document) protocol.Document {
+	for i, it := range doc {
+		if p.secret(it.Key) {
+			doc[i].Val = p.mask(it.Val)
+		} else {
+			doc[i].Val = p.value(it.Val)
+		}
+	}
+	return doc
+}
+
+func (p *redactor) value(v interface{}) interface{} {
+	switch d := v.(type) {
+	case protocol.Document:
+		return p.document(d)
+	case bson.Map:
+		for k, it := range d {
+			if p.secret(k) {
+				d[k] = p.mask(it)
+			} else {
+				d[k] = p.value(it)
+			}
+		}
+	case bson.Array:
+		for i, it := range d {
+			d[i] = p.value(it)
+		}
+	}
+	return v
+}
+
+// mask 字符串与二进制保持长度，其他类型替换为 null
+func (p *redactor) mask(v interface{}) interface{} {
+	p.changed = true
+	switch d := v.(type) {
+	case bson.Binary:
+		return make(bson.Binary, len(d))
+	case protocol.Binary:
+		return protocol.Binary{Subtype: d.Subtype, Data: make([]byte, len(d.Data))}
+	case bson.String:
+		return bson.String(strings.Repeat("*", len(d)))
+	case string:
+		return strings.Repeat("*", len(d))
+	}
+	return bson.Null{}
+}
@@ -0,0 +1,564 @@
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+// 认证命令在抓包中通常已被隐去，重放时跳过，目标部署的认证由 ReplayOptions.Username 完成
+var replayAuthCommands = map[string]bool{
+	"saslstart":    true,
+	"saslcontinue": true,
+	"authenticate": true,
+	"getnonce":     true,
+	"logout":       true,
+}
+
+// ReplayOptions 重放选项
+type ReplayOptions struct {
+	// Target 目标部署的地址
+	Target string
+	// Speed 时间倍速，1 按原始的请求间隔发送，2 为两倍速，0 表示不等待
+	Speed float64
+	// Concurrency 同时重放的最大连接数，0 表示不限制，每个抓到的连接各占一个到目标的连接
+	Concurrency int
+	// Username 非空时每个连接先以该身份认证
+	Username string
+	Password string
+	// Timeout 等待单个响应的时间，超时后放弃该连接剩余的请求
+	Timeout time.Duration
+	// MaxDiffs 报告中保留的错误差异条数，0 表示默认的 100 条
+	MaxDiffs int
+}
+
+// Stats 一组请求的延迟分布
+type Stats struct {
+	Count int
+	// Errors 没有收到响应的请求数
+	Errors int
+	Mean   time.Duration
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+}
+
+// Diff 重放结果与抓包中的响应不一致的请求，只比较错误码
+type Diff struct {
+	Conn      int64
+	RequestID int32
+	Command   string
+	Namespace string
+	Recorded  protocol.ReplyResult
+	Replayed  protocol.ReplyResult
+}
+
+// Report 重放的结果
+type Report struct {
+	Connections int
+	// Sent 发送的请求数，Skipped 跳过的认证命令与无法解码的帧
+	Sent     int
+	Skipped  int
+	Duration time.Duration
+	Total    Stats
+	Commands map[string]Stats
+	// Mismatches 错误码不一致的请求总数，Diffs 只保留前 MaxDiffs 条
+	Mismatches int
+	Diffs      []Diff
+	// Errors 连接级别的错误，例如无法连接或认证失败
+	Errors []string
+}
+
+type request struct {
+	frame     *Frame
+	msg       protocol.Message
+	command   string
+	namespace string
+	expects   bool
+	recorded  *Frame
+}
+
+type session struct {
+	conn     int64
+	requests []*request
+}
+
+// ReadFiles 依次读取抓包文件，文件末尾不完整的帧被忽略
+func ReadFiles(paths ...string) ([]*Frame, error) {
+	var out []*Frame
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		r := NewReader(f)
+		for {
+			frame, err := r.Next()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			out = append(out, frame)
+		}
+		f.Close()
+	}
+	return out, nil
+}
+
+// sessions 按连接分组，请求按抓取顺序排列并关联抓包中的响应
+func sessions(frames []*Frame) ([]*session, int) {
+	byConn := make(map[int64]*session)
+	pending := make(map[int64]map[int32]*request)
+	var order []*session
+	skipped := 0
+	for _, it := range frames {
+		s, ok := byConn[it.Conn]
+		if !ok {
+			s = &session{conn: it.Conn}
+			byConn[it.Conn] = s
+			pending[it.Conn] = make(map[int32]*request)
+			order = append(order, s)
+		}
+		if len(it.Data) < protocol.HeaderLength {
+			continue
+		}
+		if it.Direction == Out {
+			responseTo := int32(binary.LittleEndian.Uint32(it.Data[8:12]))
+			if req, ok := pending[it.Conn][responseTo]; ok {
+				req.recorded = it
+				delete(pending[it.Conn], responseTo)
+			}
+			continue
+		}
+		msg, err := protocol.Decode(it.Data)
+		if err != nil {
+			skipped++
+			continue
+		}
+		op, ns, _ := protocol.Operation(msg)
+		if replayAuthCommands[op] {
+			skipped++
+			continue
+		}
+		req := &request{frame: it, msg: msg, command: op, namespace: ns, expects: protocol.ExpectsReply(msg)}
+		if req.command == "" {
+			req.command = msg.Header().OpCode.String()
+		}
+		if req.expects {
+			pending[it.Conn][msg.Header().RequestID] = req
+		}
+		s.requests = append(s.requests, req)
+	}
+	out := order[:0]
+	for _, s := range order {
+		if len(s.requests) > 0 {
+			out = append(out, s)
+		}
+	}
+	return out, skipped
+}
+
+// Replay 在 opts.Target 上重放抓包中客户端发出的请求。
+// 每个抓到的连接对应一个到目标的连接，请求按原顺序发送，需要响应的请求收到响应后才发送下一个；
+// 请求的发送时间按 Speed 缩放原始的时间间隔。帧会全部读入内存
+func Replay(ctx context.Context, frames []*Frame, opts ReplayOptions) (*Report, error) {
+	if opts.Target == "" {
+		return nil, errors.New("no replay target")
+	}
+	if opts.Speed < 0 {
+		return nil, errors.New("speed must not be negative")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.MaxDiffs <= 0 {
+		opts.MaxDiffs = 100
+	}
+	list, skipped := sessions(frames)
+	if len(list) == 0 {
+		return nil, errors.New("no client requests to replay")
+	}
+	origin := list[0].requests[0].frame.Time
+	for _, s := range list {
+		if t := s.requests[0].frame.Time; t.Before(origin) {
+			origin = t
+		}
+	}
+	r := &replayer{
+		opts:      opts,
+		origin:    origin,
+		start:     time.Now(),
+		latencies: make(map[string][]time.Duration),
+		errors:    make(map[string]int),
+		report:    &Report{Connections: len(list), Skipped: skipped},
+	}
+	var sem chan struct{}
+	if opts.Concurrency > 0 {
+		sem = make(chan struct{}, opts.Concurrency)
+	}
+	var wg sync.WaitGroup
+	for _, s := range list {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(s *session) {
+			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			if err := r.session(ctx, s); err != nil {
+				r.fail(fmt.Sprintf("conn %d: %v", s.conn, err))
+			}
+		}(s)
+	}
+	wg.Wait()
+	r.finish()
+	return r.report, ctx.Err()
+}
+
+type replayer struct {
+	opts   ReplayOptions
+	origin time.Time
+	start  time.Time
+
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+	report    *Report
+}
+
+// due 请求按倍速缩放后的发送时间
+func (p *replayer) due(frame *Frame) time.Time {
+	if p.opts.Speed == 0 {
+		return time.Time{}
+	}
+	offset := float64(frame.Time.Sub(p.origin)) / p.opts.Speed
+	return p.start.Add(time.Duration(offset))
+}
+
+func (p *replayer) dial() (api.Context, error) {
+	c, err := api.NewBackend(p.opts.Target).NewConn()
+	if err != nil {
+		return nil, err
+	}
+	if p.opts.Username != "" {
+		if err := api.Sasl(c, p.opts.Username, p.opts.Password); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("authenticate failed: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (p *replayer) session(ctx context.Context, s *session) error {
+	if err := wait(ctx, p.due(s.requests[0].frame)); err != nil {
+		return nil
+	}
+	c, err := p.dial()
+	if err != nil {
+		p.abort(s.requests)
+		return err
+	}
+	defer c.Close()
+	replies := c.Next()
+	// 抓包中的游标 id 到目标上游标 id 的映射
+	cursors := make(map[int64]int64)
+	for i, req := range s.requests {
+		if err := wait(ctx, p.due(req.frame)); err != nil {
+			return nil
+		}
+		data, err := remap(req, cursors)
+		if err != nil {
+			return fmt.Errorf("request %d: %w", req.msg.Header().RequestID, err)
+		}
+		start := time.Now()
+		if err := c.Send(data); err != nil {
+			p.abort(s.requests[i:])
+			return err
+		}
+		p.sent()
+		if !req.expects {
+			continue
+		}
+		reply, err := await(ctx, replies, req.msg.Header().RequestID, p.opts.Timeout)
+		if err != nil {
+			p.abort(s.requests[i:])
+			return fmt.Errorf("request %d (%s): %w", req.msg.Header().RequestID, req.command, err)
+		}
+		p.observe(s.conn, req, reply, time.Since(start), cursors)
+	}
+	return nil
+}
+
+func wait(ctx context.Context, due time.Time) error {
+	d := time.Until(due)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// await 等待 ResponseTo 指向请求的响应，其他响应（例如 exhaust 游标的后续批次）被丢弃
+func await(ctx context.Context, replies <-chan protocol.Message, id int32, timeout time.Duration) (protocol.Message, error) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case msg := <-replies:
+			if msg == nil {
+				return nil, errors.New("connection closed by target")
+			}
+			if msg.Header().ResponseTo == id {
+				return msg, nil
+			}
+		case <-t.C:
+			return nil, fmt.Errorf("no reply within %s", timeout)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// remap 将请求中抓包时的游标 id 替换为目标上的游标 id，不涉及游标的请求原样发送
+func remap(req *request, cursors map[int64]int64) ([]byte, error) {
+	if len(cursors) == 0 {
+		return req.frame.Data, nil
+	}
+	id := func(v int64) (int64, bool) {
+		n, ok := cursors[v]
+		return n, ok
+	}
+	changed := false
+	switch v := req.msg.(type) {
+	case *protocol.OpGetMore:
+		if n, ok := id(v.CursorID); ok {
+			v.CursorID, changed = n, true
+		}
+	case *protocol.OpKillCursors:
+		for i, it := range v.CursorIDs {
+			if n, ok := id(it); ok {
+				v.CursorIDs[i], changed = n, true
+			}
+		}
+	case *protocol.OpMessage:
+		v.Body, changed = remapCommand(v.Body, cursors)
+	case *protocol.OpQuery:
+		v.Query, changed = remapCommand(v.Query, cursors)
+	case *protocol.OpCommand:
+		v.CommandArgs, changed = remapCommand(v.CommandArgs, cursors)
+	}
+	if !changed {
+		return req.frame.Data, nil
+	}
+	return req.msg.Encode()
+}
+
+// remapCommand 处理 getMore 与 killCursors 命令中的游标 id
+func remapCommand(doc protocol.Document, cursors map[int64]int64) (protocol.Document, bool) {
+	if len(doc) == 0 {
+		return doc, false
+	}
+	changed := false
+	switch doc[0].Key {
+	case "getMore":
+		if n, ok := cursors[tools.LookupInt64(doc, "getMore")]; ok {
+			doc = protocol.Store(doc, "getMore", n)
+			changed = true
+		}
+	case "killCursors":
+		arr := tools.LookupArray(doc, "cursors")
+		out := make(bson.Array, 0, len(arr))
+		for _, it := range arr {
+			// 游标 id 可能超出 float64 的精度，借助 LookupInt64 按整数读取
+			v := tools.LookupInt64(protocol.Document{{Key: "id", Val: it}}, "id")
+			if n, found := cursors[v]; found && v != 0 {
+				it, changed = n, true
+			}
+			out = append(out, it)
+		}
+		if changed {
+			doc = protocol.Store(doc, "cursors", out)
+		}
+	}
+	return doc, changed
+}
+
+func (p *replayer) sent() {
+	p.mu.Lock()
+	p.report.Sent++
+	p.mu.Unlock()
+}
+
+// abort 连接中断后剩余的请求都计为错误
+func (p *replayer) abort(rest []*request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, it := range rest {
+		if it.expects {
+			p.errors[it.command]++
+		}
+	}
+}
+
+func (p *replayer) fail(msg string) {
+	p.mu.Lock()
+	p.report.Errors = append(p.report.Errors, msg)
+	p.mu.Unlock()
+}
+
+func (p *replayer) observe(conn int64, req *request, reply protocol.Message, latency time.Duration, cursors map[int64]int64) {
+	replayed := protocol.Summarize(req.msg, reply)
+	var recorded protocol.ReplyResult
+	if req.recorded != nil {
+		if msg, err := protocol.Decode(req.recorded.Data); err == nil {
+			recorded = protocol.Summarize(req.msg, msg)
+			if recorded.CursorID != 0 && replayed.CursorID != 0 {
+				cursors[recorded.CursorID] = replayed.CursorID
+			}
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.latencies[req.command] = append(p.latencies[req.command], latency)
+	if req.recorded == nil || recorded.Code == replayed.Code {
+		return
+	}
+	p.report.Mismatches++
+	if len(p.report.Diffs) < p.opts.MaxDiffs {
+		p.report.Diffs = append(p.report.Diffs, Diff{
+			Conn:      conn,
+			RequestID: req.msg.Header().RequestID,
+			Command:   req.command,
+			Namespace: req.namespace,
+			Recorded:  recorded,
+			Replayed:  replayed,
+		})
+	}
+}
+
+func (p *replayer) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report.Duration = time.Since(p.start)
+	p.report.Commands = make(map[string]Stats)
+	var all []time.Duration
+	total := 0
+	names := make(map[string]bool)
+	for name := range p.latencies {
+		names[name] = true
+	}
+	for name := range p.errors {
+		names[name] = true
+	}
+	for name := range names {
+		p.report.Commands[name] = summarize(p.latencies[name], p.errors[name])
+		all = append(all, p.latencies[name]...)
+		total += p.errors[name]
+	}
+	p.report.Total = summarize(all, total)
+	sort.Strings(p.report.Errors)
+}
+
+func summarize(latencies []time.Duration, errors int) Stats {
+	s := Stats{Count: len(latencies) + errors, Errors: errors}
+	if len(latencies) == 0 {
+		return s
+	}
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, it := range sorted {
+		sum += it
+	}
+	at := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1))]
+	}
+	s.Mean = sum / time.Duration(len(sorted))
+	s.P50, s.P90, s.P99 = at(0.5), at(0.9), at(0.99)
+	s.Max = sorted[len(sorted)-1]
+	return s
+}
+
+// Print 以文本输出报告
+func (p *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "connections: %d  sent: %d  skipped: %d  duration: %s\n",
+		p.Connections, p.Sent, p.Skipped, p.Duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "%-16s %8s %7s %10s %10s %10s %10s %10s\n", "command", "count", "errors", "mean", "p50", "p90", "p99", "max")
+	names := make([]string, 0, len(p.Commands))
+	for name := range p.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	row := func(name string, s Stats) {
+		fmt.Fprintf(w, "%-16s %8d %7d %10s %10s %10s %10s %10s\n", name, s.Count, s.Errors,
+			round(s.Mean), round(s.P50), round(s.P90), round(s.P99), round(s.Max))
+	}
+	for _, name := range names {
+		row(name, p.Commands[name])
+	}
+	row("total", p.Total)
+	if p.Mismatches > 0 {
+		fmt.Fprintf(w, "\n%d replies differ from the capture:\n", p.Mismatches)
+		for _, it := range p.Diffs {
+			fmt.Fprintf(w, "  conn=%d requestId=%d %s %s: recorded %s, replayed %s\n",
+				it.Conn, it.RequestID, it.Command, it.Namespace, describe(it.Recorded), describe(it.Replayed))
+		}
+		if n := p.Mismatches - len(p.Diffs); n > 0 {
+			fmt.Fprintf(w, "  ... and %d more\n", n)
+		}
+	}
+	if len(p.Errors) > 0 {
+		fmt.Fprintln(w, "\nconnection errors:")
+		for _, it := range p.Errors {
+			fmt.Fprintf(w, "  %s\n", it)
+		}
+	}
+}
+
+func round(d time.Duration) string {
+	return d.Round(time.Microsecond).String()
+}
+
+func describe(res protocol.ReplyResult) string {
+	if res.Code == 0 {
+		return "ok"
+	}
+	out := fmt.Sprintf("code %d", res.Code)
+	if res.CodeName != "" {
+		out += " " + res.CodeName
+	}
+	if res.Error != "" {
+		out += fmt.Sprintf(" (%s)", strings.TrimSpace(res.Error))
+	}
+	return out
+}
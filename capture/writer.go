@@ -0,0 +1,101 @@
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/jjeffcaii/mongo-proxy/tools"
+)
+
+// Writer 按大小轮转的抓包文件，只追加写入，轮转后的文件依次命名为 path.1、path.2 ...，path.1 最新
+type Writer struct {
+	Path     string
+	MaxBytes int64
+	// MaxBackups 为 0 时保留所有备份
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	buf  []byte
+}
+
+// NewWriter 打开或创建抓包文件，已有的文件继续追加，maxBytes 为 0 时不轮转
+func NewWriter(path string, maxBytes int64, maxBackups int) (*Writer, error) {
+	p := &Writer{Path: path, MaxBytes: maxBytes, MaxBackups: maxBackups}
+	if err := p.open(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Write 追加一帧，整条记录一次写入，多个 Writer 追加同一文件时记录不会交错
+func (p *Writer) Write(frame *Frame) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.file == nil {
+		return os.ErrClosed
+	}
+	p.buf = frame.append(p.buf[:0])
+	if p.MaxBytes > 0 && p.size > int64(len(magic)) && p.size+int64(len(p.buf)) > p.MaxBytes {
+		if err := p.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := p.file.Write(p.buf)
+	p.size += int64(n)
+	return err
+}
+
+func (p *Writer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Close()
+	p.file = nil
+	return err
+}
+
+func (p *Writer) open() error {
+	f, err := os.OpenFile(p.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	size := info.Size()
+	if size == 0 {
+		n, err := f.Write(magic)
+		size = int64(n)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	} else {
+		head := make([]byte, len(magic))
+		if _, err := f.ReadAt(head, 0); err != nil && err != io.EOF || !bytes.Equal(head, magic) {
+			f.Close()
+			return fmt.Errorf("%s: %w", p.Path, errMagic)
+		}
+	}
+	p.file, p.size = f, size
+	return nil
+}
+
+func (p *Writer) rotate() error {
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	if err := tools.RotateFile(p.Path, p.MaxBackups); err != nil {
+		return err
+	}
+	return p.open()
+}
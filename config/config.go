@@ -0,0 +1,226 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ModeForward 转发到 Backend，find 结果为空时回退到 fallback 设置的后端
+	ModeForward = "forward"
+	// ModeRouter 按 routing 路由表将请求分发到多个后端
+	ModeRouter = "router"
+)
+
+// Config 代理的完整配置
+type Config struct {
+	Listeners   []Listener   `yaml:"listeners" json:"listeners"`
+	Backends    []Backend    `yaml:"backends" json:"backends"`
+	Routing     *Routing     `yaml:"routing,omitempty" json:"routing,omitempty"`
+	Fallback    *Fallback    `yaml:"fallback,omitempty" json:"fallback,omitempty"`
+	Middlewares []Middleware `yaml:"middlewares,omitempty" json:"middlewares,omitempty"`
+	Limits      Limits       `yaml:"limits,omitempty" json:"limits,omitempty"`
+	Admin       Admin        `yaml:"admin,omitempty" json:"admin,omitempty"`
+	Metrics     Metrics      `yaml:"metrics,omitempty" json:"metrics,omitempty"`
+	Log         Log          `yaml:"log,omitempty" json:"log,omitempty"`
+	Secrets     Secrets      `yaml:"secrets,omitempty" json:"secrets,omitempty"`
+}
+
+// Listener 代理监听的地址，Name 为空时使用 Addr
+type Listener struct {
+	Name    string `yaml:"name,omitempty" json:"name,omitempty"`
+	Addr    string `yaml:"addr" json:"addr"`
+	Mode    string `yaml:"mode,omitempty" json:"mode,omitempty"`
+	Backend string `yaml:"backend,omitempty" json:"backend,omitempty"`
+}
+
+// Backend 后端，URI 与 Addr/Username/Password 二选一，URI 中的 maxPoolSize 对应 MaxConns
+type Backend struct {
+	Name     string `yaml:"name" json:"name"`
+	URI      string `yaml:"uri,omitempty" json:"uri,omitempty"`
+	Addr     string `yaml:"addr,omitempty" json:"addr,omitempty"`
+	Username string `yaml:"username,omitempty" json:"username,omitempty"`
+	Password string `yaml:"password,omitempty" json:"password,omitempty"`
+	// PasswordFrom 引用密钥提供者中的密码，如 env:MONGO_PASSWORD、file:/run/secrets/mongo、keystore:primary，
+	// 每次建立后端连接时读取，与 Password 二选一
+	PasswordFrom string `yaml:"passwordFrom,omitempty" json:"passwordFrom,omitempty"`
+	MaxConns     int    `yaml:"maxConns,omitempty" json:"maxConns,omitempty"`
+}
+
+// Routing 命名空间路由表，Collection 为空时匹配库中所有集合
+type Routing struct {
+	Default string  `yaml:"default" json:"default"`
+	Routes  []Route `yaml:"routes,omitempty" json:"routes,omitempty"`
+}
+
+type Route struct {
+	Database   string `yaml:"database" json:"database"`
+	Collection string `yaml:"collection,omitempty" json:"collection,omitempty"`
+	Backend    string `yaml:"backend" json:"backend"`
+}
+
+// Fallback forward 模式下查询为空时回退的后端
+type Fallback struct {
+	Enabled *bool  `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	Backend string `yaml:"backend" json:"backend"`
+}
+
+// IsEnabled 未设置 enabled 时默认启用
+func (p *Fallback) IsEnabled() bool {
+	return p != nil && (p.Enabled == nil || *p.Enabled)
+}
+
+// Middleware 注册在客户端连接上的中间件，按顺序执行，Options 的结构由中间件决定
+type Middleware struct {
+	Name    string                 `yaml:"name" json:"name"`
+	Options map[string]interface{} `yaml:"options,omitempty" json:"options,omitempty"`
+}
+
+// Limits 连接限制，0 表示不限制
+type Limits struct {
+	MaxConnections int `yaml:"maxConnections,omitempty" json:"maxConnections,omitempty"`
+	// MaxPerClient 同一客户端 IP 的最大连接数
+	MaxPerClient int `yaml:"maxPerClient,omitempty" json:"maxPerClient,omitempty"`
+}
+
+// Admin 管理接口，Listen 为空时不启动 HTTP 管理接口，监听非本机地址时必须配置 Token。Users 为空时不接受管理命令
+type Admin struct {
+	Listen string   `yaml:"listen,omitempty" json:"listen,omitempty"`
+	Token  string   `yaml:"token,omitempty" json:"token,omitempty"`
+	Users  []string `yaml:"users,omitempty" json:"users,omitempty"`
+}
+
+type Metrics struct {
+	Listen string `yaml:"listen,omitempty" json:"listen,omitempty"`
+}
+
+type Log struct {
+	Level  string `yaml:"level,omitempty" json:"level,omitempty"`
+	Format string `yaml:"format,omitempty" json:"format,omitempty"`
+}
+
+// Secrets 密钥提供者的配置
+type Secrets struct {
+	Keystore *Keystore `yaml:"keystore,omitempty" json:"keystore,omitempty"`
+}
+
+// Keystore 本地加密密钥库，主密钥从环境变量 KeyEnv 或文件 KeyFile 读取，
+// KeyEnv 默认为 MONGO_PROXY_KEYSTORE_KEY
+type Keystore struct {
+	Path    string `yaml:"path" json:"path"`
+	KeyEnv  string `yaml:"keyEnv,omitempty" json:"keyEnv,omitempty"`
+	KeyFile string `yaml:"keyFile,omitempty" json:"keyFile,omitempty"`
+}
+
+// DefaultKeystoreKeyEnv 未配置 keyEnv 时读取主密钥的环境变量
+const DefaultKeystoreKeyEnv = "MONGO_PROXY_KEYSTORE_KEY"
+
+// Duration 以 "1s"、"250ms" 形式书写的时长
+type Duration time.Duration
+
+func (p *Duration) UnmarshalText(text []byte) error {
+	d, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*p = Duration(d)
+	return nil
+}
+
+func (p Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(p).String()), nil
+}
+
+// FallbackPasswordEnv 默认配置中回退后端密码所在的环境变量
+const FallbackPasswordEnv = "MONGO_PROXY_FALLBACK_PASSWORD"
+
+// Default 未提供配置文件时的配置：:27019 转发到本机 27017，管理接口与指标只监听本机。
+// 设置了环境变量 FallbackPasswordEnv 时以 admin 用户认证启用本机 27018 的回退后端，未设置时不启用回退
+func Default() *Config {
+	cfg := &Config{
+		Listeners: []Listener{{Name: "default", Addr: ":27019", Mode: ModeForward, Backend: "primary"}},
+		Backends:  []Backend{{Name: "primary", Addr: "127.0.0.1:27017"}},
+		Admin:     Admin{Listen: "127.0.0.1:9217", Users: []string{"admin"}},
+		Metrics:   Metrics{Listen: "127.0.0.1:9216"},
+	}
+	if os.Getenv(FallbackPasswordEnv) != "" {
+		cfg.Backends = append(cfg.Backends, Backend{
+			Name: "fallback", Addr: "127.0.0.1:27018", Username: "admin", PasswordFrom: "env:" + FallbackPasswordEnv,
+		})
+		cfg.Fallback = &Fallback{Backend: "fallback"}
+	}
+	return cfg
+}
+
+// Load 读取并校验配置文件，.json 按 JSON 解析，其余按 YAML 解析
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data, Format(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Format 按扩展名判断配置格式，.json 为 json，其余为 yaml
+func Format(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return "json"
+	}
+	return "yaml"
+}
+
+// Parse 解析并校验配置，未知字段视为错误
+func Parse(data []byte, format string) (*Config, error) {
+	cfg := &Config{}
+	switch format {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, jsonError(data, err)
+		}
+	case "yaml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format %q", format)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// jsonError 为语法与类型错误补充行号
+func jsonError(data []byte, err error) error {
+	var offset int64 = -1
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntax):
+		offset = syntax.Offset
+	case errors.As(err, &typ):
+		offset = typ.Offset
+	}
+	if offset < 0 || offset > int64(len(data)) {
+		return err
+	}
+	line := 1 + bytes.Count(data[:offset], []byte{'\n'})
+	return fmt.Errorf("line %d: %w", line, err)
+}
@@ -0,0 +1,233 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/secret"
+)
+
+// ValidationError 配置中的所有问题，每条以字段路径开头
+type ValidationError struct {
+	Problems []string
+}
+
+func (p *ValidationError) Error() string {
+	if len(p.Problems) == 1 {
+		return "invalid config: " + p.Problems[0]
+	}
+	return "invalid config:\n  " + strings.Join(p.Problems, "\n  ")
+}
+
+type checker struct {
+	problems []string
+}
+
+func (p *checker) add(path, format string, args ...interface{}) {
+	p.problems = append(p.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (p *checker) addr(path, addr string) {
+	if addr == "" {
+		p.add(path, "is required")
+		return
+	}
+	if _, port, err := net.SplitHostPort(addr); err != nil {
+		p.add(path, "invalid address %q: %v", addr, err)
+	} else if port == "" {
+		p.add(path, "missing port in address %q", addr)
+	}
+}
+
+// loopback 判断监听地址是否只在本机可达，主机为空表示所有网卡
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Validate 检查配置并补全监听的默认名称与模式，所有问题一次返回
+func (p *Config) Validate() error {
+	c := &checker{}
+	backends := make(map[string]bool, len(p.Backends))
+	for i, it := range p.Backends {
+		path := fmt.Sprintf("backends[%d]", i)
+		if it.Name == "" {
+			c.add(path+".name", "is required")
+		} else if backends[it.Name] {
+			c.add(path+".name", "duplicate backend %q", it.Name)
+		}
+		backends[it.Name] = true
+		if it.URI != "" && (it.Addr != "" || it.Username != "" || it.Password != "") {
+			c.add(path, "uri cannot be combined with addr, username or password")
+			continue
+		}
+		resolved, err := it.Resolve()
+		if err != nil {
+			c.add(path+".uri", "%v", err)
+			continue
+		}
+		c.addr(path+".addr", resolved.Addr)
+		if resolved.Password != "" && resolved.Username == "" {
+			c.add(path+".password", "requires username")
+		}
+		if it.PasswordFrom != "" {
+			if resolved.Password != "" {
+				c.add(path+".passwordFrom", "cannot be combined with a password")
+			} else if resolved.Username == "" {
+				c.add(path+".passwordFrom", "requires username")
+			}
+			if scheme, _, err := secret.ParseRef(it.PasswordFrom); err != nil {
+				c.add(path+".passwordFrom", "%v", err)
+			} else if scheme == "keystore" && p.Secrets.Keystore == nil {
+				c.add(path+".passwordFrom", "keystore references require secrets.keystore")
+			}
+		}
+		if it.MaxConns < 0 {
+			c.add(path+".maxConns", "must not be negative")
+		}
+	}
+	backend := func(path, name string) {
+		if name == "" {
+			c.add(path, "is required")
+		} else if !backends[name] {
+			c.add(path, "unknown backend %q", name)
+		}
+	}
+
+	if len(p.Listeners) == 0 {
+		c.add("listeners", "at least one listener is required")
+	}
+	listeners := make(map[string]bool, len(p.Listeners))
+	addrs := make(map[string]bool, len(p.Listeners))
+	for i := range p.Listeners {
+		it := &p.Listeners[i]
+		path := fmt.Sprintf("listeners[%d]", i)
+		if it.Name == "" {
+			it.Name = it.Addr
+		}
+		if listeners[it.Name] {
+			c.add(path+".name", "duplicate listener %q", it.Name)
+		}
+		listeners[it.Name] = true
+		c.addr(path+".addr", it.Addr)
+		// 端口 0 由系统分配，不会冲突
+		if addrs[it.Addr] && !strings.HasSuffix(it.Addr, ":0") {
+			c.add(path+".addr", "address %q is already used by another listener", it.Addr)
+		}
+		addrs[it.Addr] = true
+		if it.Mode == "" {
+			it.Mode = ModeForward
+		}
+		switch it.Mode {
+		case ModeForward:
+			backend(path+".backend", it.Backend)
+		case ModeRouter:
+			if it.Backend != "" {
+				c.add(path+".backend", "is not used in router mode, configure routing instead")
+			}
+			if p.Routing == nil {
+				c.add(path+".mode", "router mode requires a routing section")
+			}
+		default:
+			c.add(path+".mode", "unknown mode %q, expected %q or %q", it.Mode, ModeForward, ModeRouter)
+		}
+	}
+
+	if p.Routing != nil {
+		backend("routing.default", p.Routing.Default)
+		for i, it := range p.Routing.Routes {
+			path := fmt.Sprintf("routing.routes[%d]", i)
+			if it.Database == "" {
+				c.add(path+".database", "is required")
+			}
+			backend(path+".backend", it.Backend)
+		}
+	}
+	if p.Fallback != nil {
+		backend("fallback.backend", p.Fallback.Backend)
+	}
+	for i, it := range p.Middlewares {
+		if it.Name == "" {
+			c.add(fmt.Sprintf("middlewares[%d].name", i), "is required")
+		}
+	}
+	if p.Limits.MaxConnections < 0 {
+		c.add("limits.maxConnections", "must not be negative")
+	}
+	if p.Limits.MaxPerClient < 0 {
+		c.add("limits.maxPerClient", "must not be negative")
+	}
+	if p.Admin.Listen != "" {
+		c.addr("admin.listen", p.Admin.Listen)
+		// 管理接口可以断开连接、摘除后端，监听其他地址时必须配置 token
+		if p.Admin.Token == "" && !loopback(p.Admin.Listen) {
+			c.add("admin.token", "is required when admin.listen %q is not a loopback address", p.Admin.Listen)
+		}
+	}
+	if p.Metrics.Listen != "" {
+		c.addr("metrics.listen", p.Metrics.Listen)
+	}
+	if ks := p.Secrets.Keystore; ks != nil && ks.Path == "" {
+		c.add("secrets.keystore.path", "is required")
+	}
+	if p.Log.Level != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(p.Log.Level)); err != nil {
+			c.add("log.level", "unknown level %q, expected debug, info, warn or error", p.Log.Level)
+		}
+	}
+	switch p.Log.Format {
+	case "", "text", "json":
+	default:
+		c.add("log.format", "unknown format %q, expected text or json", p.Log.Format)
+	}
+	if len(c.problems) > 0 {
+		return &ValidationError{Problems: c.problems}
+	}
+	return nil
+}
+
+// Resolve 解析 URI，返回填好 Addr、Username、Password 与 MaxConns 的后端
+func (p Backend) Resolve() (Backend, error) {
+	if p.URI == "" {
+		return p, nil
+	}
+	u, err := ParseURI(p.URI)
+	if err != nil {
+		return p, err
+	}
+	p.Addr, p.Username, p.Password = u.Addr, u.Username, u.Password
+	if p.MaxConns == 0 {
+		p.MaxConns = u.MaxPoolSize
+	}
+	return p, nil
+}
+
+// Backend 按名称查找后端
+func (p *Config) Backend(name string) (Backend, bool) {
+	for _, it := range p.Backends {
+		if it.Name == name {
+			return it, true
+		}
+	}
+	return Backend{}, false
+}
+
+// Listener 按名称查找监听
+func (p *Config) Listener(name string) (Listener, bool) {
+	for _, it := range p.Listeners {
+		if it.Name == name {
+			return it, true
+		}
+	}
+	return Listener{}, false
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/capture"
+	"github.com/jjeffcaii/mongo-proxy/logging"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+)
+
+func runDecode(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("decode", stderr)
+	format := fs.String("format", "auto", "input format: hex, binary, capture or auto")
+	canonical := fs.Bool("canonical", false, "print documents as canonical instead of relaxed Extended JSON")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	data, err := io.ReadAll(stdin)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	switch *format {
+	case "auto":
+		if capture.IsCapture(data) {
+			return decodeCapture(data, stdout, stderr, *canonical)
+		}
+		if isHex(data) {
+			data, err = decodeHex(data)
+		}
+	case "hex":
+		data, err = decodeHex(data)
+	case "binary":
+	case "capture":
+		return decodeCapture(data, stdout, stderr, *canonical)
+	default:
+		fmt.Fprintf(stderr, "decode: unknown format %q, expected hex, binary, capture or auto\n", *format)
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "decode:", err)
+		return exitError
+	}
+	if len(data) == 0 {
+		fmt.Fprintln(stderr, "decode: no input")
+		return exitError
+	}
+	if err := decodeFrames(data, stdout, *canonical); err != nil {
+		fmt.Fprintln(stderr, "decode:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// isHex 输入只包含十六进制字符与空白时视为十六进制文本
+func isHex(data []byte) bool {
+	s := strings.TrimPrefix(string(bytes.TrimSpace(data)), "0x")
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		case c == ' ', c == '\n', c == '\r', c == '\t':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func decodeHex(data []byte) ([]byte, error) {
+	s := strings.TrimPrefix(string(bytes.TrimSpace(data)), "0x")
+	s = strings.Join(strings.Fields(s), "")
+	return hex.DecodeString(s)
+}
+
+// decodeFrames 依次解码输入中的每个消息帧
+func decodeFrames(data []byte, w io.Writer, canonical bool) error {
+	for i := 0; len(data) > 0; i++ {
+		if len(data) < protocol.HeaderLength {
+			return fmt.Errorf("frame %d: %d trailing bytes are shorter than a message header", i, len(data))
+		}
+		n := int(binary.LittleEndian.Uint32(data))
+		if n < protocol.HeaderLength || n > len(data) {
+			return fmt.Errorf("frame %d: message length %d does not match the %d bytes available", i, n, len(data))
+		}
+		msg, err := protocol.Decode(data[:n])
+		if err != nil {
+			return fmt.Errorf("frame %d: %w", i, err)
+		}
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		printMessage(w, msg, n, canonical)
+		data = data[n:]
+	}
+	return nil
+}
+
+// decodeCapture 解码抓包文件中的每一帧，文件末尾不完整的帧给出警告
+func decodeCapture(data []byte, stdout, stderr io.Writer, canonical bool) int {
+	r := capture.NewReader(bytes.NewReader(data))
+	for i := 0; ; i++ {
+		frame, err := r.Next()
+		if err == io.EOF {
+			return exitOK
+		}
+		if err == io.ErrUnexpectedEOF {
+			fmt.Fprintf(stderr, "decode: frame %d is truncated\n", i)
+			return exitOK
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, "decode:", err)
+			return exitError
+		}
+		if i > 0 {
+			fmt.Fprintln(stdout)
+		}
+		printFrame(stdout, frame, canonical)
+	}
+}
+
+// printFrame 输出带有连接与方向的帧，无法解码时只输出长度
+func printFrame(w io.Writer, frame *capture.Frame, canonical bool) {
+	fmt.Fprintf(w, "# conn=%d %s %s", frame.Conn, frame.Direction, frame.Time.UTC().Format(time.RFC3339Nano))
+	if frame.Redacted {
+		fmt.Fprint(w, " redacted")
+	}
+	fmt.Fprintln(w)
+	msg, err := protocol.Decode(frame.Data)
+	if err != nil {
+		fmt.Fprintf(w, "undecodable frame of %d bytes: %v\n", len(frame.Data), err)
+		return
+	}
+	printMessage(w, msg, len(frame.Data), canonical)
+}
+
+// printMessage 输出消息头与各字段，文档以 Extended JSON 表示
+func printMessage(w io.Writer, msg protocol.Message, length int, canonical bool) {
+	h := msg.Header()
+	fmt.Fprintf(w, "%s length=%d requestId=%d responseTo=%d\n", h.OpCode, length, h.RequestID, h.ResponseTo)
+	for _, it := range logging.Fields(msg, canonical) {
+		fmt.Fprintf(w, "  %s: %s\n", it.Key, it.Value)
+	}
+}
@@ -0,0 +1,669 @@
+package fake
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+const defaultBatchSize = 101
+
+type handler func(s *session, cmd *protocol.Command) (protocol.Document, error)
+
+// 不需要认证即可执行的命令
+var publicCommands = map[string]bool{
+	"hello":        true,
+	"ismaster":     true,
+	"ping":         true,
+	"buildinfo":    true,
+	"saslstart":    true,
+	"saslcontinue": true,
+	"endsessions":  true,
+}
+
+func (p *Server) handlers() map[string]handler {
+	return map[string]handler{
+		"hello":        p.hello,
+		"ismaster":     p.hello,
+		"ping":         empty,
+		"endsessions":  empty,
+		"buildinfo":    buildInfo,
+		"saslstart":    p.saslStart,
+		"saslcontinue": p.saslContinue,
+		"logout":       logout,
+		"find":         p.find,
+		"getmore":      p.getMore,
+		"killcursors":  p.killCursors,
+		"insert":       p.insertCommand,
+		"update":       p.update,
+		"delete":       p.delete,
+		"count":        p.count,
+		"drop":         p.drop,
+	}
+}
+
+func (p *Server) run(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	name := strings.ToLower(cmd.Name)
+	fn, ok := p.handlers()[name]
+	if !ok {
+		return nil, &protocol.CommandError{
+			Code:     protocol.CodeCommandNotFound,
+			CodeName: "CommandNotFound",
+			Message:  fmt.Sprintf("no such command: '%s'", cmd.Name),
+		}
+	}
+	p.mu.Lock()
+	secured := len(p.users) > 0
+	p.mu.Unlock()
+	if secured && s.user == "" && !publicCommands[name] {
+		return nil, &protocol.CommandError{
+			Code:     protocol.CodeUnauthorized,
+			CodeName: "Unauthorized",
+			Message:  fmt.Sprintf("command %s requires authentication", cmd.Name),
+		}
+	}
+	return fn(s, cmd)
+}
+
+func empty(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	return protocol.Document{}, nil
+}
+
+func logout(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	s.user = ""
+	return protocol.Document{}, nil
+}
+
+func buildInfo(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	return protocol.Document{
+		{Key: "version", Val: "5.0.0-fake"},
+		{Key: "versionArray", Val: bson.Array{int32(5), int32(0), int32(0), int32(0)}},
+		{Key: "maxBsonObjectSize", Val: int32(16 * 1024 * 1024)},
+	}, nil
+}
+
+// hello 不返回 logicalSessionTimeoutMinutes 与 topologyVersion，驱动不会使用会话与流式心跳
+func (p *Server) hello(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	doc := protocol.Document{
+		{Key: "ismaster", Val: true},
+		{Key: "isWritablePrimary", Val: true},
+		{Key: "helloOk", Val: true},
+		{Key: "maxBsonObjectSize", Val: int32(16 * 1024 * 1024)},
+		{Key: "maxMessageSizeBytes", Val: int32(48000000)},
+		{Key: "maxWriteBatchSize", Val: int32(100000)},
+		{Key: "localTime", Val: time.Now()},
+		{Key: "connectionId", Val: int32(s.id)},
+		{Key: "minWireVersion", Val: int32(0)},
+		{Key: "maxWireVersion", Val: p.MaxWireVersion},
+		{Key: "readOnly", Val: false},
+	}
+	if v, ok := protocol.Load(cmd.Args, "saslSupportedMechs"); ok {
+		ns, _ := tools.String(v)
+		p.mu.Lock()
+		_, exists := p.users[strings.TrimPrefix(ns, "admin.")]
+		p.mu.Unlock()
+		if exists {
+			doc = append(doc, protocol.Pair{Key: "saslSupportedMechs", Val: bson.Array{"SCRAM-SHA-1", "SCRAM-SHA-256"}})
+		}
+	}
+	return doc, nil
+}
+
+// payload 驱动以二进制发送，部分旧客户端以 base64 字符串发送
+func payload(args protocol.Document) (string, error) {
+	v, _ := protocol.Load(args, "payload")
+	switch b := v.(type) {
+	case bson.Binary:
+		return string(b), nil
+	case []byte:
+		return string(b), nil
+	}
+	if s, ok := tools.String(v); ok {
+		bs, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return s, nil
+		}
+		return string(bs), nil
+	}
+	return "", badValue("missing payload")
+}
+
+func authFailed() error {
+	return &protocol.CommandError{Code: 18, CodeName: "AuthenticationFailed", Message: errAuthFailed.Error()}
+}
+
+func (p *Server) saslStart(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	if cmd.Database != "admin" {
+		return nil, authFailed()
+	}
+	name, _ := tools.String(load(cmd.Args, "mechanism"))
+	mech, ok := mechanisms[name]
+	if !ok {
+		return nil, badValue("Received authentication for mechanism %s which is not enabled", name)
+	}
+	data, err := payload(cmd.Args)
+	if err != nil {
+		return nil, err
+	}
+	s.conv = &conversation{mech: mech}
+	if opts, ok := tools.AsDocument(load(cmd.Args, "options")); ok {
+		s.conv.skipEmpty = truthy(load(opts, "skipEmptyExchange"))
+	}
+	first, err := s.conv.start(data, func(user string) (credential, bool) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		cred, ok := p.users[user][name]
+		return cred, ok
+	})
+	if err != nil {
+		s.conv = nil
+		return nil, authFailed()
+	}
+	return protocol.Document{
+		{Key: "conversationId", Val: int32(1)},
+		{Key: "done", Val: false},
+		{Key: "payload", Val: []byte(first)},
+	}, nil
+}
+
+// saslContinue 校验证明后返回 server-final，客户端声明 skipEmptyExchange 时同时结束会话，
+// 否则等待一次空的 saslContinue
+func (p *Server) saslContinue(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	if s.conv == nil {
+		return nil, authFailed()
+	}
+	conv := s.conv
+	if conv.verified {
+		s.conv, s.user = nil, conv.user
+		return protocol.Document{
+			{Key: "conversationId", Val: int32(1)},
+			{Key: "done", Val: true},
+			{Key: "payload", Val: []byte{}},
+		}, nil
+	}
+	data, err := payload(cmd.Args)
+	if err != nil {
+		return nil, err
+	}
+	final, err := conv.finish(data)
+	if err != nil {
+		s.conv = nil
+		return nil, authFailed()
+	}
+	done := conv.skipEmpty
+	if done {
+		s.conv, s.user = nil, conv.user
+	}
+	return protocol.Document{
+		{Key: "conversationId", Val: int32(1)},
+		{Key: "done", Val: done},
+		{Key: "payload", Val: []byte(final)},
+	}, nil
+}
+
+func load(doc protocol.Document, key string) interface{} {
+	v, _ := protocol.Load(doc, key)
+	return v
+}
+
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case bson.Bool:
+		return bool(b)
+	}
+	n, _ := tools.Number(v)
+	return n != 0
+}
+
+func document(args protocol.Document, key string) (protocol.Document, error) {
+	v, ok := protocol.Load(args, key)
+	if !ok || isNull(v) {
+		return nil, nil
+	}
+	doc, ok := tools.AsDocument(v)
+	if !ok {
+		return nil, badValue("%s must be a document", key)
+	}
+	return doc, nil
+}
+
+func integer(args protocol.Document, key string) (int, error) {
+	v, ok := protocol.Load(args, key)
+	if !ok {
+		return 0, nil
+	}
+	n, ok := tools.Number(v)
+	if !ok || n < 0 {
+		return 0, badValue("%s must be a non-negative number", key)
+	}
+	return int(n), nil
+}
+
+func collection(cmd *protocol.Command) (string, error) {
+	coll := cmd.Collection()
+	if coll == "" {
+		return "", &protocol.CommandError{Code: 73, CodeName: "InvalidNamespace", Message: "collection name must be a non-empty string"}
+	}
+	return coll, nil
+}
+
+// filterDocuments 调用方持有 mu，返回匹配文档在集合中的下标
+func (p *Server) filterDocuments(db, coll string, filter protocol.Document) ([]int, error) {
+	var out []int
+	for i, it := range p.databases[db][coll] {
+		ok, err := match(it, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, i)
+		}
+	}
+	return out, nil
+}
+
+func (p *Server) find(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	coll, err := collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := document(cmd.Args, "filter")
+	if err != nil {
+		return nil, err
+	}
+	sortSpec, err := document(cmd.Args, "sort")
+	if err != nil {
+		return nil, err
+	}
+	projection, err := document(cmd.Args, "projection")
+	if err != nil {
+		return nil, err
+	}
+	skip, err := integer(cmd.Args, "skip")
+	if err != nil {
+		return nil, err
+	}
+	limit, err := integer(cmd.Args, "limit")
+	if err != nil {
+		return nil, err
+	}
+	batchSize, err := integer(cmd.Args, "batchSize")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := protocol.Load(cmd.Args, "batchSize"); !ok {
+		batchSize = defaultBatchSize
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idx, err := p.filterDocuments(cmd.Database, coll, filter)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]protocol.Document, 0, len(idx))
+	for _, i := range idx {
+		docs = append(docs, p.databases[cmd.Database][coll][i])
+	}
+	sortDocuments(docs, sortSpec)
+	if skip >= len(docs) {
+		docs = nil
+	} else {
+		docs = docs[skip:]
+	}
+	if limit > 0 && limit < len(docs) {
+		docs = docs[:limit]
+	}
+	for i, it := range docs {
+		docs[i] = project(it, projection)
+	}
+	ns := cmd.Database + "." + coll
+	if truthy(load(cmd.Args, "singleBatch")) && batchSize < len(docs) {
+		docs = docs[:batchSize]
+	}
+	batch, id := p.batch(ns, docs, batchSize)
+	return cursorDocument("firstBatch", ns, id, batch), nil
+}
+
+// batch 调用方持有 mu，剩余的文档保存为游标
+func (p *Server) batch(ns string, docs []protocol.Document, size int) ([]protocol.Document, int64) {
+	if size == 0 || size >= len(docs) {
+		return docs, 0
+	}
+	// 与 mongod 一样使用随机的 64 位游标 id
+	id := rand.Int63()
+	for id == 0 || p.cursors[id] != nil {
+		id = rand.Int63()
+	}
+	p.cursors[id] = &cursor{ns: ns, docs: docs[size:]}
+	return docs[:size], id
+}
+
+func cursorDocument(key, ns string, id int64, docs []protocol.Document) protocol.Document {
+	arr := make(bson.Array, 0, len(docs))
+	for _, it := range docs {
+		arr = append(arr, it)
+	}
+	return protocol.Document{{Key: "cursor", Val: protocol.Document{
+		{Key: key, Val: arr},
+		{Key: "id", Val: id},
+		{Key: "ns", Val: ns},
+	}}}
+}
+
+// cursorID 按整数读取游标 id，经过 float64 会丢失精度
+func cursorID(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case bson.Int64:
+		return int64(n), true
+	case bson.Int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int32:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+func cursorNotFound(id int64) error {
+	return &protocol.CommandError{Code: 43, CodeName: "CursorNotFound", Message: fmt.Sprintf("cursor id %d not found", id)}
+}
+
+func (p *Server) getMore(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	id, ok := cursorID(cmd.Args[0].Val)
+	if !ok {
+		return nil, badValue("getMore cursor id must be an integer")
+	}
+	batchSize, err := integer(cmd.Args, "batchSize")
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.cursors[id]
+	if !ok || c.ns != cmd.Database+"."+cmd.Collection() {
+		return nil, cursorNotFound(id)
+	}
+	delete(p.cursors, id)
+	batch, next := c.docs, int64(0)
+	if batchSize > 0 && batchSize < len(c.docs) {
+		batch = c.docs[:batchSize]
+		c.docs = c.docs[batchSize:]
+		p.cursors[id] = c
+		next = id
+	}
+	return cursorDocument("nextBatch", c.ns, next, batch), nil
+}
+
+func (p *Server) killCursors(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	ids := array(load(cmd.Args, "cursors"))
+	killed, missing := bson.Array{}, bson.Array{}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, it := range ids {
+		id, _ := cursorID(it)
+		if _, ok := p.cursors[id]; ok {
+			delete(p.cursors, id)
+			killed = append(killed, id)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return protocol.Document{
+		{Key: "cursorsKilled", Val: killed},
+		{Key: "cursorsNotFound", Val: missing},
+		{Key: "cursorsAlive", Val: bson.Array{}},
+		{Key: "cursorsUnknown", Val: bson.Array{}},
+	}, nil
+}
+
+// writeResult 有写错误时附加 writeErrors，ordered 写入在第一个错误处停止
+func writeResult(n int, errs bson.Array, extra ...protocol.Pair) protocol.Document {
+	doc := protocol.Document{{Key: "n", Val: int32(n)}}
+	doc = append(doc, extra...)
+	if len(errs) > 0 {
+		doc = append(doc, protocol.Pair{Key: "writeErrors", Val: errs})
+	}
+	return doc
+}
+
+func writeError(index int, err error) protocol.Document {
+	ce := protocol.AsCommandError(err)
+	return protocol.Document{
+		{Key: "index", Val: int32(index)},
+		{Key: "code", Val: ce.Code},
+		{Key: "codeName", Val: ce.CodeName},
+		{Key: "errmsg", Val: ce.Message},
+	}
+}
+
+func ordered(args protocol.Document) bool {
+	v, ok := protocol.Load(args, "ordered")
+	return !ok || truthy(v)
+}
+
+func (p *Server) insertCommand(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	coll, err := collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+	docs := array(load(cmd.Args, "documents"))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n, errs := 0, bson.Array{}
+	for i, it := range docs {
+		doc, ok := tools.AsDocument(it)
+		if !ok {
+			return nil, badValue("documents must be an array of documents")
+		}
+		if err := p.insert(cmd.Database, coll, doc); err != nil {
+			errs = append(errs, writeError(i, err))
+			if ordered(cmd.Args) {
+				break
+			}
+			continue
+		}
+		n++
+	}
+	return writeResult(n, errs), nil
+}
+
+func (p *Server) update(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	coll, err := collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n, modified, errs, upserted := 0, 0, bson.Array{}, bson.Array{}
+	for i, it := range array(load(cmd.Args, "updates")) {
+		spec, ok := tools.AsDocument(it)
+		if !ok {
+			return nil, badValue("updates must be an array of documents")
+		}
+		matched, changed, id, err := p.updateOne(cmd.Database, coll, spec)
+		if err != nil {
+			errs = append(errs, writeError(i, err))
+			if ordered(cmd.Args) {
+				break
+			}
+			continue
+		}
+		n += matched
+		modified += changed
+		if id != nil {
+			n++
+			upserted = append(upserted, protocol.Document{{Key: "index", Val: int32(i)}, {Key: "_id", Val: id}})
+		}
+	}
+	extra := []protocol.Pair{{Key: "nModified", Val: int32(modified)}}
+	if len(upserted) > 0 {
+		extra = append(extra, protocol.Pair{Key: "upserted", Val: upserted})
+	}
+	return writeResult(n, errs, extra...), nil
+}
+
+// updateOne 调用方持有 mu，返回匹配数、修改数与 upsert 生成的 _id
+func (p *Server) updateOne(db, coll string, spec protocol.Document) (int, int, interface{}, error) {
+	filter, err := document(spec, "q")
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	u, err := document(spec, "u")
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	multi := truthy(load(spec, "multi"))
+	if multi && !isOperatorUpdate(u) {
+		return 0, 0, nil, badValue("multi update is not supported for replacement-style update")
+	}
+	idx, err := p.filterDocuments(db, coll, filter)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(idx) == 0 {
+		if !truthy(load(spec, "upsert")) {
+			return 0, 0, nil, nil
+		}
+		doc, err := applyUpdate(upsertSeed(filter), u, true)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if id, ok := protocol.Load(doc, "_id"); !ok || id == nil {
+			doc = unsetPath(doc, []string{"_id"})
+		}
+		if err := p.insert(db, coll, doc); err != nil {
+			return 0, 0, nil, err
+		}
+		docs := p.databases[db][coll]
+		id, _ := protocol.Load(docs[len(docs)-1], "_id")
+		return 0, 0, id, nil
+	}
+	if !multi {
+		idx = idx[:1]
+	}
+	changed := 0
+	docs := p.databases[db][coll]
+	for _, i := range idx {
+		next, err := applyUpdate(docs[i], u, false)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if tools.Compare(next, docs[i]) != 0 {
+			changed++
+		}
+		docs[i] = next
+	}
+	return len(idx), changed, nil, nil
+}
+
+func (p *Server) delete(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	coll, err := collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n, errs := 0, bson.Array{}
+	for i, it := range array(load(cmd.Args, "deletes")) {
+		spec, ok := tools.AsDocument(it)
+		if !ok {
+			return nil, badValue("deletes must be an array of documents")
+		}
+		filter, err := document(spec, "q")
+		if err == nil {
+			var idx []int
+			if idx, err = p.filterDocuments(cmd.Database, coll, filter); err == nil {
+				if limit, _ := tools.Number(load(spec, "limit")); limit == 1 && len(idx) > 1 {
+					idx = idx[:1]
+				}
+				p.remove(cmd.Database, coll, idx)
+				n += len(idx)
+			}
+		}
+		if err != nil {
+			errs = append(errs, writeError(i, err))
+			if ordered(cmd.Args) {
+				break
+			}
+		}
+	}
+	return writeResult(n, errs), nil
+}
+
+// remove 调用方持有 mu，idx 按升序排列
+func (p *Server) remove(db, coll string, idx []int) {
+	if len(idx) == 0 {
+		return
+	}
+	docs := p.databases[db][coll]
+	out := make([]protocol.Document, 0, len(docs)-len(idx))
+	j := 0
+	for i, it := range docs {
+		if j < len(idx) && idx[j] == i {
+			j++
+			continue
+		}
+		out = append(out, it)
+	}
+	p.databases[db][coll] = out
+}
+
+func (p *Server) count(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	coll, err := collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := document(cmd.Args, "query")
+	if err != nil {
+		return nil, err
+	}
+	skip, err := integer(cmd.Args, "skip")
+	if err != nil {
+		return nil, err
+	}
+	limit, err := integer(cmd.Args, "limit")
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idx, err := p.filterDocuments(cmd.Database, coll, filter)
+	if err != nil {
+		return nil, err
+	}
+	n := len(idx) - skip
+	if n < 0 {
+		n = 0
+	}
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	return protocol.Document{{Key: "n", Val: int32(n)}}, nil
+}
+
+func (p *Server) drop(s *session, cmd *protocol.Command) (protocol.Document, error) {
+	coll, err := collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.databases[cmd.Database][coll]; !ok {
+		return nil, &protocol.CommandError{Code: 26, CodeName: "NamespaceNotFound", Message: "ns not found"}
+	}
+	delete(p.databases[cmd.Database], coll)
+	if len(p.databases[cmd.Database]) == 0 {
+		delete(p.databases, cmd.Database)
+	}
+	return protocol.Document{{Key: "ns", Val: cmd.Database + "." + coll}}, nil
+}
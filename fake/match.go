@@ -0,0 +1,285 @@
+package fake
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+func badValue(format string, args ...interface{}) error {
+	return &protocol.CommandError{
+		Code:     protocol.CodeBadValue,
+		CodeName: "BadValue",
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// values 按路径取值，路径经过数组时展开数组元素，末端为数组时同时返回数组本身与其元素
+func values(v interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		if arr := array(v); arr != nil {
+			return append([]interface{}{v}, arr...)
+		}
+		return []interface{}{v}
+	}
+	if doc, ok := tools.AsDocument(v); ok {
+		val, ok := protocol.Load(doc, parts[0])
+		if !ok {
+			return nil
+		}
+		return values(val, parts[1:])
+	}
+	if arr := array(v); arr != nil {
+		if i, err := strconv.Atoi(parts[0]); err == nil {
+			if i >= 0 && i < len(arr) {
+				return values(arr[i], parts[1:])
+			}
+			return nil
+		}
+		var out []interface{}
+		for _, it := range arr {
+			if _, ok := tools.AsDocument(it); ok {
+				out = append(out, values(it, parts)...)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func array(v interface{}) []interface{} {
+	switch a := v.(type) {
+	case bson.Array:
+		return a
+	case []interface{}:
+		return a
+	}
+	return nil
+}
+
+// match 判断文档是否满足过滤条件，支持 $and/$or/$nor 与常用的比较运算
+func match(doc protocol.Document, filter protocol.Document) (bool, error) {
+	for _, it := range filter {
+		var ok bool
+		var err error
+		switch it.Key {
+		case "$and", "$or", "$nor":
+			ok, err = logical(doc, it.Key, it.Val)
+		case "$comment":
+			ok = true
+		default:
+			ok, err = matchField(doc, it.Key, it.Val)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func logical(doc protocol.Document, op string, v interface{}) (bool, error) {
+	clauses := array(v)
+	if len(clauses) == 0 {
+		return false, badValue("%s must be a nonempty array", op)
+	}
+	for _, it := range clauses {
+		sub, ok := tools.AsDocument(it)
+		if !ok {
+			return false, badValue("%s argument's entries must be objects", op)
+		}
+		ok, err := match(doc, sub)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case op == "$and" && !ok:
+			return false, nil
+		case op == "$or" && ok:
+			return true, nil
+		case op == "$nor" && ok:
+			return false, nil
+		}
+	}
+	return op != "$or", nil
+}
+
+// operators 条件是否为 {$op: ...} 形式
+func operators(cond interface{}) (protocol.Document, bool) {
+	doc, ok := tools.AsDocument(cond)
+	if !ok || len(doc) == 0 || !strings.HasPrefix(doc[0].Key, "$") {
+		return nil, false
+	}
+	return doc, true
+}
+
+func matchField(doc protocol.Document, path string, cond interface{}) (bool, error) {
+	vals := values(doc, strings.Split(path, "."))
+	ops, ok := operators(cond)
+	if !ok {
+		return matchEqual(vals, cond), nil
+	}
+	for _, op := range ops {
+		ok, err := matchOperator(vals, op.Key, op.Val)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchEqual(vals []interface{}, want interface{}) bool {
+	if len(vals) == 0 {
+		return isNull(want)
+	}
+	for _, it := range vals {
+		if tools.Equal(it, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNull(v interface{}) bool {
+	switch v.(type) {
+	case nil, bson.Null:
+		return true
+	}
+	return false
+}
+
+func matchOperator(vals []interface{}, op string, arg interface{}) (bool, error) {
+	compare := func(fn func(c int) bool) bool {
+		for _, it := range vals {
+			if tools.Comparable(it, arg) && fn(tools.Compare(it, arg)) {
+				return true
+			}
+		}
+		return false
+	}
+	switch op {
+	case "$eq":
+		return matchEqual(vals, arg), nil
+	case "$ne":
+		return !matchEqual(vals, arg), nil
+	case "$gt":
+		return compare(func(c int) bool { return c > 0 }), nil
+	case "$gte":
+		return compare(func(c int) bool { return c >= 0 }), nil
+	case "$lt":
+		return compare(func(c int) bool { return c < 0 }), nil
+	case "$lte":
+		return compare(func(c int) bool { return c <= 0 }), nil
+	case "$in", "$nin":
+		list := array(arg)
+		if list == nil {
+			return false, badValue("%s needs an array", op)
+		}
+		found := false
+		for _, it := range list {
+			if matchEqual(vals, it) {
+				found = true
+				break
+			}
+		}
+		return found == (op == "$in"), nil
+	case "$exists":
+		want := true
+		switch v := arg.(type) {
+		case bool:
+			want = v
+		case bson.Bool:
+			want = bool(v)
+		default:
+			if n, ok := tools.Number(arg); ok {
+				want = n != 0
+			}
+		}
+		return (len(vals) > 0) == want, nil
+	case "$not":
+		ops, ok := operators(arg)
+		if !ok {
+			return false, badValue("$not needs a document")
+		}
+		for _, it := range ops {
+			ok, err := matchOperator(vals, it.Key, it.Val)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$size":
+		n, ok := tools.Number(arg)
+		if !ok {
+			return false, badValue("$size needs a number")
+		}
+		for _, it := range vals {
+			if arr := array(it); arr != nil && len(arr) == int(n) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, badValue("unknown operator: %s", op)
+}
+
+// sortDocuments 按 sort 规格稳定排序，缺失的字段视为 null
+func sortDocuments(docs []protocol.Document, spec protocol.Document) {
+	if len(spec) == 0 {
+		return
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, it := range spec {
+			a, _ := tools.Lookup(docs[i], it.Key)
+			b, _ := tools.Lookup(docs[j], it.Key)
+			c := tools.Compare(a, b)
+			if n, _ := tools.Number(it.Val); n < 0 {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// project 只支持顶层字段的包含或排除投影
+func project(doc protocol.Document, spec protocol.Document) protocol.Document {
+	if len(spec) == 0 {
+		return doc
+	}
+	include, idIncluded := false, true
+	fields := make(map[string]bool, len(spec))
+	for _, it := range spec {
+		n, ok := tools.Number(it.Val)
+		on := !ok || n != 0
+		if b, isBool := it.Val.(bool); isBool {
+			on = b
+		}
+		if it.Key == "_id" {
+			idIncluded = on
+			continue
+		}
+		fields[it.Key] = true
+		include = on
+	}
+	out := make(protocol.Document, 0, len(doc))
+	for _, it := range doc {
+		keep := fields[it.Key] == include
+		if it.Key == "_id" {
+			keep = idIncluded
+		}
+		if keep {
+			out = append(out, it)
+		}
+	}
+	return out
+}
@@ -0,0 +1,148 @@
+package fake
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const scramIterations = 4096
+
+// credential 一个用户在某种机制下的 SCRAM 凭据
+type credential struct {
+	salt      []byte
+	storedKey []byte
+	serverKey []byte
+}
+
+type mechanism struct {
+	name string
+	hash func() hash.Hash
+	// prepare 将明文密码转换为参与 PBKDF2 的密码，SCRAM-SHA-1 使用 MongoDB 的 MD5 摘要
+	prepare func(user, password string) string
+}
+
+var mechanisms = map[string]mechanism{
+	"SCRAM-SHA-1": {
+		name: "SCRAM-SHA-1",
+		hash: sha1.New,
+		prepare: func(user, password string) string {
+			digest := md5.Sum([]byte(user + ":mongo:" + password))
+			return hex.EncodeToString(digest[:])
+		},
+	},
+	"SCRAM-SHA-256": {
+		name: "SCRAM-SHA-256",
+		hash: sha256.New,
+		// 只支持不需要 SASLprep 转换的 ASCII 密码
+		prepare: func(user, password string) string { return password },
+	},
+}
+
+func (p mechanism) hmac(key []byte, data string) []byte {
+	h := hmac.New(p.hash, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (p mechanism) credential(user, password string) credential {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	salted := pbkdf2.Key([]byte(p.prepare(user, password)), salt, scramIterations, p.hash().Size(), p.hash)
+	h := p.hash()
+	h.Write(p.hmac(salted, "Client Key"))
+	return credential{
+		salt:      salt,
+		storedKey: h.Sum(nil),
+		serverKey: p.hmac(salted, "Server Key"),
+	}
+}
+
+// conversation 服务端的一次 SCRAM 会话
+type conversation struct {
+	mech        mechanism
+	user        string
+	cred        credential
+	clientFirst string
+	serverFirst string
+	nonce       string
+	verified    bool
+	// skipEmpty 客户端在 saslStart 中声明了 skipEmptyExchange
+	skipEmpty bool
+}
+
+var errAuthFailed = errors.New("Authentication failed.")
+
+func scramAttrs(s string) map[string]string {
+	m := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// start 处理 client-first，返回 server-first
+func (p *conversation) start(payload string, lookup func(user string) (credential, bool)) (string, error) {
+	// gs2 头部 "n,," 之后为 client-first-bare
+	parts := strings.SplitN(payload, ",", 3)
+	if len(parts) != 3 || parts[0] != "n" {
+		return "", errors.New("invalid SCRAM client-first message")
+	}
+	p.clientFirst = parts[2]
+	attrs := scramAttrs(p.clientFirst)
+	p.user = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(attrs["n"])
+	if attrs["r"] == "" {
+		return "", errors.New("missing client nonce")
+	}
+	cred, ok := lookup(p.user)
+	if !ok {
+		return "", errAuthFailed
+	}
+	p.cred = cred
+	nonce := make([]byte, 24)
+	rand.Read(nonce)
+	p.nonce = attrs["r"] + base64.StdEncoding.EncodeToString(nonce)
+	p.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", p.nonce, base64.StdEncoding.EncodeToString(p.cred.salt), scramIterations)
+	return p.serverFirst, nil
+}
+
+// finish 校验 client-final 中的证明，返回 server-final
+func (p *conversation) finish(payload string) (string, error) {
+	i := strings.LastIndex(payload, ",p=")
+	if i < 0 {
+		return "", errors.New("missing client proof")
+	}
+	withoutProof := payload[:i]
+	if scramAttrs(withoutProof)["r"] != p.nonce {
+		return "", errAuthFailed
+	}
+	proof, err := base64.StdEncoding.DecodeString(payload[i+3:])
+	if err != nil || len(proof) != len(p.cred.storedKey) {
+		return "", errAuthFailed
+	}
+	authMessage := p.clientFirst + "," + p.serverFirst + "," + withoutProof
+	signature := p.mech.hmac(p.cred.storedKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for j := range proof {
+		clientKey[j] = proof[j] ^ signature[j]
+	}
+	h := p.mech.hash()
+	h.Write(clientKey)
+	if !hmac.Equal(h.Sum(nil), p.cred.storedKey) {
+		return "", errAuthFailed
+	}
+	p.verified = true
+	return "v=" + base64.StdEncoding.EncodeToString(p.mech.hmac(p.cred.serverKey, authMessage)), nil
+}
@@ -0,0 +1,194 @@
+package fake
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+// Server 进程内的 MongoDB 替身，数据保存在内存中，用于在没有 mongod 的环境下端到端测试代理。
+// 支持 hello/isMaster、SCRAM-SHA-1/SCRAM-SHA-256 认证、find、getMore、killCursors、
+// insert、update、delete、count 与 drop，过滤条件只支持常用的比较与逻辑运算
+type Server struct {
+	// MaxWireVersion 默认为 13，设为 5 及以下时官方驱动改用 OP_QUERY 发送命令
+	MaxWireVersion int32
+
+	mu          sync.Mutex
+	users       map[string]map[string]credential
+	databases   map[string]map[string][]protocol.Document
+	cursors     map[int64]*cursor
+	endpoint    api.Endpoint
+	addr        net.Addr
+	connections atomic.Int64
+	requests    atomic.Int64
+}
+
+type cursor struct {
+	ns   string
+	docs []protocol.Document
+}
+
+func New() *Server {
+	return &Server{
+		MaxWireVersion: 13,
+		users:          make(map[string]map[string]credential),
+		databases:      make(map[string]map[string][]protocol.Document),
+		cursors:        make(map[int64]*cursor),
+	}
+}
+
+// AddUser 在 admin 库上创建用户，存在用户时除握手与认证外的命令都需要先认证
+func (p *Server) AddUser(user, password string) *Server {
+	creds := make(map[string]credential, len(mechanisms))
+	for name, it := range mechanisms {
+		creds[name] = it.credential(user, password)
+	}
+	p.mu.Lock()
+	p.users[user] = creds
+	p.mu.Unlock()
+	return p
+}
+
+// Start 在 addr 上开始服务，addr 为 "127.0.0.1:0" 时由系统分配端口
+func (p *Server) Start(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.addr = l.Addr()
+	p.endpoint = api.NewListenerProxy(l)
+	go p.endpoint.Serve(p.Handle)
+	return nil
+}
+
+// Addr 返回监听地址，Start 之前为空
+func (p *Server) Addr() string {
+	if p.addr == nil {
+		return ""
+	}
+	return p.addr.String()
+}
+
+// URI 返回官方驱动使用的连接串，直连而不做副本集发现
+func (p *Server) URI() string {
+	return "mongodb://" + p.Addr() + "/?directConnection=true"
+}
+
+func (p *Server) Close() error {
+	if p.endpoint == nil {
+		return nil
+	}
+	return p.endpoint.Close()
+}
+
+// Requests 返回处理过的请求数，用于断言请求是否到达该后端
+func (p *Server) Requests() int64 {
+	return p.requests.Load()
+}
+
+// Insert 直接写入测试数据，缺少 _id 时自动生成
+func (p *Server) Insert(db, coll string, docs ...protocol.Document) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, it := range docs {
+		if err := p.insert(db, coll, it); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Documents 返回集合中文档的副本，按插入顺序排列
+func (p *Server) Documents(db, coll string) []protocol.Document {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]protocol.Document(nil), p.databases[db][coll]...)
+}
+
+// Databases 返回有数据的库名
+func (p *Server) Databases() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]string, 0, len(p.databases))
+	for it := range p.databases {
+		out = append(out, it)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (p *Server) insert(db, coll string, doc protocol.Document) error {
+	id, ok := protocol.Load(doc, "_id")
+	if !ok {
+		oid, err := bson.NewObjectId()
+		if err != nil {
+			return err
+		}
+		id = oid
+		doc = append(protocol.Document{{Key: "_id", Val: id}}, doc...)
+	}
+	colls, ok := p.databases[db]
+	if !ok {
+		colls = make(map[string][]protocol.Document)
+		p.databases[db] = colls
+	}
+	for _, it := range colls[coll] {
+		if old, _ := protocol.Load(it, "_id"); tools.Equal(old, id) {
+			return &protocol.CommandError{
+				Code:     11000,
+				CodeName: "DuplicateKey",
+				Message:  fmt.Sprintf("E11000 duplicate key error collection: %s.%s index: _id_ dup key: { _id: %v }", db, coll, id),
+			}
+		}
+	}
+	colls[coll] = append(colls[coll], doc)
+	return nil
+}
+
+// session 一个客户端连接的状态
+type session struct {
+	id   int64
+	user string
+	conv *conversation
+}
+
+// Handle 处理一个客户端连接，可以直接作为 api.Endpoint 的 handler
+func (p *Server) Handle(ctx api.Context) {
+	s := &session{id: p.connections.Add(1)}
+	for msg := range ctx.Next() {
+		if msg == nil {
+			return
+		}
+		p.requests.Add(1)
+		reply := p.dispatch(s, msg)
+		if reply == nil || !protocol.ExpectsReply(msg) {
+			continue
+		}
+		if err := ctx.Reply(reply); err != nil {
+			return
+		}
+	}
+}
+
+func (p *Server) dispatch(s *session, msg protocol.Message) protocol.Message {
+	cmd, ok := protocol.ParseCommand(msg)
+	if !ok {
+		if q, isQuery := msg.(*protocol.OpQuery); isQuery {
+			return protocol.NewErrorReply(q, errors.New("legacy OP_QUERY on collections is not supported, use the find command"))
+		}
+		return nil
+	}
+	doc, err := p.run(s, cmd)
+	if err != nil {
+		return protocol.NewErrorReply(msg, err)
+	}
+	return protocol.NewCommandReply(msg, append(doc, protocol.Pair{Key: "ok", Val: float64(1)}))
+}
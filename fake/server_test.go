@@ -0,0 +1,101 @@
+package fake
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func connect(t *testing.T, uri string, auth *options.Credential) *mongo.Client {
+	opts := options.Client().ApplyURI(uri).SetServerSelectionTimeout(3 * time.Second)
+	if auth != nil {
+		opts.SetAuth(*auth)
+	}
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return client
+}
+
+func TestDriver(t *testing.T) {
+	srv := New().AddUser("admin", "secret")
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ctx := context.Background()
+
+	for _, mech := range []string{"SCRAM-SHA-1", "SCRAM-SHA-256"} {
+		client := connect(t, srv.URI(), &options.Credential{AuthMechanism: mech, Username: "admin", Password: "secret"})
+		assert.NoError(t, client.Ping(ctx, nil), mech)
+	}
+	bad := connect(t, srv.URI(), &options.Credential{Username: "admin", Password: "wrong"})
+	assert.Error(t, bad.Ping(ctx, nil))
+	anonymous := connect(t, srv.URI(), nil)
+	_, err := anonymous.Database("app").Collection("users").InsertOne(ctx, bson.M{"name": "x"})
+	assert.ErrorContains(t, err, "requires authentication")
+
+	client := connect(t, srv.URI(), &options.Credential{Username: "admin", Password: "secret"})
+	users := client.Database("app").Collection("users")
+	docs := make([]interface{}, 0, 10)
+	for i := 0; i < 10; i++ {
+		docs = append(docs, bson.D{{Key: "_id", Value: i}, {Key: "age", Value: 20 + i}, {Key: "tags", Value: bson.A{"a", i % 2}}})
+	}
+	_, err = users.InsertMany(ctx, docs)
+	assert.NoError(t, err)
+	_, err = users.InsertOne(ctx, bson.M{"_id": 3})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+
+	// 小批次强制走 getMore
+	cur, err := users.Find(ctx, bson.M{"age": bson.M{"$gte": 23}, "tags": 1},
+		options.Find().SetSort(bson.D{{Key: "age", Value: -1}}).SetBatchSize(2))
+	assert.NoError(t, err)
+	var found []bson.M
+	assert.NoError(t, cur.All(ctx, &found))
+	if assert.Len(t, found, 4) {
+		assert.EqualValues(t, 9, found[0]["_id"])
+		assert.EqualValues(t, 3, found[3]["_id"])
+	}
+
+	res, err := users.UpdateMany(ctx, bson.M{"$or": bson.A{bson.M{"_id": 0}, bson.M{"_id": 1}}}, bson.M{"$inc": bson.M{"age": 5}, "$set": bson.M{"profile.vip": true}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, res.ModifiedCount)
+	var one bson.M
+	assert.NoError(t, users.FindOne(ctx, bson.M{"profile.vip": true, "age": 26}).Decode(&one))
+	assert.EqualValues(t, 1, one["_id"])
+
+	res, err = users.UpdateOne(ctx, bson.M{"_id": 42}, bson.M{"$set": bson.M{"age": 1}}, options.Update().SetUpsert(true))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 42, res.UpsertedID)
+
+	del, err := users.DeleteMany(ctx, bson.M{"age": bson.M{"$lt": 25}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, del.DeletedCount)
+	n, err := users.EstimatedDocumentCount(ctx)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 7, n)
+	assert.Len(t, srv.Documents("app", "users"), 7)
+}
+
+func TestLegacyWireVersion(t *testing.T) {
+	srv := New()
+	srv.MaxWireVersion = 5
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ctx := context.Background()
+	users := connect(t, srv.URI(), nil).Database("app").Collection("users")
+	_, err := users.InsertOne(ctx, bson.M{"_id": 1, "name": "a"})
+	assert.NoError(t, err)
+	var doc bson.M
+	assert.NoError(t, users.FindOne(ctx, bson.M{"name": "a"}).Decode(&doc))
+	assert.EqualValues(t, 1, doc["_id"])
+}
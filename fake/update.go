@@ -0,0 +1,158 @@
+package fake
+
+import (
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+// isOperatorUpdate 更新文档以 $ 开头时按运算符处理，否则整体替换
+func isOperatorUpdate(u protocol.Document) bool {
+	return len(u) > 0 && strings.HasPrefix(u[0].Key, "$")
+}
+
+// applyUpdate 返回更新后的副本，支持 $set、$unset、$inc、$setOnInsert 与整体替换，_id 保持不变
+func applyUpdate(doc protocol.Document, u protocol.Document, inserting bool) (protocol.Document, error) {
+	id, _ := protocol.Load(doc, "_id")
+	if !isOperatorUpdate(u) {
+		out := protocol.Document{{Key: "_id", Val: id}}
+		for _, it := range u {
+			if it.Key == "_id" {
+				if !tools.Equal(it.Val, id) {
+					return nil, immutableID()
+				}
+				continue
+			}
+			out = append(out, it)
+		}
+		return out, nil
+	}
+	out := clone(doc)
+	for _, op := range u {
+		args, ok := tools.AsDocument(op.Val)
+		if !ok {
+			return nil, badValue("modifier %s expects a document", op.Key)
+		}
+		for _, it := range args {
+			if it.Key == "_id" && op.Key != "$setOnInsert" {
+				return nil, immutableID()
+			}
+			parts := strings.Split(it.Key, ".")
+			switch op.Key {
+			case "$set":
+				out = setPath(out, parts, it.Val)
+			case "$setOnInsert":
+				if inserting {
+					out = setPath(out, parts, it.Val)
+				}
+			case "$unset":
+				out = unsetPath(out, parts)
+			case "$inc":
+				cur, _ := tools.Lookup(out, it.Key)
+				sum, err := add(cur, it.Val)
+				if err != nil {
+					return nil, err
+				}
+				out = setPath(out, parts, sum)
+			default:
+				return nil, badValue("unknown modifier: %s", op.Key)
+			}
+		}
+	}
+	return out, nil
+}
+
+func immutableID() error {
+	return &protocol.CommandError{
+		Code:     protocol.CodeImmutableField,
+		CodeName: "ImmutableField",
+		Message:  "Performing an update on the path '_id' would modify the immutable field '_id'",
+	}
+}
+
+// add 整数相加保持整数类型，任一方为浮点数时结果为 float64
+func add(cur, delta interface{}) (interface{}, error) {
+	d, ok := tools.Number(delta)
+	if !ok {
+		return nil, badValue("cannot increment with non-numeric argument")
+	}
+	if cur == nil {
+		return delta, nil
+	}
+	c, ok := tools.Number(cur)
+	if !ok {
+		return nil, badValue("cannot apply $inc to a value of non-numeric type")
+	}
+	switch cur.(type) {
+	case bson.Int32, int32:
+		switch delta.(type) {
+		case bson.Int32, int32:
+			return int32(c + d), nil
+		}
+	}
+	switch cur.(type) {
+	case bson.Int32, bson.Int64, int32, int64, int:
+		switch delta.(type) {
+		case bson.Int32, bson.Int64, int32, int64, int:
+			return int64(c + d), nil
+		}
+	}
+	return c + d, nil
+}
+
+func clone(doc protocol.Document) protocol.Document {
+	out := make(protocol.Document, len(doc))
+	copy(out, doc)
+	return out
+}
+
+// setPath 设置点分路径，中间缺失的文档会被创建
+func setPath(doc protocol.Document, parts []string, val interface{}) protocol.Document {
+	if len(parts) == 1 {
+		return protocol.Store(doc, parts[0], val)
+	}
+	cur, _ := protocol.Load(doc, parts[0])
+	sub, ok := tools.AsDocument(cur)
+	if !ok {
+		sub = protocol.Document{}
+	}
+	return protocol.Store(doc, parts[0], setPath(clone(sub), parts[1:], val))
+}
+
+func unsetPath(doc protocol.Document, parts []string) protocol.Document {
+	out := make(protocol.Document, 0, len(doc))
+	for _, it := range doc {
+		if it.Key != parts[0] {
+			out = append(out, it)
+			continue
+		}
+		if len(parts) == 1 {
+			continue
+		}
+		if sub, ok := tools.AsDocument(it.Val); ok {
+			it.Val = unsetPath(sub, parts[1:])
+		}
+		out = append(out, it)
+	}
+	return out
+}
+
+// upsertSeed 以过滤条件中的等值字段作为插入文档的初始内容
+func upsertSeed(filter protocol.Document) protocol.Document {
+	out := protocol.Document{}
+	for _, it := range filter {
+		if strings.HasPrefix(it.Key, "$") {
+			continue
+		}
+		if _, ok := operators(it.Val); ok {
+			if ops, _ := tools.AsDocument(it.Val); len(ops) == 1 && ops[0].Key == "$eq" {
+				out = setPath(out, strings.Split(it.Key, "."), ops[0].Val)
+			}
+			continue
+		}
+		out = setPath(out, strings.Split(it.Key, "."), it.Val)
+	}
+	return out
+}
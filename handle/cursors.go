@@ -0,0 +1,46 @@
+package handle
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// CursorInfo 打开中的虚拟游标
+type CursorInfo struct {
+	ID        int64     `json:"id"`
+	Namespace string    `json:"namespace"`
+	Backends  []string  `json:"backends"`
+	Conn      int64     `json:"conn"`
+	Created   time.Time `json:"created"`
+}
+
+// 所有会话中打开的虚拟游标，只保存创建时的信息，游标本身仍只在会话内访问
+var openCursors sync.Map // id -> CursorInfo
+
+// Cursors 按 id 返回所有打开的虚拟游标
+func Cursors() []CursorInfo {
+	out := make([]CursorInfo, 0)
+	openCursors.Range(func(_, v interface{}) bool {
+		out = append(out, v.(CursorInfo))
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func (p *shardSession) keep(cursor *MergeCursor) {
+	p.merged[cursor.ID] = cursor
+	openCursors.Store(cursor.ID, CursorInfo{
+		ID:        cursor.ID,
+		Namespace: cursor.Namespace,
+		Backends:  cursor.Backends(),
+		Conn:      p.client.ID(),
+		Created:   time.Now(),
+	})
+}
+
+func (p *shardSession) drop(id int64) {
+	delete(p.merged, id)
+	openCursors.Delete(id)
+}
@@ -0,0 +1,39 @@
+package handle
+
+import (
+	"sync/atomic"
+
+	"github.com/jjeffcaii/mongo-proxy/secret"
+)
+
+// FallbackConfig Forwarder 在主库查询为空时回退的后端，Addr 为空时不连接回退后端，修改只影响之后建立的连接，
+// Enabled 的修改对已有连接立即生效
+type FallbackConfig struct {
+	Enabled  bool
+	Addr     string
+	Username string
+	Password string
+	// Secret 非空时每次连接回退后端调用以取得当前密码，代替 Password
+	Secret func() (string, error)
+}
+
+var fallback atomic.Pointer[FallbackConfig]
+
+func init() {
+	fallback.Store(&FallbackConfig{
+		Enabled:  true,
+		Addr:     "127.0.0.1:27018",
+		Username: "admin",
+		Secret:   secret.Func("env:MONGO_PROXY_FALLBACK_PASSWORD"),
+	})
+}
+
+// Fallback 返回当前的回退设置
+func Fallback() FallbackConfig {
+	return *fallback.Load()
+}
+
+// SetFallback 替换回退设置
+func SetFallback(cfg FallbackConfig) {
+	fallback.Store(&cfg)
+}
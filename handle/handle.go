@@ -1,20 +1,44 @@
 package handle
 
 import (
-	"log"
-
 	"github.com/jjeffcaii/mongo-proxy/api"
 )
 
-func ProxyHandle(ctx api.Context) {
-	primaryDB := api.NewBackend("127.0.0.1:27017")
-	fallbackDB := api.NewBackend("127.0.0.1:27018")
+// Forwarder 将客户端请求转发到 Primary，Fallback() 启用时 find 结果为空改查回退后端
+type Forwarder struct {
+	Primary Upstream
+}
 
-	primaryCtx, err := primaryDB.NewConn()
-	fallbackCtx, err := fallbackDB.NewConn()
-	err = api.Sasl(fallbackCtx, "admin", "secret")
+func (p *Forwarder) Handle(ctx api.Context) {
+	primaryCtx, err := dialUpstream(p.Primary)
+	if err != nil {
+		ctx.Logger().Error("connect upstream failed", "upstream", p.Primary.Name, "err", err)
+		return
+	}
+	defer primaryCtx.Close()
+	cfg := Fallback()
+	if cfg.Addr == "" {
+		Forward(ctx, primaryCtx)
+		return
+	}
+	fallbackCtx, err := api.SharedPool(cfg.Addr, 0).Get()
 	if err != nil {
-		log.Println(err)
+		ctx.Logger().Error("connect fallback failed", "addr", cfg.Addr, "err", err)
+		return
+	}
+	defer fallbackCtx.Close()
+	if cfg.Username != "" {
+		password, err := Upstream{Password: cfg.Password, Secret: cfg.Secret}.password()
+		if err != nil {
+			ctx.Logger().Error("read fallback password failed", "err", err)
+		} else if err := api.Sasl(fallbackCtx, cfg.Username, password); err != nil {
+			ctx.Logger().Error("authenticate fallback failed", "addr", cfg.Addr, "user", cfg.Username, "err", err)
+		}
 	}
 	ForwardFind(ctx, primaryCtx, fallbackCtx)
 }
+
+// ProxyHandle 转发到本地 27017，未使用配置文件时的默认行为
+func ProxyHandle(ctx api.Context) {
+	(&Forwarder{Primary: Upstream{Name: "primary", Addr: "127.0.0.1:27017"}}).Handle(ctx)
+}
@@ -0,0 +1,240 @@
+package handle
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sort"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+const (
+	// 与 mongod 一致，find 未指定 batchSize 时首批返回 101 条
+	defaultFirstBatch = 101
+	// getMore 未指定 batchSize 时每批最多返回的条数
+	defaultNextBatch = 1000
+)
+
+// SortKey 排序字段，Desc 为 true 表示降序
+type SortKey struct {
+	Path string
+	Desc bool
+}
+
+// ParseSort 解析 sort 文档，{$meta: ...} 之类无法在代理侧比较的排序会被忽略
+func ParseSort(doc protocol.Document) []SortKey {
+	keys := make([]SortKey, 0, len(doc))
+	for _, it := range doc {
+		n, ok := tools.Number(it.Val)
+		if !ok {
+			continue
+		}
+		keys = append(keys, SortKey{Path: it.Key, Desc: n < 0})
+	}
+	return keys
+}
+
+// CompareBySort 按排序字段比较两个文档，缺失的字段视为 null
+func CompareBySort(a, b interface{}, keys []SortKey) int {
+	x, _ := tools.AsDocument(a)
+	y, _ := tools.AsDocument(b)
+	for _, k := range keys {
+		v1, _ := tools.Lookup(x, k.Path)
+		v2, _ := tools.Lookup(y, k.Path)
+		c := tools.Compare(v1, v2)
+		if k.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// SortDocuments 稳定排序，排序字段相同的文档保持原有顺序
+func SortDocuments(docs bson.Array, keys []SortKey) {
+	if len(keys) == 0 {
+		return
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		return CompareBySort(docs[i], docs[j], keys) < 0
+	})
+}
+
+// fetchFunc 在分片上执行 getMore，返回下一批文档和新的游标 ID
+type fetchFunc func(backend string, id int64, batchSize int32) (bson.Array, int64, error)
+
+// killFunc 关闭分片上的游标
+type killFunc func(backend string, id int64) error
+
+type shardCursor struct {
+	backend string
+	id      int64
+	buffer  bson.Array
+}
+
+func (p *shardCursor) exhausted() bool {
+	return p.id == 0 && len(p.buffer) == 0
+}
+
+// MergeCursor 虚拟游标，对多个分片游标做多路归并，skip 与 limit 在归并后生效
+type MergeCursor struct {
+	ID        int64
+	Namespace string
+	Sort      []SortKey
+	Skip      int64
+	Limit     int64
+	BatchSize int32
+
+	skipped  int64
+	returned int64
+	shards   []*shardCursor
+	fetch    fetchFunc
+	kill     killFunc
+}
+
+// Add 添加一个分片游标及其首批数据
+func (p *MergeCursor) Add(backend string, id int64, firstBatch bson.Array) {
+	p.shards = append(p.shards, &shardCursor{
+		backend: backend,
+		id:      id,
+		buffer:  firstBatch,
+	})
+}
+
+// Next 返回最多 n 条归并后的文档
+func (p *MergeCursor) Next(n int) (bson.Array, error) {
+	out := make(bson.Array, 0)
+	for n <= 0 || len(out) < n {
+		if p.Limit > 0 && p.returned >= p.Limit {
+			break
+		}
+		doc, ok, err := p.pop()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		if p.skipped < p.Skip {
+			p.skipped++
+			continue
+		}
+		out = append(out, doc)
+		p.returned++
+	}
+	if p.Exhausted() {
+		if err := p.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Backends 返回参与归并的分片
+func (p *MergeCursor) Backends() []string {
+	out := make([]string, 0, len(p.shards))
+	for _, it := range p.shards {
+		out = append(out, it.backend)
+	}
+	return out
+}
+
+// Exhausted 所有分片已读完或已达到 limit
+func (p *MergeCursor) Exhausted() bool {
+	if p.Limit > 0 && p.returned >= p.Limit {
+		return true
+	}
+	for _, it := range p.shards {
+		if !it.exhausted() {
+			return false
+		}
+	}
+	return true
+}
+
+// Close 关闭仍在分片上打开的游标
+func (p *MergeCursor) Close() error {
+	var first error
+	for _, it := range p.shards {
+		if it.id == 0 {
+			continue
+		}
+		if err := p.kill(it.backend, it.id); err != nil && first == nil {
+			first = err
+		}
+		it.id = 0
+		it.buffer = nil
+	}
+	return first
+}
+
+// pop 取出下一条文档，有排序时每个分片都需要先有候选文档
+func (p *MergeCursor) pop() (interface{}, bool, error) {
+	var best *shardCursor
+	for _, it := range p.shards {
+		for len(it.buffer) == 0 && it.id != 0 {
+			docs, id, err := p.fetch(it.backend, it.id, p.BatchSize)
+			if err != nil {
+				return nil, false, err
+			}
+			it.buffer, it.id = docs, id
+		}
+		if len(it.buffer) == 0 {
+			continue
+		}
+		if best == nil {
+			best = it
+			if len(p.Sort) == 0 {
+				break
+			}
+			continue
+		}
+		if CompareBySort(it.buffer[0], best.buffer[0], p.Sort) < 0 {
+			best = it
+		}
+	}
+	if best == nil {
+		return nil, false, nil
+	}
+	doc := best.buffer[0]
+	best.buffer = best.buffer[1:]
+	return doc, true, nil
+}
+
+// newCursorID 生成虚拟游标 ID，最高位为 0 保证为正数
+func newCursorID() int64 {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return int64(binary.LittleEndian.Uint64(b) >> 1)
+}
+
+// cursorReply 构造 find/getMore 的游标响应
+func cursorReply(id int64, ns, batchKey string, docs bson.Array) protocol.Document {
+	return protocol.Document{
+		{Key: "cursor", Val: protocol.Document{
+			{Key: batchKey, Val: docs},
+			{Key: "id", Val: bson.Int64(id)},
+			{Key: "ns", Val: ns},
+		}},
+		{Key: "ok", Val: float64(1)},
+	}
+}
+
+// mergeDistinct 合并各分片 distinct 的结果并去重
+func mergeDistinct(values bson.Array) bson.Array {
+	sort.SliceStable(values, func(i, j int) bool {
+		return tools.Compare(values[i], values[j]) < 0
+	})
+	out := make(bson.Array, 0, len(values))
+	for i, it := range values {
+		if i > 0 && tools.Equal(values[i-1], it) {
+			continue
+		}
+		out = append(out, it)
+	}
+	return out
+}
@@ -0,0 +1,274 @@
+package handle
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/logging"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeShards 每个分片按 batch 条数分页返回数据
+type fakeShards struct {
+	data   map[string]bson.Array
+	batch  int
+	killed []string
+}
+
+func (p *fakeShards) fetch(backend string, id int64, batchSize int32) (bson.Array, int64, error) {
+	offset := int(id)
+	rows := p.data[backend][offset:]
+	if len(rows) > p.batch {
+		return rows[:p.batch], int64(offset + p.batch), nil
+	}
+	return rows, 0, nil
+}
+
+func (p *fakeShards) kill(backend string, id int64) error {
+	p.killed = append(p.killed, backend)
+	return nil
+}
+
+func (p *fakeShards) cursor(skip, limit int64, keys []SortKey) *MergeCursor {
+	cursor := &MergeCursor{Sort: keys, Skip: skip, Limit: limit, fetch: p.fetch, kill: p.kill}
+	for _, backend := range []string{"a", "b", "c"} {
+		docs, next, _ := p.fetch(backend, 0, 0)
+		cursor.Add(backend, next, docs)
+	}
+	return cursor
+}
+
+func rows(values ...int32) bson.Array {
+	out := make(bson.Array, 0, len(values))
+	for _, v := range values {
+		out = append(out, bson.Map{"v": bson.Int32(v)})
+	}
+	return out
+}
+
+func values(docs bson.Array) []int64 {
+	out := make([]int64, 0, len(docs))
+	for _, it := range docs {
+		doc, _ := tools.AsDocument(it)
+		out = append(out, tools.LookupInt64(doc, "v"))
+	}
+	return out
+}
+
+func TestMergeCursor_Sorted(t *testing.T) {
+	shards := &fakeShards{batch: 2, data: map[string]bson.Array{
+		"a": rows(1, 4, 7, 10),
+		"b": rows(2, 5, 8),
+		"c": rows(3, 6, 9),
+	}}
+	cursor := shards.cursor(0, 0, ParseSort(protocol.Document{{Key: "v", Val: int32(1)}}))
+	first, err := cursor.Next(4)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2, 3, 4}, values(first))
+	assert.False(t, cursor.Exhausted())
+	rest, err := cursor.Next(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{5, 6, 7, 8, 9, 10}, values(rest))
+	assert.True(t, cursor.Exhausted())
+	assert.Empty(t, shards.killed)
+}
+
+func TestMergeCursor_SkipLimit(t *testing.T) {
+	shards := &fakeShards{batch: 2, data: map[string]bson.Array{
+		"a": rows(10, 7, 4, 1),
+		"b": rows(8, 5, 2),
+		"c": rows(9, 6, 3),
+	}}
+	cursor := shards.cursor(2, 3, ParseSort(protocol.Document{{Key: "v", Val: int32(-1)}}))
+	docs, err := cursor.Next(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{8, 7, 6}, values(docs))
+	assert.True(t, cursor.Exhausted())
+	assert.ElementsMatch(t, []string{"b", "c"}, shards.killed)
+}
+
+func TestMergeDistinct(t *testing.T) {
+	merged := mergeDistinct(bson.Array{bson.Int32(3), "x", float64(1), bson.Int64(3), bson.String("x")})
+	assert.Equal(t, bson.Array{float64(1), bson.Int32(3), "x"}, merged)
+}
+
+func TestShardSession_KillCursors(t *testing.T) {
+	// 超过 2^53 的 id 经过 float64 转换后会变成另一个值
+	id := int64(1<<53 + 1)
+	shards := &fakeShards{batch: 1, data: map[string]bson.Array{"a": rows(1, 2)}}
+	session := &shardSession{
+		sharder: &Sharder{Default: "a"},
+		cursors: make(map[int64]string),
+		merged:  map[int64]*MergeCursor{id: shards.cursor(0, 0, nil)},
+	}
+	msg := protocol.NewOpMessage()
+	msg.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 1}
+	msg.Body = protocol.Document{
+		{Key: "killCursors", Val: bson.String("users")},
+		{Key: "cursors", Val: bson.Array{bson.Int64(id)}},
+		{Key: "$db", Val: bson.String("app")},
+	}
+	cmd, _ := protocol.ParseCommand(msg)
+	res, err := session.killCursors(msg, cmd)
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc, _ := protocol.ReplyDocument(res)
+	assert.Equal(t, []interface{}{bson.Int64(id)}, tools.LookupArray(doc, "cursorsKilled"))
+	assert.Empty(t, session.merged)
+	assert.Equal(t, []string{"a"}, shards.killed)
+}
+
+// stubBackend 同步应答请求的后端连接，respond 为 nil 的请求不应答
+type stubBackend struct {
+	api.Context
+	sent    []protocol.Message
+	replies chan protocol.Message
+	respond func(req *protocol.Command) protocol.Document
+}
+
+func newStubBackend(respond func(req *protocol.Command) protocol.Document) *stubBackend {
+	return &stubBackend{replies: make(chan protocol.Message, 16), respond: respond}
+}
+
+func (p *stubBackend) SendMessage(msg protocol.Message) error {
+	p.sent = append(p.sent, msg)
+	if protocol.ExpectsReply(msg) {
+		cmd, _ := protocol.ParseCommand(msg)
+		p.replies <- protocol.NewCommandReply(msg, p.respond(cmd))
+	}
+	return nil
+}
+
+func (p *stubBackend) Next() <-chan protocol.Message {
+	return p.replies
+}
+
+func (p *stubBackend) Close() error {
+	return nil
+}
+
+func command(db string, body ...protocol.Pair) *protocol.OpMessage {
+	msg := protocol.NewOpMessage()
+	msg.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 1}
+	msg.Body = append(protocol.Document(body), protocol.Pair{Key: "$db", Val: bson.String(db)})
+	return msg
+}
+
+func TestShardSession_GetMoreFailed(t *testing.T) {
+	a := newStubBackend(func(cmd *protocol.Command) protocol.Document {
+		if cmd.Name == "getMore" {
+			return protocol.Document{
+				{Key: "ok", Val: float64(0)},
+				{Key: "errmsg", Val: "cursor id 5 not found"},
+				{Key: "code", Val: bson.Int32(43)},
+				{Key: "codeName", Val: "CursorNotFound"},
+			}
+		}
+		return protocol.Document{{Key: "ok", Val: float64(1)}}
+	})
+	session := &shardSession{
+		sharder: &Sharder{Default: "a"},
+		conns:   map[string]api.Context{"a": a},
+		cursors: make(map[int64]string),
+		merged:  make(map[int64]*MergeCursor),
+	}
+	find := command("app", protocol.Pair{Key: "find", Val: "orders"})
+	cursor := &MergeCursor{
+		ID:    7,
+		fetch: session.fetcher(find, "app", "orders"),
+		kill:  session.killer(find, "app", "orders"),
+	}
+	cursor.Add("a", 5, bson.Array{})
+	session.merged[cursor.ID] = cursor
+
+	// 分片的错误原样交给客户端，虚拟游标随之释放
+	_, err := session.handle(command("app", protocol.Pair{Key: "getMore", Val: bson.Int64(cursor.ID)}, protocol.Pair{Key: "collection", Val: "orders"}))
+	var ce *protocol.CommandError
+	if assert.True(t, errors.As(err, &ce)) {
+		assert.Equal(t, protocol.CodeCursorNotFound, ce.Code)
+		assert.Equal(t, "CursorNotFound", ce.CodeName)
+		assert.Contains(t, ce.Message, "cursor id 5 not found")
+	}
+	assert.Empty(t, session.merged)
+	if assert.Len(t, a.sent, 2) {
+		last, _ := protocol.ParseCommand(a.sent[1])
+		assert.Equal(t, "killCursors", last.Name)
+	}
+}
+
+// stubClient 依次交出 requests 并记录写回的响应
+type stubClient struct {
+	api.Context
+	requests chan protocol.Message
+	replies  []protocol.Message
+}
+
+func (p *stubClient) Next() <-chan protocol.Message { return p.requests }
+func (p *stubClient) Logger() *slog.Logger          { return logging.Default() }
+
+func (p *stubClient) Reply(msg protocol.Message) error {
+	p.replies = append(p.replies, msg)
+	return nil
+}
+
+func TestShardSession_Unacknowledged(t *testing.T) {
+	ok := func(*protocol.Command) protocol.Document { return protocol.Document{{Key: "ok", Val: float64(1)}} }
+	low, high := newStubBackend(ok), newStubBackend(ok)
+	sharder := &Sharder{Default: "low"}
+	sharder.Shard("app", "orders", "uid", &RangeStrategy{Ranges: []ShardRange{
+		{Max: int32(100), Shard: "low"},
+		{Min: int32(100), Shard: "high"},
+	}})
+	client := &stubClient{requests: make(chan protocol.Message, 2)}
+	session := &shardSession{
+		sharder: sharder,
+		client:  client,
+		conns:   map[string]api.Context{"low": low, "high": high},
+		cursors: make(map[int64]string),
+		merged:  make(map[int64]*MergeCursor),
+	}
+	insert := command("app",
+		protocol.Pair{Key: "insert", Val: "orders"},
+		protocol.Pair{Key: "documents", Val: bson.Array{
+			protocol.Document{{Key: "uid", Val: bson.Int32(1)}},
+			protocol.Document{{Key: "uid", Val: bson.Int32(200)}},
+		}},
+		protocol.Pair{Key: "writeConcern", Val: protocol.Document{{Key: "w", Val: bson.Int32(0)}}},
+	)
+	insert.FlagBits = protocol.MsgFlagMoreToCome
+	// 缺少分片键的 w:0 写操作同样不能应答
+	bad := command("app",
+		protocol.Pair{Key: "insert", Val: "orders"},
+		protocol.Pair{Key: "documents", Val: bson.Array{protocol.Document{{Key: "name", Val: "x"}}}},
+	)
+	bad.FlagBits = protocol.MsgFlagMoreToCome
+	client.requests <- insert
+	client.requests <- bad
+	close(client.requests)
+
+	done := make(chan struct{})
+	go func() {
+		session.serve()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("session blocked waiting for a reply to an unacknowledged write")
+	}
+	assert.Empty(t, client.replies)
+	for _, backend := range []*stubBackend{low, high} {
+		if assert.Len(t, backend.sent, 1) {
+			assert.False(t, protocol.ExpectsReply(backend.sent[0]))
+			cmd, _ := protocol.ParseCommand(backend.sent[0])
+			assert.Len(t, tools.LookupArray(cmd.Args, "documents"), 1)
+		}
+	}
+}
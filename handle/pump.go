@@ -2,9 +2,9 @@ package handle
 
 import (
 	"io"
-	"log"
 
 	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/metrics"
 	"github.com/jjeffcaii/mongo-proxy/protocol"
 	"github.com/jjeffcaii/mongo-proxy/tools"
 )
@@ -27,14 +27,7 @@ func Forward(source api.Context, target api.Context) {
 				err = io.EOF
 				break
 			}
-			old := msg.Header().RequestID
-			msg.Header().RequestID = 0
-			var bs []byte
-			bs, err = msg.Encode()
-			msg.Header().RequestID = old
-			if err == nil {
-				err = source.Send(bs)
-			}
+			err = source.Reply(msg)
 			break
 		}
 		if err != nil {
@@ -85,10 +78,10 @@ func ForwardFind(source api.Context, primaryCtx api.Context, fallbackCtx api.Con
 			if reply, ok := msg.(*protocol.OpReply); ok {
 				//tools.PrintOpReply(reply)
 				//判断是否 find 且结果为空
-				if IsFindResultEmpty(reply) {
-					log.Println("[proxy] primary DB no result → try fallback")
+				if IsFindResultEmpty(reply) && Fallback().Enabled {
+					source.Logger().Debug("primary returned no documents, trying fallback")
 					if lastFindQuery == nil {
-						log.Println("[error] lastFindQuery == nil，无法 fallback")
+						source.Logger().Warn("no find query to send to fallback")
 						continue
 					}
 					//// 请求 ID
@@ -98,7 +91,7 @@ func ForwardFind(source api.Context, primaryCtx api.Context, fallbackCtx api.Con
 
 					// 转发 find 请求到 fallbackDB
 					if err := fallbackCtx.SendMessage(lastFindQuery); err != nil {
-						log.Println("[fallback send error]", err)
+						source.Logger().Warn("send to fallback failed", "err", err)
 						continue
 					}
 					continue
@@ -106,12 +99,9 @@ func ForwardFind(source api.Context, primaryCtx api.Context, fallbackCtx api.Con
 			}
 
 			// primary 有结果 → 原样返回给客户端
-			if bs, err := msg.Encode(); err == nil {
-				err = source.Send(bs)
-				if err != nil {
-					log.Println("[proxy send error]", err)
-					return // 如果发送失败，终止连接
-				}
+			if err := source.Reply(msg); err != nil {
+				source.Logger().Warn("reply to client failed", "err", err)
+				return // 如果发送失败，终止连接
 			}
 			continue
 		// 获取fallbackDB msg，返回给客户端
@@ -119,8 +109,14 @@ func ForwardFind(source api.Context, primaryCtx api.Context, fallbackCtx api.Con
 			if msg == nil {
 				return
 			}
-			bs, _ := msg.Encode()
-			source.Send(bs)
+			if reply, ok := msg.(*protocol.OpReply); ok {
+				if IsFindResultEmpty(reply) {
+					metrics.Fallbacks.Inc("miss")
+				} else {
+					metrics.Fallbacks.Inc("hit")
+				}
+			}
+			source.Reply(msg)
 		}
 	}
 }
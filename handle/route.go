@@ -0,0 +1,139 @@
+package handle
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+)
+
+type MatchKind int8
+
+const (
+	MatchExact MatchKind = iota
+	MatchPrefix
+	MatchGlob
+)
+
+func (k MatchKind) String() string {
+	switch k {
+	case MatchExact:
+		return "exact"
+	case MatchPrefix:
+		return "prefix"
+	case MatchGlob:
+		return "glob"
+	}
+	return fmt.Sprintf("MatchKind(%d)", k)
+}
+
+// Pattern 库名或集合名的匹配规则
+type Pattern struct {
+	Kind MatchKind
+	Expr string
+}
+
+// ParsePattern 解析匹配表达式：空串或 "*" 匹配全部，仅以一个 "*" 结尾视为前缀，含 "*?[" 视为 glob，其余精确匹配
+func ParsePattern(expr string) Pattern {
+	if expr == "" {
+		return Pattern{MatchGlob, "*"}
+	}
+	if i := strings.IndexAny(expr, "*?["); i < 0 {
+		return Pattern{MatchExact, expr}
+	} else if i == len(expr)-1 && expr[i] == '*' && i > 0 {
+		return Pattern{MatchPrefix, expr[:i]}
+	}
+	return Pattern{MatchGlob, expr}
+}
+
+func (p Pattern) Match(s string) bool {
+	switch p.Kind {
+	case MatchExact:
+		return p.Expr == s
+	case MatchPrefix:
+		return strings.HasPrefix(s, p.Expr)
+	case MatchGlob:
+		ok, err := path.Match(p.Expr, s)
+		return err == nil && ok
+	}
+	return false
+}
+
+func (p Pattern) String() string {
+	if p.Kind == MatchPrefix {
+		return p.Expr + "*"
+	}
+	return p.Expr
+}
+
+// Route 将命名空间映射到指定后端
+type Route struct {
+	Database   Pattern
+	Collection Pattern
+	Backend    string
+}
+
+func (p Route) String() string {
+	return fmt.Sprintf("%s.%s -> %s", p.Database, p.Collection, p.Backend)
+}
+
+// RoutingTable 路由表，按添加顺序匹配，第一个命中的规则生效
+type RoutingTable struct {
+	Default string
+	Routes  []Route
+}
+
+// Add 添加一条路由，db 和 coll 的语法见 ParsePattern
+func (p *RoutingTable) Add(db, coll, backend string) *RoutingTable {
+	p.Routes = append(p.Routes, Route{
+		Database:   ParsePattern(db),
+		Collection: ParsePattern(coll),
+		Backend:    backend,
+	})
+	return p
+}
+
+// Resolve 查找命名空间对应的后端，coll 为空时只匹配不限制集合的规则
+func (p *RoutingTable) Resolve(db, coll string) string {
+	for _, it := range p.Routes {
+		if it.Database.Match(db) && it.Collection.Match(coll) {
+			return it.Backend
+		}
+	}
+	return p.Default
+}
+
+// Backends 返回路由表引用的全部后端名
+func (p *RoutingTable) Backends() []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	add(p.Default)
+	for _, it := range p.Routes {
+		add(it.Backend)
+	}
+	return names
+}
+
+// Target 根据消息内容计算目标后端：命令使用 $db 与集合，旧版操作使用 DatabaseSupport
+func (p *RoutingTable) Target(msg protocol.Message) string {
+	if cmd, ok := protocol.ParseCommand(msg); ok {
+		return p.Resolve(cmd.Database, cmd.Collection())
+	}
+	if ds, ok := msg.(protocol.DatabaseSupport); ok {
+		if tbl, ok := ds.TableName(); ok {
+			return p.Resolve(tbl.Database, tbl.Collection)
+		}
+	}
+	return p.Default
+}
+
+func NewRoutingTable(defaultBackend string) *RoutingTable {
+	return &RoutingTable{Default: defaultBackend}
+}
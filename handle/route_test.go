@@ -0,0 +1,53 @@
+package handle
+
+import (
+	"testing"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePattern(t *testing.T) {
+	assert.Equal(t, Pattern{MatchGlob, "*"}, ParsePattern(""))
+	assert.Equal(t, Pattern{MatchExact, "orders"}, ParsePattern("orders"))
+	assert.Equal(t, Pattern{MatchPrefix, "log_"}, ParsePattern("log_*"))
+	assert.Equal(t, Pattern{MatchGlob, "log_*_2024"}, ParsePattern("log_*_2024"))
+	assert.True(t, ParsePattern("log_*").Match("log_2024"))
+	assert.False(t, ParsePattern("log_*").Match("orders"))
+	assert.True(t, ParsePattern("log_??").Match("log_01"))
+}
+
+func TestRoutingTable_Target(t *testing.T) {
+	table := NewRoutingTable("main").
+		Add("app", "orders", "orders").
+		Add("app", "archive_*", "archive").
+		Add("analytics", "", "olap")
+
+	query := protocol.NewOpQuery()
+	query.FullCollectionName = "app.orders"
+	assert.Equal(t, "orders", table.Target(query))
+
+	insert := protocol.NewOpInsert()
+	insert.FullCollectionName = "app.archive_2019"
+	assert.Equal(t, "archive", table.Target(insert))
+
+	msg := protocol.NewOpMessage()
+	msg.Body = protocol.Document{
+		{Key: "find", Val: "events"},
+		{Key: "$db", Val: "analytics"},
+	}
+	assert.Equal(t, "olap", table.Target(msg))
+
+	msg.Body = protocol.Document{
+		{Key: "listCollections", Val: int32(1)},
+		{Key: "$db", Val: "app"},
+	}
+	assert.Equal(t, "main", table.Target(msg))
+
+	cmd := protocol.NewOpQuery()
+	cmd.FullCollectionName = "app.$cmd"
+	cmd.Query = protocol.Document{{Key: "count", Val: "orders"}}
+	assert.Equal(t, "orders", table.Target(cmd))
+
+	assert.Equal(t, []string{"main", "orders", "archive", "olap"}, table.Backends())
+}
@@ -0,0 +1,253 @@
+package handle
+
+import (
+	"fmt"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+)
+
+// Upstream 一个后端集群，设置了 Username 时代理会以该身份认证
+type Upstream struct {
+	Name     string
+	Addr     string
+	Username string
+	Password string
+	// Secret 非空时每次建立连接调用以取得当前密码，代替 Password。
+	// 密码轮换后新建的连接使用新密码，已认证的连接不受影响，随客户端断开逐渐退出
+	Secret func() (string, error)
+	// MaxConns 到该后端的最大连接数，为 0 时不限制
+	MaxConns int
+}
+
+func (p Upstream) password() (string, error) {
+	if p.Secret != nil {
+		return p.Secret()
+	}
+	return p.Password, nil
+}
+
+// connect 从共享连接池建立到后端的连接，MaxConns 限制并发连接数
+func connect(upstream Upstream) (api.Context, error) {
+	return api.SharedPool(upstream.Addr, upstream.MaxConns).Get()
+}
+
+// dialUpstream 建立到后端的连接，配置了用户名时先完成认证
+func dialUpstream(upstream Upstream) (api.Context, error) {
+	c, err := connect(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if upstream.Username != "" {
+		password, err := upstream.password()
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("credentials for backend %s: %w", upstream.Name, err)
+		}
+		if err := api.Sasl(c, upstream.Username, password); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("authenticate backend %s failed: %w", upstream.Name, err)
+		}
+	}
+	return c, nil
+}
+
+// Router 按路由表将请求分发到多个后端，客户端看到的是单一的逻辑部署
+type Router struct {
+	Table     *RoutingTable
+	Upstreams map[string]Upstream
+}
+
+// Validate 检查路由表引用的后端是否都已配置
+func (p *Router) Validate() error {
+	if p.Table == nil || p.Table.Default == "" {
+		return fmt.Errorf("routing table has no default backend")
+	}
+	for _, name := range p.Table.Backends() {
+		if _, ok := p.Upstreams[name]; !ok {
+			return fmt.Errorf("route references unknown backend %q", name)
+		}
+	}
+	return nil
+}
+
+// Handle 作为 api.Endpoint 的 handler 使用
+func (p *Router) Handle(ctx api.Context) {
+	s := &routeSession{
+		router:  p,
+		client:  ctx,
+		conns:   make(map[string]api.Context),
+		cursors: make(map[int64]string),
+		replies: make(chan routedReply),
+		done:    make(chan struct{}),
+	}
+	defer s.close()
+	s.serve()
+}
+
+func NewRouter(table *RoutingTable, upstreams ...Upstream) *Router {
+	m := make(map[string]Upstream, len(upstreams))
+	for _, it := range upstreams {
+		m[it.Name] = it
+	}
+	return &Router{Table: table, Upstreams: m}
+}
+
+type routedReply struct {
+	backend string
+	msg     protocol.Message
+}
+
+// routeSession 单个客户端连接的路由状态，只在 serve 所在的 goroutine 中访问
+type routeSession struct {
+	router  *Router
+	client  api.Context
+	conns   map[string]api.Context
+	cursors map[int64]string
+	replies chan routedReply
+	done    chan struct{}
+}
+
+func (p *routeSession) serve() {
+	chClient := p.client.Next()
+	for {
+		select {
+		case msg := <-chClient:
+			if msg == nil {
+				return
+			}
+			if err := p.dispatch(msg); err != nil {
+				p.client.Logger().Error("dispatch request failed", "err", err)
+				return
+			}
+		case it := <-p.replies:
+			if it.msg == nil {
+				p.client.Logger().Warn("backend connection closed", "backend", it.backend)
+				return
+			}
+			if id := cursorOf(it.msg); id != 0 {
+				p.cursors[id] = it.backend
+			}
+			if err := p.client.Reply(it.msg); err != nil {
+				p.client.Logger().Warn("reply to client failed", "err", err)
+				return
+			}
+		}
+	}
+}
+
+func (p *routeSession) dispatch(msg protocol.Message) error {
+	backend := p.target(msg)
+	conn, err := p.conn(backend)
+	if err != nil {
+		// 一个后端不可达时只让这个请求失败，客户端仍可访问其他后端
+		p.client.Logger().Warn("connect backend failed", "backend", backend, "err", err)
+		if !protocol.ExpectsReply(msg) {
+			return nil
+		}
+		return p.client.Reply(protocol.NewErrorReply(msg, &protocol.CommandError{
+			Code:     protocol.CodeHostUnreachable,
+			CodeName: "HostUnreachable",
+			Message:  fmt.Sprintf("backend %s is unreachable: %v", backend, err),
+		}))
+	}
+	return conn.SendMessage(msg)
+}
+
+// target 游标相关的请求优先发往创建游标的后端，killCursors 之后不再记录这些游标
+func (p *routeSession) target(msg protocol.Message) string {
+	var ids []int64
+	kill := false
+	switch v := msg.(type) {
+	case *protocol.OpGetMore:
+		ids = []int64{v.CursorID}
+	case *protocol.OpKillCursors:
+		ids, kill = v.CursorIDs, true
+	default:
+		if cmd, ok := protocol.ParseCommand(msg); ok {
+			switch cmd.Name {
+			case "getMore":
+				ids = []int64{tools.LookupInt64(cmd.Args, "getMore")}
+			case "killCursors":
+				for _, it := range tools.LookupArray(cmd.Args, "cursors") {
+					ids = append(ids, tools.LookupInt64(protocol.Document{{Key: "id", Val: it}}, "id"))
+				}
+				kill = true
+			}
+		}
+	}
+	backend := p.router.Table.Target(msg)
+	for _, id := range ids {
+		if it, ok := p.cursors[id]; ok {
+			backend = it
+			break
+		}
+	}
+	if kill {
+		for _, id := range ids {
+			delete(p.cursors, id)
+		}
+	}
+	return backend
+}
+
+// conn 按需建立到后端的连接
+func (p *routeSession) conn(backend string) (api.Context, error) {
+	if c, ok := p.conns[backend]; ok {
+		return c, nil
+	}
+	upstream, ok := p.router.Upstreams[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", backend)
+	}
+	c, err := dialUpstream(upstream)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[backend] = c
+	go p.pump(backend, c)
+	return c, nil
+}
+
+func (p *routeSession) pump(backend string, c api.Context) {
+	for msg := range c.Next() {
+		select {
+		case p.replies <- routedReply{backend, msg}:
+		case <-p.done:
+			return
+		}
+	}
+	select {
+	case p.replies <- routedReply{backend: backend}:
+	case <-p.done:
+	}
+}
+
+func (p *routeSession) close() {
+	close(p.done)
+	for name, c := range p.conns {
+		if err := c.Close(); err != nil {
+			p.client.Logger().Warn("close backend failed", "backend", name, "err", err)
+		}
+	}
+}
+
+// cursorOf 提取响应中新建的游标 ID
+func cursorOf(msg protocol.Message) int64 {
+	var doc protocol.Document
+	switch v := msg.(type) {
+	case *protocol.OpReply:
+		if v.CursorID != 0 {
+			return v.CursorID
+		}
+		if len(v.Documents) > 0 {
+			doc = v.Documents[0]
+		}
+	case *protocol.OpCommandReply:
+		doc = v.CommandReply
+	case *protocol.OpMessage:
+		doc = v.Body
+	}
+	return tools.LookupInt64(tools.LookupDocument(doc, "cursor"), "id")
+}
@@ -0,0 +1,128 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/fake"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+	driver "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func startFake(t *testing.T) *fake.Server {
+	srv := fake.New()
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// startRouter 在随机端口上启动 Router 并返回连接到它的客户端
+func startRouter(t *testing.T, router *Router) *mongo.Client {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := api.NewListenerProxy(l)
+	go endpoint.Serve(router.Handle)
+	t.Cleanup(func() { endpoint.Close() })
+	opts := options.Client().
+		ApplyURI("mongodb://" + l.Addr().String() + "/?directConnection=true").
+		SetServerSelectionTimeout(3 * time.Second)
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return client
+}
+
+func TestRouter_CursorPinning(t *testing.T) {
+	main, orders := startFake(t), startFake(t)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, orders.Insert("app", "orders", protocol.Document{{Key: "_id", Val: bson.Int32(i)}}))
+		assert.NoError(t, main.Insert("app", "users", protocol.Document{{Key: "_id", Val: bson.Int32(i)}}))
+	}
+	router := NewRouter(NewRoutingTable("main").Add("app", "orders", "orders"),
+		Upstream{Name: "main", Addr: main.Addr()},
+		Upstream{Name: "orders", Addr: orders.Addr()},
+	)
+	client := startRouter(t, router)
+	ctx := context.Background()
+
+	// 两个后端上的游标交替读取，getMore 各自回到创建游标的后端
+	opts := options.Find().SetBatchSize(2)
+	a, err := client.Database("app").Collection("orders").Find(ctx, driver.M{}, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := client.Database("app").Collection("users").Find(ctx, driver.M{}, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	n := 0
+	for a.Next(ctx) && b.Next(ctx) {
+		n++
+	}
+	assert.NoError(t, a.Err())
+	assert.NoError(t, b.Err())
+	assert.Equal(t, 5, n)
+
+	// 游标 id 优先于命名空间的路由
+	session := &routeSession{router: router, cursors: map[int64]string{42: "orders"}}
+	getMore := protocol.NewOpMessage()
+	getMore.Body = protocol.Document{
+		{Key: "getMore", Val: bson.Int64(42)},
+		{Key: "collection", Val: "users"},
+		{Key: "$db", Val: "app"},
+	}
+	assert.Equal(t, "orders", session.target(getMore))
+	kill := protocol.NewOpMessage()
+	kill.Body = protocol.Document{
+		{Key: "killCursors", Val: "users"},
+		{Key: "cursors", Val: bson.Array{bson.Int64(42)}},
+		{Key: "$db", Val: "app"},
+	}
+	assert.Equal(t, "orders", session.target(kill))
+	assert.Empty(t, session.cursors)
+	session.cursors[43] = "orders"
+	legacy := protocol.NewOpKillCursors()
+	legacy.CursorIDs = []int64{43}
+	assert.Equal(t, "orders", session.target(legacy))
+	assert.Empty(t, session.cursors)
+}
+
+func TestRouter_DialFailed(t *testing.T) {
+	main := startFake(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+	router := NewRouter(NewRoutingTable("main").Add("app", "down", "down"),
+		Upstream{Name: "main", Addr: main.Addr()},
+		Upstream{Name: "down", Addr: down},
+	)
+	client := startRouter(t, router)
+	ctx := context.Background()
+
+	// 不可达的后端返回命令错误，而不是断开客户端连接
+	err = client.Database("app").Collection("down").FindOne(ctx, driver.M{}).Err()
+	var ce mongo.CommandError
+	if assert.True(t, errors.As(err, &ce), "%v", err) {
+		assert.Equal(t, protocol.CodeHostUnreachable, ce.Code)
+	}
+	_, err = client.Database("app").Collection("users").InsertOne(ctx, driver.M{"name": "x"})
+	assert.NoError(t, err)
+	assert.Len(t, main.Documents("app", "users"), 1)
+}
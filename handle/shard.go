@@ -0,0 +1,243 @@
+package handle
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+var errNoShards = errors.New("shard strategy has no backends")
+
+// 无法路由的操作以命令错误的形式返回给客户端
+func errShardKeyNotFound(format string, args ...interface{}) error {
+	return &protocol.CommandError{Code: protocol.CodeShardKeyNotFound, CodeName: "ShardKeyNotFound", Message: fmt.Sprintf(format, args...)}
+}
+
+func errImmutableShardKey(key string) error {
+	return &protocol.CommandError{Code: protocol.CodeImmutableField, CodeName: "ImmutableField", Message: fmt.Sprintf("update would change shard key %s", key)}
+}
+
+func errIllegalShardOp(format string, args ...interface{}) error {
+	return &protocol.CommandError{Code: protocol.CodeIllegalOperation, CodeName: "IllegalOperation", Message: fmt.Sprintf(format, args...)}
+}
+
+// ShardStrategy 将分片键的值映射到后端
+type ShardStrategy interface {
+	Locate(key interface{}) (string, error)
+	Backends() []string
+}
+
+// HashStrategy 对分片键取哈希后按后端数量取模
+type HashStrategy struct {
+	Shards []string
+}
+
+func (p *HashStrategy) Locate(key interface{}) (string, error) {
+	if len(p.Shards) == 0 {
+		return "", errNoShards
+	}
+	bs, err := protocol.Document{{Key: "", Val: normalizeKey(key)}}.Encode()
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New64a()
+	h.Write(bs)
+	return p.Shards[h.Sum64()%uint64(len(p.Shards))], nil
+}
+
+func (p *HashStrategy) Backends() []string {
+	return p.Shards
+}
+
+// normalizeKey 数值统一为 int64 或 double，保证 1、NumberLong(1)、1.0 落在同一分片
+func normalizeKey(key interface{}) interface{} {
+	if f, ok := tools.Number(key); ok {
+		if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return bson.Int64(f)
+		}
+		return bson.Float(f)
+	}
+	if s, ok := tools.String(key); ok {
+		return bson.String(s)
+	}
+	return key
+}
+
+// ShardRange 左闭右开区间 [Min, Max)，nil 表示无界
+type ShardRange struct {
+	Min   interface{}
+	Max   interface{}
+	Shard string
+}
+
+// RangeStrategy 按区间映射分片键
+type RangeStrategy struct {
+	Ranges []ShardRange
+}
+
+func (p *RangeStrategy) Locate(key interface{}) (string, error) {
+	for _, it := range p.Ranges {
+		if it.Min != nil && tools.Compare(key, it.Min) < 0 {
+			continue
+		}
+		if it.Max != nil && tools.Compare(key, it.Max) >= 0 {
+			continue
+		}
+		return it.Shard, nil
+	}
+	return "", errShardKeyNotFound("no shard range contains key %v", key)
+}
+
+func (p *RangeStrategy) Backends() []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0, len(p.Ranges))
+	for _, it := range p.Ranges {
+		if !seen[it.Shard] {
+			seen[it.Shard] = true
+			names = append(names, it.Shard)
+		}
+	}
+	return names
+}
+
+// ShardRule 集合的分片规则，Key 支持 "a.b" 形式的路径
+type ShardRule struct {
+	Database   string
+	Collection string
+	Key        string
+	Strategy   ShardStrategy
+}
+
+func (p *ShardRule) String() string {
+	return fmt.Sprintf("%s.%s{%s}", p.Database, p.Collection, p.Key)
+}
+
+// keyValues 从查询条件中提取分片键的等值条件，无法确定时返回 false
+func (p *ShardRule) keyValues(filter protocol.Document) ([]interface{}, bool) {
+	for _, it := range filter {
+		switch it.Key {
+		case p.Key:
+			return equalities(it.Val)
+		case "$and":
+			arr, _ := it.Val.(bson.Array)
+			for _, sub := range arr {
+				if doc, ok := tools.AsDocument(sub); ok {
+					if vals, ok := p.keyValues(doc); ok {
+						return vals, true
+					}
+				}
+			}
+		}
+	}
+	// 嵌套文档形式的等值条件，如 {tenant: {id: 1}}
+	if strings.Contains(p.Key, ".") {
+		if v, ok := tools.Lookup(filter, p.Key); ok && !isOperatorDocument(v) {
+			return []interface{}{v}, true
+		}
+	}
+	return nil, false
+}
+
+// targets 计算查询涉及的分片，无分片键时广播到所有分片
+func (p *ShardRule) targets(filter protocol.Document) ([]string, error) {
+	vals, ok := p.keyValues(filter)
+	if !ok {
+		return p.Strategy.Backends(), nil
+	}
+	return p.locateAll(vals)
+}
+
+func (p *ShardRule) locateAll(vals []interface{}) ([]string, error) {
+	seen := make(map[string]bool)
+	backends := make([]string, 0, len(vals))
+	for _, v := range vals {
+		backend, err := p.Strategy.Locate(v)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[backend] {
+			seen[backend] = true
+			backends = append(backends, backend)
+		}
+	}
+	return backends, nil
+}
+
+// locateDocument 定位待插入文档所在的分片
+func (p *ShardRule) locateDocument(doc interface{}) (string, error) {
+	d, _ := tools.AsDocument(doc)
+	v, ok := tools.Lookup(d, p.Key)
+	if !ok {
+		return "", errShardKeyNotFound("document is missing shard key %s", p.Key)
+	}
+	return p.Strategy.Locate(v)
+}
+
+// checkUpdate 拒绝修改分片键的更新，按分片键等值条件修改为相同的值是允许的
+func (p *ShardRule) checkUpdate(filter protocol.Document, update interface{}) error {
+	vals, targeted := p.keyValues(filter)
+	unchanged := func(v interface{}) bool {
+		return targeted && len(vals) == 1 && tools.Equal(vals[0], v)
+	}
+	if _, ok := update.(bson.Array); ok {
+		return errIllegalShardOp("pipeline update is not supported on sharded collection %s", p)
+	}
+	doc, _ := tools.AsDocument(update)
+	if !isOperatorDocument(doc) {
+		// 整体替换必须携带原分片键
+		v, ok := tools.Lookup(doc, p.Key)
+		if !ok || !unchanged(v) {
+			return errImmutableShardKey(p.Key)
+		}
+		return nil
+	}
+	for _, op := range doc {
+		fields, _ := tools.AsDocument(op.Val)
+		for _, f := range fields {
+			if !overlaps(f.Key, p.Key) {
+				continue
+			}
+			if op.Key == "$set" && f.Key == p.Key && unchanged(f.Val) {
+				continue
+			}
+			return errImmutableShardKey(p.Key)
+		}
+	}
+	return nil
+}
+
+// equalities 解析字段条件，支持字面量、$eq 与 $in
+func equalities(v interface{}) ([]interface{}, bool) {
+	doc, ok := tools.AsDocument(v)
+	if !ok || !isOperatorDocument(doc) {
+		return []interface{}{v}, true
+	}
+	if len(doc) != 1 {
+		return nil, false
+	}
+	switch doc[0].Key {
+	case "$eq":
+		return []interface{}{doc[0].Val}, true
+	case "$in":
+		if arr, ok := doc[0].Val.(bson.Array); ok && len(arr) > 0 {
+			return arr, true
+		}
+	}
+	return nil, false
+}
+
+func isOperatorDocument(v interface{}) bool {
+	doc, ok := tools.AsDocument(v)
+	return ok && len(doc) > 0 && strings.HasPrefix(doc[0].Key, "$")
+}
+
+// overlaps 判断两个字段路径是否存在包含关系
+func overlaps(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
@@ -0,0 +1,102 @@
+package handle
+
+import (
+	"testing"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashStrategy_Locate(t *testing.T) {
+	strategy := &HashStrategy{Shards: []string{"a", "b", "c"}}
+	x, err := strategy.Locate(int32(42))
+	assert.NoError(t, err)
+	y, _ := strategy.Locate(bson.Int64(42))
+	z, _ := strategy.Locate(float64(42))
+	assert.Equal(t, x, y)
+	assert.Equal(t, x, z)
+}
+
+func TestRangeStrategy_Locate(t *testing.T) {
+	strategy := &RangeStrategy{Ranges: []ShardRange{
+		{Max: int32(100), Shard: "low"},
+		{Min: int32(100), Shard: "high"},
+	}}
+	backend, err := strategy.Locate(bson.Int64(99))
+	assert.NoError(t, err)
+	assert.Equal(t, "low", backend)
+	backend, _ = strategy.Locate(float64(100))
+	assert.Equal(t, "high", backend)
+	assert.Equal(t, []string{"low", "high"}, strategy.Backends())
+}
+
+func TestShardRule_KeyValues(t *testing.T) {
+	rule := &ShardRule{Key: "tenant"}
+	vals, ok := rule.keyValues(protocol.Document{{Key: "tenant", Val: "t1"}})
+	assert.True(t, ok)
+	assert.Equal(t, []interface{}{"t1"}, vals)
+
+	vals, ok = rule.keyValues(protocol.Document{{Key: "tenant", Val: protocol.Document{
+		{Key: "$in", Val: bson.Array{"t1", "t2"}},
+	}}})
+	assert.True(t, ok)
+	assert.Len(t, vals, 2)
+
+	_, ok = rule.keyValues(protocol.Document{{Key: "tenant", Val: protocol.Document{
+		{Key: "$gt", Val: "t1"},
+	}}})
+	assert.False(t, ok)
+
+	vals, ok = rule.keyValues(protocol.Document{{Key: "$and", Val: bson.Array{
+		bson.Map{"age": int32(3)},
+		bson.Map{"tenant": "t3"},
+	}}})
+	assert.True(t, ok)
+	assert.Equal(t, []interface{}{"t3"}, vals)
+
+	nested := &ShardRule{Key: "owner.id"}
+	vals, ok = nested.keyValues(protocol.Document{{Key: "owner", Val: protocol.Document{{Key: "id", Val: int32(7)}}}})
+	assert.True(t, ok)
+	assert.Equal(t, []interface{}{int32(7)}, vals)
+}
+
+func TestShardRule_CheckUpdate(t *testing.T) {
+	rule := &ShardRule{Key: "tenant"}
+	filter := protocol.Document{{Key: "tenant", Val: "t1"}}
+	assert.NoError(t, rule.checkUpdate(filter, protocol.Document{
+		{Key: "$set", Val: protocol.Document{{Key: "name", Val: "x"}}},
+	}))
+	assert.NoError(t, rule.checkUpdate(filter, protocol.Document{
+		{Key: "$set", Val: protocol.Document{{Key: "tenant", Val: "t1"}}},
+	}))
+	assert.Error(t, rule.checkUpdate(filter, protocol.Document{
+		{Key: "$set", Val: protocol.Document{{Key: "tenant", Val: "t2"}}},
+	}))
+	assert.Error(t, rule.checkUpdate(nil, protocol.Document{
+		{Key: "$unset", Val: protocol.Document{{Key: "tenant", Val: ""}}},
+	}))
+	assert.Error(t, rule.checkUpdate(filter, protocol.Document{{Key: "name", Val: "replaced"}}))
+}
+
+func TestMergeWriteResults(t *testing.T) {
+	doc := mergeWriteResults([]writeResult{
+		{
+			doc: protocol.Document{
+				{Key: "n", Val: bson.Int32(1)},
+				{Key: "writeErrors", Val: bson.Array{bson.Map{"index": bson.Int32(1), "code": bson.Int32(11000)}}},
+				{Key: "ok", Val: bson.Float(1)},
+			},
+			indexes: []int{0, 3},
+		},
+		{
+			doc:     protocol.Document{{Key: "n", Val: bson.Int32(2)}, {Key: "ok", Val: bson.Float(1)}},
+			indexes: []int{1, 2},
+		},
+	})
+	assert.Equal(t, int64(3), tools.LookupInt64(doc, "n"))
+	errs := tools.LookupArray(doc, "writeErrors")
+	assert.Len(t, errs, 1)
+	assert.Equal(t, int64(3), tools.LookupInt64(errs[0].(protocol.Document), "index"))
+}
@@ -0,0 +1,912 @@
+package handle
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+// DDL 命令在所有分片上执行
+var broadcastCommands = map[string]bool{
+	"create":        true,
+	"drop":          true,
+	"createIndexes": true,
+	"dropIndexes":   true,
+	"collMod":       true,
+}
+
+// Sharder 在没有 mongos 的情况下按分片键将集合拆分到多个独立的副本集，
+// 未配置分片规则的命名空间以及 hello、认证等命令都发往 Default
+type Sharder struct {
+	Default   string
+	Rules     []ShardRule
+	Upstreams map[string]Upstream
+}
+
+// Shard 为集合添加分片规则
+func (p *Sharder) Shard(db, coll, key string, strategy ShardStrategy) *Sharder {
+	p.Rules = append(p.Rules, ShardRule{
+		Database:   db,
+		Collection: coll,
+		Key:        key,
+		Strategy:   strategy,
+	})
+	return p
+}
+
+// Validate 检查分片规则引用的后端是否都已配置
+func (p *Sharder) Validate() error {
+	if _, ok := p.Upstreams[p.Default]; !ok {
+		return fmt.Errorf("unknown default backend %q", p.Default)
+	}
+	for _, rule := range p.Rules {
+		if rule.Key == "" {
+			return fmt.Errorf("shard rule %s has no key", rule.String())
+		}
+		if len(rule.Strategy.Backends()) == 0 {
+			return fmt.Errorf("shard rule %s: %w", rule.String(), errNoShards)
+		}
+		for _, name := range rule.Strategy.Backends() {
+			if _, ok := p.Upstreams[name]; !ok {
+				return fmt.Errorf("shard rule %s references unknown backend %q", rule.String(), name)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Sharder) rule(db, coll string) *ShardRule {
+	for i := range p.Rules {
+		if p.Rules[i].Database == db && p.Rules[i].Collection == coll {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+// Handle 作为 api.Endpoint 的 handler 使用
+func (p *Sharder) Handle(ctx api.Context) {
+	s := &shardSession{
+		sharder: p,
+		client:  ctx,
+		conns:   make(map[string]api.Context),
+		cursors: make(map[int64]string),
+		merged:  make(map[int64]*MergeCursor),
+	}
+	defer s.close()
+	s.serve()
+}
+
+func NewSharder(defaultBackend string, upstreams ...Upstream) *Sharder {
+	m := make(map[string]Upstream, len(upstreams))
+	for _, it := range upstreams {
+		m[it.Name] = it
+	}
+	return &Sharder{Default: defaultBackend, Upstreams: m}
+}
+
+// shardSession 单个客户端连接的分片状态，请求按顺序同步处理
+type shardSession struct {
+	sharder *Sharder
+	client  api.Context
+	conns   map[string]api.Context
+	cursors map[int64]string
+	merged  map[int64]*MergeCursor
+	// current 正在处理的客户端请求，拆分出的子请求继承它的 Span
+	current protocol.Message
+}
+
+func (p *shardSession) serve() {
+	for msg := range p.client.Next() {
+		p.current = msg
+		res, err := p.handle(msg)
+		var ce *protocol.CommandError
+		if errors.As(err, &ce) {
+			res, err = protocol.NewErrorReply(msg, ce), nil
+		}
+		if err != nil {
+			p.client.Logger().Error("handle sharded request failed", "err", err)
+			return
+		}
+		// 客户端不等待响应的请求不能应答，否则后续请求会收到错位的响应
+		if res == nil || !protocol.ExpectsReply(msg) {
+			if ce != nil {
+				p.client.Logger().Warn("drop unacknowledged request", "err", ce)
+			}
+			continue
+		}
+		res.Header().ResponseTo = msg.Header().RequestID
+		if err := p.client.Reply(res); err != nil {
+			p.client.Logger().Warn("reply to client failed", "err", err)
+			return
+		}
+	}
+}
+
+func (p *shardSession) handle(msg protocol.Message) (protocol.Message, error) {
+	if cmd, ok := protocol.ParseCommand(msg); ok {
+		return p.handleCommand(msg, cmd)
+	}
+	switch v := msg.(type) {
+	case *protocol.OpQuery:
+		return p.handleQuery(v)
+	case *protocol.OpInsert:
+		return nil, p.handleInsert(v)
+	case *protocol.OpUpdate:
+		return nil, p.handleUpdate(v)
+	case *protocol.OpDelete:
+		return nil, p.handleDelete(v)
+	case *protocol.OpGetMore:
+		return p.forward(p.owner(v.CursorID), msg)
+	case *protocol.OpKillCursors:
+		groups := make(map[string][]int64)
+		for _, id := range v.CursorIDs {
+			owner := p.owner(id)
+			groups[owner] = append(groups[owner], id)
+			delete(p.cursors, id)
+		}
+		for backend, ids := range groups {
+			sub := *v
+			sub.Op = copyOp(v.Op)
+			sub.NumberOfCursorIDs = int32(len(ids))
+			sub.CursorIDs = ids
+			if _, err := p.forward(backend, &sub); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+	return p.forward(p.sharder.Default, msg)
+}
+
+func (p *shardSession) handleCommand(msg protocol.Message, cmd *protocol.Command) (protocol.Message, error) {
+	switch cmd.Name {
+	case "getMore":
+		id := tools.LookupInt64(cmd.Args, "getMore")
+		if cursor, ok := p.merged[id]; ok {
+			return p.mergedGetMore(msg, cmd, cursor)
+		}
+		return p.forward(p.owner(id), msg)
+	case "killCursors":
+		return p.killCursors(msg, cmd)
+	}
+	rule := p.sharder.rule(cmd.Database, cmd.Collection())
+	if rule == nil {
+		return p.forward(p.sharder.Default, msg)
+	}
+	args := cmd.Args
+	switch cmd.Name {
+	case "find":
+		targets, err := rule.targets(tools.LookupDocument(args, "filter"))
+		if err != nil {
+			return nil, err
+		}
+		if len(targets) == 1 {
+			return p.forward(targets[0], msg)
+		}
+		return p.scatterFind(msg, cmd, targets)
+	case "count":
+		targets, err := rule.targets(tools.LookupDocument(args, "query"))
+		if err != nil {
+			return nil, err
+		}
+		if len(targets) == 1 {
+			return p.forward(targets[0], msg)
+		}
+		return p.scatterCount(msg, cmd, targets)
+	case "distinct":
+		targets, err := rule.targets(tools.LookupDocument(args, "query"))
+		if err != nil {
+			return nil, err
+		}
+		if len(targets) == 1 {
+			return p.forward(targets[0], msg)
+		}
+		return p.scatterDistinct(msg, targets)
+	case "aggregate":
+		var filter protocol.Document
+		if pipeline := tools.LookupArray(args, "pipeline"); len(pipeline) > 0 {
+			stage, _ := tools.AsDocument(pipeline[0])
+			filter = tools.LookupDocument(stage, "$match")
+		}
+		return p.targeted(msg, rule, filter)
+	case "findAndModify", "findandmodify":
+		filter := tools.LookupDocument(args, "query")
+		if update, ok := protocol.Load(args, "update"); ok {
+			if err := rule.checkUpdate(filter, update); err != nil {
+				return nil, err
+			}
+		}
+		return p.targeted(msg, rule, filter)
+	case "insert":
+		return p.insert(msg, cmd, rule)
+	case "update":
+		return p.write(msg, cmd, rule, "updates", func(stmt protocol.Document) ([]string, error) {
+			filter := tools.LookupDocument(stmt, "q")
+			u, _ := protocol.Load(stmt, "u")
+			if err := rule.checkUpdate(filter, u); err != nil {
+				return nil, err
+			}
+			return p.writeTargets(rule, filter, tools.LookupBool(stmt, "multi"), tools.LookupBool(stmt, "upsert"))
+		})
+	case "delete":
+		return p.write(msg, cmd, rule, "deletes", func(stmt protocol.Document) ([]string, error) {
+			filter := tools.LookupDocument(stmt, "q")
+			return p.writeTargets(rule, filter, tools.LookupInt64(stmt, "limit") == 0, false)
+		})
+	}
+	if broadcastCommands[cmd.Name] {
+		return p.broadcast(msg, rule.Strategy.Backends())
+	}
+	return nil, errIllegalShardOp("command %s is not supported on sharded collection %s", cmd.Name, rule)
+}
+
+// targeted 只能路由到单个分片的操作
+func (p *shardSession) targeted(msg protocol.Message, rule *ShardRule, filter protocol.Document) (protocol.Message, error) {
+	vals, ok := rule.keyValues(filter)
+	if !ok {
+		return nil, errShardKeyNotFound("query must contain an equality on shard key %s", rule.Key)
+	}
+	targets, err := rule.locateAll(vals)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) != 1 {
+		return nil, errIllegalShardOp("operation on %s must target a single shard", rule)
+	}
+	return p.forward(targets[0], msg)
+}
+
+// writeTargets 计算更新或删除语句涉及的分片，只有 multi 语句允许广播
+func (p *shardSession) writeTargets(rule *ShardRule, filter protocol.Document, multi, upsert bool) ([]string, error) {
+	vals, ok := rule.keyValues(filter)
+	if !ok {
+		if upsert {
+			return nil, errShardKeyNotFound("upsert on %s requires an equality on shard key %s", rule, rule.Key)
+		}
+		if !multi {
+			return nil, errShardKeyNotFound("single document write on %s requires an equality on shard key %s", rule, rule.Key)
+		}
+		return rule.Strategy.Backends(), nil
+	}
+	targets, err := rule.locateAll(vals)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) > 1 && !multi {
+		return nil, errIllegalShardOp("single document write on %s must target a single shard", rule)
+	}
+	return targets, nil
+}
+
+// insert 按分片拆分待插入的文档
+func (p *shardSession) insert(msg protocol.Message, cmd *protocol.Command, rule *ShardRule) (protocol.Message, error) {
+	return p.write(msg, cmd, rule, "documents", func(doc protocol.Document) ([]string, error) {
+		backend, err := rule.locateDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+		return []string{backend}, nil
+	})
+}
+
+// write 将批量写操作按分片拆分为子批次，并合并各分片的写结果
+func (p *shardSession) write(
+	msg protocol.Message,
+	cmd *protocol.Command,
+	rule *ShardRule,
+	field string,
+	locate func(stmt protocol.Document) ([]string, error),
+) (protocol.Message, error) {
+	stmts := tools.LookupArray(cmd.Args, field)
+	batches := make(map[string]*writeBatch)
+	order := make([]string, 0)
+	for i, it := range stmts {
+		stmt, _ := tools.AsDocument(it)
+		targets, err := locate(stmt)
+		if err != nil {
+			return nil, err
+		}
+		for _, backend := range targets {
+			b, ok := batches[backend]
+			if !ok {
+				b = &writeBatch{backend: backend}
+				batches[backend] = b
+				order = append(order, backend)
+			}
+			b.stmts = append(b.stmts, it)
+			b.indexes = append(b.indexes, i)
+		}
+	}
+	if len(order) == 0 {
+		order = append(order, rule.Strategy.Backends()[0])
+		batches[order[0]] = &writeBatch{backend: order[0]}
+	}
+	if len(order) == 1 {
+		return p.forward(order[0], msg)
+	}
+	// w:0 的写操作带有 moreToCome，子批次同样不会有响应
+	acknowledged := protocol.ExpectsReply(msg)
+	results := make([]writeResult, 0, len(order))
+	for _, backend := range order {
+		b := batches[backend]
+		sub := protocol.NewCommandMessage(msg, cmd.Database, protocol.Store(cmd.Args, field, b.stmts))
+		if !acknowledged {
+			if _, err := p.forward(backend, sub); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		res, err := p.roundTrip(backend, sub)
+		if err != nil {
+			return nil, err
+		}
+		doc, _ := protocol.ReplyDocument(res)
+		results = append(results, writeResult{doc, b.indexes})
+	}
+	if !acknowledged {
+		return nil, nil
+	}
+	return protocol.NewCommandReply(msg, mergeWriteResults(results)), nil
+}
+
+// scatterFind 广播查询并通过虚拟游标归并各分片的结果，skip/limit 在归并后生效
+func (p *shardSession) scatterFind(msg protocol.Message, cmd *protocol.Command, targets []string) (protocol.Message, error) {
+	args := cmd.Args
+	skip := tools.LookupInt64(args, "skip")
+	limit := tools.LookupInt64(args, "limit")
+	single := limit < 0 || tools.LookupBool(args, "singleBatch")
+	if limit < 0 {
+		limit = -limit
+	}
+	sub := protocol.Store(args, "skip", bson.Int64(0))
+	if limit > 0 {
+		sub = protocol.Store(sub, "limit", bson.Int64(skip+limit))
+	}
+	sub = protocol.Store(sub, "singleBatch", false)
+	req := protocol.NewCommandMessage(msg, cmd.Database, sub)
+	cursor := &MergeCursor{
+		ID:        newCursorID(),
+		Namespace: cmd.Database + "." + cmd.Collection(),
+		Sort:      ParseSort(tools.LookupDocument(args, "sort")),
+		Skip:      skip,
+		Limit:     limit,
+		BatchSize: int32(tools.LookupInt64(args, "batchSize")),
+		fetch:     p.fetcher(msg, cmd.Database, cmd.Collection()),
+		kill:      p.killer(msg, cmd.Database, cmd.Collection()),
+	}
+	for _, backend := range targets {
+		res, err := p.roundTrip(backend, req)
+		if err != nil {
+			return nil, err
+		}
+		doc, _ := protocol.ReplyDocument(res)
+		if tools.LookupFloat64(doc, "ok") != 1 {
+			cursor.Close()
+			return res, nil
+		}
+		c := tools.LookupDocument(doc, "cursor")
+		cursor.Add(backend, tools.LookupInt64(c, "id"), tools.LookupArray(c, "firstBatch"))
+	}
+	docs := make(bson.Array, 0)
+	if _, ok := protocol.Load(args, "batchSize"); !ok || cursor.BatchSize > 0 {
+		n := int(cursor.BatchSize)
+		if n <= 0 {
+			n = defaultFirstBatch
+		}
+		var err error
+		if docs, err = cursor.Next(n); err != nil {
+			return nil, p.abort(cursor, err)
+		}
+	}
+	var id int64
+	if single {
+		cursor.Close()
+	} else if !cursor.Exhausted() {
+		id = cursor.ID
+		p.keep(cursor)
+	}
+	return protocol.NewCommandReply(msg, cursorReply(id, cursor.Namespace, "firstBatch", docs)), nil
+}
+
+// mergedGetMore 从虚拟游标读取下一批
+func (p *shardSession) mergedGetMore(msg protocol.Message, cmd *protocol.Command, cursor *MergeCursor) (protocol.Message, error) {
+	n := int(tools.LookupInt64(cmd.Args, "batchSize"))
+	if n <= 0 {
+		n = defaultNextBatch
+	}
+	docs, err := cursor.Next(n)
+	if err != nil {
+		return nil, p.abort(cursor, err)
+	}
+	id := cursor.ID
+	if cursor.Exhausted() {
+		p.drop(id)
+		id = 0
+	}
+	return protocol.NewCommandReply(msg, cursorReply(id, cursor.Namespace, "nextBatch", docs)), nil
+}
+
+// abort 分片上的 getMore 失败后释放虚拟游标，客户端收到命令错误而不是断开连接
+func (p *shardSession) abort(cursor *MergeCursor, err error) error {
+	p.drop(cursor.ID)
+	cursor.Close()
+	var ce *protocol.CommandError
+	if errors.As(err, &ce) {
+		return ce
+	}
+	return &protocol.CommandError{
+		Code:     protocol.CodeCursorNotFound,
+		CodeName: "CursorNotFound",
+		Message:  fmt.Sprintf("cursor id %d lost: %v", cursor.ID, err),
+	}
+}
+
+// fetcher 以 like 的线协议格式在分片上执行 getMore
+func (p *shardSession) fetcher(like protocol.Message, db, coll string) fetchFunc {
+	return func(backend string, id int64, batchSize int32) (bson.Array, int64, error) {
+		args := protocol.Document{
+			{Key: "getMore", Val: bson.Int64(id)},
+			{Key: "collection", Val: coll},
+		}
+		if batchSize > 0 {
+			args = append(args, protocol.Pair{Key: "batchSize", Val: batchSize})
+		}
+		res, err := p.roundTrip(backend, protocol.NewCommandMessage(like, db, args))
+		if err != nil {
+			return nil, 0, err
+		}
+		doc, _ := protocol.ReplyDocument(res)
+		if tools.LookupFloat64(doc, "ok") != 1 {
+			return nil, 0, backendError(backend, doc)
+		}
+		c := tools.LookupDocument(doc, "cursor")
+		return tools.LookupArray(c, "nextBatch"), tools.LookupInt64(c, "id"), nil
+	}
+}
+
+// backendError 保留分片返回的 code、codeName 与 errmsg
+func backendError(backend string, doc protocol.Document) *protocol.CommandError {
+	errmsg, _ := protocol.Load(doc, "errmsg")
+	codeName, _ := protocol.Load(doc, "codeName")
+	ce := &protocol.CommandError{Code: tools.LookupInt32(doc, "code")}
+	ce.CodeName, _ = tools.String(codeName)
+	msg, _ := tools.String(errmsg)
+	ce.Message = fmt.Sprintf("getMore on backend %s failed: %s", backend, msg)
+	if ce.Code == 0 {
+		ce.Code, ce.CodeName = protocol.CodeInternalError, "InternalError"
+	}
+	return ce
+}
+
+// killer 关闭分片上的游标，结果只用于清理因此忽略
+func (p *shardSession) killer(like protocol.Message, db, coll string) killFunc {
+	return func(backend string, id int64) error {
+		_, err := p.roundTrip(backend, protocol.NewCommandMessage(like, db, protocol.Document{
+			{Key: "killCursors", Val: coll},
+			{Key: "cursors", Val: bson.Array{bson.Int64(id)}},
+		}))
+		return err
+	}
+}
+
+// scatterDistinct 合并各分片 distinct 的结果
+func (p *shardSession) scatterDistinct(msg protocol.Message, targets []string) (protocol.Message, error) {
+	values := make(bson.Array, 0)
+	for _, backend := range targets {
+		res, err := p.roundTrip(backend, msg)
+		if err != nil {
+			return nil, err
+		}
+		doc, _ := protocol.ReplyDocument(res)
+		if tools.LookupFloat64(doc, "ok") != 1 {
+			return res, nil
+		}
+		values = append(values, tools.LookupArray(doc, "values")...)
+	}
+	return protocol.NewCommandReply(msg, protocol.Document{
+		{Key: "values", Val: mergeDistinct(values)},
+		{Key: "ok", Val: float64(1)},
+	}), nil
+}
+
+// scatterCount 汇总各分片的计数，skip/limit 在汇总后生效
+func (p *shardSession) scatterCount(msg protocol.Message, cmd *protocol.Command, targets []string) (protocol.Message, error) {
+	skip := tools.LookupInt64(cmd.Args, "skip")
+	limit := tools.LookupInt64(cmd.Args, "limit")
+	if limit < 0 {
+		limit = -limit
+	}
+	args := make(protocol.Document, 0, len(cmd.Args))
+	for _, it := range cmd.Args {
+		if it.Key != "skip" && it.Key != "limit" {
+			args = append(args, it)
+		}
+	}
+	req := protocol.NewCommandMessage(msg, cmd.Database, args)
+	var total int64
+	for _, backend := range targets {
+		res, err := p.roundTrip(backend, req)
+		if err != nil {
+			return nil, err
+		}
+		doc, _ := protocol.ReplyDocument(res)
+		if tools.LookupFloat64(doc, "ok") != 1 {
+			return res, nil
+		}
+		total += tools.LookupInt64(doc, "n")
+	}
+	total -= skip
+	if total < 0 {
+		total = 0
+	}
+	if limit > 0 && total > limit {
+		total = limit
+	}
+	return protocol.NewCommandReply(msg, protocol.Document{
+		{Key: "n", Val: bson.Int64(total)},
+		{Key: "ok", Val: float64(1)},
+	}), nil
+}
+
+// broadcast 在所有分片上执行命令，返回第一个失败的响应或最后一个响应
+func (p *shardSession) broadcast(msg protocol.Message, targets []string) (protocol.Message, error) {
+	var last protocol.Message
+	for _, backend := range targets {
+		res, err := p.roundTrip(backend, msg)
+		if err != nil {
+			return nil, err
+		}
+		if doc, _ := protocol.ReplyDocument(res); tools.LookupFloat64(doc, "ok") != 1 {
+			return res, nil
+		}
+		last = res
+	}
+	return last, nil
+}
+
+func (p *shardSession) killCursors(msg protocol.Message, cmd *protocol.Command) (protocol.Message, error) {
+	groups := make(map[string]bson.Array)
+	order := make([]string, 0)
+	killed := make(bson.Array, 0)
+	for _, it := range tools.LookupArray(cmd.Args, "cursors") {
+		// 虚拟游标的 id 有 63 位，不能经过 float64 转换
+		id := tools.LookupInt64(protocol.Document{{Key: "id", Val: it}}, "id")
+		if cursor, ok := p.merged[id]; ok {
+			p.drop(id)
+			if err := cursor.Close(); err != nil {
+				return nil, err
+			}
+			killed = append(killed, it)
+			continue
+		}
+		owner := p.owner(id)
+		if _, ok := groups[owner]; !ok {
+			order = append(order, owner)
+		}
+		groups[owner] = append(groups[owner], it)
+		delete(p.cursors, id)
+	}
+	if len(killed) == 0 && len(order) == 0 {
+		return p.forward(p.sharder.Default, msg)
+	}
+	if len(killed) == 0 && len(order) == 1 {
+		return p.forward(order[0], msg)
+	}
+	merged := protocol.Document{{Key: "cursorsKilled", Val: killed}}
+	for _, backend := range order {
+		sub := protocol.NewCommandMessage(msg, cmd.Database, protocol.Store(cmd.Args, "cursors", groups[backend]))
+		res, err := p.roundTrip(backend, sub)
+		if err != nil {
+			return nil, err
+		}
+		doc, _ := protocol.ReplyDocument(res)
+		for _, key := range []string{"cursorsKilled", "cursorsNotFound", "cursorsAlive", "cursorsUnknown"} {
+			arr := tools.LookupArray(merged, key)
+			merged = protocol.Store(merged, key, append(arr, tools.LookupArray(doc, key)...))
+		}
+	}
+	return protocol.NewCommandReply(msg, protocol.Store(merged, "ok", float64(1))), nil
+}
+
+// handleQuery 旧版 OP_QUERY 查询
+func (p *shardSession) handleQuery(q *protocol.OpQuery) (protocol.Message, error) {
+	tbl, _ := q.TableName()
+	if tbl == nil {
+		return p.forward(p.sharder.Default, q)
+	}
+	rule := p.sharder.rule(tbl.Database, tbl.Collection)
+	if rule == nil {
+		return p.forward(p.sharder.Default, q)
+	}
+	filter := q.Query
+	if wrapped := tools.LookupDocument(q.Query, "$query"); wrapped != nil {
+		filter = wrapped
+	}
+	targets, err := rule.targets(filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 1 {
+		return p.forward(targets[0], q)
+	}
+	sub := *q
+	sub.Op = copyOp(q.Op)
+	sub.NumberToSkip = 0
+	sub.NumberToReturn = 0
+	docs := make(bson.Array, 0)
+	for _, backend := range targets {
+		res, err := p.roundTrip(backend, &sub)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			r, ok := res.(*protocol.OpReply)
+			if !ok {
+				return nil, fmt.Errorf("unexpected reply type: %T", res)
+			}
+			for _, doc := range r.Documents {
+				docs = append(docs, doc)
+			}
+			if r.CursorID == 0 {
+				break
+			}
+			more := protocol.NewOpGetMore()
+			more.Op = copyOp(q.Op)
+			more.OpHeader.OpCode = protocol.OpCodeGetMore
+			more.FullCollectionName = q.FullCollectionName
+			more.CursorID = r.CursorID
+			if res, err = p.roundTrip(backend, more); err != nil {
+				return nil, err
+			}
+		}
+	}
+	SortDocuments(docs, ParseSort(tools.LookupDocument(q.Query, "$orderby")))
+	limit := int64(q.NumberToReturn)
+	if limit < 0 {
+		limit = -limit
+	}
+	docs = window(docs, int64(q.NumberToSkip), limit)
+	out := protocol.NewOpReply()
+	out.OpHeader = &protocol.Header{OpCode: protocol.OpCodeReply}
+	out.NumberReturned = int32(len(docs))
+	for _, it := range docs {
+		out.Documents = append(out.Documents, it.(protocol.Document))
+	}
+	return out, nil
+}
+
+// handleInsert 旧版 OP_INSERT 没有响应，按分片拆分后直接发送
+func (p *shardSession) handleInsert(v *protocol.OpInsert) error {
+	tbl, _ := v.TableName()
+	var rule *ShardRule
+	if tbl != nil {
+		rule = p.sharder.rule(tbl.Database, tbl.Collection)
+	}
+	if rule == nil {
+		_, err := p.forward(p.sharder.Default, v)
+		return err
+	}
+	groups := make(map[string][]protocol.Document)
+	for _, doc := range v.Documents {
+		backend, err := rule.locateDocument(doc)
+		if err != nil {
+			p.client.Logger().Warn("drop legacy insert", "rule", rule.String(), "err", err)
+			return nil
+		}
+		groups[backend] = append(groups[backend], doc)
+	}
+	for backend, docs := range groups {
+		sub := *v
+		sub.Op = copyOp(v.Op)
+		sub.Documents = docs
+		if _, err := p.forward(backend, &sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *shardSession) handleUpdate(v *protocol.OpUpdate) error {
+	return p.legacyWrite(v, v.Selector, func(rule *ShardRule) ([]string, error) {
+		if err := rule.checkUpdate(v.Selector, v.Update); err != nil {
+			return nil, err
+		}
+		return p.writeTargets(rule, v.Selector, v.Flags&2 != 0, v.Flags&1 != 0)
+	})
+}
+
+func (p *shardSession) handleDelete(v *protocol.OpDelete) error {
+	return p.legacyWrite(v, v.Selector, func(rule *ShardRule) ([]string, error) {
+		return p.writeTargets(rule, v.Selector, v.Flags&1 == 0, false)
+	})
+}
+
+// legacyWrite 旧版写操作没有响应，无法路由时只能记录日志
+func (p *shardSession) legacyWrite(msg protocol.Message, selector protocol.Document, locate func(*ShardRule) ([]string, error)) error {
+	tbl, _ := msg.(protocol.DatabaseSupport).TableName()
+	var rule *ShardRule
+	if tbl != nil {
+		rule = p.sharder.rule(tbl.Database, tbl.Collection)
+	}
+	if rule == nil {
+		_, err := p.forward(p.sharder.Default, msg)
+		return err
+	}
+	targets, err := locate(rule)
+	var ce *protocol.CommandError
+	if errors.As(err, &ce) {
+		p.client.Logger().Warn("drop legacy write", "rule", rule.String(), "err", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, backend := range targets {
+		if _, err := p.forward(backend, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// owner 返回创建游标的分片，未知游标发往默认后端
+func (p *shardSession) owner(id int64) string {
+	if backend, ok := p.cursors[id]; ok {
+		return backend
+	}
+	return p.sharder.Default
+}
+
+// forward 将请求原样发往一个分片，没有响应的操作返回 nil
+func (p *shardSession) forward(backend string, msg protocol.Message) (protocol.Message, error) {
+	if !protocol.ExpectsReply(msg) {
+		c, err := p.conn(backend)
+		if err != nil {
+			return nil, err
+		}
+		return nil, p.send(c, msg)
+	}
+	res, err := p.roundTrip(backend, msg)
+	if err != nil {
+		return nil, err
+	}
+	if id := cursorOf(res); id != 0 {
+		p.cursors[id] = backend
+	}
+	return res, nil
+}
+
+func (p *shardSession) roundTrip(backend string, msg protocol.Message) (protocol.Message, error) {
+	c, err := p.conn(backend)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.send(c, msg); err != nil {
+		return nil, err
+	}
+	res, ok := <-c.Next()
+	if !ok {
+		return nil, fmt.Errorf("backend %s closed", backend)
+	}
+	return res, nil
+}
+
+func (p *shardSession) send(c api.Context, msg protocol.Message) error {
+	api.Propagate(p.current, msg)
+	return c.SendMessage(msg)
+}
+
+func (p *shardSession) conn(backend string) (api.Context, error) {
+	if c, ok := p.conns[backend]; ok {
+		return c, nil
+	}
+	upstream, ok := p.sharder.Upstreams[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", backend)
+	}
+	c, err := dialUpstream(upstream)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[backend] = c
+	return c, nil
+}
+
+func (p *shardSession) close() {
+	for id, cursor := range p.merged {
+		p.drop(id)
+		cursor.Close()
+	}
+	for name, c := range p.conns {
+		if err := c.Close(); err != nil {
+			p.client.Logger().Warn("close backend failed", "backend", name, "err", err)
+		}
+	}
+}
+
+type writeBatch struct {
+	backend string
+	stmts   bson.Array
+	indexes []int
+}
+
+type writeResult struct {
+	doc     protocol.Document
+	indexes []int
+}
+
+// mergeWriteResults 合并各分片的写结果，upserted 与 writeErrors 中的 index 还原为原批次中的位置
+func mergeWriteResults(results []writeResult) protocol.Document {
+	var n, modified int64
+	hasModified := false
+	upserted := make(bson.Array, 0)
+	writeErrors := make(bson.Array, 0)
+	var concernError interface{}
+	for _, r := range results {
+		if tools.LookupFloat64(r.doc, "ok") != 1 {
+			return r.doc
+		}
+		n += tools.LookupInt64(r.doc, "n")
+		if _, ok := protocol.Load(r.doc, "nModified"); ok {
+			hasModified = true
+			modified += tools.LookupInt64(r.doc, "nModified")
+		}
+		upserted = append(upserted, remapIndexes(tools.LookupArray(r.doc, "upserted"), r.indexes)...)
+		writeErrors = append(writeErrors, remapIndexes(tools.LookupArray(r.doc, "writeErrors"), r.indexes)...)
+		if v, ok := protocol.Load(r.doc, "writeConcernError"); ok && concernError == nil {
+			concernError = v
+		}
+	}
+	out := protocol.Document{{Key: "n", Val: int32(n)}}
+	if hasModified {
+		out = append(out, protocol.Pair{Key: "nModified", Val: int32(modified)})
+	}
+	if len(upserted) > 0 {
+		out = append(out, protocol.Pair{Key: "upserted", Val: upserted})
+	}
+	if len(writeErrors) > 0 {
+		out = append(out, protocol.Pair{Key: "writeErrors", Val: writeErrors})
+	}
+	if concernError != nil {
+		out = append(out, protocol.Pair{Key: "writeConcernError", Val: concernError})
+	}
+	return append(out, protocol.Pair{Key: "ok", Val: float64(1)})
+}
+
+func remapIndexes(items bson.Array, indexes []int) bson.Array {
+	out := make(bson.Array, 0, len(items))
+	for _, it := range items {
+		doc, ok := tools.AsDocument(it)
+		if !ok {
+			continue
+		}
+		i := int(tools.LookupInt64(doc, "index"))
+		if i >= 0 && i < len(indexes) {
+			doc = protocol.Store(doc, "index", int32(indexes[i]))
+		}
+		out = append(out, doc)
+	}
+	return out
+}
+
+// window 在合并后的结果上应用 skip 与 limit
+func window(docs bson.Array, skip, limit int64) bson.Array {
+	if skip >= int64(len(docs)) {
+		return docs[:0]
+	}
+	docs = docs[skip:]
+	if limit > 0 && limit < int64(len(docs)) {
+		docs = docs[:limit]
+	}
+	return docs
+}
+
+func copyOp(op *protocol.Op) *protocol.Op {
+	h := *op.OpHeader
+	return &protocol.Op{OpHeader: &h}
+}
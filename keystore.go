@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/config"
+	"github.com/jjeffcaii/mongo-proxy/secret"
+)
+
+// runKeystore 管理本地加密密钥库：genkey 生成主密钥，set 从标准输入读取值并保存，list 列出名称
+func runKeystore(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "Usage: mongo-proxy keystore <genkey|set|list> [flags]")
+		return exitUsage
+	}
+	action, args := args[0], args[1:]
+	if action == "genkey" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintln(stdout, base64.StdEncoding.EncodeToString(key))
+		return exitOK
+	}
+
+	fs := newFlagSet("keystore "+action, stderr)
+	path := fs.String("path", "", "keystore file")
+	keyEnv := fs.String("key-env", config.DefaultKeystoreKeyEnv, "environment variable holding the base64 master key")
+	keyFile := fs.String("key-file", "", "file holding the base64 master key, used when the environment variable is not set")
+	var name string
+	if action == "set" {
+		fs.StringVar(&name, "name", "", "secret name, the value is read from stdin")
+	}
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *path == "" {
+		fmt.Fprintf(stderr, "keystore %s: --path is required\n", action)
+		return exitUsage
+	}
+	key, err := secret.LoadKey(*keyEnv, *keyFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	ks, err := secret.NewKeystore(*path, key)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	switch action {
+	case "set":
+		if name == "" {
+			fmt.Fprintln(stderr, "keystore set: --name is required")
+			return exitUsage
+		}
+		bs, err := io.ReadAll(stdin)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		value := strings.TrimRight(string(bs), "\r\n")
+		if value == "" {
+			fmt.Fprintln(stderr, "keystore set: empty value on stdin")
+			return exitError
+		}
+		if err := ks.Set(name, value); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintf(stdout, "stored %q in %s\n", name, *path)
+	case "list":
+		names, err := ks.Names()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		for _, it := range names {
+			fmt.Fprintln(stdout, it)
+		}
+	default:
+		fmt.Fprintf(stderr, "keystore: unknown action %q, expected genkey, set or list\n", action)
+		return exitUsage
+	}
+	return exitOK
+}
@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+)
+
+// Dump 在 debug 级别输出解码后的消息，文档以 Extended JSON 表示并隐去认证信息，
+// direction 为 in 或 out
+func Dump(logger *slog.Logger, direction string, msg protocol.Message) {
+	if logger == nil || !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	attrs := []any{
+		slog.String("direction", direction),
+		slog.String("opcode", msg.Header().OpCode.String()),
+		slog.Int("requestId", int(msg.Header().RequestID)),
+		slog.Int("responseTo", int(msg.Header().ResponseTo)),
+	}
+	attrs = append(attrs, fields(msg, false)...)
+	logger.Debug("message", attrs...)
+}
+
+func fields(msg protocol.Message, canonical bool) []any {
+	auth := isAuth(msg)
+	doc := func(key string, d protocol.Document) slog.Attr {
+		return slog.String(key, extJSON(Redact(d, auth), canonical))
+	}
+	docs := func(key string, ds []protocol.Document) slog.Attr {
+		out := make([]string, 0, len(ds))
+		for _, d := range ds {
+			out = append(out, extJSON(Redact(d, auth), canonical))
+		}
+		return slog.Any(key, out)
+	}
+	switch v := msg.(type) {
+	case *protocol.OpMessage:
+		out := []any{slog.Uint64("flags", uint64(v.FlagBits)), doc("body", v.Body)}
+		for _, seq := range v.Sequences {
+			out = append(out, docs(seq.Identifier, seq.Documents))
+		}
+		return out
+	case *protocol.OpQuery:
+		out := []any{slog.String("ns", v.FullCollectionName), doc("query", v.Query)}
+		if len(v.ReturnFieldsSelector) > 0 {
+			out = append(out, doc("fields", v.ReturnFieldsSelector))
+		}
+		return out
+	case *protocol.OpReply:
+		return []any{
+			slog.Int("flags", int(v.ResponseFlags)),
+			slog.Int64("cursorId", v.CursorID),
+			docs("documents", v.Documents),
+		}
+	case *protocol.OpInsert:
+		return []any{slog.String("ns", v.FullCollectionName), docs("documents", v.Documents)}
+	case *protocol.OpUpdate:
+		return []any{slog.String("ns", v.FullCollectionName), doc("selector", v.Selector), doc("update", v.Update)}
+	case *protocol.OpDelete:
+		return []any{slog.String("ns", v.FullCollectionName), doc("selector", v.Selector)}
+	case *protocol.OpGetMore:
+		return []any{slog.String("ns", v.FullCollectionName), slog.Int64("cursorId", v.CursorID)}
+	case *protocol.OpKillCursors:
+		return []any{slog.Any("cursorIds", v.CursorIDs)}
+	case *protocol.OpCommand:
+		return []any{slog.String("db", v.Database), doc("args", v.CommandArgs)}
+	case *protocol.OpCommandReply:
+		return []any{doc("reply", v.CommandReply)}
+	}
+	return nil
+}
+
+// Fields 返回消息中按操作码区分的字段，文档以 Extended JSON 表示并隐去认证信息，
+// canonical 为 false 时使用 relaxed 模式
+func Fields(msg protocol.Message, canonical bool) []slog.Attr {
+	in := fields(msg, canonical)
+	out := make([]slog.Attr, 0, len(in))
+	for _, it := range in {
+		out = append(out, it.(slog.Attr))
+	}
+	return out
+}
@@ -0,0 +1,21 @@
+package logging
+
+import (
+	"encoding/json"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+)
+
+// ExtJSON 以 relaxed 模式的 Extended JSON 输出文档，用于日志
+func ExtJSON(doc protocol.Document) string {
+	return extJSON(doc, false)
+}
+
+func extJSON(doc protocol.Document, canonical bool) string {
+	bs, err := protocol.MarshalExtJSON(doc, canonical)
+	if err != nil {
+		// 日志不因无法编码的值而丢失，输出错误信息
+		bs, _ = json.Marshal(err.Error())
+	}
+	return string(bs)
+}
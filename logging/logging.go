@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var base atomic.Pointer[slog.Logger]
+
+func init() {
+	base.Store(New(os.Stderr, slog.LevelInfo, false))
+}
+
+// Default 返回全局日志，未注入日志的组件使用它
+func Default() *slog.Logger {
+	return base.Load()
+}
+
+// SetDefault 替换全局日志，已创建的连接继续使用原来的日志
+func SetDefault(logger *slog.Logger) {
+	if logger != nil {
+		base.Store(logger)
+	}
+}
+
+// New 创建输出到 w 的日志，json 为 true 时每条日志一行 JSON，否则为 key=value 文本
+func New(w io.Writer, level slog.Level, json bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if json {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// ParseLevel 解析 debug、info、warn、error
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return level, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"math"
+	"testing"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtJSON(t *testing.T) {
+	doc := protocol.Document{
+		{Key: "_id", Val: bson.ObjectId{0x5f, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{Key: "n", Val: bson.Int32(1)},
+		{Key: "big", Val: bson.Int64(1 << 40)},
+		{Key: "f", Val: bson.Float(2)},
+		{Key: "nan", Val: bson.Float(math.NaN())},
+		{Key: "at", Val: bson.UTCDateTime(0)},
+		{Key: "tags", Val: bson.Array{bson.String("a"), bson.Null{}}},
+		{Key: "sub", Val: bson.Map{"b": bson.Bool(true), "a": bson.String(`"q"`)}},
+	}
+	assert.Equal(t, `{"_id":{"$oid":"5f0000000000000000000001"},"n":1,"big":1099511627776,"f":2.0,`+
+		`"nan":{"$numberDouble":"NaN"},"at":{"$date":"1970-01-01T00:00:00Z"},"tags":["a",null],`+
+		`"sub":{"a":"\"q\"","b":true}}`, ExtJSON(doc))
+}
+
+func TestDumpRedactsCredentials(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelDebug, true)
+	q := protocol.NewOpQuery()
+	q.OpHeader = &protocol.Header{OpCode: protocol.OpCodeQuery, RequestID: 3}
+	q.FullCollectionName = "admin.$cmd"
+	q.Query = protocol.Document{
+		{Key: "saslStart", Val: int32(1)},
+		{Key: "mechanism", Val: "SCRAM-SHA-1"},
+		{Key: "payload", Val: []byte("n,,n=admin,r=secretnonce")},
+	}
+	Dump(logger, "in", q)
+	out := buf.String()
+	assert.Contains(t, out, `"opcode":"OP_QUERY"`)
+	assert.Contains(t, out, `SCRAM-SHA-1`)
+	assert.Contains(t, out, redacted)
+	assert.NotContains(t, out, "secretnonce")
+
+	buf.Reset()
+	Dump(New(&buf, slog.LevelInfo, true), "in", q)
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/sbunce/bson"
+)
+
+const redacted = "<redacted>"
+
+// SecretKeys 任何文档中都会隐去的字段：SASL 载荷以及用户管理命令中的密码
+var SecretKeys = map[string]bool{
+	"payload":  true,
+	"pwd":      true,
+	"password": true,
+}
+
+// AuthKeys 认证相关的消息中额外隐去的字段，MONGODB-CR 的 key 与 nonce 可用于离线破解
+var AuthKeys = map[string]bool{
+	"key":   true,
+	"nonce": true,
+}
+
+// AuthCommands 认证握手中的命令（小写），日志、抓包与指标共用
+var AuthCommands = map[string]bool{
+	"saslstart":    true,
+	"saslcontinue": true,
+	"authenticate": true,
+	"getnonce":     true,
+}
+
+// userCommands 请求中带有密码的用户管理命令
+var userCommands = map[string]bool{
+	"createuser": true,
+	"updateuser": true,
+}
+
+// IsCredentialCommand 判断命令（小写）是否为认证或用户管理命令，其中的 AuthKeys 也需要隐去
+func IsCredentialCommand(name string) bool {
+	return AuthCommands[name] || userCommands[name]
+}
+
+// isAuth 判断消息是否为认证或用户管理命令，响应无法判断时按普通消息处理
+func isAuth(msg protocol.Message) bool {
+	cmd, ok := protocol.ParseCommand(msg)
+	return ok && IsCredentialCommand(strings.ToLower(cmd.Name))
+}
+
+// RedactCommand 返回隐去认证信息后的命令参数
+func RedactCommand(cmd *protocol.Command) protocol.Document {
+	return Redact(cmd.Args, IsCredentialCommand(strings.ToLower(cmd.Name)))
+}
+
+// Redact 返回隐去认证信息后的文档副本，auth 为 true 时按认证命令处理
+func Redact(doc protocol.Document, auth bool) protocol.Document {
+	if doc == nil {
+		return nil
+	}
+	out := make(protocol.Document, 0, len(doc))
+	for _, it := range doc {
+		if SecretKeys[it.Key] || auth && AuthKeys[it.Key] {
+			it.Val = redacted
+		} else {
+			it.Val = redactValue(it.Val, auth)
+		}
+		out = append(out, it)
+	}
+	return out
+}
+
+func redactValue(v interface{}, auth bool) interface{} {
+	switch d := v.(type) {
+	case bson.Array:
+		out := make(bson.Array, 0, len(d))
+		for _, it := range d {
+			out = append(out, redactValue(it, auth))
+		}
+		return out
+	case protocol.Document:
+		return Redact(d, auth)
+	case bson.Map:
+		return Redact(sortedDocument(d), auth)
+	}
+	return v
+}
+
+// sortedDocument bson.Map 没有顺序，按字段名排序保证输出稳定
+func sortedDocument(m bson.Map) protocol.Document {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	doc := make(protocol.Document, 0, len(m))
+	for _, k := range keys {
+		doc = append(doc, protocol.Pair{Key: k, Val: m[k]})
+	}
+	return doc
+}
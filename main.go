@@ -1,18 +1,65 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"io"
+	"os"
+)
 
-	"github.com/jjeffcaii/mongo-proxy/api"
-	"github.com/jjeffcaii/mongo-proxy/handle"
+// 退出码
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
 )
 
+type command struct {
+	name    string
+	summary string
+	run     func(args []string, stdin io.Reader, stdout, stderr io.Writer) int
+}
+
+var commands = []command{
+	{"serve", "start the proxy", runServe},
+	{"check-config", "validate a configuration file", runCheckConfig},
+	{"decode", "decode wire protocol frames read from stdin", runDecode},
+	{"pcap", "extract MongoDB traffic from a pcap or pcapng file", runPcap},
+	{"replay", "replay captured client traffic against a deployment", runReplay},
+	{"keystore", "manage the encrypted local keystore for backend credentials", runKeystore},
+	{"version", "print version information", runVersion},
+}
+
 func main() {
-	// 创建代理
-	proxy := api.NewProxy(":27019")
-	log.Println("proxy server start")
-	err := proxy.Serve(handle.ProxyHandle)
-	if err != nil {
-		return
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run 分发子命令，未指定子命令时等同于 serve
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		return runServe(nil, stdin, stdout, stderr)
+	}
+	switch args[0] {
+	case "-h", "-help", "--help", "help":
+		usage(stdout)
+		return exitOK
+	}
+	for _, it := range commands {
+		if it.name == args[0] {
+			return it.run(args[1:], stdin, stdout, stderr)
+		}
+	}
+	fmt.Fprintf(stderr, "mongo-proxy: unknown command %q\n\n", args[0])
+	usage(stderr)
+	return exitUsage
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: mongo-proxy <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, it := range commands {
+		fmt.Fprintf(w, "  %-14s %s\n", it.name, it.summary)
 	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "mongo-proxy <command> -h" for the flags of a command.`)
 }
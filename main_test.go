@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jjeffcaii/mongo-proxy/config"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecode(t *testing.T) {
+	msg := protocol.NewOpMessage()
+	msg.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 7}
+	msg.Body = protocol.Document{{Key: "find", Val: "users"}, {Key: "$db", Val: "app"}}
+	bs, err := msg.Encode()
+	assert.NoError(t, err)
+
+	var stdout, stderr bytes.Buffer
+	input := hex.EncodeToString(bs) + "\n" + hex.EncodeToString(bs)
+	assert.Equal(t, exitOK, run([]string{"decode"}, strings.NewReader(input), &stdout, &stderr), stderr.String())
+	assert.Equal(t, 2, strings.Count(stdout.String(), "OP_MSG"))
+	assert.Contains(t, stdout.String(), `body: {"find":"users","$db":"app"}`)
+
+	stdout.Reset()
+	assert.Equal(t, exitOK, run([]string{"decode", "--format", "binary"}, bytes.NewReader(bs), &stdout, &stderr))
+	assert.Contains(t, stdout.String(), "requestId=7")
+
+	assert.Equal(t, exitError, run([]string{"decode"}, bytes.NewReader(bs[:20]), &stdout, &stderr))
+}
+
+func TestServe_Default(t *testing.T) {
+	// 没有配置文件、也没有设置回退密码时仍然可以启动
+	t.Setenv(config.FallbackPasswordEnv, "")
+	srv, err := startServer("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer srv.Close()
+	addr := srv.Addr("default")
+	if assert.NotNil(t, addr) {
+		conn, err := net.Dial("tcp", addr.String())
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("listeners:\n  - addr: \":27019\"\n    backend: x\n"), 0o644))
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, exitError, run([]string{"check-config", "--config", path}, nil, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), `listeners[0].backend: unknown backend "x"`)
+	assert.Equal(t, exitUsage, run([]string{"check-config"}, nil, &stdout, &stderr))
+	assert.Equal(t, exitUsage, run([]string{"nope"}, nil, &stdout, &stderr))
+}
@@ -0,0 +1,333 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Collector 能够以 Prometheus 文本格式输出自身的指标
+type Collector interface {
+	Name() string
+	Write(w io.Writer) error
+}
+
+// Registry 指标注册表
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register 注册指标，同名指标会导致 panic
+func (p *Registry) Register(cs ...Collector) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range cs {
+		for _, it := range p.collectors {
+			if it.Name() == c.Name() {
+				panic("duplicate metric " + c.Name())
+			}
+		}
+		p.collectors = append(p.collectors, c)
+	}
+}
+
+// Write 按名称顺序输出所有指标
+func (p *Registry) Write(w io.Writer) error {
+	p.mu.Lock()
+	cs := append([]Collector(nil), p.collectors...)
+	p.mu.Unlock()
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Name() < cs[j].Name() })
+	bw := bufio.NewWriter(w)
+	for _, c := range cs {
+		if err := c.Write(bw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler 以 Prometheus 文本格式输出指标的 HTTP handler
+func (p *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := p.Write(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// vec 按标签值分组的指标
+type vec[T any] struct {
+	name, help, kind string
+	labels           []string
+	mu               sync.Mutex
+	values           map[string]*T
+	order            []string
+	create           func() *T
+}
+
+func (p *vec[T]) Name() string {
+	return p.name
+}
+
+func (p *vec[T]) with(values []string) *T {
+	if len(values) != len(p.labels) {
+		panic(fmt.Sprintf("metric %s wants %d labels, got %d", p.name, len(p.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if it, ok := p.values[key]; ok {
+		return it
+	}
+	it := p.create()
+	p.values[key] = it
+	p.order = append(p.order, key)
+	return it
+}
+
+func (p *vec[T]) header(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", p.name, p.help, p.name, p.kind)
+	return err
+}
+
+// each 按标签值排序遍历
+func (p *vec[T]) each(fn func(labels string, it *T) error) error {
+	p.mu.Lock()
+	keys := append([]string(nil), p.order...)
+	p.mu.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		p.mu.Lock()
+		it := p.values[key]
+		p.mu.Unlock()
+		if err := fn(p.format(key, ""), it); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// format 生成 {a="x",b="y"} 形式的标签，extra 为附加的标签对
+func (p *vec[T]) format(key, extra string) string {
+	if len(p.labels) == 0 && extra == "" {
+		return ""
+	}
+	parts := make([]string, 0, len(p.labels)+1)
+	if len(p.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			parts = append(parts, p.labels[i]+"="+quote(v))
+		}
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func newVec[T any](kind, name, help string, labels []string, create func() *T) *vec[T] {
+	return &vec[T]{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]*T),
+		create: create,
+	}
+}
+
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (p *value) add(d float64) {
+	p.mu.Lock()
+	p.v += d
+	p.mu.Unlock()
+}
+
+func (p *value) set(v float64) {
+	p.mu.Lock()
+	p.v = v
+	p.mu.Unlock()
+}
+
+func (p *value) get() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.v
+}
+
+// CounterVec 只增不减的计数器
+type CounterVec struct {
+	*vec[value]
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec("counter", name, help, labels, func() *value { return &value{} })}
+}
+
+func (p *CounterVec) Inc(labels ...string) {
+	p.with(labels).add(1)
+}
+
+func (p *CounterVec) Add(v float64, labels ...string) {
+	if v < 0 {
+		return
+	}
+	p.with(labels).add(v)
+}
+
+// Value 返回当前值，主要用于测试
+func (p *CounterVec) Value(labels ...string) float64 {
+	return p.with(labels).get()
+}
+
+func (p *CounterVec) Write(w io.Writer) error {
+	if err := p.header(w); err != nil {
+		return err
+	}
+	return p.each(func(labels string, it *value) error {
+		_, err := fmt.Fprintf(w, "%s%s %s\n", p.name, labels, formatFloat(it.get()))
+		return err
+	})
+}
+
+// GaugeVec 可增可减的瞬时值
+type GaugeVec struct {
+	*vec[value]
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec("gauge", name, help, labels, func() *value { return &value{} })}
+}
+
+func (p *GaugeVec) Set(v float64, labels ...string) {
+	p.with(labels).set(v)
+}
+
+func (p *GaugeVec) Inc(labels ...string) {
+	p.with(labels).add(1)
+}
+
+func (p *GaugeVec) Dec(labels ...string) {
+	p.with(labels).add(-1)
+}
+
+func (p *GaugeVec) Value(labels ...string) float64 {
+	return p.with(labels).get()
+}
+
+func (p *GaugeVec) Write(w io.Writer) error {
+	if err := p.header(w); err != nil {
+		return err
+	}
+	return p.each(func(labels string, it *value) error {
+		_, err := fmt.Fprintf(w, "%s%s %s\n", p.name, labels, formatFloat(it.get()))
+		return err
+	})
+}
+
+// DefaultBuckets 延迟直方图的默认分桶，单位为秒
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec 累积分桶直方图
+type HistogramVec struct {
+	*vec[histogram]
+	buckets []float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		vec: newVec("histogram", name, help, labels, func() *histogram {
+			return &histogram{counts: make([]uint64, len(buckets))}
+		}),
+		buckets: buckets,
+	}
+}
+
+func (p *HistogramVec) Observe(v float64, labels ...string) {
+	h := p.with(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range p.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Count 返回观测次数，主要用于测试
+func (p *HistogramVec) Count(labels ...string) uint64 {
+	h := p.with(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (p *HistogramVec) Write(w io.Writer) error {
+	if err := p.header(w); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	keys := append([]string(nil), p.order...)
+	p.mu.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		p.mu.Lock()
+		h := p.values[key]
+		p.mu.Unlock()
+		h.mu.Lock()
+		counts, count, sum := append([]uint64(nil), h.counts...), h.count, h.sum
+		h.mu.Unlock()
+		for i, upper := range p.buckets {
+			le := "le=" + quote(formatFloat(upper))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", p.name, p.format(key, le), counts[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", p.name, p.format(key, `le="+Inf"`), count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n",
+			p.name, p.format(key, ""), formatFloat(sum), p.name, p.format(key, ""), count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quote 按 Prometheus 文本格式转义标签值
+func quote(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	c := NewCounterVec("test_total", "Test counter.", "kind")
+	h := NewHistogramVec("test_seconds", "Test histogram.", []float64{0.1, 1}, "ns")
+	r.Register(h, c)
+	c.Inc(`a"b`)
+	c.Add(2, `a"b`)
+	h.Observe(0.5, "db.coll")
+
+	var b strings.Builder
+	assert.NoError(t, r.Write(&b))
+	assert.Equal(t, `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{ns="db.coll",le="0.1"} 0
+test_seconds_bucket{ns="db.coll",le="1"} 1
+test_seconds_bucket{ns="db.coll",le="+Inf"} 1
+test_seconds_sum{ns="db.coll"} 0.5
+test_seconds_count{ns="db.coll"} 1
+# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{kind="a\"b"} 3
+`, b.String())
+	assert.Panics(t, func() { r.Register(NewGaugeVec("test_total", "dup")) })
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"net/http"
+)
+
+// Default 代理内置指标所在的注册表
+var Default = NewRegistry()
+
+var (
+	Connections = NewGaugeVec("mongo_proxy_connections",
+		"Open connections by side (client or backend).", "side")
+	Requests = NewCounterVec("mongo_proxy_requests_total",
+		"Requests received from clients by opcode and command name.", "opcode", "command")
+	Bytes = NewCounterVec("mongo_proxy_bytes_total",
+		"Wire bytes by side and direction (in or out).", "side", "direction")
+	BackendLatency = NewHistogramVec("mongo_proxy_backend_latency_seconds",
+		"Time between sending a request to a backend and receiving its reply.", DefaultBuckets, "backend", "command")
+	Fallbacks = NewCounterVec("mongo_proxy_fallback_total",
+		"Finds retried on the fallback backend by result (hit or miss).", "result")
+	AuthFailures = NewCounterVec("mongo_proxy_auth_failures_total",
+		"Failed authentications by side (client or backend).", "side")
+	PoolInUse = NewGaugeVec("mongo_proxy_pool_in_use",
+		"Backend connections currently checked out of the pool.", "backend")
+	PoolCapacity = NewGaugeVec("mongo_proxy_pool_capacity",
+		"Maximum backend connections allowed by the pool.", "backend")
+	PoolWaits = NewCounterVec("mongo_proxy_pool_waits_total",
+		"Connection requests that had to wait for a free pool slot.", "backend")
+	PoolTimeouts = NewCounterVec("mongo_proxy_pool_timeouts_total",
+		"Connection requests that timed out waiting for a free pool slot.", "backend")
+)
+
+func init() {
+	Default.Register(
+		Connections,
+		Requests,
+		Bytes,
+		BackendLatency,
+		Fallbacks,
+		AuthFailures,
+		PoolInUse,
+		PoolCapacity,
+		PoolWaits,
+		PoolTimeouts,
+	)
+}
+
+// Handler 输出 Default 中的指标
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// Serve 在 addr 上提供 /metrics，阻塞直到出错
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.ListenAndServe(addr, mux)
+}
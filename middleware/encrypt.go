@@ -0,0 +1,546 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+// 密文格式：magic | mode | len(keyID) | keyID | nonce | AES-256-GCM 密文
+const (
+	cipherMagic         = "MPXE"
+	cipherRandom        = byte(1)
+	cipherDeterministic = byte(2)
+	cipherNonceSize     = 12
+)
+
+// KeyProvider 按 ID 返回 32 字节的数据密钥
+type KeyProvider interface {
+	Key(id string) ([]byte, error)
+}
+
+// KeyFile 本地密钥文件，内容为密钥 ID 到 base64 编码密钥的 JSON 对象
+type KeyFile map[string][]byte
+
+func (p KeyFile) Key(id string) ([]byte, error) {
+	key, ok := p[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown data key %q", id)
+	}
+	return key, nil
+}
+
+// LoadKeyFile 读取密钥文件，密钥长度必须为 32 字节
+func LoadKeyFile(path string) (KeyFile, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(bs, &raw); err != nil {
+		return nil, fmt.Errorf("parse key file %s failed: %w", path, err)
+	}
+	keys := make(KeyFile, len(raw))
+	for id, it := range raw {
+		key, err := base64.StdEncoding.DecodeString(it)
+		if err != nil {
+			return nil, fmt.Errorf("decode data key %q failed: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("data key %q must be 32 bytes, got %d", id, len(key))
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// EncryptedField 需要加密的字段，Deterministic 为 true 时相同明文得到相同密文，可用于等值查询
+type EncryptedField struct {
+	Namespace     string
+	Path          string
+	KeyID         string
+	Deterministic bool
+}
+
+// Encryptor 在写入与等值查询中加密字段，在响应中解密。
+// 同时通过 Use 与 UseResponse 注册在客户端连接上
+type Encryptor struct {
+	Fields []EncryptedField
+	Keys   KeyProvider
+}
+
+func NewEncryptor(keys KeyProvider) *Encryptor {
+	return &Encryptor{Keys: keys}
+}
+
+// Encrypt 追加加密字段
+func (p *Encryptor) Encrypt(namespace, path, keyID string, deterministic bool) *Encryptor {
+	p.Fields = append(p.Fields, EncryptedField{
+		Namespace:     namespace,
+		Path:          path,
+		KeyID:         keyID,
+		Deterministic: deterministic,
+	})
+	return p
+}
+
+func (p *Encryptor) fields(ns string) []EncryptedField {
+	var out []EncryptedField
+	for _, it := range p.Fields {
+		if matchAny([]string{it.Namespace}, ns) {
+			out = append(out, it)
+		}
+	}
+	return out
+}
+
+func (p *Encryptor) Handle(ctx api.Context, req protocol.Message) error {
+	r := describe(req)
+	if r == nil {
+		return nil
+	}
+	fields := p.fields(r.namespace)
+	if len(fields) == 0 {
+		return nil
+	}
+	if err := p.rewrite(req, fields); err != nil {
+		return api.Reject(req, err)
+	}
+	return nil
+}
+
+func (p *Encryptor) HandleResponse(ctx api.Context, req, reply protocol.Message) (protocol.Message, error) {
+	if len(p.Fields) == 0 {
+		return reply, nil
+	}
+	if v, ok := reply.(*protocol.OpReply); ok {
+		for i, doc := range v.Documents {
+			d, _ := tools.AsDocument(p.decrypt(doc))
+			v.Documents[i] = d
+		}
+		return reply, nil
+	}
+	if doc, ok := protocol.ReplyDocument(reply); ok {
+		d, _ := tools.AsDocument(p.decrypt(doc))
+		protocol.SetReplyDocument(reply, d)
+	}
+	return reply, nil
+}
+
+// decrypt 递归解密所有由代理生成的密文，无法解密的值保持原样
+func (p *Encryptor) decrypt(v interface{}) interface{} {
+	switch d := v.(type) {
+	case protocol.Document:
+		out := make(protocol.Document, 0, len(d))
+		for _, it := range d {
+			it.Val = p.decrypt(it.Val)
+			out = append(out, it)
+		}
+		return out
+	case bson.Map:
+		for k, it := range d {
+			d[k] = p.decrypt(it)
+		}
+		return d
+	case bson.Array:
+		out := make(bson.Array, 0, len(d))
+		for _, it := range d {
+			out = append(out, p.decrypt(it))
+		}
+		return out
+	case bson.Binary:
+		if plain, err := p.open(d); err == nil {
+			return plain
+		}
+	}
+	return v
+}
+
+// rewrite 加密写入的文档与查询条件中的等值比较
+func (p *Encryptor) rewrite(req protocol.Message, fields []EncryptedField) error {
+	if cmd, ok := protocol.ParseCommand(req); ok {
+		args := cmd.Args
+		var err error
+		for _, key := range []string{"filter", "query"} {
+			if filter := subDocument(args, key); filter != nil {
+				if filter, err = p.encryptFilter(filter, fields); err != nil {
+					return err
+				}
+				args = protocol.Store(args, key, filter)
+			}
+		}
+		switch strings.ToLower(cmd.Name) {
+		case "insert":
+			if args, err = p.rewriteArray(args, "documents", func(doc protocol.Document) (protocol.Document, error) {
+				return p.encryptDocument(doc, fields)
+			}); err != nil {
+				return err
+			}
+		case "update":
+			if args, err = p.rewriteArray(args, "updates", func(stmt protocol.Document) (protocol.Document, error) {
+				return p.rewriteStatement(stmt, "q", "u", fields)
+			}); err != nil {
+				return err
+			}
+		case "delete":
+			if args, err = p.rewriteArray(args, "deletes", func(stmt protocol.Document) (protocol.Document, error) {
+				return p.rewriteStatement(stmt, "q", "", fields)
+			}); err != nil {
+				return err
+			}
+		case "findandmodify":
+			if args, err = p.rewriteStatement(args, "", "update", fields); err != nil {
+				return err
+			}
+		case "aggregate":
+			pipeline := tools.LookupArray(args, "pipeline")
+			out := make(bson.Array, 0, len(pipeline))
+			for _, it := range pipeline {
+				stage, _ := tools.AsDocument(it)
+				if match := subDocument(stage, "$match"); match != nil {
+					if match, err = p.encryptFilter(match, fields); err != nil {
+						return err
+					}
+					it = protocol.Document{{Key: "$match", Val: match}}
+				}
+				out = append(out, it)
+			}
+			if pipeline != nil {
+				args = protocol.Store(args, "pipeline", out)
+			}
+		}
+		protocol.SetCommandArgs(req, args)
+		return nil
+	}
+	var err error
+	switch v := req.(type) {
+	case *protocol.OpQuery:
+		if q := tools.LookupDocument(v.Query, "$query"); q != nil {
+			if q, err = p.encryptFilter(q, fields); err == nil {
+				v.Query = protocol.Store(v.Query, "$query", q)
+			}
+		} else {
+			v.Query, err = p.encryptFilter(v.Query, fields)
+		}
+	case *protocol.OpInsert:
+		for i, doc := range v.Documents {
+			if v.Documents[i], err = p.encryptDocument(doc, fields); err != nil {
+				return err
+			}
+		}
+	case *protocol.OpUpdate:
+		if v.Selector, err = p.encryptFilter(v.Selector, fields); err != nil {
+			return err
+		}
+		v.Update, err = p.encryptUpdate(v.Update, fields)
+	case *protocol.OpDelete:
+		v.Selector, err = p.encryptFilter(v.Selector, fields)
+	}
+	return err
+}
+
+func (p *Encryptor) rewriteArray(args protocol.Document, key string, fn func(protocol.Document) (protocol.Document, error)) (protocol.Document, error) {
+	arr := tools.LookupArray(args, key)
+	if arr == nil {
+		return args, nil
+	}
+	out := make(bson.Array, 0, len(arr))
+	for _, it := range arr {
+		doc, ok := tools.AsDocument(it)
+		if !ok {
+			out = append(out, it)
+			continue
+		}
+		doc, err := fn(doc)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, doc)
+	}
+	return protocol.Store(args, key, out), nil
+}
+
+// rewriteStatement 加密 update/delete 语句中的查询条件与更新文档，findAndModify 的条件已在外层处理
+func (p *Encryptor) rewriteStatement(stmt protocol.Document, filterKey, updateKey string, fields []EncryptedField) (protocol.Document, error) {
+	var err error
+	if filterKey != "" {
+		if q := subDocument(stmt, filterKey); q != nil {
+			if q, err = p.encryptFilter(q, fields); err != nil {
+				return nil, err
+			}
+			stmt = protocol.Store(stmt, filterKey, q)
+		}
+	}
+	if updateKey == "" {
+		return stmt, nil
+	}
+	v, ok := protocol.Load(stmt, updateKey)
+	if !ok {
+		return stmt, nil
+	}
+	u, isDoc := tools.AsDocument(v)
+	if !isDoc {
+		return nil, errEncryptedField(fields[0].Path, "pipeline updates are not supported on collections with encrypted field")
+	}
+	if u, err = p.encryptUpdate(u, fields); err != nil {
+		return nil, err
+	}
+	return protocol.Store(stmt, updateKey, u), nil
+}
+
+func (p *Encryptor) encryptDocument(doc protocol.Document, fields []EncryptedField) (protocol.Document, error) {
+	var v interface{} = doc
+	for _, f := range fields {
+		var err error
+		v = p.encryptPath(v, f, strings.Split(f.Path, "."), &err)
+		if err != nil {
+			return nil, err
+		}
+	}
+	out, _ := tools.AsDocument(v)
+	return out, nil
+}
+
+func (p *Encryptor) encryptPath(v interface{}, f EncryptedField, parts []string, errp *error) interface{} {
+	return maskPath(v, parts, func(val interface{}) interface{} {
+		if *errp != nil {
+			return val
+		}
+		sealed, err := p.seal(f, val)
+		if err != nil {
+			*errp = err
+			return val
+		}
+		return sealed
+	})
+}
+
+// encryptUpdate 替换文档整体加密，$set 与 $setOnInsert 只加密命中的字段，其他更新操作符不能作用于加密字段
+func (p *Encryptor) encryptUpdate(u protocol.Document, fields []EncryptedField) (protocol.Document, error) {
+	if len(u) == 0 || !strings.HasPrefix(u[0].Key, "$") {
+		return p.encryptDocument(u, fields)
+	}
+	out := make(protocol.Document, 0, len(u))
+	for _, op := range u {
+		spec, ok := tools.AsDocument(op.Val)
+		if !ok {
+			out = append(out, op)
+			continue
+		}
+		next := make(protocol.Document, 0, len(spec))
+		for _, it := range spec {
+			for _, f := range fields {
+				var err error
+				switch {
+				case it.Key == f.Path || strings.HasPrefix(f.Path, it.Key+"."):
+					if op.Key == "$unset" {
+						continue
+					}
+					if op.Key != "$set" && op.Key != "$setOnInsert" {
+						return nil, errEncryptedField(f.Path, "operator "+op.Key+" is not supported on encrypted field")
+					}
+					rest := strings.Split(strings.TrimPrefix(strings.TrimPrefix(f.Path, it.Key), "."), ".")
+					if it.Key == f.Path {
+						rest = nil
+					}
+					it.Val = p.encryptPath(it.Val, f, rest, &err)
+				case strings.HasPrefix(it.Key, f.Path+"."):
+					return nil, errEncryptedField(f.Path, "cannot update part of encrypted field")
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			next = append(next, it)
+		}
+		out = append(out, protocol.Pair{Key: op.Key, Val: next})
+	}
+	return out, nil
+}
+
+// encryptFilter 加密确定性字段上的等值比较，其他比较无法在密文上执行
+func (p *Encryptor) encryptFilter(filter protocol.Document, fields []EncryptedField) (protocol.Document, error) {
+	out := make(protocol.Document, 0, len(filter))
+	for _, it := range filter {
+		switch it.Key {
+		case "$and", "$or", "$nor":
+			arr, _ := it.Val.(bson.Array)
+			next := make(bson.Array, 0, len(arr))
+			for _, sub := range arr {
+				d, ok := tools.AsDocument(sub)
+				if !ok {
+					next = append(next, sub)
+					continue
+				}
+				d, err := p.encryptFilter(d, fields)
+				if err != nil {
+					return nil, err
+				}
+				next = append(next, d)
+			}
+			it.Val = next
+			out = append(out, it)
+			continue
+		}
+		for _, f := range fields {
+			if strings.HasPrefix(it.Key, f.Path+".") || strings.HasPrefix(f.Path, it.Key+".") {
+				return nil, errEncryptedField(f.Path, "only equality on the whole encrypted field is supported")
+			}
+			if it.Key != f.Path {
+				continue
+			}
+			if !f.Deterministic {
+				return nil, errEncryptedField(f.Path, "randomly encrypted field cannot be queried")
+			}
+			val, err := p.encryptCondition(f, it.Val)
+			if err != nil {
+				return nil, err
+			}
+			it.Val = val
+		}
+		out = append(out, it)
+	}
+	return out, nil
+}
+
+func (p *Encryptor) encryptCondition(f EncryptedField, cond interface{}) (interface{}, error) {
+	d, ok := tools.AsDocument(cond)
+	if !ok || len(d) == 0 || !strings.HasPrefix(d[0].Key, "$") {
+		return p.seal(f, cond)
+	}
+	out := make(protocol.Document, 0, len(d))
+	for _, it := range d {
+		switch it.Key {
+		case "$eq", "$ne":
+			sealed, err := p.seal(f, it.Val)
+			if err != nil {
+				return nil, err
+			}
+			it.Val = sealed
+		case "$in", "$nin":
+			arr, _ := it.Val.(bson.Array)
+			next := make(bson.Array, 0, len(arr))
+			for _, v := range arr {
+				sealed, err := p.seal(f, v)
+				if err != nil {
+					return nil, err
+				}
+				next = append(next, sealed)
+			}
+			it.Val = next
+		case "$exists":
+		default:
+			return nil, errEncryptedField(f.Path, "operator "+it.Key+" is not supported on encrypted field")
+		}
+		out = append(out, it)
+	}
+	return out, nil
+}
+
+// seal 加密单个值，明文以 {v: value} 的 BSON 编码保留类型
+func (p *Encryptor) seal(f EncryptedField, v interface{}) (bson.Binary, error) {
+	key, err := p.Keys.Key(f.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, mac, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := protocol.EncodeDocument(protocol.Document{{Key: "v", Val: v}})
+	if err != nil {
+		return nil, err
+	}
+	mode, nonce := cipherRandom, make([]byte, cipherNonceSize)
+	if f.Deterministic {
+		mode = cipherDeterministic
+		h := hmac.New(sha256.New, mac)
+		h.Write(plain)
+		copy(nonce, h.Sum(nil))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	b.WriteString(cipherMagic)
+	b.WriteByte(mode)
+	b.WriteByte(byte(len(f.KeyID)))
+	b.WriteString(f.KeyID)
+	b.Write(nonce)
+	b.Write(aead.Seal(nil, nonce, plain, []byte(f.KeyID)))
+	return bson.Binary(b.Bytes()), nil
+}
+
+func (p *Encryptor) open(bs []byte) (interface{}, error) {
+	if !bytes.HasPrefix(bs, []byte(cipherMagic)) || len(bs) < len(cipherMagic)+2 {
+		return nil, errNotCiphertext
+	}
+	bs = bs[len(cipherMagic)+1:]
+	n := int(bs[0])
+	if len(bs) < 1+n+cipherNonceSize {
+		return nil, errNotCiphertext
+	}
+	keyID := string(bs[1 : 1+n])
+	nonce := bs[1+n : 1+n+cipherNonceSize]
+	key, err := p.Keys.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, _, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, nonce, bs[1+n+cipherNonceSize:], []byte(keyID))
+	if err != nil {
+		return nil, err
+	}
+	doc, err := protocol.DecodeDocument(plain)
+	if err != nil {
+		return nil, err
+	}
+	v, _ := protocol.Load(doc, "v")
+	return v, nil
+}
+
+// newCipher 从数据密钥派生加密密钥与确定性模式使用的 MAC 密钥
+func newCipher(key []byte) (cipher.AEAD, []byte, error) {
+	if len(key) != 32 {
+		return nil, nil, fmt.Errorf("data key must be 32 bytes, got %d", len(key))
+	}
+	derive := func(label string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(label))
+		return h.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("enc"))
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, derive("mac"), nil
+}
+
+var errNotCiphertext = fmt.Errorf("not a proxy ciphertext")
+
+func errEncryptedField(path, reason string) error {
+	return &protocol.CommandError{
+		Code:     protocol.CodeBadValue,
+		CodeName: "BadValue",
+		Message:  fmt.Sprintf("%s: %s", reason, path),
+	}
+}
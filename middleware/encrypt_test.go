@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestEncryptor(t *testing.T) *Encryptor {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	assert.NoError(t, os.WriteFile(file, []byte(`{"k1":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}`), 0600))
+	keys, err := LoadKeyFile(file)
+	assert.NoError(t, err)
+	return NewEncryptor(keys).
+		Encrypt("crm.users", "ssn", "k1", true).
+		Encrypt("crm.users", "profile.note", "k1", false)
+}
+
+func TestEncryptInsertAndQuery(t *testing.T) {
+	p := newTestEncryptor(t)
+	fields := p.fields("crm.users")
+
+	msg := protocol.NewOpMessage()
+	msg.Body = protocol.Document{{Key: "insert", Val: "users"}, {Key: "$db", Val: "crm"}}
+	msg.Sequences = []protocol.DocumentSequence{{Identifier: "documents", Documents: []protocol.Document{{
+		{Key: "ssn", Val: "123-45-6789"},
+		{Key: "profile", Val: protocol.Document{{Key: "note", Val: "vip"}}},
+	}}}}
+	assert.NoError(t, p.rewrite(msg, fields))
+	doc := msg.Sequences[0].Documents[0]
+	ssn, _ := protocol.Load(doc, "ssn")
+	note, _ := tools.Lookup(doc, "profile.note")
+	assert.IsType(t, bson.Binary{}, ssn)
+	assert.IsType(t, bson.Binary{}, note)
+
+	// 确定性加密的等值查询与写入的密文一致
+	filter, err := p.encryptFilter(protocol.Document{{Key: "ssn", Val: "123-45-6789"}}, fields)
+	assert.NoError(t, err)
+	v, _ := protocol.Load(filter, "ssn")
+	assert.Equal(t, ssn, v)
+
+	_, err = p.encryptFilter(protocol.Document{{Key: "profile.note", Val: "vip"}}, fields)
+	assert.Error(t, err)
+	_, err = p.encryptFilter(protocol.Document{{Key: "ssn", Val: protocol.Document{{Key: "$gt", Val: "1"}}}}, fields)
+	assert.Error(t, err)
+
+	plain, _ := tools.AsDocument(p.decrypt(doc))
+	ssn, _ = protocol.Load(plain, "ssn")
+	note, _ = tools.Lookup(plain, "profile.note")
+	s1, _ := tools.String(ssn)
+	s2, _ := tools.String(note)
+	assert.Equal(t, "123-45-6789", s1)
+	assert.Equal(t, "vip", s2)
+}
@@ -0,0 +1,280 @@
+package middleware
+
+import (
+	"path"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+// Action 规则命中后的动作
+type Action int8
+
+const (
+	Deny Action = iota
+	Allow
+)
+
+func (p Action) String() string {
+	if p == Allow {
+		return "allow"
+	}
+	return "deny"
+}
+
+// FirewallRule 防火墙规则，各条件之间为与关系，条件为空表示不限制。
+// Namespaces 与 Users 支持 path.Match 风格的通配符，如 "shop.*"、"*@admin"
+type FirewallRule struct {
+	Name       string
+	Action     Action
+	Commands   []string
+	Namespaces []string
+	Operators  []string
+	Users      []string
+	// Collscan 为 true 时只匹配不带过滤条件与 hint 的查询，
+	// Indexed 中列出的字段视为有索引，过滤条件引用任意一个即不算全表扫描
+	Collscan bool
+	Indexed  []string
+	// Message 拒绝时返回给客户端的说明
+	Message string
+}
+
+// DefaultFirewallRules 拦截服务端 JavaScript 与删库操作，全表扫描规则需要按集合另行配置
+func DefaultFirewallRules() []FirewallRule {
+	return []FirewallRule{
+		{Name: "no-server-js", Operators: []string{"$where", "$function", "$accumulator"}},
+		{Name: "no-mapreduce", Commands: []string{"mapReduce"}},
+		{Name: "no-eval", Commands: []string{"eval", "$eval"}},
+		{Name: "no-drop-database", Commands: []string{"dropDatabase"}},
+	}
+}
+
+// request 规则匹配使用的请求视图
+type request struct {
+	command   string
+	namespace string
+	user      string
+	operators map[string]bool
+	filters   []protocol.Document
+	hinted    bool
+}
+
+func (p *FirewallRule) match(req *request) bool {
+	if len(p.Commands) > 0 && !containsFold(p.Commands, req.command) {
+		return false
+	}
+	if len(p.Namespaces) > 0 && !matchAny(p.Namespaces, req.namespace) {
+		return false
+	}
+	if len(p.Users) > 0 && !matchAny(p.Users, req.user) {
+		return false
+	}
+	if len(p.Operators) > 0 {
+		found := false
+		for _, it := range p.Operators {
+			if req.operators[it] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if p.Collscan && !p.collscan(req) {
+		return false
+	}
+	return true
+}
+
+// collscan 判断请求是否会扫描整个集合
+func (p *FirewallRule) collscan(req *request) bool {
+	if req.hinted || len(req.filters) == 0 {
+		return false
+	}
+	for _, filter := range req.filters {
+		indexed := false
+		for _, field := range p.Indexed {
+			if _, ok := tools.Lookup(filter, field); ok {
+				indexed = true
+				break
+			}
+		}
+		if !indexed && (len(p.Indexed) > 0 || len(filter) == 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// Firewall 按顺序匹配规则，第一条命中的规则决定放行或拒绝，都不命中时放行。
+// DryRun 模式下只记录会被拒绝的请求，不做拦截
+type Firewall struct {
+	Rules  []FirewallRule
+	DryRun bool
+}
+
+func NewFirewall(rules ...FirewallRule) *Firewall {
+	return &Firewall{Rules: rules}
+}
+
+// Allow 追加放行规则
+func (p *Firewall) Allow(rule FirewallRule) *Firewall {
+	rule.Action = Allow
+	p.Rules = append(p.Rules, rule)
+	return p
+}
+
+// Deny 追加拒绝规则
+func (p *Firewall) Deny(rule FirewallRule) *Firewall {
+	rule.Action = Deny
+	p.Rules = append(p.Rules, rule)
+	return p
+}
+
+func (p *Firewall) Handle(ctx api.Context, req protocol.Message) error {
+	r := describe(req)
+	if r == nil {
+		return nil
+	}
+	// saslStart 中声明的用户未经后端确认，不能用来匹配 Users
+	if id := ctx.Identity(); id != nil && id.Verified {
+		r.user = id.String()
+	}
+	rule := p.evaluate(r)
+	if rule == nil || rule.Action == Allow {
+		return nil
+	}
+	if p.DryRun {
+		ctx.Logger().Warn("firewall dry-run would block request", "rule", rule.Name, "command", r.command, "ns", r.namespace, "user", r.user)
+		return nil
+	}
+	ctx.Logger().Warn("firewall blocked request", "rule", rule.Name, "command", r.command, "ns", r.namespace, "user", r.user)
+	msg := rule.Message
+	if msg == "" {
+		msg = "operation blocked by proxy rule " + rule.Name
+	}
+	return deny(req, protocol.CodeUnauthorized, "Unauthorized", "%s", msg)
+}
+
+func (p *Firewall) evaluate(req *request) *FirewallRule {
+	for i := range p.Rules {
+		if p.Rules[i].match(req) {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+// 命令中携带查询条件的字段
+var filterFields = map[string][]string{
+	"find":          {"filter"},
+	"count":         {"query"},
+	"distinct":      {"query"},
+	"findandmodify": {"query"},
+}
+
+// describe 将请求转换为规则匹配使用的视图，不需要检查的消息返回 nil
+func describe(msg protocol.Message) *request {
+	name, ns, ok := protocol.Operation(msg)
+	if !ok || name == "killcursors" {
+		return nil
+	}
+	r := &request{command: name, namespace: ns, operators: make(map[string]bool)}
+	if cmd, ok := protocol.ParseCommand(msg); ok {
+		for i, it := range cmd.Args {
+			if i == 0 {
+				continue
+			}
+			collectOperators(it.Val, r.operators)
+		}
+		_, r.hinted = protocol.Load(cmd.Args, "hint")
+		for _, key := range filterFields[r.command] {
+			v, _ := protocol.Load(cmd.Args, key)
+			filter, _ := tools.AsDocument(v)
+			r.filters = append(r.filters, filter)
+		}
+		// update 与 delete 的每条语句都可能是全表扫描
+		for _, key := range []string{"updates", "deletes"} {
+			for _, it := range tools.LookupArray(cmd.Args, key) {
+				stmt, _ := tools.AsDocument(it)
+				v, _ := protocol.Load(stmt, "q")
+				filter, _ := tools.AsDocument(v)
+				r.filters = append(r.filters, filter)
+			}
+		}
+		// 聚合只有开头的 $match 能使用索引
+		if r.command == "aggregate" {
+			if stages := tools.LookupArray(cmd.Args, "pipeline"); len(stages) > 0 {
+				stage, _ := tools.AsDocument(stages[0])
+				if len(stage) > 0 && stage[0].Key == "$match" {
+					filter, _ := tools.AsDocument(stage[0].Val)
+					r.filters = append(r.filters, filter)
+				}
+			}
+		}
+		return r
+	}
+	switch v := msg.(type) {
+	case *protocol.OpQuery:
+		filter := v.Query
+		if q := tools.LookupDocument(v.Query, "$query"); q != nil {
+			filter = q
+			_, r.hinted = protocol.Load(v.Query, "$hint")
+		}
+		r.filters = append(r.filters, filter)
+		collectOperators(filter, r.operators)
+	case *protocol.OpUpdate:
+		r.filters = append(r.filters, v.Selector)
+		collectOperators(v.Selector, r.operators)
+		collectOperators(v.Update, r.operators)
+	case *protocol.OpDelete:
+		r.filters = append(r.filters, v.Selector)
+		collectOperators(v.Selector, r.operators)
+	}
+	return r
+}
+
+// collectOperators 递归收集文档中使用的 $ 操作符
+func collectOperators(v interface{}, out map[string]bool) {
+	if doc, ok := tools.AsDocument(v); ok {
+		for _, it := range doc {
+			if strings.HasPrefix(it.Key, "$") {
+				out[it.Key] = true
+			}
+			collectOperators(it.Val, out)
+		}
+		return
+	}
+	switch arr := v.(type) {
+	case bson.Array:
+		for _, it := range arr {
+			collectOperators(it, out)
+		}
+	case []interface{}:
+		for _, it := range arr {
+			collectOperators(it, out)
+		}
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, it := range list {
+		if strings.EqualFold(it, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, it := range patterns {
+		if ok, _ := path.Match(it, s); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func command(db string, body ...protocol.Pair) *protocol.OpMessage {
+	msg := protocol.NewOpMessage()
+	msg.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 1}
+	msg.Body = append(protocol.Document(body), protocol.Pair{Key: "$db", Val: bson.String(db)})
+	return msg
+}
+
+func TestFirewall_Handle(t *testing.T) {
+	// 放行规则排在默认规则之前
+	ops := FirewallRule{Name: "ops", Action: Allow, Users: []string{"ops@admin"}, Commands: []string{"dropDatabase"}}
+	p := NewFirewall(append([]FirewallRule{ops}, DefaultFirewallRules()...)...).
+		Deny(FirewallRule{Name: "drop-shop", Commands: []string{"drop"}, Namespaces: []string{"shop.*"}})
+	anonymous := &testContext{}
+	verified := &testContext{id: &api.Identity{User: "ops", Database: "admin", Verified: true}}
+	claimed := &testContext{id: &api.Identity{User: "ops", Database: "admin"}}
+
+	assert.IsType(t, &api.Response{}, p.Handle(anonymous, command("shop", protocol.Pair{Key: "drop", Val: bson.String("orders")})))
+	assert.NoError(t, p.Handle(anonymous, command("crm", protocol.Pair{Key: "drop", Val: bson.String("orders")})))
+	where := command("shop",
+		protocol.Pair{Key: "find", Val: bson.String("orders")},
+		protocol.Pair{Key: "filter", Val: protocol.Document{{Key: "$where", Val: bson.String("true")}}},
+	)
+	assert.IsType(t, &api.Response{}, p.Handle(anonymous, where))
+
+	// 只有后端确认过的用户能命中 Users
+	drop := command("shop", protocol.Pair{Key: "dropDatabase", Val: bson.Int32(1)})
+	assert.NoError(t, p.Handle(verified, drop))
+	assert.IsType(t, &api.Response{}, p.Handle(claimed, drop))
+	assert.IsType(t, &api.Response{}, p.Handle(anonymous, drop))
+
+	p.DryRun = true
+	assert.NoError(t, p.Handle(anonymous, drop))
+}
+
+func TestFirewall_Collscan(t *testing.T) {
+	p := NewFirewall().Deny(FirewallRule{Name: "scan", Namespaces: []string{"shop.orders"}, Collscan: true, Indexed: []string{"_id", "user.id"}})
+	ctx := &testContext{}
+	find := func(filter protocol.Document, extra ...protocol.Pair) *protocol.OpMessage {
+		body := append([]protocol.Pair{{Key: "find", Val: bson.String("orders")}, {Key: "filter", Val: filter}}, extra...)
+		return command("shop", body...)
+	}
+
+	assert.IsType(t, &api.Response{}, p.Handle(ctx, find(protocol.Document{})))
+	assert.IsType(t, &api.Response{}, p.Handle(ctx, find(protocol.Document{{Key: "status", Val: bson.String("new")}})))
+	assert.NoError(t, p.Handle(ctx, find(protocol.Document{{Key: "user", Val: protocol.Document{{Key: "id", Val: bson.Int32(1)}}}})))
+	assert.NoError(t, p.Handle(ctx, find(protocol.Document{}, protocol.Pair{Key: "hint", Val: protocol.Document{{Key: "status", Val: bson.Int32(1)}}})))
+
+	aggregate := func(match protocol.Document) *protocol.OpMessage {
+		return command("shop",
+			protocol.Pair{Key: "aggregate", Val: bson.String("orders")},
+			protocol.Pair{Key: "pipeline", Val: bson.Array{protocol.Document{{Key: "$match", Val: match}}}},
+			protocol.Pair{Key: "cursor", Val: protocol.Document{}},
+		)
+	}
+	assert.IsType(t, &api.Response{}, p.Handle(ctx, aggregate(protocol.Document{})))
+	assert.NoError(t, p.Handle(ctx, aggregate(protocol.Document{{Key: "_id", Val: bson.Int32(1)}})))
+
+	// 没有 Indexed 时只拦截空的过滤条件
+	p = NewFirewall().Deny(FirewallRule{Name: "scan", Collscan: true})
+	assert.IsType(t, &api.Response{}, p.Handle(ctx, find(protocol.Document{})))
+	assert.NoError(t, p.Handle(ctx, find(protocol.Document{{Key: "status", Val: bson.String("new")}})))
+}
@@ -0,0 +1,463 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+// MaskMethod 字段脱敏方式
+type MaskMethod int8
+
+const (
+	// MaskRedact 替换为固定的 "***"
+	MaskRedact MaskMethod = iota
+	// MaskHash 替换为 HMAC-SHA256 的十六进制摘要
+	MaskHash
+	// MaskTruncate 字符串只保留前 Keep 个字符，其余替换为 *
+	MaskTruncate
+	// MaskTokenize 替换为确定性的令牌，相同的值得到相同的令牌，可用于关联但无法还原
+	MaskTokenize
+)
+
+const redacted = "***"
+
+// MaskField 需要脱敏的字段，Path 为点分路径，经过数组时对每个元素生效
+type MaskField struct {
+	Path   string
+	Method MaskMethod
+	Keep   int
+}
+
+// MaskRule 对匹配 Namespace 的集合脱敏，Roles 为空时对所有客户端生效
+type MaskRule struct {
+	Namespace string
+	Roles     []string
+	Fields    []MaskField
+}
+
+// RoleResolver 返回客户端的角色
+type RoleResolver interface {
+	Roles(id *api.Identity) []string
+}
+
+// RoleMap 用户名到角色列表的映射
+type RoleMap map[string][]string
+
+func (p RoleMap) Roles(id *api.Identity) []string {
+	return p[id.User]
+}
+
+// Masker 对查询结果中的字段脱敏，并拒绝按脱敏字段过滤或排序的请求以防止推断原值。
+// 同时通过 Use 与 UseResponse 注册在客户端连接上
+type Masker struct {
+	Rules    []MaskRule
+	Resolver RoleResolver
+	// Key 用于 MaskHash 与 MaskTokenize 的 HMAC 密钥
+	Key []byte
+}
+
+func NewMasker(resolver RoleResolver, key []byte) *Masker {
+	return &Masker{Resolver: resolver, Key: key}
+}
+
+// Mask 追加脱敏规则
+func (p *Masker) Mask(namespace string, roles []string, fields ...MaskField) *Masker {
+	p.Rules = append(p.Rules, MaskRule{Namespace: namespace, Roles: roles, Fields: fields})
+	return p
+}
+
+// fields 返回当前客户端在命名空间上需要脱敏的字段。saslStart 中声明的用户未经后端确认，
+// 身份未确认时按限制最多的角色处理，所有规则都生效
+func (p *Masker) fields(ctx api.Context, ns string) []MaskField {
+	id := ctx.Identity()
+	verified := id != nil && id.Verified
+	var roles []string
+	if verified && p.Resolver != nil {
+		roles = p.Resolver.Roles(id)
+	}
+	var out []MaskField
+	for _, rule := range p.Rules {
+		if !matchAny([]string{rule.Namespace}, ns) {
+			continue
+		}
+		if verified && len(rule.Roles) > 0 && !intersects(rule.Roles, roles) {
+			continue
+		}
+		out = append(out, rule.Fields...)
+	}
+	return out
+}
+
+func (p *Masker) Handle(ctx api.Context, req protocol.Message) error {
+	r := describe(req)
+	if r == nil {
+		return nil
+	}
+	var stages []protocol.Pair
+	if cmd, ok := protocol.ParseCommand(req); ok && r.command == "aggregate" {
+		stages = pipelineStages(tools.LookupArray(cmd.Args, "pipeline"), nil)
+		// $lookup 等阶段读取的文档不经过脱敏，读取有脱敏字段的集合时直接拒绝
+		for _, it := range stages {
+			if coll := foreignCollection(it); coll != "" {
+				if ns := cmd.Database + "." + coll; len(p.fields(ctx, ns)) > 0 {
+					return deny(req, protocol.CodeUnauthorized, "Unauthorized", "collection %s has masked fields and cannot be read by %s", ns, it.Key)
+				}
+			}
+		}
+	}
+	fields := p.fields(ctx, r.namespace)
+	if len(fields) == 0 {
+		return nil
+	}
+	for _, it := range stages {
+		if maskUnsafeStages[it.Key] {
+			return deny(req, protocol.CodeUnauthorized, "Unauthorized", "%s is not allowed on collections with masked fields", it.Key)
+		}
+	}
+	for _, path := range referencedPaths(req) {
+		if f := coveredBy(fields, path); f != nil {
+			return deny(req, protocol.CodeUnauthorized, "Unauthorized", "field %s is masked and cannot be used in filters, sorts or expressions", f.Path)
+		}
+	}
+	return nil
+}
+
+func (p *Masker) HandleResponse(ctx api.Context, req, reply protocol.Message) (protocol.Message, error) {
+	r := describe(req)
+	if r == nil {
+		return reply, nil
+	}
+	fields := p.fields(ctx, r.namespace)
+	if len(fields) == 0 {
+		return reply, nil
+	}
+	if v, ok := reply.(*protocol.OpReply); ok {
+		if _, isCmd := protocol.ParseCommand(req); !isCmd {
+			for i, doc := range v.Documents {
+				v.Documents[i] = p.maskDocument(doc, fields)
+			}
+			return reply, nil
+		}
+	}
+	doc, ok := protocol.ReplyDocument(reply)
+	if !ok {
+		return reply, nil
+	}
+	cursor := subDocument(doc, "cursor")
+	if cursor == nil {
+		// findAndModify 返回的文档在 value 字段中
+		if value := subDocument(doc, "value"); value != nil {
+			protocol.SetReplyDocument(reply, protocol.Store(doc, "value", p.maskDocument(value, fields)))
+		}
+		return reply, nil
+	}
+	for _, key := range []string{"firstBatch", "nextBatch"} {
+		batch := tools.LookupArray(cursor, key)
+		if batch == nil {
+			continue
+		}
+		out := make(bson.Array, 0, len(batch))
+		for _, it := range batch {
+			if d, ok := tools.AsDocument(it); ok {
+				it = p.maskDocument(d, fields)
+			}
+			out = append(out, it)
+		}
+		cursor = protocol.Store(cursor, key, out)
+	}
+	protocol.SetReplyDocument(reply, protocol.Store(doc, "cursor", cursor))
+	return reply, nil
+}
+
+func (p *Masker) maskDocument(doc protocol.Document, fields []MaskField) protocol.Document {
+	var v interface{} = doc
+	for _, f := range fields {
+		f := f
+		v = maskPath(v, strings.Split(f.Path, "."), func(val interface{}) interface{} {
+			return p.apply(f, val)
+		})
+	}
+	out, _ := tools.AsDocument(v)
+	return out
+}
+
+func (p *Masker) apply(f MaskField, v interface{}) interface{} {
+	switch f.Method {
+	case MaskHash:
+		return hex.EncodeToString(p.digest(v))
+	case MaskTruncate:
+		s, ok := tools.String(v)
+		if !ok {
+			return redacted
+		}
+		rs := []rune(s)
+		if len(rs) <= f.Keep {
+			return s
+		}
+		return string(rs[:f.Keep]) + strings.Repeat("*", len(rs)-f.Keep)
+	case MaskTokenize:
+		return "tok_" + base64.RawURLEncoding.EncodeToString(p.digest(v)[:12])
+	}
+	return redacted
+}
+
+func (p *Masker) digest(v interface{}) []byte {
+	mac := hmac.New(sha256.New, p.Key)
+	if s, ok := tools.String(v); ok {
+		fmt.Fprintf(mac, "string:%s", s)
+	} else {
+		fmt.Fprintf(mac, "%T:%v", v, v)
+	}
+	return mac.Sum(nil)
+}
+
+// maskPath 沿路径替换字段的值，路径经过数组时对每个元素递归
+func maskPath(v interface{}, parts []string, fn func(interface{}) interface{}) interface{} {
+	if len(parts) == 0 {
+		return fn(v)
+	}
+	switch d := v.(type) {
+	case protocol.Document:
+		out := make(protocol.Document, 0, len(d))
+		for _, it := range d {
+			if it.Key == parts[0] {
+				it.Val = maskPath(it.Val, parts[1:], fn)
+			}
+			out = append(out, it)
+		}
+		return out
+	case bson.Map:
+		if val, ok := d[parts[0]]; ok {
+			d[parts[0]] = maskPath(val, parts[1:], fn)
+		}
+		return d
+	case bson.Array:
+		out := make(bson.Array, 0, len(d))
+		for _, it := range d {
+			out = append(out, maskPath(it, parts, fn))
+		}
+		return out
+	}
+	return v
+}
+
+// coveredBy 路径与脱敏字段相同、是其父路径或子路径时都可能泄露原值，空路径表示整个文档
+func coveredBy(fields []MaskField, path string) *MaskField {
+	for i, f := range fields {
+		if path == "" || path == f.Path || strings.HasPrefix(path, f.Path+".") || strings.HasPrefix(f.Path, path+".") {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// referencedPaths 收集请求在过滤条件、排序、投影与聚合表达式中引用的字段路径
+func referencedPaths(msg protocol.Message) []string {
+	var out []string
+	if cmd, ok := protocol.ParseCommand(msg); ok {
+		for _, key := range []string{"filter", "query"} {
+			if d := subDocument(cmd.Args, key); d != nil {
+				out = filterPaths(d, "", out)
+			}
+		}
+		if sort := subDocument(cmd.Args, "sort"); sort != nil {
+			for _, it := range sort {
+				out = append(out, it.Key)
+			}
+		}
+		// 投影与管道更新中的 $字段 表达式可以把脱敏字段换个名字返回
+		for _, key := range []string{"projection", "fields"} {
+			if d := subDocument(cmd.Args, key); d != nil {
+				out = expressionPaths(d, out)
+			}
+		}
+		switch strings.ToLower(cmd.Name) {
+		case "findandmodify":
+			v, _ := protocol.Load(cmd.Args, "update")
+			if pipeline, ok := v.(bson.Array); ok {
+				out = expressionPaths(pipeline, out)
+			}
+		case "distinct":
+			v, _ := protocol.Load(cmd.Args, "key")
+			if key, ok := tools.String(v); ok {
+				out = append(out, key)
+			}
+		case "aggregate":
+			for _, s := range pipelineStages(tools.LookupArray(cmd.Args, "pipeline"), nil) {
+				spec, _ := tools.AsDocument(s.Val)
+				switch s.Key {
+				case "$match":
+					out = filterPaths(spec, "", out)
+				case "$sort":
+					for _, k := range spec {
+						out = append(out, k.Key)
+					}
+				}
+				out = expressionPaths(s.Val, out)
+			}
+		}
+		for _, key := range []string{"updates", "deletes"} {
+			for _, it := range tools.LookupArray(cmd.Args, key) {
+				stmt, _ := tools.AsDocument(it)
+				if q := subDocument(stmt, "q"); q != nil {
+					out = filterPaths(q, "", out)
+				}
+				v, _ := protocol.Load(stmt, "u")
+				if pipeline, ok := v.(bson.Array); ok {
+					out = expressionPaths(pipeline, out)
+				}
+			}
+		}
+		return out
+	}
+	switch v := msg.(type) {
+	case *protocol.OpQuery:
+		filter := v.Query
+		if q := tools.LookupDocument(v.Query, "$query"); q != nil {
+			filter = q
+			for _, it := range tools.LookupDocument(v.Query, "$orderby") {
+				out = append(out, it.Key)
+			}
+		}
+		out = filterPaths(filter, "", out)
+		out = expressionPaths(v.ReturnFieldsSelector, out)
+	case *protocol.OpUpdate:
+		out = filterPaths(v.Selector, "", out)
+	case *protocol.OpDelete:
+		out = filterPaths(v.Selector, "", out)
+	}
+	return out
+}
+
+// filterPaths 收集查询条件中的字段路径，$and/$or/$elemMatch 等会递归展开
+func filterPaths(filter protocol.Document, prefix string, out []string) []string {
+	for _, it := range filter {
+		if strings.HasPrefix(it.Key, "$") {
+			if it.Key == "$expr" || it.Key == "$where" {
+				out = expressionPaths(it.Val, out)
+				continue
+			}
+			switch v := it.Val.(type) {
+			case bson.Array:
+				for _, sub := range v {
+					if d, ok := tools.AsDocument(sub); ok {
+						out = filterPaths(d, prefix, out)
+					}
+				}
+			default:
+				if d, ok := tools.AsDocument(v); ok {
+					out = filterPaths(d, prefix, out)
+				}
+			}
+			continue
+		}
+		path := prefix + it.Key
+		out = append(out, path)
+		if d, ok := tools.AsDocument(it.Val); ok {
+			if elem := subDocument(d, "$elemMatch"); elem != nil {
+				out = filterPaths(elem, path+".", out)
+			}
+		}
+	}
+	return out
+}
+
+// expressionPaths 收集聚合表达式中以 $ 开头的字段引用。$$ROOT 与 $$CURRENT 引用整个文档，
+// 记为空路径或其后的字段路径，其他 $$ 开头的变量除外
+func expressionPaths(v interface{}, out []string) []string {
+	if s, ok := tools.String(v); ok {
+		switch {
+		case strings.HasPrefix(s, "$$"):
+			name, path, _ := strings.Cut(s[2:], ".")
+			if name == "ROOT" || name == "CURRENT" {
+				out = append(out, path)
+			}
+		case strings.HasPrefix(s, "$"):
+			out = append(out, s[1:])
+		}
+		return out
+	}
+	if d, ok := tools.AsDocument(v); ok {
+		for _, it := range d {
+			out = expressionPaths(it.Val, out)
+		}
+		return out
+	}
+	if arr, ok := v.(bson.Array); ok {
+		for _, it := range arr {
+			out = expressionPaths(it, out)
+		}
+	}
+	return out
+}
+
+// maskUnsafeStages 在有脱敏字段的集合上不允许的聚合阶段：关联其他集合时 localField 等
+// 普通字段名无法与表达式区分，$out 与 $merge 会把未脱敏的文档写入其他集合
+var maskUnsafeStages = map[string]bool{
+	"$lookup":      true,
+	"$graphLookup": true,
+	"$unionWith":   true,
+	"$out":         true,
+	"$merge":       true,
+}
+
+// pipelineStages 展开聚合管道中的所有阶段，包括 $facet、$lookup 与 $unionWith 中的子管道
+func pipelineStages(pipeline bson.Array, out []protocol.Pair) []protocol.Pair {
+	for _, it := range pipeline {
+		stage, _ := tools.AsDocument(it)
+		for _, s := range stage {
+			out = append(out, s)
+			spec, _ := tools.AsDocument(s.Val)
+			switch s.Key {
+			case "$facet":
+				for _, sub := range spec {
+					if arr, ok := sub.Val.(bson.Array); ok {
+						out = pipelineStages(arr, out)
+					}
+				}
+			case "$lookup", "$unionWith":
+				out = pipelineStages(tools.LookupArray(spec, "pipeline"), out)
+			}
+		}
+	}
+	return out
+}
+
+// foreignCollection 返回 $lookup、$graphLookup 与 $unionWith 读取的集合
+func foreignCollection(stage protocol.Pair) string {
+	key := "from"
+	switch stage.Key {
+	case "$lookup", "$graphLookup":
+	case "$unionWith":
+		if coll, ok := tools.String(stage.Val); ok {
+			return coll
+		}
+		key = "coll"
+	default:
+		return ""
+	}
+	spec, _ := tools.AsDocument(stage.Val)
+	v, _ := protocol.Load(spec, key)
+	coll, _ := tools.String(v)
+	return coll
+}
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaskDocument(t *testing.T) {
+	m := NewMasker(RoleMap{}, []byte("secret"))
+	fields := []MaskField{
+		{Path: "ssn", Method: MaskRedact},
+		{Path: "phone", Method: MaskTruncate, Keep: 3},
+		{Path: "contacts.email", Method: MaskTokenize},
+	}
+	doc := m.maskDocument(protocol.Document{
+		{Key: "name", Val: "tom"},
+		{Key: "ssn", Val: "123-45-6789"},
+		{Key: "phone", Val: "13800138000"},
+		{Key: "contacts", Val: bson.Array{
+			bson.Map{"email": "a@example.com"},
+			bson.Map{"email": "a@example.com"},
+		}},
+	}, fields)
+	name, _ := protocol.Load(doc, "name")
+	ssn, _ := protocol.Load(doc, "ssn")
+	phone, _ := protocol.Load(doc, "phone")
+	assert.Equal(t, "tom", name)
+	assert.Equal(t, redacted, ssn)
+	assert.Equal(t, "138********", phone)
+	contacts := tools.LookupArray(doc, "contacts")
+	e1, _ := tools.Lookup(doc, "contacts.0.email")
+	e2 := contacts[1].(bson.Map)["email"]
+	assert.NotEqual(t, "a@example.com", e1)
+	assert.Equal(t, e1, e2)
+}
+
+func TestReferencedPaths(t *testing.T) {
+	msg := protocol.NewOpMessage()
+	msg.Body = protocol.Document{
+		{Key: "find", Val: "users"},
+		{Key: "filter", Val: protocol.Document{
+			{Key: "$or", Val: bson.Array{
+				protocol.Document{{Key: "name", Val: "tom"}},
+				protocol.Document{{Key: "contacts", Val: protocol.Document{
+					{Key: "$elemMatch", Val: protocol.Document{{Key: "email", Val: "x"}}},
+				}}},
+			}},
+		}},
+		{Key: "sort", Val: protocol.Document{{Key: "age", Val: int32(1)}}},
+		{Key: "$db", Val: "crm"},
+	}
+	paths := referencedPaths(msg)
+	assert.ElementsMatch(t, []string{"name", "contacts", "contacts.email", "age"}, paths)
+	fields := []MaskField{{Path: "contacts.email"}}
+	assert.NotNil(t, coveredBy(fields, "contacts"))
+	assert.Nil(t, coveredBy(fields, "name"))
+}
+
+func TestMasker_Fields(t *testing.T) {
+	m := NewMasker(RoleMap{"alice": {"analyst"}, "bob": {"admin"}}, nil).
+		Mask("crm.users", []string{"analyst"}, MaskField{Path: "ssn"})
+	assert.Len(t, m.fields(&testContext{id: &api.Identity{User: "alice", Verified: true}}, "crm.users"), 1)
+	assert.Empty(t, m.fields(&testContext{id: &api.Identity{User: "bob", Verified: true}}, "crm.users"))
+	// 未完成认证时声明的用户不能摆脱脱敏
+	assert.Len(t, m.fields(&testContext{id: &api.Identity{User: "bob"}}, "crm.users"), 1)
+	assert.Len(t, m.fields(&testContext{}, "crm.users"), 1)
+}
+
+func TestReferencedPaths_Projection(t *testing.T) {
+	// 投影中的 $ssn 会以新的字段名返回原值
+	msg := protocol.NewOpMessage()
+	msg.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 1}
+	msg.Body = protocol.Document{
+		{Key: "find", Val: "users"},
+		{Key: "projection", Val: protocol.Document{{Key: "leak", Val: "$ssn"}, {Key: "name", Val: int32(1)}}},
+		{Key: "$db", Val: "crm"},
+	}
+	assert.Equal(t, []string{"ssn"}, referencedPaths(msg))
+
+	msg.Body = protocol.Document{
+		{Key: "findAndModify", Val: "users"},
+		{Key: "query", Val: protocol.Document{{Key: "name", Val: "tom"}}},
+		{Key: "fields", Val: protocol.Document{{Key: "a", Val: protocol.Document{{Key: "$concat", Val: bson.Array{"$phone", "-"}}}}}},
+		{Key: "update", Val: bson.Array{protocol.Document{{Key: "$set", Val: protocol.Document{{Key: "leak", Val: "$ssn"}}}}}},
+		{Key: "new", Val: true},
+		{Key: "$db", Val: "crm"},
+	}
+	assert.ElementsMatch(t, []string{"name", "phone", "ssn"}, referencedPaths(msg))
+
+	m := NewMasker(RoleMap{}, nil).Mask("crm.users", nil, MaskField{Path: "ssn"})
+	assert.IsType(t, &api.Response{}, m.Handle(&testContext{}, msg))
+}
+
+func TestMasker_Pipeline(t *testing.T) {
+	m := NewMasker(RoleMap{}, nil).Mask("crm.users", nil, MaskField{Path: "ssn"})
+	ctx := &testContext{}
+	aggregate := func(coll string, stages ...protocol.Document) *protocol.OpMessage {
+		pipeline := make(bson.Array, 0, len(stages))
+		for _, it := range stages {
+			pipeline = append(pipeline, it)
+		}
+		return command("crm",
+			protocol.Pair{Key: "aggregate", Val: bson.String(coll)},
+			protocol.Pair{Key: "pipeline", Val: pipeline},
+		)
+	}
+	stage := func(name string, spec interface{}) protocol.Document {
+		return protocol.Document{{Key: name, Val: spec}}
+	}
+	allowed := aggregate("users", stage("$match", protocol.Document{{Key: "name", Val: "tom"}}))
+	assert.NoError(t, m.Handle(ctx, allowed))
+
+	for name, req := range map[string]*protocol.OpMessage{
+		// 从未脱敏的集合关联读取脱敏的集合
+		"lookup": aggregate("orders", stage("$lookup", protocol.Document{
+			{Key: "from", Val: "users"}, {Key: "localField", Val: "uid"}, {Key: "foreignField", Val: "_id"}, {Key: "as", Val: "u"},
+		})),
+		"unionWith": aggregate("orders", stage("$unionWith", "users")),
+		"unionWith in facet": aggregate("orders", stage("$facet", protocol.Document{
+			{Key: "all", Val: bson.Array{stage("$unionWith", protocol.Document{{Key: "coll", Val: "users"}})}},
+		})),
+		"graphLookup": aggregate("orders", stage("$graphLookup", protocol.Document{
+			{Key: "from", Val: "users"}, {Key: "startWith", Val: "$uid"}, {Key: "connectFromField", Val: "ref"},
+			{Key: "connectToField", Val: "_id"}, {Key: "as", Val: "u"},
+		})),
+		// 脱敏集合上的 localField 是普通字段名，同样拒绝关联
+		"lookup from masked": aggregate("users", stage("$lookup", protocol.Document{
+			{Key: "from", Val: "orders"}, {Key: "localField", Val: "ssn"}, {Key: "foreignField", Val: "ssn"}, {Key: "as", Val: "o"},
+		})),
+		// $$ROOT 与 $$CURRENT 把整个文档换个名字返回
+		"replaceRoot": aggregate("users", stage("$replaceRoot", protocol.Document{
+			{Key: "newRoot", Val: protocol.Document{{Key: "copy", Val: "$$ROOT"}}},
+		})),
+		"project": aggregate("users", stage("$project", protocol.Document{{Key: "leak", Val: "$$CURRENT.ssn"}})),
+		"group": aggregate("users", stage("$group", protocol.Document{
+			{Key: "_id", Val: nil}, {Key: "docs", Val: protocol.Document{{Key: "$push", Val: "$$ROOT"}}},
+		})),
+		// 写入其他集合的文档不经过脱敏
+		"out":   aggregate("users", stage("$out", "copy")),
+		"merge": aggregate("users", stage("$merge", protocol.Document{{Key: "into", Val: "copy"}})),
+	} {
+		assert.IsType(t, &api.Response{}, m.Handle(ctx, req), name)
+	}
+
+	// 没有脱敏字段的集合之间可以关联，$$ROOT 也不受限制
+	assert.NoError(t, m.Handle(ctx, aggregate("orders",
+		stage("$lookup", protocol.Document{{Key: "from", Val: "items"}, {Key: "localField", Val: "sku"}, {Key: "foreignField", Val: "_id"}, {Key: "as", Val: "i"}}),
+		stage("$replaceRoot", protocol.Document{{Key: "newRoot", Val: protocol.Document{{Key: "copy", Val: "$$ROOT"}}}}),
+	)))
+}
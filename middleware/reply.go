@@ -0,0 +1,17 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+)
+
+// deny 以命令错误拒绝请求，由 implContext 直接应答客户端，没有响应的旧版写操作只会被丢弃
+func deny(req protocol.Message, code int32, codeName string, format string, args ...interface{}) error {
+	return api.Reject(req, &protocol.CommandError{
+		Code:     code,
+		CodeName: codeName,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
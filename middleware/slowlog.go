@@ -0,0 +1,251 @@
+package middleware
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+)
+
+const (
+	// 每个形状保留最近的耗时样本用于计算分位数
+	slowSamples = 512
+	// 最多统计的形状数量，超出后新形状只计入 Overflow
+	maxShapes = 1000
+)
+
+// QueryShape 查询形状，过滤条件中的字面值被替换为 "?"，排序保留方向，投影只保留字段名
+type QueryShape struct {
+	Namespace  string
+	Command    string
+	Filter     string
+	Sort       string
+	Projection string
+}
+
+func (p QueryShape) String() string {
+	var b strings.Builder
+	b.WriteString(p.Command)
+	b.WriteByte(' ')
+	b.WriteString(p.Namespace)
+	if p.Filter != "" {
+		b.WriteString(" filter=")
+		b.WriteString(p.Filter)
+	}
+	if p.Sort != "" {
+		b.WriteString(" sort=")
+		b.WriteString(p.Sort)
+	}
+	if p.Projection != "" {
+		b.WriteString(" projection=")
+		b.WriteString(p.Projection)
+	}
+	return b.String()
+}
+
+// ShapeOf 计算请求的查询形状
+func ShapeOf(req protocol.Message) (QueryShape, bool) {
+	op, ns, ok := protocol.Operation(req)
+	if !ok {
+		return QueryShape{}, false
+	}
+	shape := QueryShape{Namespace: ns, Command: op}
+	if filter, ok := protocol.Filter(req); ok {
+		shape.Filter = tools.Shape(filter)
+	}
+	var sortDoc, projection protocol.Document
+	if cmd, ok := protocol.ParseCommand(req); ok {
+		sortDoc = subDocument(cmd.Args, "sort")
+		projection = subDocument(cmd.Args, "projection")
+		if projection == nil {
+			projection = subDocument(cmd.Args, "fields")
+		}
+	} else if q, ok := req.(*protocol.OpQuery); ok {
+		sortDoc = tools.LookupDocument(q.Query, "$orderby")
+		projection = q.ReturnFieldsSelector
+	}
+	shape.Sort = sortShape(sortDoc)
+	shape.Projection = fieldsShape(projection)
+	return shape, true
+}
+
+func sortShape(doc protocol.Document) string {
+	if len(doc) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(doc))
+	for _, it := range doc {
+		dir := "1"
+		if n, ok := tools.Number(it.Val); !ok {
+			dir = `"?"`
+		} else if n < 0 {
+			dir = "-1"
+		}
+		parts = append(parts, strconv.Quote(it.Key)+":"+dir)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func fieldsShape(doc protocol.Document) string {
+	if len(doc) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(doc))
+	for _, it := range doc {
+		keys = append(keys, strconv.Quote(it.Key))
+	}
+	return "[" + strings.Join(keys, ",") + "]"
+}
+
+// ShapeStats 一个查询形状的慢查询统计
+type ShapeStats struct {
+	Shape QueryShape
+	Count int64
+	Total time.Duration
+	Max   time.Duration
+	P50   time.Duration
+	P99   time.Duration
+}
+
+type shapeStats struct {
+	count   int64
+	total   time.Duration
+	max     time.Duration
+	samples []time.Duration
+	next    int
+}
+
+func (p *shapeStats) add(d time.Duration) {
+	p.count++
+	p.total += d
+	if d > p.max {
+		p.max = d
+	}
+	if len(p.samples) < slowSamples {
+		p.samples = append(p.samples, d)
+		return
+	}
+	p.samples[p.next] = d
+	p.next = (p.next + 1) % slowSamples
+}
+
+// SlowLog 按查询形状汇总耗时超过 Threshold 的请求的次数与分位数，所有客户端连接共享
+type SlowLog struct {
+	Threshold time.Duration
+	// Overflow 形状数量超过上限后未被统计的慢查询次数
+	Overflow int64
+
+	mu     sync.Mutex
+	shapes map[QueryShape]*shapeStats
+}
+
+func NewSlowLog(threshold time.Duration) *SlowLog {
+	return &SlowLog{
+		Threshold: threshold,
+		shapes:    make(map[QueryShape]*shapeStats),
+	}
+}
+
+// SlowTimer 记录请求的耗时并交给共享的 SlowLog，需要同时通过 Use 与 UseResponse 注册在客户端连接上。
+// 每个客户端连接使用独立的实例，连接关闭后尚未收到响应的请求随实例一起释放
+type SlowTimer struct {
+	log     *SlowLog
+	mu      sync.Mutex
+	pending map[protocol.Message]time.Time
+}
+
+func NewSlowTimer(log *SlowLog) *SlowTimer {
+	return &SlowTimer{log: log, pending: make(map[protocol.Message]time.Time)}
+}
+
+func (p *SlowTimer) Handle(ctx api.Context, req protocol.Message) error {
+	if protocol.ExpectsReply(req) {
+		p.mu.Lock()
+		p.pending[req] = time.Now()
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+func (p *SlowTimer) HandleResponse(ctx api.Context, req, reply protocol.Message) (protocol.Message, error) {
+	p.mu.Lock()
+	start, ok := p.pending[req]
+	delete(p.pending, req)
+	p.mu.Unlock()
+	if !ok {
+		return reply, nil
+	}
+	if elapsed := time.Since(start); elapsed >= p.log.Threshold {
+		if shape, ok := ShapeOf(req); ok {
+			ctx.Logger().Warn("slow query", "elapsed", elapsed, "shape", shape.String())
+		}
+		p.log.Observe(req, elapsed)
+	}
+	return reply, nil
+}
+
+// Observe 记录一次慢查询
+func (p *SlowLog) Observe(req protocol.Message, elapsed time.Duration) {
+	shape, ok := ShapeOf(req)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats, ok := p.shapes[shape]
+	if !ok {
+		if len(p.shapes) >= maxShapes {
+			p.Overflow++
+			return
+		}
+		stats = &shapeStats{}
+		p.shapes[shape] = stats
+	}
+	stats.add(elapsed)
+}
+
+// Report 返回各形状的统计，按总耗时降序
+func (p *SlowLog) Report() []ShapeStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]ShapeStats, 0, len(p.shapes))
+	for shape, it := range p.shapes {
+		samples := append([]time.Duration(nil), it.samples...)
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		out = append(out, ShapeStats{
+			Shape: shape,
+			Count: it.count,
+			Total: it.total,
+			Max:   it.max,
+			P50:   percentile(samples, 0.5),
+			P99:   percentile(samples, 0.99),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Total > out[j].Total })
+	return out
+}
+
+// Reset 清空统计
+func (p *SlowLog) Reset() {
+	p.mu.Lock()
+	p.shapes = make(map[QueryShape]*shapeStats)
+	p.Overflow = 0
+	p.mu.Unlock()
+}
+
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func findUsers(name string, age int32) *protocol.OpMessage {
+	return command("crm",
+		protocol.Pair{Key: "find", Val: bson.String("users")},
+		protocol.Pair{Key: "filter", Val: protocol.Document{
+			{Key: "name", Val: bson.String(name)},
+			{Key: "age", Val: protocol.Document{{Key: "$gt", Val: bson.Int32(age)}}},
+		}},
+		protocol.Pair{Key: "sort", Val: protocol.Document{{Key: "age", Val: bson.Int32(-1)}}},
+		protocol.Pair{Key: "projection", Val: protocol.Document{{Key: "name", Val: bson.Int32(1)}}},
+	)
+}
+
+func TestShapeOf(t *testing.T) {
+	// 字面值不同的请求得到相同的形状
+	a, ok := ShapeOf(findUsers("tom", 20))
+	assert.True(t, ok)
+	b, _ := ShapeOf(findUsers("jerry", 30))
+	assert.Equal(t, a, b)
+	assert.Equal(t, "find", a.Command)
+	assert.Equal(t, "crm.users", a.Namespace)
+	assert.NotContains(t, a.Filter, "tom")
+	assert.Equal(t, `{"age":-1}`, a.Sort)
+	assert.Equal(t, `["name"]`, a.Projection)
+	assert.Equal(t, "find crm.users filter="+a.Filter+` sort={"age":-1} projection=["name"]`, a.String())
+
+	c, _ := ShapeOf(command("crm",
+		protocol.Pair{Key: "find", Val: bson.String("users")},
+		protocol.Pair{Key: "filter", Val: protocol.Document{{Key: "name", Val: bson.String("tom")}}},
+	))
+	assert.NotEqual(t, a, c)
+}
+
+func TestSlowTimer(t *testing.T) {
+	log := NewSlowLog(time.Hour)
+	ctx := &testContext{}
+	timer := NewSlowTimer(log)
+	req := findUsers("tom", 20)
+	assert.NoError(t, timer.Handle(ctx, req))
+	_, err := timer.HandleResponse(ctx, req, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, log.Report())
+
+	// 超过阈值的请求计入共享的统计，未收到响应的请求只留在所在连接的实例中
+	log.Threshold = 0
+	other := NewSlowTimer(log)
+	assert.NoError(t, timer.Handle(ctx, req))
+	assert.NoError(t, other.Handle(ctx, findUsers("jerry", 30)))
+	_, err = timer.HandleResponse(ctx, req, nil)
+	assert.NoError(t, err)
+	report := log.Report()
+	if assert.Len(t, report, 1) {
+		assert.Equal(t, int64(1), report[0].Count)
+	}
+	assert.Empty(t, timer.pending)
+	assert.Len(t, other.pending, 1)
+}
+
+func TestSlowLog_Report(t *testing.T) {
+	log := NewSlowLog(0)
+	req := findUsers("tom", 20)
+	for i := 1; i <= 100; i++ {
+		log.Observe(req, time.Duration(i)*time.Millisecond)
+	}
+	report := log.Report()
+	if assert.Len(t, report, 1) {
+		assert.Equal(t, int64(100), report[0].Count)
+		assert.Equal(t, 100*time.Millisecond, report[0].Max)
+		assert.Equal(t, 5050*time.Millisecond, report[0].Total)
+		assert.Equal(t, 50*time.Millisecond, report[0].P50)
+		assert.Equal(t, 99*time.Millisecond, report[0].P99)
+	}
+
+	// 形状数量达到上限后新形状只计入 Overflow
+	log.Reset()
+	for i := 0; i < maxShapes+10; i++ {
+		log.Observe(command("crm", protocol.Pair{Key: "find", Val: bson.String("c" + strconv.Itoa(i))}), time.Millisecond)
+	}
+	assert.Len(t, log.Report(), maxShapes)
+	assert.Equal(t, int64(10), log.Overflow)
+	log.Observe(command("crm", protocol.Pair{Key: "find", Val: bson.String("c0")}), time.Millisecond)
+	assert.Equal(t, int64(10), log.Overflow)
+}
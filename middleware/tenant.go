@@ -0,0 +1,404 @@
+package middleware
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+)
+
+// 握手、认证与会话命令不做租户改写
+var tenantNeutralCommands = map[string]bool{
+	"hello":             true,
+	"ismaster":          true,
+	"ping":              true,
+	"buildinfo":         true,
+	"saslstart":         true,
+	"saslcontinue":      true,
+	"authenticate":      true,
+	"logout":            true,
+	"getnonce":          true,
+	"endsessions":       true,
+	"getlasterror":      true,
+	"whatsmyuri":        true,
+	"connectionstatus":  true,
+	"committransaction": true,
+	"aborttransaction":  true,
+}
+
+// 租户在系统库上只能执行的命令，命名空间参数和响应会被改写
+var tenantAdminCommands = map[string]bool{
+	"listdatabases":    true,
+	"renamecollection": true,
+}
+
+var systemDatabases = map[string]bool{
+	"admin":     true,
+	"local":     true,
+	"config":    true,
+	"$external": true,
+}
+
+// TenantResolver 根据客户端身份返回租户的库名前缀，如 "tenant42_"
+type TenantResolver interface {
+	Resolve(id *api.Identity) (prefix string, ok bool)
+}
+
+// TenantMap 用户名到租户 ID 的映射，前缀为 "<租户ID>_"。租户 ID 不能含有 _，
+// 否则租户 t 的库 1_app 与租户 t_1 的库 app 都会变成 t_1_app
+type TenantMap map[string]string
+
+func (p TenantMap) Resolve(id *api.Identity) (string, bool) {
+	tenant, ok := p[id.User]
+	if !ok || tenant == "" || strings.Contains(tenant, "_") {
+		return "", false
+	}
+	return tenant + "_", true
+}
+
+// TenantRewriter 按租户前缀改写库名，使每个租户只能看到自己的库：
+// 请求侧改写旧版操作的 FullCollectionName、命令的 $db 以及聚合阶段中的命名空间，
+// 响应侧还原游标 ns、过滤 listDatabases。租户只按后端确认过的身份选择，认证完成前拒绝访问命名空间。
+// 每个客户端连接使用独立的实例，同时通过 Use 与 UseResponse 注册在客户端连接上。
+type TenantRewriter struct {
+	resolver TenantResolver
+	prefix   atomic.Value
+}
+
+func NewTenantRewriter(resolver TenantResolver) *TenantRewriter {
+	return &TenantRewriter{resolver: resolver}
+}
+
+func (p *TenantRewriter) Handle(ctx api.Context, req protocol.Message) error {
+	prefix, ok := "", false
+	// saslStart 中声明的用户尚未认证，不能用来切换租户
+	if id := ctx.Identity(); id != nil && id.Verified {
+		prefix, ok = p.resolver.Resolve(id)
+	}
+	if ok {
+		p.prefix.Store(prefix)
+	}
+	if cmd, isCmd := protocol.ParseCommand(req); isCmd {
+		name := strings.ToLower(cmd.Name)
+		if tenantNeutralCommands[name] {
+			return nil
+		}
+		if !ok {
+			return deny(req, protocol.CodeUnauthorized, "Unauthorized", "command %s requires authentication", cmd.Name)
+		}
+		if systemDatabases[cmd.Database] && !tenantAdminCommands[name] {
+			return deny(req, protocol.CodeUnauthorized, "Unauthorized", "not authorized on %s to execute command %s", cmd.Database, cmd.Name)
+		}
+		if err := rewriteCommand(req, cmd, prefix); err != nil {
+			return deny(req, protocol.CodeUnauthorized, "Unauthorized", "%v", err)
+		}
+		return nil
+	}
+	ds, isNs := req.(protocol.DatabaseSupport)
+	if !isNs {
+		return nil
+	}
+	tbl, _ := ds.TableName()
+	if !ok || tbl == nil || systemDatabases[tbl.Database] {
+		return deny(req, protocol.CodeUnauthorized, "Unauthorized", "not authorized on namespace")
+	}
+	ns := prefix + tbl.String()
+	switch v := req.(type) {
+	case *protocol.OpQuery:
+		v.FullCollectionName = ns
+	case *protocol.OpInsert:
+		v.FullCollectionName = ns
+	case *protocol.OpUpdate:
+		v.FullCollectionName = ns
+	case *protocol.OpDelete:
+		v.FullCollectionName = ns
+	case *protocol.OpGetMore:
+		v.FullCollectionName = ns
+	}
+	return nil
+}
+
+// HandleResponse 还原响应中的库名，注册在客户端连接上
+func (p *TenantRewriter) HandleResponse(ctx api.Context, req, reply protocol.Message) (protocol.Message, error) {
+	prefix, _ := p.prefix.Load().(string)
+	if prefix == "" {
+		return reply, nil
+	}
+	cmd, ok := protocol.ParseCommand(req)
+	if !ok {
+		return reply, nil
+	}
+	if doc, ok := protocol.ReplyDocument(reply); ok {
+		protocol.SetReplyDocument(reply, restoreReply(doc, prefix, listing(cmd)))
+	}
+	return reply, nil
+}
+
+// listing 判断命令是否为 listDatabases、listCollections、listIndexes 或其后续的 getMore
+func listing(cmd *protocol.Command) string {
+	switch name := strings.ToLower(cmd.Name); name {
+	case "listdatabases", "listcollections", "listindexes":
+		return name
+	case "getmore":
+		if coll := cmd.Collection(); strings.HasPrefix(coll, "$cmd.list") {
+			return strings.ToLower(strings.TrimPrefix(coll, "$cmd."))
+		}
+	}
+	return ""
+}
+
+type errCrossTenant struct {
+	db string
+}
+
+func (p *errCrossTenant) Error() string {
+	return "not authorized to access database " + p.db
+}
+
+// rewriteCommand 改写命令所在的库以及参数中引用其他库的命名空间
+func rewriteCommand(req protocol.Message, cmd *protocol.Command, prefix string) error {
+	db := cmd.Database
+	if !systemDatabases[db] {
+		db = prefix + db
+	}
+	args := cmd.Args
+	var err error
+	switch strings.ToLower(cmd.Name) {
+	case "renamecollection":
+		for _, key := range []string{"renameCollection", "to"} {
+			v, _ := protocol.Load(args, key)
+			ns, _ := tools.String(v)
+			if ns, err = prefixNamespace(ns, prefix); err != nil {
+				return err
+			}
+			args = protocol.Store(args, key, ns)
+		}
+	case "aggregate":
+		if pipeline := bson.Array(tools.LookupArray(args, "pipeline")); pipeline != nil {
+			if pipeline, err = rewritePipeline(pipeline, prefix); err != nil {
+				return err
+			}
+			args = protocol.Store(args, "pipeline", pipeline)
+		}
+	case "mapreduce":
+		if out := subDocument(args, "out"); out != nil {
+			if out, err = prefixDatabaseField(out, "db", prefix); err != nil {
+				return err
+			}
+			args = protocol.Store(args, "out", out)
+		}
+	}
+	if _, ok := protocol.Load(args, "$db"); ok {
+		args = protocol.Store(args, "$db", db)
+	}
+	switch v := req.(type) {
+	case *protocol.OpQuery:
+		v.FullCollectionName = db + ".$cmd"
+	case *protocol.OpCommand:
+		v.Database = db
+	}
+	protocol.SetCommandArgs(req, args)
+	return nil
+}
+
+// rewritePipeline 改写 $lookup、$unionWith、$out、$merge、$facet 中的跨库引用
+func rewritePipeline(pipeline bson.Array, prefix string) (bson.Array, error) {
+	out := make(bson.Array, 0, len(pipeline))
+	for _, it := range pipeline {
+		stage, ok := tools.AsDocument(it)
+		if !ok || len(stage) == 0 {
+			out = append(out, it)
+			continue
+		}
+		name, spec := stage[0].Key, stage[0].Val
+		var err error
+		switch name {
+		case "$lookup", "$unionWith":
+			if doc, ok := tools.AsDocument(spec); ok {
+				if from := subDocument(doc, "from"); from != nil {
+					if from, err = prefixDatabaseField(from, "db", prefix); err != nil {
+						return nil, err
+					}
+					doc = protocol.Store(doc, "from", from)
+				}
+				if sub := bson.Array(tools.LookupArray(doc, "pipeline")); sub != nil {
+					if sub, err = rewritePipeline(sub, prefix); err != nil {
+						return nil, err
+					}
+					doc = protocol.Store(doc, "pipeline", sub)
+				}
+				spec = doc
+			}
+		case "$out":
+			if doc, ok := tools.AsDocument(spec); ok {
+				if spec, err = prefixDatabaseField(doc, "db", prefix); err != nil {
+					return nil, err
+				}
+			}
+		case "$merge":
+			if doc, ok := tools.AsDocument(spec); ok {
+				if into := subDocument(doc, "into"); into != nil {
+					if into, err = prefixDatabaseField(into, "db", prefix); err != nil {
+						return nil, err
+					}
+					spec = protocol.Store(doc, "into", into)
+				}
+			}
+		case "$facet":
+			if doc, ok := tools.AsDocument(spec); ok {
+				facets := make(protocol.Document, 0, len(doc))
+				for _, f := range doc {
+					sub, _ := f.Val.(bson.Array)
+					if sub, err = rewritePipeline(sub, prefix); err != nil {
+						return nil, err
+					}
+					facets = append(facets, protocol.Pair{Key: f.Key, Val: sub})
+				}
+				spec = facets
+			}
+		}
+		out = append(out, protocol.Document{{Key: name, Val: spec}})
+	}
+	return out, nil
+}
+
+// subDocument 数组中的文档会被解码为 bson.Map，统一转换为 Document
+func subDocument(doc protocol.Document, key string) protocol.Document {
+	v, _ := protocol.Load(doc, key)
+	d, _ := tools.AsDocument(v)
+	return d
+}
+
+func prefixDatabaseField(doc protocol.Document, key, prefix string) (protocol.Document, error) {
+	v, ok := protocol.Load(doc, key)
+	if !ok {
+		return doc, nil
+	}
+	db, _ := tools.String(v)
+	if systemDatabases[db] {
+		return nil, &errCrossTenant{db}
+	}
+	return protocol.Store(doc, key, prefix+db), nil
+}
+
+func prefixNamespace(ns, prefix string) (string, error) {
+	tbl, ok := protocol.ParseTableName(ns)
+	if !ok {
+		return ns, nil
+	}
+	if systemDatabases[tbl.Database] {
+		return "", &errCrossTenant{tbl.Database}
+	}
+	return prefix + ns, nil
+}
+
+// restoreReply 去掉响应中的租户前缀，listDatabases 只保留当前租户的库
+func restoreReply(doc protocol.Document, prefix, list string) protocol.Document {
+	out := make(protocol.Document, 0, len(doc))
+	for _, it := range doc {
+		switch it.Key {
+		case "cursor":
+			if cursor, ok := tools.AsDocument(it.Val); ok {
+				it.Val = restoreCursor(cursor, prefix, list != "")
+			}
+		case "databases":
+			if arr, ok := it.Val.(bson.Array); ok && list == "listdatabases" {
+				it.Val = restoreDatabases(arr, prefix)
+			}
+		case "errmsg":
+			if s, ok := tools.String(it.Val); ok {
+				it.Val = strings.ReplaceAll(s, prefix, "")
+			}
+		case "writeErrors":
+			if arr, ok := it.Val.(bson.Array); ok {
+				errs := make(bson.Array, 0, len(arr))
+				for _, e := range arr {
+					if d, ok := tools.AsDocument(e); ok {
+						e = restoreReply(d, prefix, "")
+					}
+					errs = append(errs, e)
+				}
+				it.Val = errs
+			}
+		}
+		out = append(out, it)
+	}
+	// totalSize 只统计当前租户的库
+	if dbs := tools.LookupArray(out, "databases"); dbs != nil && list == "listdatabases" {
+		if _, ok := protocol.Load(out, "totalSize"); ok {
+			var total float64
+			for _, it := range dbs {
+				d, _ := tools.AsDocument(it)
+				v, _ := protocol.Load(d, "sizeOnDisk")
+				n, _ := tools.Number(v)
+				total += n
+			}
+			out = protocol.Store(out, "totalSize", total)
+		}
+	}
+	return out
+}
+
+func restoreCursor(cursor protocol.Document, prefix string, listing bool) protocol.Document {
+	v, _ := protocol.Load(cursor, "ns")
+	ns, _ := tools.String(v)
+	if !strings.HasPrefix(ns, prefix) {
+		return cursor
+	}
+	cursor = protocol.Store(cursor, "ns", strings.TrimPrefix(ns, prefix))
+	// listIndexes 与 listCollections 的结果中包含完整命名空间
+	if !listing {
+		return cursor
+	}
+	for _, key := range []string{"firstBatch", "nextBatch"} {
+		batch := tools.LookupArray(cursor, key)
+		if batch == nil {
+			continue
+		}
+		out := make(bson.Array, 0, len(batch))
+		for _, it := range batch {
+			if d, ok := tools.AsDocument(it); ok {
+				d = trimNamespaceField(d, "ns", prefix)
+				if idIndex := subDocument(d, "idIndex"); idIndex != nil {
+					d = protocol.Store(d, "idIndex", trimNamespaceField(idIndex, "ns", prefix))
+				}
+				it = d
+			}
+			out = append(out, it)
+		}
+		cursor = protocol.Store(cursor, key, out)
+	}
+	return cursor
+}
+
+func restoreDatabases(dbs bson.Array, prefix string) bson.Array {
+	out := make(bson.Array, 0, len(dbs))
+	for _, it := range dbs {
+		d, ok := tools.AsDocument(it)
+		if !ok {
+			continue
+		}
+		v, _ := protocol.Load(d, "name")
+		name, _ := tools.String(v)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		out = append(out, protocol.Store(d, "name", strings.TrimPrefix(name, prefix)))
+	}
+	return out
+}
+
+func trimNamespaceField(doc protocol.Document, key, prefix string) protocol.Document {
+	v, ok := protocol.Load(doc, key)
+	if !ok {
+		return doc
+	}
+	s, _ := tools.String(v)
+	if !strings.HasPrefix(s, prefix) {
+		return doc
+	}
+	return protocol.Store(doc, key, strings.TrimPrefix(s, prefix))
+}
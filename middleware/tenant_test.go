@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteCommand(t *testing.T) {
+	msg := protocol.NewOpMessage()
+	msg.Body = protocol.Document{
+		{Key: "aggregate", Val: "orders"},
+		{Key: "pipeline", Val: bson.Array{
+			protocol.Document{{Key: "$out", Val: protocol.Document{
+				{Key: "db", Val: "reports"},
+				{Key: "coll", Val: "daily"},
+			}}},
+		}},
+		{Key: "$db", Val: "shop"},
+	}
+	cmd, ok := protocol.ParseCommand(msg)
+	assert.True(t, ok)
+	assert.NoError(t, rewriteCommand(msg, cmd, "t1_"))
+	db, _ := protocol.Load(msg.Body, "$db")
+	assert.Equal(t, "t1_shop", db)
+	stage, _ := tools.AsDocument(tools.LookupArray(msg.Body, "pipeline")[0])
+	out, _ := protocol.Load(subDocument(stage, "$out"), "db")
+	assert.Equal(t, "t1_reports", out)
+
+	msg.Body = protocol.Document{
+		{Key: "aggregate", Val: "orders"},
+		{Key: "pipeline", Val: bson.Array{
+			protocol.Document{{Key: "$merge", Val: protocol.Document{
+				{Key: "into", Val: protocol.Document{{Key: "db", Val: "admin"}, {Key: "coll", Val: "x"}}},
+			}}},
+		}},
+		{Key: "$db", Val: "shop"},
+	}
+	cmd, _ = protocol.ParseCommand(msg)
+	assert.Error(t, rewriteCommand(msg, cmd, "t1_"))
+}
+
+func TestRestoreReply(t *testing.T) {
+	doc := restoreReply(protocol.Document{
+		{Key: "databases", Val: bson.Array{
+			protocol.Document{{Key: "name", Val: "t1_shop"}, {Key: "sizeOnDisk", Val: bson.Int64(10)}},
+			protocol.Document{{Key: "name", Val: "t2_shop"}, {Key: "sizeOnDisk", Val: bson.Int64(20)}},
+		}},
+		{Key: "totalSize", Val: bson.Int64(30)},
+		{Key: "ok", Val: float64(1)},
+	}, "t1_", "listdatabases")
+	dbs := tools.LookupArray(doc, "databases")
+	assert.Len(t, dbs, 1)
+	name, _ := protocol.Load(dbs[0].(protocol.Document), "name")
+	assert.Equal(t, "shop", name)
+	assert.Equal(t, float64(10), tools.LookupFloat64(doc, "totalSize"))
+
+	doc = restoreReply(protocol.Document{
+		{Key: "cursor", Val: protocol.Document{
+			{Key: "firstBatch", Val: bson.Array{}},
+			{Key: "id", Val: bson.Int64(0)},
+			{Key: "ns", Val: "t1_shop.orders"},
+		}},
+	}, "t1_", "")
+	ns, _ := protocol.Load(tools.LookupDocument(doc, "cursor"), "ns")
+	assert.Equal(t, "shop.orders", ns)
+}
+
+// testContext 只实现中间件用到的方法
+type testContext struct {
+	api.Context
+	id *api.Identity
+}
+
+func (p *testContext) Identity() *api.Identity {
+	return p.id
+}
+
+func (p *testContext) Logger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestTenantMap_Resolve(t *testing.T) {
+	// t 的库 1_app 与 t_1 的库 app 不能映射到同一个库
+	tenants := TenantMap{"alice": "t", "bob": "t_1"}
+	prefix, ok := tenants.Resolve(&api.Identity{User: "alice"})
+	assert.True(t, ok)
+	assert.Equal(t, "t_", prefix)
+	_, ok = tenants.Resolve(&api.Identity{User: "bob"})
+	assert.False(t, ok)
+}
+
+func TestTenantRewriter_Verified(t *testing.T) {
+	p := NewTenantRewriter(TenantMap{"alice": "t1", "bob": "t2"})
+	find := func() *protocol.OpMessage {
+		msg := protocol.NewOpMessage()
+		msg.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: 1}
+		msg.Body = protocol.Document{{Key: "find", Val: "orders"}, {Key: "$db", Val: "shop"}}
+		return msg
+	}
+
+	// saslStart 中声明但未认证的用户不能切换租户
+	msg := find()
+	err := p.Handle(&testContext{id: &api.Identity{User: "bob"}}, msg)
+	assert.IsType(t, &api.Response{}, err)
+	db, _ := protocol.Load(msg.Body, "$db")
+	assert.Equal(t, "shop", db)
+
+	msg = find()
+	assert.NoError(t, p.Handle(&testContext{id: &api.Identity{User: "alice", Verified: true}}, msg))
+	db, _ = protocol.Load(msg.Body, "$db")
+	assert.Equal(t, "t1_shop", db)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jjeffcaii/mongo-proxy/capture"
+	"github.com/jjeffcaii/mongo-proxy/pcap"
+)
+
+// runPcap 从 pcap/pcapng 文件中重组 MongoDB 流量，输出解码后的消息，或者转换为可以重放的抓包文件
+func runPcap(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("pcap", stderr)
+	file := fs.String("file", "", "pcap or pcapng file, - reads stdin")
+	port := fs.Uint("port", 27017, "server port of the MongoDB traffic")
+	out := fs.String("out", "", "write frames to this capture file instead of printing them")
+	canonical := fs.Bool("canonical", false, "print documents as canonical instead of relaxed Extended JSON")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *file == "" {
+		fmt.Fprintln(stderr, "pcap: --file is required")
+		return exitUsage
+	}
+	if *port == 0 || *port > 65535 {
+		fmt.Fprintf(stderr, "pcap: invalid port %d\n", *port)
+		return exitUsage
+	}
+	in := stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintln(stderr, "pcap:", err)
+			return exitError
+		}
+		defer f.Close()
+		in = f
+	}
+	frames, stats, err := pcap.Frames(in, uint16(*port))
+	if err != nil {
+		fmt.Fprintln(stderr, "pcap:", err)
+		return exitError
+	}
+	if *out != "" {
+		w, err := capture.NewWriter(*out, 0, 0)
+		if err != nil {
+			fmt.Fprintln(stderr, "pcap:", err)
+			return exitError
+		}
+		for _, it := range frames {
+			if err := w.Write(it); err != nil {
+				w.Close()
+				fmt.Fprintln(stderr, "pcap:", err)
+				return exitError
+			}
+		}
+		if err := w.Close(); err != nil {
+			fmt.Fprintln(stderr, "pcap:", err)
+			return exitError
+		}
+	} else {
+		for i, it := range frames {
+			if i > 0 {
+				fmt.Fprintln(stdout)
+			}
+			printFrame(stdout, it, *canonical)
+		}
+	}
+	fmt.Fprintf(stderr, "packets: %d  segments: %d  connections: %d  frames: %d  gaps: %d  discarded bytes: %d\n",
+		stats.Packets, stats.Segments, stats.Connections, stats.Frames, stats.Gaps, stats.Discarded)
+	if stats.Fragments > 0 {
+		fmt.Fprintf(stderr, "pcap: ignored %d IP fragments\n", stats.Fragments)
+	}
+	if stats.Truncated {
+		fmt.Fprintln(stderr, "pcap: the file ends with a truncated packet")
+	}
+	return exitOK
+}
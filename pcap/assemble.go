@@ -0,0 +1,319 @@
+package pcap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/capture"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+)
+
+// maxPending 单个方向上等待缺失数据的乱序字节数，超过后放弃缺失的部分
+const maxPending = 4 << 20
+
+// maxMessageSize 与服务端的 maxMessageSizeBytes 一致
+const maxMessageSize = 48000000
+
+// Stats 重组过程的统计
+type Stats struct {
+	Packets     int
+	Segments    int
+	Fragments   int
+	Connections int
+	Frames      int
+	// Gaps 因丢包或截断而跳过的区间数，Discarded 为重新对齐消息边界时丢弃的字节数
+	Gaps      int
+	Discarded int
+	// Truncated 文件末尾不完整
+	Truncated bool
+}
+
+// framer 即 api 中的 splicer，数据不足时返回 io.EOF，追加数据后可以继续读取
+type framer interface {
+	Next() ([]byte, error)
+}
+
+type connKey struct {
+	client, server netip.AddrPort
+}
+
+type conn struct {
+	id      int64
+	closed  bool
+	streams [2]*stream
+}
+
+// stream 一个方向上的字节流。没有看到 SYN 或者跳过了缺失的数据时，
+// 需要先找到看起来合法的消息头才能继续切分
+type stream struct {
+	started bool
+	resync  bool
+	next    uint32
+	pending map[uint32]*segment
+	held    int
+	raw     []byte
+	buf     *bytes.Buffer
+	frames  framer
+}
+
+// Assembler 将端口 Port 上的 TCP 段重组为 MongoDB 消息帧，目的端口为 Port 的方向视为客户端请求
+type Assembler struct {
+	Port  uint16
+	Emit  func(frame *capture.Frame)
+	Stats Stats
+
+	conns map[connKey]*conn
+	seq   int64
+}
+
+func NewAssembler(port uint16, emit func(frame *capture.Frame)) *Assembler {
+	return &Assembler{Port: port, Emit: emit, conns: make(map[connKey]*conn)}
+}
+
+// Add 处理一个数据包，与端口无关的数据包被忽略
+func (p *Assembler) Add(pkt *Packet) {
+	p.Stats.Packets++
+	seg, err := parse(pkt)
+	if err == errFragment {
+		p.Stats.Fragments++
+	}
+	if err != nil {
+		return
+	}
+	var (
+		key connKey
+		dir capture.Direction
+	)
+	switch p.Port {
+	case seg.Dst.Port():
+		key, dir = connKey{seg.Src, seg.Dst}, capture.In
+	case seg.Src.Port():
+		key, dir = connKey{seg.Dst, seg.Src}, capture.Out
+	default:
+		return
+	}
+	p.Stats.Segments++
+	c, ok := p.conns[key]
+	// 已关闭的连接上出现新的 SYN 表示客户端复用了端口
+	if !ok || c.closed && dir == capture.In && seg.Flags&flagSYN != 0 {
+		p.seq++
+		c = &conn{id: p.seq, streams: [2]*stream{{}, {}}}
+		p.conns[key] = c
+		p.Stats.Connections++
+	}
+	p.add(c, dir, seg, pkt.Time)
+	if seg.Flags&(flagFIN|flagRST) != 0 {
+		c.closed = true
+	}
+}
+
+// Flush 文件读完后放弃仍在等待的缺失数据，输出之后能切分出的消息
+func (p *Assembler) Flush() {
+	for _, c := range p.conns {
+		for dir, s := range c.streams {
+			for len(s.pending) > 0 {
+				p.skip(c, capture.Direction(dir), s, time.Time{})
+			}
+		}
+	}
+}
+
+func (p *Assembler) add(c *conn, dir capture.Direction, seg *segment, t time.Time) {
+	s := c.streams[dir]
+	if seg.Flags&flagSYN != 0 {
+		// 重传的 SYN 不影响已经开始的流
+		if !s.started {
+			*s = stream{started: true, next: seg.Seq + 1}
+			s.reset(false)
+		}
+		return
+	}
+	if len(seg.Payload)+seg.Missing == 0 {
+		return
+	}
+	if !s.started {
+		s.started, s.next = true, seg.Seq
+		s.reset(true)
+	}
+	if int32(seg.Seq-s.next) > 0 {
+		p.hold(s, seg, t)
+		for s.held > maxPending {
+			p.skip(c, dir, s, t)
+		}
+		return
+	}
+	p.deliver(c, dir, s, seg, t)
+	p.drain(c, dir, s, t)
+}
+
+// hold 暂存乱序到达的段，同一序号保留较长的一个
+func (p *Assembler) hold(s *stream, seg *segment, t time.Time) {
+	if s.pending == nil {
+		s.pending = make(map[uint32]*segment)
+	}
+	if old, ok := s.pending[seg.Seq]; ok {
+		if len(old.Payload)+old.Missing >= len(seg.Payload)+seg.Missing {
+			return
+		}
+		s.held -= len(old.Payload)
+	}
+	cp := *seg
+	cp.Payload = append([]byte(nil), seg.Payload...)
+	cp.at = t
+	s.pending[seg.Seq] = &cp
+	s.held += len(cp.Payload)
+}
+
+// drain 交付已经连续的暂存段，t 为零值时使用段的到达时间
+func (p *Assembler) drain(c *conn, dir capture.Direction, s *stream, t time.Time) {
+	for found := true; found; {
+		found = false
+		for seq, seg := range s.pending {
+			if int32(seq-s.next) <= 0 {
+				delete(s.pending, seq)
+				s.held -= len(seg.Payload)
+				when := t
+				if when.IsZero() {
+					when = seg.at
+				}
+				p.deliver(c, dir, s, seg, when)
+				found = true
+			}
+		}
+	}
+}
+
+// skip 放弃到下一个暂存段之间缺失的数据
+func (p *Assembler) skip(c *conn, dir capture.Direction, s *stream, t time.Time) {
+	var first *segment
+	for _, seg := range s.pending {
+		if first == nil || int32(seg.Seq-first.Seq) < 0 {
+			first = seg
+		}
+	}
+	if first == nil {
+		return
+	}
+	p.gap(s, int(first.Seq-s.next))
+	p.drain(c, dir, s, t)
+}
+
+func (p *Assembler) gap(s *stream, n int) {
+	p.Stats.Gaps++
+	s.next += uint32(n)
+	s.reset(true)
+}
+
+// deliver 交付从 s.next 开始或与之重叠的段，重传的部分被裁掉
+func (p *Assembler) deliver(c *conn, dir capture.Direction, s *stream, seg *segment, t time.Time) {
+	trim := int(s.next - seg.Seq)
+	payload, missing := seg.Payload, seg.Missing
+	if trim >= len(payload)+missing {
+		return
+	}
+	if trim <= len(payload) {
+		payload = payload[trim:]
+	} else {
+		missing -= trim - len(payload)
+		payload = nil
+	}
+	s.next += uint32(len(payload))
+	p.write(c, dir, s, payload, t)
+	if missing > 0 {
+		p.gap(s, missing)
+	}
+}
+
+func (p *Assembler) write(c *conn, dir capture.Direction, s *stream, payload []byte, t time.Time) {
+	if s.resync {
+		s.raw = append(s.raw, payload...)
+		off := findHeader(s.raw, dir)
+		if off < 0 {
+			if keep := protocol.HeaderLength - 1; len(s.raw) > keep {
+				p.Stats.Discarded += len(s.raw) - keep
+				s.raw = append(s.raw[:0], s.raw[len(s.raw)-keep:]...)
+			}
+			return
+		}
+		p.Stats.Discarded += off
+		payload = s.raw[off:]
+		s.raw, s.resync = nil, false
+	}
+	s.buf.Write(payload)
+	for {
+		data, err := s.frames.Next()
+		if err != nil {
+			return
+		}
+		p.Stats.Frames++
+		if p.Emit != nil {
+			p.Emit(&capture.Frame{Conn: c.id, Time: t, Direction: dir, Data: data})
+		}
+	}
+}
+
+func (s *stream) reset(resync bool) {
+	s.resync = resync
+	s.raw = nil
+	s.buf = &bytes.Buffer{}
+	s.frames = api.NewSplicer(bufio.NewReader(s.buf))
+}
+
+// findHeader 查找看起来合法的消息头：长度与操作码有效，请求的 ResponseTo 为 0 而响应的不为 0；
+// 数据足够时还要求整条消息可以解码
+func findHeader(bs []byte, dir capture.Direction) int {
+	for i := 0; i+protocol.HeaderLength <= len(bs); i++ {
+		size := int(binary.LittleEndian.Uint32(bs[i:]))
+		if size < protocol.HeaderLength || size > maxMessageSize {
+			continue
+		}
+		if protocol.NewMessage(protocol.ParseOpCode(bs[i:])) == nil {
+			continue
+		}
+		responseTo := binary.LittleEndian.Uint32(bs[i+8:])
+		if (dir == capture.In) != (responseTo == 0) {
+			continue
+		}
+		if i+size <= len(bs) {
+			if _, err := protocol.Decode(bs[i : i+size]); err != nil {
+				continue
+			}
+		}
+		return i
+	}
+	return -1
+}
+
+// Frames 读取 pcap 或 pcapng 文件，按出现顺序返回端口 port 上的消息帧。
+// 文件末尾不完整时返回已经读到的部分并设置 Stats.Truncated
+func Frames(r io.Reader, port uint16) ([]*capture.Frame, Stats, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	var out []*capture.Frame
+	asm := NewAssembler(port, func(frame *capture.Frame) {
+		out = append(out, frame)
+	})
+	for {
+		pkt, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			asm.Stats.Truncated = true
+			break
+		}
+		if err != nil {
+			return nil, asm.Stats, err
+		}
+		asm.Add(pkt)
+	}
+	asm.Flush()
+	return out, asm.Stats, nil
+}
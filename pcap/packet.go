@@ -0,0 +1,188 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+const (
+	etherIPv4 = 0x0800
+	etherIPv6 = 0x86dd
+	etherVLAN = 0x8100
+	etherQinQ = 0x88a8
+	protoTCP  = 6
+)
+
+// TCP 标志位
+const (
+	flagFIN = 0x01
+	flagSYN = 0x02
+	flagRST = 0x04
+)
+
+var (
+	errNotTCP   = errors.New("not a TCP segment")
+	errFragment = errors.New("IP fragment")
+)
+
+// segment 解析出的 TCP 段，Missing 为抓包时截断、没有抓到的载荷字节数
+type segment struct {
+	Src, Dst netip.AddrPort
+	Seq      uint32
+	Flags    byte
+	Payload  []byte
+	Missing  int
+	// at 乱序暂存时记录的到达时间
+	at time.Time
+}
+
+// parse 解析数据包中的 TCP 段，非 TCP 数据包返回 errNotTCP
+func parse(pkt *Packet) (*segment, error) {
+	data := pkt.Data
+	truncated := pkt.Length - len(pkt.Data)
+	var ether uint16
+	switch pkt.LinkType {
+	case LinkEthernet:
+		if len(data) < 14 {
+			return nil, errNotTCP
+		}
+		ether, data = binary.BigEndian.Uint16(data[12:14]), data[14:]
+		for (ether == etherVLAN || ether == etherQinQ) && len(data) >= 4 {
+			ether, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+	case LinkLinuxSLL:
+		if len(data) < 16 {
+			return nil, errNotTCP
+		}
+		ether, data = binary.BigEndian.Uint16(data[14:16]), data[16:]
+	case LinkSLL2:
+		if len(data) < 20 {
+			return nil, errNotTCP
+		}
+		ether, data = binary.BigEndian.Uint16(data[0:2]), data[20:]
+	case LinkNull, LinkLoop:
+		// BSD 回环接口的地址族，NULL 为主机字节序，LOOP 为网络字节序
+		if len(data) < 4 {
+			return nil, errNotTCP
+		}
+		family := binary.LittleEndian.Uint32(data)
+		if pkt.LinkType == LinkLoop || family > 0xffff {
+			family = binary.BigEndian.Uint32(data)
+		}
+		switch family {
+		case 2:
+			ether = etherIPv4
+		case 24, 28, 30:
+			ether = etherIPv6
+		}
+		data = data[4:]
+	case LinkRaw, LinkIPv4, LinkIPv6:
+		if len(data) == 0 {
+			return nil, errNotTCP
+		}
+		switch data[0] >> 4 {
+		case 4:
+			ether = etherIPv4
+		case 6:
+			ether = etherIPv6
+		}
+	default:
+		return nil, fmt.Errorf("unsupported link type %d", pkt.LinkType)
+	}
+	switch ether {
+	case etherIPv4:
+		return parseIPv4(data, truncated)
+	case etherIPv6:
+		return parseIPv6(data, truncated)
+	}
+	return nil, errNotTCP
+}
+
+func parseIPv4(data []byte, truncated int) (*segment, error) {
+	if len(data) < 20 {
+		return nil, errNotTCP
+	}
+	ihl := int(data[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(data[2:4]))
+	if data[9] != protoTCP || ihl < 20 || len(data) < ihl {
+		return nil, errNotTCP
+	}
+	// MF 标志或非零的片偏移
+	if binary.BigEndian.Uint16(data[6:8])&0x3fff != 0 {
+		return nil, errFragment
+	}
+	src, _ := netip.AddrFromSlice(data[12:16])
+	dst, _ := netip.AddrFromSlice(data[16:20])
+	// total 为 0 时通常是开启了 TSO 的本机抓包，以实际长度为准
+	length := total - ihl
+	if total == 0 {
+		length = len(data) - ihl + truncated
+	}
+	return parseTCP(src, dst, data[ihl:], length)
+}
+
+func parseIPv6(data []byte, truncated int) (*segment, error) {
+	if len(data) < 40 {
+		return nil, errNotTCP
+	}
+	length := int(binary.BigEndian.Uint16(data[4:6]))
+	if length == 0 {
+		length = len(data) - 40 + truncated
+	}
+	next := data[6]
+	src, _ := netip.AddrFromSlice(data[8:24])
+	dst, _ := netip.AddrFromSlice(data[24:40])
+	data = data[40:]
+	// 跳过扩展头
+	for {
+		switch next {
+		case protoTCP:
+			return parseTCP(src, dst, data, length)
+		case 0, 43, 60:
+			if len(data) < 8 {
+				return nil, errNotTCP
+			}
+			size := (int(data[1]) + 1) * 8
+			if len(data) < size {
+				return nil, errNotTCP
+			}
+			next, data, length = data[0], data[size:], length-size
+		case 44:
+			return nil, errFragment
+		default:
+			return nil, errNotTCP
+		}
+	}
+}
+
+// parseTCP length 为 IP 层声明的 TCP 段长度，用于判断载荷是否被截断
+func parseTCP(src, dst netip.Addr, data []byte, length int) (*segment, error) {
+	if len(data) < 20 {
+		return nil, errNotTCP
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || len(data) < offset {
+		return nil, errNotTCP
+	}
+	seg := &segment{
+		Src:   netip.AddrPortFrom(src.Unmap(), binary.BigEndian.Uint16(data[0:2])),
+		Dst:   netip.AddrPortFrom(dst.Unmap(), binary.BigEndian.Uint16(data[2:4])),
+		Seq:   binary.BigEndian.Uint32(data[4:8]),
+		Flags: data[13],
+	}
+	payload := data[offset:]
+	want := length - offset
+	if want < len(payload) {
+		// 以太网帧可能带有填充
+		if want < 0 {
+			want = 0
+		}
+		payload = payload[:want]
+	}
+	seg.Payload = payload
+	seg.Missing = want - len(payload)
+	return seg, nil
+}
@@ -0,0 +1,191 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/capture"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	client = netip.MustParseAddrPort("10.0.0.1:51000")
+	server = netip.MustParseAddrPort("10.0.0.2:27017")
+)
+
+func command(t *testing.T, id, responseTo int32, key string) []byte {
+	msg := protocol.NewOpMessage()
+	msg.OpHeader = &protocol.Header{OpCode: protocol.OpCodeMessage, RequestID: id, ResponseTo: responseTo}
+	msg.Body = protocol.Document{{Key: key, Val: int32(1)}, {Key: "$db", Val: "admin"}}
+	bs, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+// ethernet 构造 Ethernet/IPv4/TCP 数据包
+func ethernet(src, dst netip.AddrPort, seq uint32, flags byte, payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 12))
+	binary.Write(&buf, binary.BigEndian, uint16(etherIPv4))
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(40+len(payload)))
+	ip[8], ip[9] = 64, protoTCP
+	copy(ip[12:], src.Addr().AsSlice())
+	copy(ip[16:], dst.Addr().AsSlice())
+	buf.Write(ip)
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12], tcp[13] = 5<<4, flags|0x10
+	buf.Write(tcp)
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+func pcapFile(start time.Time, packets ...[]byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []uint32{magicMicros, 0x00040002, 0, 0, 65535, uint32(LinkEthernet)})
+	for i, it := range packets {
+		ts := start.Add(time.Duration(i) * time.Millisecond)
+		binary.Write(&buf, binary.LittleEndian, []uint32{uint32(ts.Unix()), uint32(ts.Nanosecond() / 1000), uint32(len(it)), uint32(len(it))})
+		buf.Write(it)
+	}
+	return buf.Bytes()
+}
+
+func pcapngFile(start time.Time, packets ...[]byte) []byte {
+	return pcapng(start, 9, packets...)
+}
+
+// pcapng 接口的 if_tsresol 为 tsresol，数据包的时间戳按纳秒写入
+func pcapng(start time.Time, tsresol byte, packets ...[]byte) []byte {
+	var buf bytes.Buffer
+	block := func(kind uint32, body []byte) {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		binary.Write(&buf, binary.BigEndian, []uint32{kind, uint32(12 + len(body))})
+		buf.Write(body)
+		binary.Write(&buf, binary.BigEndian, uint32(12+len(body)))
+	}
+	shb := make([]byte, 16)
+	binary.BigEndian.PutUint32(shb[0:], byteOrderMagic)
+	binary.BigEndian.PutUint16(shb[4:], 1)
+	binary.BigEndian.PutUint64(shb[8:], ^uint64(0))
+	block(blockSectionHeader, shb)
+	idb := []byte{0, byte(LinkEthernet), 0, 0, 0, 0, 0, 0, 0, 9, 0, 1, tsresol, 0, 0, 0, 0, 0, 0, 0}
+	block(1, idb)
+	for i, it := range packets {
+		ts := uint64(start.Add(time.Duration(i) * time.Millisecond).UnixNano())
+		body := make([]byte, 20, 20+len(it))
+		binary.BigEndian.PutUint32(body[4:], uint32(ts>>32))
+		binary.BigEndian.PutUint32(body[8:], uint32(ts))
+		binary.BigEndian.PutUint32(body[12:], uint32(len(it)))
+		binary.BigEndian.PutUint32(body[16:], uint32(len(it)))
+		block(6, append(body, it...))
+	}
+	return buf.Bytes()
+}
+
+func TestFrames(t *testing.T) {
+	req := command(t, 1, 0, "ping")
+	res := command(t, 100, 1, "ok")
+	req2 := command(t, 2, 0, "hello")
+	head, tail := req[:10], req[10:]
+	const c0, s0 = 1000, 5000
+	packets := [][]byte{
+		ethernet(client, server, c0, flagSYN, nil),
+		ethernet(server, client, s0, flagSYN, nil),
+		// 后半段先到，前半段重传一次
+		ethernet(client, server, c0+1+10, 0, tail),
+		ethernet(client, server, c0+1, 0, head),
+		ethernet(client, server, c0+1, 0, head),
+		ethernet(server, client, s0+1, 0, res),
+		ethernet(client, server, c0+1+uint32(len(req)), 0, req2),
+	}
+	start := time.Unix(1700000000, 0)
+
+	for name, data := range map[string][]byte{
+		"pcap":   pcapFile(start, packets...),
+		"pcapng": pcapngFile(start, packets...),
+	} {
+		frames, stats, err := Frames(bytes.NewReader(data), 27017)
+		assert.NoError(t, err, name)
+		assert.Equal(t, 7, stats.Packets, name)
+		assert.Equal(t, 1, stats.Connections, name)
+		assert.Equal(t, 0, stats.Gaps, name)
+		if !assert.Len(t, frames, 3, name) {
+			continue
+		}
+		assert.Equal(t, req, frames[0].Data, name)
+		assert.Equal(t, capture.In, frames[0].Direction, name)
+		assert.Equal(t, start.Add(3*time.Millisecond), frames[0].Time, name)
+		assert.Equal(t, res, frames[1].Data, name)
+		assert.Equal(t, capture.Out, frames[1].Direction, name)
+		assert.Equal(t, req2, frames[2].Data, name)
+		for _, it := range frames {
+			assert.Equal(t, int64(1), it.Conn, name)
+		}
+	}
+}
+
+func TestFrames_Resync(t *testing.T) {
+	req := command(t, 7, 0, "ping")
+	// 没有握手，从一条消息的中间开始抓包
+	packets := [][]byte{
+		ethernet(client, server, 1, 0, append(command(t, 6, 0, "hello")[5:], req...)),
+	}
+	frames, stats, err := Frames(bytes.NewReader(pcapFile(time.Now(), packets...)), 27017)
+	assert.NoError(t, err)
+	if assert.Len(t, frames, 1) {
+		assert.Equal(t, req, frames[0].Data)
+	}
+	assert.True(t, stats.Discarded > 0)
+
+	// 文件末尾不完整
+	data := pcapFile(time.Now(), packets...)
+	_, stats, err = Frames(bytes.NewReader(data[:len(data)-3]), 27017)
+	assert.NoError(t, err)
+	assert.True(t, stats.Truncated)
+
+	_, _, err = Frames(bytes.NewReader([]byte("not a capture")), 27017)
+	assert.Error(t, err)
+}
+
+func TestReader_Resolution(t *testing.T) {
+	pkt := ethernet(client, server, 1, flagSYN, nil)
+	start := time.Unix(1700000000, 0)
+	// 超出 uint64 的精度会让每秒的单位数变为 0 或溢出
+	for _, tsresol := range []byte{0x80 + 64, 0xff, 20, 0x7f} {
+		r, err := NewReader(bytes.NewReader(pcapng(start, tsresol, pkt)))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.NotPanics(t, func() {
+			_, err = r.Next()
+		}, "%#x", tsresol)
+		assert.Error(t, err, "%#x", tsresol)
+	}
+	// 2^-63 与 10^-19 秒仍然可以表示，小数部分不能溢出
+	for _, tsresol := range []byte{0x80 + 63, 19} {
+		r, err := NewReader(bytes.NewReader(pcapng(start, tsresol, pkt)))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		_, err = r.Next()
+		assert.NoError(t, err, "%#x", tsresol)
+	}
+	units, _ := resolution(0x80 + 63)
+	r := &Reader{interfaces: []iface{{units: units}}}
+	ts := r.timestamp(0, 0xffffffff, 0xffffffff)
+	assert.Equal(t, int64(1), ts.Unix())
+	assert.True(t, ts.Nanosecond() >= 0 && ts.Nanosecond() < 1000000000)
+}
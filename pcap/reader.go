@@ -0,0 +1,301 @@
+// Package pcap 读取 tcpdump 等工具生成的 pcap/pcapng 文件，重组其中的 MongoDB TCP 流
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// 链路层类型，见 https://www.tcpdump.org/linktypes.html
+const (
+	LinkNull     uint16 = 0
+	LinkEthernet uint16 = 1
+	LinkRaw      uint16 = 101
+	LinkLoop     uint16 = 108
+	LinkLinuxSLL uint16 = 113
+	LinkIPv4     uint16 = 228
+	LinkIPv6     uint16 = 229
+	LinkSLL2     uint16 = 276
+)
+
+const (
+	magicMicros        = 0xa1b2c3d4
+	magicNanos         = 0xa1b23c4d
+	blockSectionHeader = 0x0a0d0d0a
+	byteOrderMagic     = 0x1a2b3c4d
+)
+
+// 单个数据包或 pcapng 块的长度上限，超过时认为文件已损坏
+const maxBlockSize = 64 << 20
+
+var errFormat = errors.New("not a pcap or pcapng file")
+
+// Packet 文件中的一个数据包，Length 为原始长度，大于 len(Data) 表示抓包时被截断
+type Packet struct {
+	Time     time.Time
+	LinkType uint16
+	Length   int
+	Data     []byte
+}
+
+// Reader 顺序读取 pcap 或 pcapng 文件中的数据包，格式由文件头判断
+type Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	next  func() (*Packet, error)
+
+	// pcap
+	linkType uint16
+	nanos    bool
+
+	// pcapng，每个 section 重新定义接口
+	interfaces []iface
+}
+
+// iface pcapng 的接口描述，时间戳单位为 1/units 秒
+type iface struct {
+	linkType uint16
+	units    uint64
+	offset   int64
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	p := &Reader{r: bufio.NewReader(r)}
+	head, err := p.r.Peek(4)
+	if err != nil {
+		return nil, errFormat
+	}
+	if binary.LittleEndian.Uint32(head) == blockSectionHeader {
+		p.next = p.nextBlock
+		return p, nil
+	}
+	if err := p.readHeader(); err != nil {
+		return nil, err
+	}
+	p.next = p.nextRecord
+	return p, nil
+}
+
+// Next 返回下一个数据包，文件结束时返回 io.EOF
+func (p *Reader) Next() (*Packet, error) {
+	return p.next()
+}
+
+func (p *Reader) readHeader() error {
+	head := make([]byte, 24)
+	if _, err := io.ReadFull(p.r, head); err != nil {
+		return errFormat
+	}
+	switch {
+	case binary.LittleEndian.Uint32(head) == magicMicros:
+		p.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(head) == magicMicros:
+		p.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(head) == magicNanos:
+		p.order, p.nanos = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(head) == magicNanos:
+		p.order, p.nanos = binary.BigEndian, true
+	default:
+		return errFormat
+	}
+	// 高 16 位可能带有 FCS 信息
+	p.linkType = uint16(p.order.Uint32(head[20:24]))
+	return nil
+}
+
+func (p *Reader) nextRecord() (*Packet, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(p.r, head); err != nil {
+		return nil, err
+	}
+	sec := int64(p.order.Uint32(head[0:4]))
+	frac := int64(p.order.Uint32(head[4:8]))
+	size := p.order.Uint32(head[8:12])
+	if size > maxBlockSize {
+		return nil, fmt.Errorf("packet of %d bytes exceeds limit", size)
+	}
+	pkt := &Packet{LinkType: p.linkType, Length: int(p.order.Uint32(head[12:16])), Data: make([]byte, size)}
+	if _, err := io.ReadFull(p.r, pkt.Data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if p.nanos {
+		pkt.Time = time.Unix(sec, frac)
+	} else {
+		pkt.Time = time.Unix(sec, frac*1000)
+	}
+	return pkt, nil
+}
+
+// nextBlock 读取 pcapng 的块，跳过数据包以外的块
+func (p *Reader) nextBlock() (*Packet, error) {
+	for {
+		head, err := p.r.Peek(12)
+		if err == io.EOF && len(head) == 0 {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		kind := binary.LittleEndian.Uint32(head)
+		if kind == blockSectionHeader {
+			switch binary.LittleEndian.Uint32(head[8:12]) {
+			case byteOrderMagic:
+				p.order = binary.LittleEndian
+			default:
+				if binary.BigEndian.Uint32(head[8:12]) != byteOrderMagic {
+					return nil, errFormat
+				}
+				p.order = binary.BigEndian
+			}
+			p.interfaces = p.interfaces[:0]
+		} else if p.order == nil {
+			return nil, errFormat
+		}
+		kind = p.order.Uint32(head[0:4])
+		size := p.order.Uint32(head[4:8])
+		if size < 12 || size%4 != 0 || size > maxBlockSize {
+			return nil, fmt.Errorf("bad pcapng block length %d", size)
+		}
+		block := make([]byte, size)
+		if _, err := io.ReadFull(p.r, block); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		body := block[8 : size-4]
+		switch kind {
+		case 1:
+			it, err := p.parseInterface(body)
+			if err != nil {
+				return nil, err
+			}
+			p.interfaces = append(p.interfaces, it)
+		case 6:
+			if pkt, err := p.enhancedPacket(body); err != nil || pkt != nil {
+				return pkt, err
+			}
+		case 3:
+			if pkt, err := p.simplePacket(body); err != nil || pkt != nil {
+				return pkt, err
+			}
+		case 2:
+			if pkt, err := p.obsoletePacket(body); err != nil || pkt != nil {
+				return pkt, err
+			}
+		}
+	}
+}
+
+func (p *Reader) parseInterface(body []byte) (iface, error) {
+	it := iface{units: 1000000}
+	if len(body) < 8 {
+		return it, nil
+	}
+	it.linkType = p.order.Uint16(body[0:2])
+	for opts := body[8:]; len(opts) >= 4; {
+		code, size := p.order.Uint16(opts[0:2]), int(p.order.Uint16(opts[2:4]))
+		if code == 0 || 4+size > len(opts) {
+			break
+		}
+		val := opts[4 : 4+size]
+		switch {
+		case code == 9 && size == 1:
+			units, ok := resolution(val[0])
+			if !ok {
+				return it, fmt.Errorf("unsupported pcapng timestamp resolution %#x", val[0])
+			}
+			it.units = units
+		case code == 14 && size == 8:
+			it.offset = int64(p.order.Uint64(val))
+		}
+		opts = opts[4+(size+3)/4*4:]
+	}
+	return it, nil
+}
+
+// resolution 解析 if_tsresol：最高位为 0 时表示 10 的负幂，否则为 2 的负幂，
+// 每秒的单位数需要能用 uint64 表示
+func resolution(v byte) (uint64, bool) {
+	if v&0x80 != 0 {
+		exp := v & 0x7f
+		return uint64(1) << exp, exp < 64
+	}
+	if v > 19 {
+		return 0, false
+	}
+	units := uint64(1)
+	for i := byte(0); i < v; i++ {
+		units *= 10
+	}
+	return units, true
+}
+
+func (p *Reader) timestamp(id int, high, low uint32) time.Time {
+	it := iface{units: 1000000}
+	if id < len(p.interfaces) {
+		it = p.interfaces[id]
+	}
+	ts := uint64(high)<<32 | uint64(low)
+	sec := ts / it.units
+	// frac < units，frac*1e9/units 小于 1e9，用 128 位中间结果避免溢出
+	hi, lo := bits.Mul64(ts%it.units, 1000000000)
+	nsec, _ := bits.Div64(hi, lo, it.units)
+	return time.Unix(int64(sec)+it.offset, int64(nsec))
+}
+
+func (p *Reader) interfaceLink(id int) uint16 {
+	if id < len(p.interfaces) {
+		return p.interfaces[id].linkType
+	}
+	return LinkEthernet
+}
+
+func (p *Reader) enhancedPacket(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, errors.New("short enhanced packet block")
+	}
+	id := int(p.order.Uint32(body[0:4]))
+	size := int(p.order.Uint32(body[12:16]))
+	if 20+size > len(body) {
+		return nil, errors.New("enhanced packet exceeds block")
+	}
+	return &Packet{
+		Time:     p.timestamp(id, p.order.Uint32(body[4:8]), p.order.Uint32(body[8:12])),
+		LinkType: p.interfaceLink(id),
+		Length:   int(p.order.Uint32(body[16:20])),
+		Data:     body[20 : 20+size],
+	}, nil
+}
+
+// simplePacket 没有时间戳，捕获长度受接口 snaplen 限制，这里按块长度截取
+func (p *Reader) simplePacket(body []byte) (*Packet, error) {
+	if len(body) < 4 {
+		return nil, errors.New("short simple packet block")
+	}
+	length := int(p.order.Uint32(body[0:4]))
+	data := body[4:]
+	if length < len(data) {
+		data = data[:length]
+	}
+	return &Packet{LinkType: p.interfaceLink(0), Length: length, Data: data}, nil
+}
+
+func (p *Reader) obsoletePacket(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, errors.New("short packet block")
+	}
+	id := int(p.order.Uint16(body[0:2]))
+	size := int(p.order.Uint32(body[12:16]))
+	if 20+size > len(body) {
+		return nil, errors.New("packet exceeds block")
+	}
+	return &Packet{
+		Time:     p.timestamp(id, p.order.Uint32(body[4:8]), p.order.Uint32(body[8:12])),
+		LinkType: p.interfaceLink(id),
+		Length:   int(p.order.Uint32(body[16:20])),
+		Data:     body[20 : 20+size],
+	}, nil
+}
@@ -3,6 +3,7 @@ package protocol
 import (
 	"bytes"
 	"fmt"
+	"strings"
 
 	"github.com/sbunce/bson"
 )
@@ -23,8 +24,31 @@ const (
 	OpCodeKillCursor OpCode = 2007
 	OpCodeCmd        OpCode = 2010
 	OpCodeCmdReply   OpCode = 2011
+	OpCodeMessage    OpCode = 2013
 )
 
+var opNames = map[OpCode]string{
+	OpCodeReply:      "OP_REPLY",
+	OpCodeMsg:        "OP_MSG_LEGACY",
+	OpCodeUpdate:     "OP_UPDATE",
+	OpCodeInsert:     "OP_INSERT",
+	OpReserved:       "RESERVED",
+	OpCodeQuery:      "OP_QUERY",
+	OpCodeGetMore:    "OP_GET_MORE",
+	OpCodeDel:        "OP_DELETE",
+	OpCodeKillCursor: "OP_KILL_CURSORS",
+	OpCodeCmd:        "OP_COMMAND",
+	OpCodeCmdReply:   "OP_COMMANDREPLY",
+	OpCodeMessage:    "OP_MSG",
+}
+
+func (p OpCode) String() string {
+	if name, ok := opNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("OP_%d", int32(p))
+}
+
 type Document = bson.Slice
 type Pair = bson.Pair
 
@@ -42,6 +66,15 @@ func (p TableName) String() string {
 	return fmt.Sprintf("%s.%s", p.Database, p.Collection)
 }
 
+// ParseTableName 解析 "db.collection" 形式的命名空间，集合名中可以包含 "."
+func ParseTableName(ns string) (*TableName, bool) {
+	sp := strings.SplitN(ns, ".", 2)
+	if len(sp) != 2 || sp[0] == "" || sp[1] == "" {
+		return nil, false
+	}
+	return &TableName{sp[0], sp[1]}, true
+}
+
 type DatabaseSupport interface {
 	TableName() (tbl *TableName, ok bool)
 }
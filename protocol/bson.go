@@ -0,0 +1,234 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/sbunce/bson"
+)
+
+// sbunce/bson 无法表示的 BSON 类型。其余类型仍使用 sbunce/bson 中的定义，
+// 解码结果与之前保持一致：字符串为 bson.String，数组为 bson.Array，子类型为 0 的二进制为 bson.Binary
+
+// 二进制子类型
+const (
+	BinaryGeneric   byte = 0x00
+	BinaryFunction  byte = 0x01
+	BinaryOld       byte = 0x02
+	BinaryUUIDOld   byte = 0x03
+	BinaryUUID      byte = 0x04
+	BinaryMD5       byte = 0x05
+	BinaryEncrypted byte = 0x06
+	BinaryColumn    byte = 0x07
+	BinarySensitive byte = 0x08
+	BinaryUser      byte = 0x80
+)
+
+// Binary 子类型不为 0 的二进制数据。子类型 0x02 的 Data 包括内部的长度前缀，保证原样编码
+type Binary struct {
+	Subtype byte
+	Data    []byte
+}
+
+// UUID 子类型为 0x03 或 0x04 且长度为 16 字节时，返回 8-4-4-4-12 形式的 UUID
+func (p Binary) UUID() (string, bool) {
+	if p.Subtype != BinaryUUID && p.Subtype != BinaryUUIDOld || len(p.Data) != 16 {
+		return "", false
+	}
+	s := hex.EncodeToString(p.Data)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:], true
+}
+
+// ParseUUID 解析 8-4-4-4-12 形式的 UUID，返回子类型为 0x04 的二进制
+func ParseUUID(s string) (Binary, error) {
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return Binary{}, fmt.Errorf("invalid uuid %q", s)
+	}
+	bs, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil {
+		return Binary{}, fmt.Errorf("invalid uuid %q", s)
+	}
+	return Binary{Subtype: BinaryUUID, Data: bs}, nil
+}
+
+// CodeWithScope 带作用域的 JavaScript，与 bson.JavascriptScope 不同，作用域保持字段顺序
+type CodeWithScope struct {
+	Code  string
+	Scope Document
+}
+
+// Decimal128 IEEE 754-2008 128 位十进制浮点数，按 BID 编码保存
+type Decimal128 struct {
+	High, Low uint64
+}
+
+const (
+	decimalBias      = 6176
+	decimalMaxExp    = 6111
+	decimalMinExp    = -6176
+	decimalMaxDigits = 34
+)
+
+var decimalMaxCoefficient = new(big.Int).Sub(new(big.Int).Exp(big.NewInt(10), big.NewInt(decimalMaxDigits), nil), big.NewInt(1))
+
+// IsNaN 与 IsInf 判断特殊值
+func (p Decimal128) IsNaN() bool {
+	return p.High>>58&0x1f == 0x1f
+}
+
+func (p Decimal128) IsInf() bool {
+	return p.High>>58&0x1f == 0x1e
+}
+
+// parts 返回系数与指数，系数超出 34 位十进制数时按规范视为 0
+func (p Decimal128) parts() (*big.Int, int) {
+	var (
+		exp  uint64
+		high uint64
+	)
+	if p.High>>61&3 == 3 {
+		// 这种形式的系数总是超出范围
+		exp = p.High >> 47 & 0x3fff
+	} else {
+		exp = p.High >> 49 & 0x3fff
+		high = p.High & (1<<49 - 1)
+	}
+	coef := new(big.Int).SetUint64(high)
+	coef.Lsh(coef, 64).Or(coef, new(big.Int).SetUint64(p.Low))
+	if coef.Cmp(decimalMaxCoefficient) > 0 {
+		coef.SetInt64(0)
+	}
+	return coef, int(exp) - decimalBias
+}
+
+// String 按 Extended JSON 规范中的格式输出
+func (p Decimal128) String() string {
+	neg := p.High>>63 == 1
+	switch {
+	case p.IsNaN():
+		return "NaN"
+	case p.IsInf() && neg:
+		return "-Infinity"
+	case p.IsInf():
+		return "Infinity"
+	}
+	coef, exp := p.parts()
+	digits := coef.String()
+	var b strings.Builder
+	if neg {
+		b.WriteByte('-')
+	}
+	adjusted := exp + len(digits) - 1
+	switch {
+	case exp > 0 || adjusted < -6:
+		// 科学计数法
+		b.WriteByte(digits[0])
+		if len(digits) > 1 {
+			b.WriteByte('.')
+			b.WriteString(digits[1:])
+		}
+		b.WriteByte('E')
+		if adjusted >= 0 {
+			b.WriteByte('+')
+		}
+		b.WriteString(strconv.Itoa(adjusted))
+	case exp == 0:
+		b.WriteString(digits)
+	default:
+		point := len(digits) + exp
+		if point <= 0 {
+			b.WriteString("0.")
+			b.WriteString(strings.Repeat("0", -point))
+			b.WriteString(digits)
+		} else {
+			b.WriteString(digits[:point])
+			b.WriteByte('.')
+			b.WriteString(digits[point:])
+		}
+	}
+	return b.String()
+}
+
+// Float64 转换为最接近的 double，用于比较
+func (p Decimal128) Float64() float64 {
+	f, _ := strconv.ParseFloat(p.String(), 64)
+	return f
+}
+
+// ParseDecimal128 解析十进制字符串，无法精确表示时返回错误而不做舍入
+func ParseDecimal128(s string) (Decimal128, error) {
+	invalid := fmt.Errorf("invalid decimal128 %q", s)
+	body := s
+	neg := false
+	if body != "" && (body[0] == '-' || body[0] == '+') {
+		neg, body = body[0] == '-', body[1:]
+	}
+	var sign uint64
+	if neg {
+		sign = 1 << 63
+	}
+	switch strings.ToLower(body) {
+	case "nan":
+		return Decimal128{High: 0x1f << 58}, nil
+	case "inf", "infinity":
+		return Decimal128{High: sign | 0x1e<<58}, nil
+	}
+	mantissa, expPart, hasExp := strings.Cut(strings.ToLower(body), "e")
+	exp := 0
+	if hasExp {
+		n, err := strconv.Atoi(expPart)
+		if err != nil {
+			return Decimal128{}, invalid
+		}
+		exp = n
+	}
+	whole, frac, _ := strings.Cut(mantissa, ".")
+	digits := whole + frac
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return Decimal128{}, invalid
+	}
+	exp -= len(frac)
+	digits = strings.TrimLeft(digits, "0")
+	if digits == "" {
+		digits = "0"
+	}
+	// 多余的位数只能是末尾的 0
+	for len(digits) > decimalMaxDigits || exp < decimalMinExp {
+		if !strings.HasSuffix(digits, "0") || len(digits) == 1 {
+			if digits == "0" && exp < decimalMinExp {
+				exp = decimalMinExp
+				break
+			}
+			return Decimal128{}, invalid
+		}
+		digits, exp = digits[:len(digits)-1], exp+1
+	}
+	// 指数过大时在系数末尾补 0
+	for exp > decimalMaxExp {
+		if digits == "0" {
+			exp = decimalMaxExp
+			break
+		}
+		if len(digits) >= decimalMaxDigits {
+			return Decimal128{}, invalid
+		}
+		digits, exp = digits+"0", exp-1
+	}
+	coef, _ := new(big.Int).SetString(digits, 10)
+	low := new(big.Int).And(coef, new(big.Int).SetUint64(^uint64(0))).Uint64()
+	high := new(big.Int).Rsh(coef, 64).Uint64()
+	return Decimal128{High: sign | uint64(exp+decimalBias)<<49 | high, Low: low}, nil
+}
+
+// Timestamp 拆分 bson.Timestamp，T 为秒，I 为同一秒内的序号
+func Timestamp(ts bson.Timestamp) (t, i uint32) {
+	return uint32(uint64(ts) >> 32), uint32(ts)
+}
+
+// NewTimestamp 由秒与序号构造 bson.Timestamp
+func NewTimestamp(t, i uint32) bson.Timestamp {
+	return bson.Timestamp(int64(uint64(t)<<32 | uint64(i)))
+}
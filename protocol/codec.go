@@ -0,0 +1,491 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbunce/bson"
+)
+
+// BSON 元素类型
+const (
+	kindDouble        byte = 0x01
+	kindString        byte = 0x02
+	kindDocument      byte = 0x03
+	kindArray         byte = 0x04
+	kindBinary        byte = 0x05
+	kindUndefined     byte = 0x06
+	kindObjectID      byte = 0x07
+	kindBool          byte = 0x08
+	kindDateTime      byte = 0x09
+	kindNull          byte = 0x0a
+	kindRegex         byte = 0x0b
+	kindDBPointer     byte = 0x0c
+	kindCode          byte = 0x0d
+	kindSymbol        byte = 0x0e
+	kindCodeWithScope byte = 0x0f
+	kindInt32         byte = 0x10
+	kindTimestamp     byte = 0x11
+	kindInt64         byte = 0x12
+	kindDecimal       byte = 0x13
+	kindMinKey        byte = 0xff
+	kindMaxKey        byte = 0x7f
+)
+
+// maxNesting 与服务端一致的嵌套层数上限，防止恶意输入耗尽栈空间
+const maxNesting = 100
+
+var errShortDocument = errors.New("bson: document is truncated")
+
+// DecodeDocument 解码一个完整的 BSON 文档。sbunce/bson 会丢弃二进制子类型、
+// 以 bson.Map 表示数组中的文档并按字符串顺序排列数组下标，这里保证重新编码后与原始字节一致
+func DecodeDocument(bs []byte) (Document, error) {
+	doc, n, err := decodeDocument(bs, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(bs) {
+		return nil, fmt.Errorf("bson: %d trailing bytes after document", len(bs)-n)
+	}
+	return doc, nil
+}
+
+// EncodeDocument 编码文档，嵌套的 bson.Map 按字段名排序
+func EncodeDocument(doc Document) ([]byte, error) {
+	return encodeDocument(doc)
+}
+
+// decodeDocument 返回文档与其占用的字节数
+func decodeDocument(bs []byte, depth int) (Document, int, error) {
+	if depth > maxNesting {
+		return nil, 0, errors.New("bson: document is nested too deeply")
+	}
+	if len(bs) < 5 {
+		return nil, 0, errShortDocument
+	}
+	size := int(int32(binary.LittleEndian.Uint32(bs)))
+	if size < 5 || size > len(bs) {
+		return nil, 0, errShortDocument
+	}
+	if bs[size-1] != 0 {
+		return nil, 0, errors.New("bson: document is not terminated")
+	}
+	doc := Document{}
+	for off := 4; off < size-1; {
+		kind := bs[off]
+		key, n, err := readCString(bs[:size-1], off+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		off += 1 + n
+		val, n, err := decodeValue(kind, bs[off:size-1], depth)
+		if err != nil {
+			return nil, 0, fmt.Errorf("bson: field %q: %w", key, err)
+		}
+		off += n
+		doc = append(doc, Pair{Key: key, Val: val})
+	}
+	return doc, size, nil
+}
+
+func decodeValue(kind byte, bs []byte, depth int) (interface{}, int, error) {
+	need := func(n int) error {
+		if len(bs) < n {
+			return errShortDocument
+		}
+		return nil
+	}
+	switch kind {
+	case kindDouble:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return bson.Float(math.Float64frombits(binary.LittleEndian.Uint64(bs))), 8, nil
+	case kindString, kindCode, kindSymbol:
+		s, n, err := readBSONString(bs)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch kind {
+		case kindCode:
+			return bson.Javascript(s), n, nil
+		case kindSymbol:
+			return bson.Symbol(s), n, nil
+		}
+		return bson.String(s), n, nil
+	case kindDocument:
+		return decodeDocument(bs, depth+1)
+	case kindArray:
+		doc, n, err := decodeDocument(bs, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		arr := make(bson.Array, 0, len(doc))
+		for _, it := range doc {
+			arr = append(arr, it.Val)
+		}
+		return arr, n, nil
+	case kindBinary:
+		if err := need(5); err != nil {
+			return nil, 0, err
+		}
+		size := int(int32(binary.LittleEndian.Uint32(bs)))
+		if size < 0 || need(5+size) != nil {
+			return nil, 0, errShortDocument
+		}
+		data := append([]byte{}, bs[5:5+size]...)
+		if subtype := bs[4]; subtype != BinaryGeneric {
+			return Binary{Subtype: subtype, Data: data}, 5 + size, nil
+		}
+		return bson.Binary(data), 5 + size, nil
+	case kindUndefined:
+		return bson.Undefined{}, 0, nil
+	case kindObjectID:
+		if err := need(12); err != nil {
+			return nil, 0, err
+		}
+		return bson.ObjectId(append([]byte{}, bs[:12]...)), 12, nil
+	case kindBool:
+		if err := need(1); err != nil {
+			return nil, 0, err
+		}
+		if bs[0] > 1 {
+			return nil, 0, fmt.Errorf("invalid boolean %d", bs[0])
+		}
+		return bson.Bool(bs[0] == 1), 1, nil
+	case kindDateTime:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return bson.UTCDateTime(binary.LittleEndian.Uint64(bs)), 8, nil
+	case kindNull:
+		return bson.Null{}, 0, nil
+	case kindRegex:
+		pattern, n, err := readCString(bs, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		options, m, err := readCString(bs, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		return bson.Regexp{Pattern: pattern, Options: options}, n + m, nil
+	case kindDBPointer:
+		ns, n, err := readBSONString(bs)
+		if err != nil {
+			return nil, 0, err
+		}
+		if need(n+12) != nil {
+			return nil, 0, errShortDocument
+		}
+		return bson.DBPointer{Name: ns, ObjectId: bson.ObjectId(append([]byte{}, bs[n:n+12]...))}, n + 12, nil
+	case kindCodeWithScope:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		size := int(int32(binary.LittleEndian.Uint32(bs)))
+		if size < 14 || need(size) != nil {
+			return nil, 0, errShortDocument
+		}
+		code, n, err := readBSONString(bs[4:size])
+		if err != nil {
+			return nil, 0, err
+		}
+		scope, m, err := decodeDocument(bs[4+n:size], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		if 4+n+m != size {
+			return nil, 0, errors.New("invalid code with scope length")
+		}
+		return CodeWithScope{Code: code, Scope: scope}, size, nil
+	case kindInt32:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		return bson.Int32(binary.LittleEndian.Uint32(bs)), 4, nil
+	case kindTimestamp:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return bson.Timestamp(binary.LittleEndian.Uint64(bs)), 8, nil
+	case kindInt64:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return bson.Int64(binary.LittleEndian.Uint64(bs)), 8, nil
+	case kindDecimal:
+		if err := need(16); err != nil {
+			return nil, 0, err
+		}
+		return Decimal128{Low: binary.LittleEndian.Uint64(bs), High: binary.LittleEndian.Uint64(bs[8:])}, 16, nil
+	case kindMinKey:
+		return bson.MinKey{}, 0, nil
+	case kindMaxKey:
+		return bson.MaxKey{}, 0, nil
+	}
+	return nil, 0, fmt.Errorf("unknown element type 0x%02x", kind)
+}
+
+// readCString 读取 offset 处以 0 结尾的字符串，返回的长度包括结尾的 0
+func readCString(bs []byte, offset int) (string, int, error) {
+	if offset > len(bs) {
+		return "", 0, errShortDocument
+	}
+	i := bytes.IndexByte(bs[offset:], 0)
+	if i < 0 {
+		return "", 0, errShortDocument
+	}
+	return string(bs[offset : offset+i]), i + 1, nil
+}
+
+// readBSONString 读取带有长度前缀的字符串
+func readBSONString(bs []byte) (string, int, error) {
+	if len(bs) < 4 {
+		return "", 0, errShortDocument
+	}
+	size := int(int32(binary.LittleEndian.Uint32(bs)))
+	if size < 1 || 4+size > len(bs) {
+		return "", 0, errShortDocument
+	}
+	if bs[3+size] != 0 {
+		return "", 0, errors.New("string is not terminated")
+	}
+	return string(bs[4 : 3+size]), 4 + size, nil
+}
+
+// encodeDocument 编码文档。sbunce/bson 会丢弃空数组，客户端因此收不到空的 firstBatch，
+// 所以常见类型都在这里编码，只有其他 Go 类型交给 sbunce/bson
+func encodeDocument(doc Document) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := appendDocument(&buf, doc, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func appendDocument(buf *bytes.Buffer, doc Document, depth int) error {
+	if depth > maxNesting {
+		return errors.New("bson: document is nested too deeply")
+	}
+	start := buf.Len()
+	buf.Write(make([]byte, 4))
+	for _, it := range doc {
+		if err := appendElement(buf, it.Key, it.Val, depth); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(0)
+	binary.LittleEndian.PutUint32(buf.Bytes()[start:], uint32(buf.Len()-start))
+	return nil
+}
+
+func appendElement(buf *bytes.Buffer, key string, val interface{}, depth int) error {
+	if strings.IndexByte(key, 0) >= 0 {
+		return fmt.Errorf("bson: key %q contains a null byte", key)
+	}
+	head := func(kind byte) {
+		buf.WriteByte(kind)
+		buf.WriteString(key)
+		buf.WriteByte(0)
+	}
+	switch v := val.(type) {
+	case nil, bson.Null:
+		head(kindNull)
+	case Document:
+		head(kindDocument)
+		return appendDocument(buf, v, depth+1)
+	case JSONDocument:
+		head(kindDocument)
+		return appendDocument(buf, Document(v), depth+1)
+	case bson.Map:
+		head(kindDocument)
+		return appendDocument(buf, sortedDocument(v), depth+1)
+	case bson.Array:
+		head(kindArray)
+		return appendDocument(buf, arrayDocument(v), depth+1)
+	case []interface{}:
+		head(kindArray)
+		return appendDocument(buf, arrayDocument(v), depth+1)
+	case []Document:
+		arr := make([]interface{}, 0, len(v))
+		for _, it := range v {
+			arr = append(arr, it)
+		}
+		head(kindArray)
+		return appendDocument(buf, arrayDocument(arr), depth+1)
+	case bson.Float:
+		head(kindDouble)
+		appendUint64(buf, math.Float64bits(float64(v)))
+	case float64:
+		head(kindDouble)
+		appendUint64(buf, math.Float64bits(v))
+	case bson.String:
+		head(kindString)
+		appendString(buf, string(v))
+	case string:
+		head(kindString)
+		appendString(buf, v)
+	case bson.Binary:
+		head(kindBinary)
+		appendBinary(buf, BinaryGeneric, v)
+	case []byte:
+		head(kindBinary)
+		appendBinary(buf, BinaryGeneric, v)
+	case Binary:
+		head(kindBinary)
+		appendBinary(buf, v.Subtype, v.Data)
+	case bson.Undefined:
+		head(kindUndefined)
+	case bson.ObjectId:
+		if len(v) != 12 {
+			return fmt.Errorf("bson: field %q: object id must be 12 bytes", key)
+		}
+		head(kindObjectID)
+		buf.Write(v)
+	case bson.Bool:
+		head(kindBool)
+		appendBool(buf, bool(v))
+	case bool:
+		head(kindBool)
+		appendBool(buf, v)
+	case bson.UTCDateTime:
+		head(kindDateTime)
+		appendUint64(buf, uint64(v))
+	case time.Time:
+		head(kindDateTime)
+		appendUint64(buf, uint64(v.UnixMilli()))
+	case bson.Regexp:
+		if strings.IndexByte(v.Pattern, 0) >= 0 || strings.IndexByte(v.Options, 0) >= 0 {
+			return fmt.Errorf("bson: field %q: regular expression contains a null byte", key)
+		}
+		head(kindRegex)
+		buf.WriteString(v.Pattern)
+		buf.WriteByte(0)
+		buf.WriteString(v.Options)
+		buf.WriteByte(0)
+	case bson.DBPointer:
+		if len(v.ObjectId) != 12 {
+			return fmt.Errorf("bson: field %q: object id must be 12 bytes", key)
+		}
+		head(kindDBPointer)
+		appendString(buf, v.Name)
+		buf.Write(v.ObjectId)
+	case bson.Javascript:
+		head(kindCode)
+		appendString(buf, string(v))
+	case bson.Symbol:
+		head(kindSymbol)
+		appendString(buf, string(v))
+	case CodeWithScope:
+		head(kindCodeWithScope)
+		return appendCodeWithScope(buf, v.Code, v.Scope, depth)
+	case bson.JavascriptScope:
+		head(kindCodeWithScope)
+		return appendCodeWithScope(buf, v.Javascript, sortedDocument(v.Scope), depth)
+	case bson.Int32:
+		head(kindInt32)
+		appendUint32(buf, uint32(v))
+	case int32:
+		head(kindInt32)
+		appendUint32(buf, uint32(v))
+	case bson.Timestamp:
+		head(kindTimestamp)
+		appendUint64(buf, uint64(v))
+	case bson.Int64:
+		head(kindInt64)
+		appendUint64(buf, uint64(v))
+	case int64:
+		head(kindInt64)
+		appendUint64(buf, uint64(v))
+	case int:
+		// 与 sbunce/bson 一致，int 编码为 int64
+		head(kindInt64)
+		appendUint64(buf, uint64(v))
+	case Decimal128:
+		head(kindDecimal)
+		appendUint64(buf, v.Low)
+		appendUint64(buf, v.High)
+	case bson.MinKey:
+		head(kindMinKey)
+	case bson.MaxKey:
+		head(kindMaxKey)
+	default:
+		// 单个元素的文档去掉长度前缀与结尾的 0 即为元素本身
+		bs, err := bson.Slice{{Key: key, Val: val}}.Encode()
+		if err != nil {
+			return err
+		}
+		buf.Write(bs[4 : len(bs)-1])
+	}
+	return nil
+}
+
+func appendCodeWithScope(buf *bytes.Buffer, code string, scope Document, depth int) error {
+	start := buf.Len()
+	buf.Write(make([]byte, 4))
+	appendString(buf, code)
+	if err := appendDocument(buf, scope, depth+1); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(buf.Bytes()[start:], uint32(buf.Len()-start))
+	return nil
+}
+
+func appendUint32(buf *bytes.Buffer, v uint32) {
+	buf.Write(binary.LittleEndian.AppendUint32(nil, v))
+}
+
+func appendUint64(buf *bytes.Buffer, v uint64) {
+	buf.Write(binary.LittleEndian.AppendUint64(nil, v))
+}
+
+func appendString(buf *bytes.Buffer, s string) {
+	appendUint32(buf, uint32(len(s)+1))
+	buf.WriteString(s)
+	buf.WriteByte(0)
+}
+
+func appendBinary(buf *bytes.Buffer, subtype byte, data []byte) {
+	appendUint32(buf, uint32(len(data)))
+	buf.WriteByte(subtype)
+	buf.Write(data)
+}
+
+func appendBool(buf *bytes.Buffer, v bool) {
+	if v {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+}
+
+// arrayDocument 数组按下标作为键编码
+func arrayDocument(arr []interface{}) Document {
+	doc := make(Document, 0, len(arr))
+	for i, it := range arr {
+		doc = append(doc, Pair{Key: strconv.Itoa(i), Val: it})
+	}
+	return doc
+}
+
+// sortedDocument bson.Map 没有顺序，按字段名排序保证输出稳定
+func sortedDocument(m bson.Map) Document {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	doc := make(Document, 0, len(m))
+	for _, k := range keys {
+		doc = append(doc, Pair{Key: k, Val: m[k]})
+	}
+	return doc
+}
@@ -0,0 +1,283 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"testing"
+
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试中按 BSON 规范直接拼出字节，不依赖被测的编码器
+
+func rawElement(kind byte, key string, payload ...[]byte) []byte {
+	out := append([]byte{kind}, key...)
+	out = append(out, 0)
+	for _, it := range payload {
+		out = append(out, it...)
+	}
+	return out
+}
+
+func rawDocument(elements ...[]byte) []byte {
+	body := bytes.Join(elements, nil)
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(body)+5))
+	return append(append(out, body...), 0)
+}
+
+func rawString(s string) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(len(s)+1)), append([]byte(s), 0)...)
+}
+
+func rawCString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func rawInt32(n int32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, uint32(n))
+}
+
+func rawInt64(n int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(n))
+}
+
+func rawBinary(subtype byte, data []byte) []byte {
+	return append(append(rawInt32(int32(len(data))), subtype), data...)
+}
+
+var (
+	oid  = []byte{0x5f, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	uuid = []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}
+)
+
+// allTypes 包括 sbunce/bson 无法原样保留的类型：二进制子类型、Decimal128、保持顺序的作用域、
+// 超过 10 个元素的数组以及数组中的文档
+func allTypes() []byte {
+	arr := make([][]byte, 0, 12)
+	for i := 0; i < 11; i++ {
+		arr = append(arr, rawElement(0x10, strconv.Itoa(i), rawInt32(int32(i))))
+	}
+	arr = append(arr, rawElement(0x03, "11", rawDocument(
+		rawElement(0x02, "z", rawString("last")),
+		rawElement(0x02, "a", rawString("first")),
+	)))
+	scope := rawDocument(rawElement(0x10, "z", rawInt32(1)), rawElement(0x10, "a", rawInt32(2)))
+	code := rawString("function() { return z + a; }")
+	cws := append(rawInt32(int32(4+len(code)+len(scope))), append(code, scope...)...)
+	return rawDocument(
+		rawElement(0x01, "double", rawInt64(0x3ff8000000000000)),
+		rawElement(0x02, "string", rawString("héllo")),
+		rawElement(0x03, "doc", rawDocument(rawElement(0x0a, "null"))),
+		rawElement(0x04, "array", rawDocument(arr...)),
+		rawElement(0x04, "empty", rawDocument()),
+		rawElement(0x05, "generic", rawBinary(0x00, []byte("bin"))),
+		rawElement(0x05, "uuid", rawBinary(0x04, uuid)),
+		rawElement(0x05, "legacyUuid", rawBinary(0x03, uuid)),
+		rawElement(0x05, "old", rawBinary(0x02, append(rawInt32(2), 'o', 'k'))),
+		rawElement(0x05, "user", rawBinary(0x80, []byte{1})),
+		rawElement(0x06, "undefined"),
+		rawElement(0x07, "oid", oid),
+		rawElement(0x08, "bool", []byte{1}),
+		rawElement(0x09, "date", rawInt64(-86400000)),
+		rawElement(0x0b, "regex", rawCString("^a.*"), rawCString("imx")),
+		rawElement(0x0c, "dbPointer", rawString("db.coll"), oid),
+		rawElement(0x0d, "code", rawString("function() {}")),
+		rawElement(0x0e, "symbol", rawString("sym")),
+		rawElement(0x0f, "codeWithScope", cws),
+		rawElement(0x10, "int32", rawInt32(-5)),
+		rawElement(0x11, "timestamp", rawInt32(7), rawInt32(1700000000)),
+		rawElement(0x12, "int64", rawInt64(1<<53+1)),
+		// 1.5 即系数 15、指数 -1
+		rawElement(0x13, "decimal", rawInt64(15), rawInt64(int64(6175)<<49)),
+		rawElement(0xff, "minKey"),
+		rawElement(0x7f, "maxKey"),
+	)
+}
+
+func TestDecodeDocument(t *testing.T) {
+	raw := allTypes()
+	doc, err := DecodeDocument(raw)
+	if !assert.NoError(t, err) {
+		return
+	}
+	out, err := EncodeDocument(doc)
+	assert.NoError(t, err)
+	assert.Equal(t, raw, out)
+
+	arr, _ := Load(doc, "array")
+	if assert.Len(t, arr, 12) {
+		assert.Equal(t, bson.Int32(10), arr.(bson.Array)[10])
+		assert.Equal(t, Document{{Key: "z", Val: bson.String("last")}, {Key: "a", Val: bson.String("first")}}, arr.(bson.Array)[11])
+	}
+	uuidVal, _ := Load(doc, "uuid")
+	s, ok := uuidVal.(Binary).UUID()
+	assert.True(t, ok)
+	assert.Equal(t, "12345678-9abc-def0-1234-56789abcdef0", s)
+	regex, _ := Load(doc, "regex")
+	assert.Equal(t, bson.Regexp{Pattern: "^a.*", Options: "imx"}, regex)
+	ts, _ := Load(doc, "timestamp")
+	sec, inc := Timestamp(ts.(bson.Timestamp))
+	assert.Equal(t, uint32(1700000000), sec)
+	assert.Equal(t, uint32(7), inc)
+	dec, _ := Load(doc, "decimal")
+	assert.Equal(t, "1.5", dec.(Decimal128).String())
+	cws, _ := Load(doc, "codeWithScope")
+	assert.Equal(t, "z", cws.(CodeWithScope).Scope[0].Key)
+
+	// Extended JSON 也能完整还原
+	js, err := MarshalExtJSON(doc, true)
+	assert.NoError(t, err)
+	back, err := UnmarshalExtJSON(js)
+	assert.NoError(t, err)
+	out, err = EncodeDocument(back)
+	assert.NoError(t, err)
+	assert.Equal(t, raw, out)
+
+	// 任意截断或损坏都返回错误而不是 panic
+	for i := 0; i < len(raw); i++ {
+		_, err := DecodeDocument(raw[:i])
+		assert.Error(t, err, i)
+	}
+	for i := 4; i < len(raw)-1; i++ {
+		bad := append([]byte{}, raw...)
+		bad[i] ^= 0xff
+		assert.NotPanics(t, func() { DecodeDocument(bad) }, i)
+	}
+	_, err = DecodeDocument(append(raw, 0))
+	assert.Error(t, err)
+}
+
+// TestRoundTrip 每种操作码解码后重新编码，与原始字节一致
+func TestRoundTrip(t *testing.T) {
+	raw := allTypes()
+	doc, err := DecodeDocument(raw)
+	if !assert.NoError(t, err) {
+		return
+	}
+	header := func(code OpCode) *Header {
+		return &Header{OpCode: code, RequestID: 3, ResponseTo: 2}
+	}
+
+	query := NewOpQuery()
+	query.OpHeader = header(OpCodeQuery)
+	query.FullCollectionName = "db.coll"
+	query.NumberToReturn = -1
+	query.Query, query.ReturnFieldsSelector = doc, doc
+
+	reply := NewOpReply()
+	reply.OpHeader = header(OpCodeReply)
+	reply.CursorID = 1 << 40
+	reply.NumberReturned = 2
+	reply.Documents = []Document{doc, doc}
+
+	insert := NewOpInsert()
+	insert.OpHeader = header(OpCodeInsert)
+	insert.FullCollectionName = "db.coll"
+	insert.Documents = []Document{doc}
+
+	update := NewOpUpdate()
+	update.OpHeader = header(OpCodeUpdate)
+	update.FullCollectionName = "db.coll"
+	update.Selector, update.Update = doc, doc
+
+	del := NewOpDelete()
+	del.OpHeader = header(OpCodeDel)
+	del.FullCollectionName = "db.coll"
+	del.Selector = doc
+
+	getMore := NewOpGetMore()
+	getMore.OpHeader = header(OpCodeGetMore)
+	getMore.FullCollectionName = "db.coll"
+	getMore.CursorID = 1 << 40
+
+	kill := NewOpKillCursors()
+	kill.OpHeader = header(OpCodeKillCursor)
+	kill.NumberOfCursorIDs = 2
+	kill.CursorIDs = []int64{1, 1 << 40}
+
+	cmd := NewOpCommand()
+	cmd.OpHeader = header(OpCodeCmd)
+	cmd.Database = "db"
+	cmd.CommandName = "insert"
+	cmd.Metadata, cmd.CommandArgs = Document{}, doc
+	cmd.InputDocs = []Document{doc}
+
+	cmdReply := NewOpCommandReply()
+	cmdReply.OpHeader = header(OpCodeCmdReply)
+	cmdReply.Metadata, cmdReply.CommandReply = Document{}, doc
+	cmdReply.OutputDocs = []Document{doc}
+
+	msg := NewOpMessage()
+	msg.OpHeader = header(OpCodeMessage)
+	msg.FlagBits = MsgFlagChecksumPresent
+	msg.Body = doc
+	msg.Sequences = []DocumentSequence{{Identifier: "documents", Documents: []Document{doc, doc}}}
+
+	legacy := NewOpMsg()
+	legacy.OpHeader = header(OpCodeMsg)
+	legacy.Message = "hello"
+
+	for _, it := range []Message{query, reply, insert, update, del, getMore, kill, cmd, cmdReply, msg, legacy} {
+		name := it.Header().OpCode.String()
+		bs, err := it.Encode()
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		decoded, err := Decode(bs)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		again, err := decoded.Encode()
+		assert.NoError(t, err, name)
+		assert.Equal(t, bs, again, name)
+		if it != getMore && it != kill && it != legacy {
+			assert.True(t, bytes.Contains(bs, raw), name)
+		}
+		// 截断的帧要么报错，要么恰好落在字段边界上，重新编码后长度不变（OP_MSG 会重新计算校验和）
+		for i := HeaderLength; i < len(bs); i++ {
+			cut := append([]byte{}, bs[:i]...)
+			binary.LittleEndian.PutUint32(cut, uint32(i))
+			assert.NotPanics(t, func() {
+				decoded, err := Decode(cut)
+				if err != nil {
+					return
+				}
+				again, err := decoded.Encode()
+				assert.NoError(t, err, "%s size=%d", name, i)
+				assert.Len(t, again, i, "%s size=%d", name, i)
+			}, "%s size=%d", name, i)
+		}
+	}
+}
+
+func TestDecimal128(t *testing.T) {
+	for _, it := range []struct{ in, out string }{
+		{"0", "0"},
+		{"-0", "-0"},
+		{"1.5", "1.5"},
+		{"-1.50", "-1.50"},
+		{"0.001", "0.001"},
+		{"1E+3", "1E+3"},
+		{"1000", "1000"},
+		{"0.0000001", "1E-7"},
+		{"12345678901234567890123456789012.34", "12345678901234567890123456789012.34"},
+		{"9.999999999999999999999999999999999E+6144", "9.999999999999999999999999999999999E+6144"},
+		{"1E-6176", "1E-6176"},
+		{"1E+6112", "1.0E+6112"},
+		{"NaN", "NaN"},
+		{"-Infinity", "-Infinity"},
+	} {
+		d, err := ParseDecimal128(it.in)
+		if assert.NoError(t, err, it.in) {
+			assert.Equal(t, it.out, d.String(), it.in)
+		}
+	}
+	for _, it := range []string{"", ".", "1e", "abc", "1.2.3", "12345678901234567890123456789012345", "1E-6177", "1E+6145"} {
+		_, err := ParseDecimal128(it)
+		assert.Error(t, err, it)
+	}
+	d, _ := ParseDecimal128("2.5")
+	assert.Equal(t, 2.5, d.Float64())
+}
@@ -0,0 +1,293 @@
+package protocol
+
+import (
+	"strings"
+
+	"github.com/sbunce/bson"
+)
+
+const cmdCollection = "$cmd"
+
+// Command 统一描述通过 OP_QUERY、OP_COMMAND 或 OP_MSG 发送的数据库命令
+type Command struct {
+	Name     string
+	Database string
+	Args     Document
+}
+
+// Collection 返回命令作用的集合，find/insert/count 等命令的第一个值即集合名，getMore 使用 collection 字段
+func (p *Command) Collection() string {
+	if p.Name == "getMore" {
+		if v, ok := Load(p.Args, "collection"); ok {
+			return toString(v)
+		}
+		return ""
+	}
+	if len(p.Args) == 0 {
+		return ""
+	}
+	return toString(p.Args[0].Val)
+}
+
+// TableName 返回命令作用的命名空间
+func (p *Command) TableName() (*TableName, bool) {
+	coll := p.Collection()
+	if p.Database == "" || coll == "" {
+		return nil, false
+	}
+	return &TableName{p.Database, coll}, true
+}
+
+// ParseCommand 从消息中解析命令，非命令消息返回 false
+func ParseCommand(msg Message) (*Command, bool) {
+	var cmd *Command
+	switch v := msg.(type) {
+	case *OpQuery:
+		tbl, ok := v.TableName()
+		if !ok || tbl.Collection != cmdCollection {
+			return nil, false
+		}
+		args := v.Query
+		// 旧版驱动会将命令包装在 $query 中
+		if wrapped, ok := Load(args, "$query"); ok {
+			if doc, ok := wrapped.(Document); ok {
+				args = doc
+			}
+		}
+		cmd = &Command{Database: tbl.Database, Args: args}
+	case *OpCommand:
+		cmd = &Command{Name: v.CommandName, Database: v.Database, Args: v.CommandArgs}
+	case *OpMessage:
+		// kind=1 的文档序列等价于 body 中的同名数组
+		args := v.Body
+		if len(v.Sequences) > 0 {
+			args = make(Document, 0, len(v.Body)+len(v.Sequences))
+			args = append(args, v.Body...)
+			for _, seq := range v.Sequences {
+				arr := make(bson.Array, 0, len(seq.Documents))
+				for _, doc := range seq.Documents {
+					arr = append(arr, doc)
+				}
+				args = append(args, Pair{Key: seq.Identifier, Val: arr})
+			}
+		}
+		cmd = &Command{Args: args}
+	default:
+		return nil, false
+	}
+	if len(cmd.Args) == 0 {
+		return nil, false
+	}
+	if cmd.Name == "" {
+		cmd.Name = cmd.Args[0].Key
+	}
+	if db, ok := Load(cmd.Args, "$db"); ok {
+		cmd.Database = toString(db)
+	}
+	return cmd, true
+}
+
+// Operation 返回消息对应的操作名与命名空间，命令使用小写的命令名，
+// 旧版操作使用 find、insert、update、delete、getmore 与 killcursors
+func Operation(msg Message) (name, ns string, ok bool) {
+	if cmd, isCmd := ParseCommand(msg); isCmd {
+		ns = cmd.Database
+		if coll := cmd.Collection(); coll != "" {
+			ns = cmd.Database + "." + coll
+		}
+		return strings.ToLower(cmd.Name), ns, true
+	}
+	switch v := msg.(type) {
+	case *OpQuery:
+		return "find", v.FullCollectionName, true
+	case *OpGetMore:
+		return "getmore", v.FullCollectionName, true
+	case *OpInsert:
+		return "insert", v.FullCollectionName, true
+	case *OpUpdate:
+		return "update", v.FullCollectionName, true
+	case *OpDelete:
+		return "delete", v.FullCollectionName, true
+	case *OpKillCursors:
+		return "killcursors", "", true
+	}
+	return "", "", false
+}
+
+// Filter 返回请求的查询条件，聚合返回整个 pipeline，批量写只取第一条语句
+func Filter(req Message) (interface{}, bool) {
+	if cmd, ok := ParseCommand(req); ok {
+		for _, key := range []string{"filter", "query", "pipeline"} {
+			if v, ok := Load(cmd.Args, key); ok {
+				return v, true
+			}
+		}
+		for _, key := range []string{"updates", "deletes"} {
+			if arr, ok := load(cmd.Args, key).(bson.Array); ok && len(arr) > 0 {
+				switch stmt := arr[0].(type) {
+				case Document:
+					return Load(stmt, "q")
+				case bson.Map:
+					q, ok := stmt["q"]
+					return q, ok
+				}
+			}
+		}
+		return nil, false
+	}
+	switch v := req.(type) {
+	case *OpQuery:
+		if q, ok := Load(v.Query, "$query"); ok {
+			return q, true
+		}
+		return v.Query, true
+	case *OpUpdate:
+		return v.Selector, true
+	case *OpDelete:
+		return v.Selector, true
+	}
+	return nil, false
+}
+
+// SetCommandArgs 用修改后的命令参数替换消息内容，OP_MSG 中来自文档序列的字段写回对应的序列
+func SetCommandArgs(msg Message, args Document) bool {
+	switch v := msg.(type) {
+	case *OpQuery:
+		if _, ok := Load(v.Query, "$query"); ok {
+			v.Query = Store(v.Query, "$query", args)
+		} else {
+			v.Query = args
+		}
+	case *OpCommand:
+		v.CommandArgs = args
+	case *OpMessage:
+		seqs := make(map[string]int, len(v.Sequences))
+		for i, seq := range v.Sequences {
+			seqs[seq.Identifier] = i
+		}
+		body := make(Document, 0, len(args))
+		for _, it := range args {
+			i, ok := seqs[it.Key]
+			if !ok {
+				body = append(body, it)
+				continue
+			}
+			arr, _ := it.Val.(bson.Array)
+			docs := make([]Document, 0, len(arr))
+			for _, d := range arr {
+				if doc, ok := d.(Document); ok {
+					docs = append(docs, doc)
+				}
+			}
+			v.Sequences[i].Documents = docs
+		}
+		v.Body = body
+	default:
+		return false
+	}
+	return true
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case bson.String:
+		return string(s)
+	}
+	return ""
+}
+
+// NewCommandMessage 按 like 的线协议格式构造一条命令请求，头部沿用 like 的 RequestID
+func NewCommandMessage(like Message, db string, args Document) Message {
+	h := *like.Header()
+	h.MessageLength = 0
+	switch v := like.(type) {
+	case *OpQuery:
+		q := NewOpQuery()
+		q.OpHeader = &h
+		q.Flags = v.Flags
+		q.FullCollectionName = db + "." + cmdCollection
+		q.NumberToReturn = -1
+		q.Query = args
+		return q
+	case *OpCommand:
+		c := NewOpCommand()
+		c.OpHeader = &h
+		c.Database = db
+		if len(args) > 0 {
+			c.CommandName = args[0].Key
+		}
+		c.Metadata = v.Metadata
+		c.CommandArgs = args
+		return c
+	case *OpMessage:
+		m := NewOpMessage()
+		m.OpHeader = &h
+		m.FlagBits = v.FlagBits
+		m.Body = Store(args, "$db", db)
+		return m
+	}
+	return nil
+}
+
+// NewCommandReply 按请求的线协议格式构造命令响应，ResponseTo 指向请求
+func NewCommandReply(req Message, doc Document) Message {
+	h := &Header{ResponseTo: req.Header().RequestID}
+	switch req.(type) {
+	case *OpQuery:
+		h.OpCode = OpCodeReply
+		reply := NewOpReply()
+		reply.OpHeader = h
+		reply.NumberReturned = 1
+		reply.Documents = []Document{doc}
+		return reply
+	case *OpCommand:
+		h.OpCode = OpCodeCmdReply
+		reply := NewOpCommandReply()
+		reply.OpHeader = h
+		reply.Metadata = Document{}
+		reply.CommandReply = doc
+		return reply
+	case *OpMessage:
+		h.OpCode = OpCodeMessage
+		reply := NewOpMessage()
+		reply.OpHeader = h
+		reply.Body = doc
+		return reply
+	}
+	return nil
+}
+
+// SetReplyDocument 替换命令响应中的结果文档
+func SetReplyDocument(msg Message, doc Document) bool {
+	switch v := msg.(type) {
+	case *OpReply:
+		if len(v.Documents) > 0 {
+			v.Documents[0] = doc
+			return true
+		}
+	case *OpCommandReply:
+		v.CommandReply = doc
+		return true
+	case *OpMessage:
+		v.Body = doc
+		return true
+	}
+	return false
+}
+
+// ReplyDocument 返回命令响应中的结果文档
+func ReplyDocument(msg Message) (Document, bool) {
+	switch v := msg.(type) {
+	case *OpReply:
+		if len(v.Documents) > 0 {
+			return v.Documents[0], true
+		}
+	case *OpCommandReply:
+		return v.CommandReply, v.CommandReply != nil
+	case *OpMessage:
+		return v.Body, v.Body != nil
+	}
+	return nil, false
+}
@@ -0,0 +1,46 @@
+package protocol
+
+// NewMessage 按操作码创建空消息，不支持的操作码返回 nil
+func NewMessage(code OpCode) Message {
+	switch code {
+	case OpCodeReply:
+		return NewOpReply()
+	case OpCodeMsg:
+		return NewOpMsg()
+	case OpCodeUpdate:
+		return NewOpUpdate()
+	case OpCodeInsert:
+		return NewOpInsert()
+	case OpCodeQuery:
+		return NewOpQuery()
+	case OpCodeGetMore:
+		return NewOpGetMore()
+	case OpCodeDel:
+		return NewOpDelete()
+	case OpCodeKillCursor:
+		return NewOpKillCursors()
+	case OpCodeCmd:
+		return NewOpCommand()
+	case OpCodeCmdReply:
+		return NewOpCommandReply()
+	case OpCodeMessage:
+		return NewOpMessage()
+	}
+	return nil
+}
+
+// Decode 解码一个完整的消息帧，包括 16 字节的消息头
+func Decode(bs []byte) (Message, error) {
+	if len(bs) < HeaderLength {
+		return nil, errHeaderLength
+	}
+	code := ParseOpCode(bs)
+	msg := NewMessage(code)
+	if msg == nil {
+		return nil, &errOpCode{code}
+	}
+	if err := msg.Decode(bs); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
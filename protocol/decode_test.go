@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var allOpCodes = []OpCode{
+	OpCodeReply, OpCodeMsg, OpCodeUpdate, OpCodeInsert, OpCodeQuery, OpCodeGetMore,
+	OpCodeDel, OpCodeKillCursor, OpCodeCmd, OpCodeCmdReply, OpCodeMessage,
+}
+
+// frame 构造指定操作码的帧，消息头之后填充 fill
+func frame(code OpCode, size int, fill byte) []byte {
+	bs := bytes.Repeat([]byte{fill}, size)
+	binary.LittleEndian.PutUint32(bs, uint32(size))
+	binary.LittleEndian.PutUint32(bs[4:], 1)
+	binary.LittleEndian.PutUint32(bs[8:], 0)
+	binary.LittleEndian.PutUint32(bs[12:], uint32(code))
+	return bs
+}
+
+func TestDecode_Truncated(t *testing.T) {
+	for _, code := range allOpCodes {
+		// 只有消息头的帧缺少必需的字段
+		_, err := Decode(frame(code, HeaderLength, 0))
+		assert.Error(t, err, code.String())
+		for size := HeaderLength; size < HeaderLength+40; size++ {
+			for _, fill := range []byte{0, 0xff} {
+				bs := frame(code, size, fill)
+				assert.NotPanics(t, func() { Decode(bs) }, "%s size=%d fill=%x", code, size, fill)
+			}
+		}
+	}
+	// 字符串没有结尾的 0
+	_, err := Decode(frame(OpCodeQuery, 20, 0xff))
+	assert.Error(t, err)
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, code := range allOpCodes {
+		f.Add(frame(code, HeaderLength, 0))
+		f.Add(frame(code, HeaderLength+8, 0xff))
+	}
+	query := NewOpQuery()
+	query.OpHeader = &Header{OpCode: OpCodeQuery, RequestID: 1}
+	query.FullCollectionName = "db.$cmd"
+	query.NumberToReturn = -1
+	query.Query = Document{{Key: "ping", Val: int32(1)}}
+	msg := NewOpMessage()
+	msg.OpHeader = &Header{OpCode: OpCodeMessage, RequestID: 2}
+	msg.FlagBits = MsgFlagChecksumPresent
+	msg.Body = Document{{Key: "insert", Val: "users"}, {Key: "$db", Val: "app"}}
+	msg.Sequences = []DocumentSequence{{Identifier: "documents", Documents: []Document{{{Key: "a", Val: int32(1)}}}}}
+	for _, it := range []Message{query, msg} {
+		bs, err := it.Encode()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(bs)
+	}
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		// 任意输入都只能返回错误，不能 panic
+		msg, err := Decode(bs)
+		if err == nil {
+			msg.Encode()
+		}
+	})
+}
@@ -2,7 +2,9 @@ package protocol
 
 import "fmt"
 
-var errHeaderLength = fmt.Errorf(fmt.Sprintf("at least %d bytes", HeaderLength))
+var errHeaderLength = fmt.Errorf("at least %d bytes", HeaderLength)
+
+var errBodySection = fmt.Errorf("OP_MSG must contain exactly one body section")
 
 type errMessageLength struct {
 	need, actually int
@@ -19,3 +21,19 @@ type errMessageOffset struct {
 func (p *errMessageOffset) Error() string {
 	return fmt.Sprintf("broken message: read=%d, total=%d", p.offset, p.totals)
 }
+
+type errSectionKind struct {
+	kind byte
+}
+
+func (p *errSectionKind) Error() string {
+	return fmt.Sprintf("bad OP_MSG section kind %d", p.kind)
+}
+
+type errOpCode struct {
+	code OpCode
+}
+
+func (p *errOpCode) Error() string {
+	return fmt.Sprintf("unsupported opcode %d", int32(p.code))
+}
@@ -0,0 +1,668 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbunce/bson"
+)
+
+// MongoDB Extended JSON v2，见 https://www.mongodb.com/docs/manual/reference/mongodb-extended-json/
+// Canonical 模式保留全部类型信息；Relaxed 模式中 int32、int64 与有限的 double 输出为 JSON 数字，
+// 1970 到 9999 年之间的时间输出为 ISO-8601 字符串，更易阅读但可能丢失数字类型
+
+// MarshalExtJSON 将文档编码为 Extended JSON，canonical 为 false 时使用 relaxed 模式
+func MarshalExtJSON(doc Document, canonical bool) ([]byte, error) {
+	e := &extEncoder{canonical: canonical}
+	if err := e.value(doc); err != nil {
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalExtJSON 解析 canonical 或 relaxed 模式的 Extended JSON 文档，字段保持原有顺序。
+// 没有类型包装的数字按大小依次解析为 int32、int64 或 double
+func UnmarshalExtJSON(data []byte) (Document, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := parseJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("extjson: unexpected data after document")
+	}
+	doc, ok := v.(Document)
+	if !ok {
+		return nil, errors.New("extjson: top-level value is not a document")
+	}
+	out, err := fromExtJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+	return out.(Document), nil
+}
+
+// JSONDocument 经 encoding/json 编解码时使用 relaxed 模式的 Extended JSON，用于管理接口等 JSON 输出
+type JSONDocument Document
+
+func (p JSONDocument) MarshalJSON() ([]byte, error) {
+	if p == nil {
+		return []byte("null"), nil
+	}
+	return MarshalExtJSON(Document(p), false)
+}
+
+func (p *JSONDocument) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*p = nil
+		return nil
+	}
+	doc, err := UnmarshalExtJSON(data)
+	if err != nil {
+		return err
+	}
+	*p = JSONDocument(doc)
+	return nil
+}
+
+type extEncoder struct {
+	buf       bytes.Buffer
+	canonical bool
+}
+
+func (p *extEncoder) value(v interface{}) error {
+	switch d := v.(type) {
+	case nil, bson.Null:
+		p.buf.WriteString("null")
+	case Document:
+		return p.document(d)
+	case JSONDocument:
+		return p.document(Document(d))
+	case bson.Map:
+		return p.document(sortedDocument(d))
+	case bson.Array:
+		return p.array(d)
+	case []interface{}:
+		return p.array(d)
+	case []Document:
+		arr := make([]interface{}, 0, len(d))
+		for _, it := range d {
+			arr = append(arr, it)
+		}
+		return p.array(arr)
+	case bson.String:
+		p.string(string(d))
+	case string:
+		p.string(d)
+	case bson.Bool:
+		p.buf.WriteString(strconv.FormatBool(bool(d)))
+	case bool:
+		p.buf.WriteString(strconv.FormatBool(d))
+	case bson.Int32:
+		p.int32(int32(d))
+	case int32:
+		p.int32(d)
+	case bson.Int64:
+		p.int64(int64(d))
+	case int64:
+		p.int64(d)
+	case int:
+		p.int64(int64(d))
+	case bson.Float:
+		p.double(float64(d))
+	case float64:
+		p.double(d)
+	case bson.ObjectId:
+		p.objectID(d)
+	case bson.UTCDateTime:
+		p.datetime(int64(d))
+	case time.Time:
+		p.datetime(d.UnixMilli())
+	case bson.Binary:
+		p.binary(d, 0)
+	case []byte:
+		p.binary(d, 0)
+	case Binary:
+		p.binary(d.Data, d.Subtype)
+	case Decimal128:
+		p.buf.WriteString(`{"$numberDecimal":"` + d.String() + `"}`)
+	case bson.Timestamp:
+		p.buf.WriteString(`{"$timestamp":{"t":` + strconv.FormatUint(uint64(d)>>32, 10) +
+			`,"i":` + strconv.FormatUint(uint64(d)&math.MaxUint32, 10) + `}}`)
+	case bson.Regexp:
+		p.buf.WriteString(`{"$regularExpression":{"pattern":`)
+		p.string(d.Pattern)
+		p.buf.WriteString(`,"options":`)
+		p.string(sortOptions(d.Options))
+		p.buf.WriteString(`}}`)
+	case bson.DBPointer:
+		p.buf.WriteString(`{"$dbPointer":{"$ref":`)
+		p.string(d.Name)
+		p.buf.WriteString(`,"$id":`)
+		p.objectID(d.ObjectId)
+		p.buf.WriteString(`}}`)
+	case bson.Javascript:
+		p.buf.WriteString(`{"$code":`)
+		p.string(string(d))
+		p.buf.WriteByte('}')
+	case CodeWithScope:
+		p.buf.WriteString(`{"$code":`)
+		p.string(d.Code)
+		p.buf.WriteString(`,"$scope":`)
+		if err := p.document(d.Scope); err != nil {
+			return err
+		}
+		p.buf.WriteByte('}')
+	case bson.JavascriptScope:
+		p.buf.WriteString(`{"$code":`)
+		p.string(d.Javascript)
+		p.buf.WriteString(`,"$scope":`)
+		if err := p.value(d.Scope); err != nil {
+			return err
+		}
+		p.buf.WriteByte('}')
+	case bson.Symbol:
+		p.buf.WriteString(`{"$symbol":`)
+		p.string(string(d))
+		p.buf.WriteByte('}')
+	case bson.MinKey:
+		p.buf.WriteString(`{"$minKey":1}`)
+	case bson.MaxKey:
+		p.buf.WriteString(`{"$maxKey":1}`)
+	case bson.Undefined:
+		p.buf.WriteString(`{"$undefined":true}`)
+	default:
+		return fmt.Errorf("extjson: unsupported type %T", v)
+	}
+	return nil
+}
+
+func (p *extEncoder) document(doc Document) error {
+	p.buf.WriteByte('{')
+	for i, it := range doc {
+		if i > 0 {
+			p.buf.WriteByte(',')
+		}
+		p.string(it.Key)
+		p.buf.WriteByte(':')
+		if err := p.value(it.Val); err != nil {
+			return err
+		}
+	}
+	p.buf.WriteByte('}')
+	return nil
+}
+
+func (p *extEncoder) array(arr []interface{}) error {
+	p.buf.WriteByte('[')
+	for i, it := range arr {
+		if i > 0 {
+			p.buf.WriteByte(',')
+		}
+		if err := p.value(it); err != nil {
+			return err
+		}
+	}
+	p.buf.WriteByte(']')
+	return nil
+}
+
+func (p *extEncoder) string(s string) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	p.buf.Write(bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}))
+}
+
+func (p *extEncoder) int32(n int32) {
+	if p.canonical {
+		p.buf.WriteString(`{"$numberInt":"` + strconv.FormatInt(int64(n), 10) + `"}`)
+		return
+	}
+	p.buf.WriteString(strconv.FormatInt(int64(n), 10))
+}
+
+func (p *extEncoder) int64(n int64) {
+	if p.canonical {
+		p.buf.WriteString(`{"$numberLong":"` + strconv.FormatInt(n, 10) + `"}`)
+		return
+	}
+	p.buf.WriteString(strconv.FormatInt(n, 10))
+}
+
+func (p *extEncoder) double(f float64) {
+	if p.canonical || math.IsNaN(f) || math.IsInf(f, 0) {
+		p.buf.WriteString(`{"$numberDouble":"` + formatDouble(f) + `"}`)
+		return
+	}
+	p.buf.WriteString(formatDouble(f))
+}
+
+func (p *extEncoder) objectID(id bson.ObjectId) {
+	p.buf.WriteString(`{"$oid":"` + hex.EncodeToString(id) + `"}`)
+}
+
+func (p *extEncoder) datetime(ms int64) {
+	t := time.UnixMilli(ms).UTC()
+	if p.canonical || t.Year() < 1970 || t.Year() > 9999 {
+		p.buf.WriteString(`{"$date":{"$numberLong":"` + strconv.FormatInt(ms, 10) + `"}}`)
+		return
+	}
+	p.buf.WriteString(`{"$date":"` + t.Format("2006-01-02T15:04:05.999Z07:00") + `"}`)
+}
+
+func (p *extEncoder) binary(bs []byte, subtype byte) {
+	p.buf.WriteString(`{"$binary":{"base64":"` + base64.StdEncoding.EncodeToString(bs) +
+		`","subType":"` + hex.EncodeToString([]byte{subtype}) + `"}}`)
+}
+
+// formatDouble 整数值保留小数点以区分 double 与整数
+func formatDouble(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case f == math.Trunc(f) && math.Abs(f) < 1e15:
+		if f == 0 && math.Signbit(f) {
+			return "-0.0"
+		}
+		return strconv.FormatFloat(f, 'f', 1, 64)
+	}
+	return strconv.FormatFloat(f, 'G', -1, 64)
+}
+
+// sortOptions 正则选项按字母顺序输出
+func sortOptions(s string) string {
+	bs := []byte(s)
+	sort.Slice(bs, func(i, j int) bool { return bs[i] < bs[j] })
+	return string(bs)
+}
+
+// parseJSON 按顺序读取 JSON 值，对象解析为 Document，数组解析为 []interface{}，数字保留为 json.Number
+func parseJSON(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("extjson: %w", err)
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			doc := Document{}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, fmt.Errorf("extjson: %w", err)
+				}
+				val, err := parseJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				doc = append(doc, Pair{Key: key.(string), Val: val})
+			}
+			_, err := dec.Token()
+			return doc, err
+		case '[':
+			arr := []interface{}{}
+			for dec.More() {
+				val, err := parseJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, val)
+			}
+			_, err := dec.Token()
+			return arr, err
+		}
+		return nil, fmt.Errorf("extjson: unexpected %v", t)
+	}
+	return tok, nil
+}
+
+// fromExtJSON 将 parseJSON 的结果转换为 BSON 值，识别 $ 开头的类型包装
+func fromExtJSON(v interface{}) (interface{}, error) {
+	switch d := v.(type) {
+	case nil:
+		return bson.Null{}, nil
+	case bool:
+		return bson.Bool(d), nil
+	case string:
+		return bson.String(d), nil
+	case json.Number:
+		return parseNumber(string(d))
+	case []interface{}:
+		out := make(bson.Array, 0, len(d))
+		for _, it := range d {
+			val, err := fromExtJSON(it)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, val)
+		}
+		return out, nil
+	case Document:
+		if len(d) > 0 && strings.HasPrefix(d[0].Key, "$") {
+			if val, ok, err := fromWrapper(d); ok || err != nil {
+				return val, err
+			}
+		}
+		out := make(Document, 0, len(d))
+		for _, it := range d {
+			val, err := fromExtJSON(it.Val)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, Pair{Key: it.Key, Val: val})
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("extjson: unexpected value %v", v)
+}
+
+func parseNumber(s string) (interface{}, error) {
+	if !strings.ContainsAny(s, ".eE") {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			if n >= math.MinInt32 && n <= math.MaxInt32 {
+				return bson.Int32(n), nil
+			}
+			return bson.Int64(n), nil
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("extjson: invalid number %s", s)
+	}
+	return bson.Float(f), nil
+}
+
+// fromWrapper 解析类型包装，第一个键不是已知的包装时 ok 为 false，按普通文档处理
+func fromWrapper(doc Document) (val interface{}, ok bool, err error) {
+	key := doc[0].Key
+	invalid := func() (interface{}, bool, error) {
+		return nil, true, fmt.Errorf("extjson: invalid %s value", key)
+	}
+	keys := func(want ...string) bool {
+		if len(doc) != len(want) {
+			return false
+		}
+		for i, it := range want {
+			if doc[i].Key != it {
+				return false
+			}
+		}
+		return true
+	}
+	switch key {
+	case "$oid":
+		s, ok := doc[0].Val.(string)
+		if !keys("$oid") || !ok {
+			return invalid()
+		}
+		id, err := parseObjectID(s)
+		if err != nil {
+			return invalid()
+		}
+		return id, true, nil
+	case "$symbol", "$numberInt", "$numberLong", "$numberDouble", "$numberDecimal", "$uuid":
+		s, ok := doc[0].Val.(string)
+		if !keys(key) || !ok {
+			return invalid()
+		}
+		switch key {
+		case "$symbol":
+			return bson.Symbol(s), true, nil
+		case "$numberInt":
+			n, err := strconv.ParseInt(s, 10, 32)
+			if err != nil {
+				return invalid()
+			}
+			return bson.Int32(n), true, nil
+		case "$numberLong":
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return invalid()
+			}
+			return bson.Int64(n), true, nil
+		case "$numberDecimal":
+			d, err := ParseDecimal128(s)
+			if err != nil {
+				return invalid()
+			}
+			return d, true, nil
+		case "$uuid":
+			b, err := ParseUUID(s)
+			if err != nil {
+				return invalid()
+			}
+			return b, true, nil
+		}
+		f, err := parseDouble(s)
+		if err != nil {
+			return invalid()
+		}
+		return bson.Float(f), true, nil
+	case "$binary":
+		var (
+			data    string
+			subtype string
+		)
+		if sub, ok := doc[0].Val.(Document); ok && len(doc) == 1 {
+			// {"$binary":{"base64":...,"subType":...}}，两个字段的顺序不限
+			for _, it := range sub {
+				s, ok := it.Val.(string)
+				if !ok {
+					return invalid()
+				}
+				switch it.Key {
+				case "base64":
+					data = s
+				case "subType":
+					subtype = s
+				default:
+					return invalid()
+				}
+			}
+			if len(sub) != 2 {
+				return invalid()
+			}
+		} else if s, ok := doc[0].Val.(string); ok && keys("$binary", "$type") {
+			// 旧版的 {"$binary":...,"$type":...}
+			data = s
+			if subtype, ok = doc[1].Val.(string); !ok {
+				return invalid()
+			}
+		} else {
+			return invalid()
+		}
+		bs, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return invalid()
+		}
+		kind, err := strconv.ParseUint(subtype, 16, 8)
+		if err != nil || len(subtype) > 2 {
+			return invalid()
+		}
+		if byte(kind) != BinaryGeneric {
+			return Binary{Subtype: byte(kind), Data: bs}, true, nil
+		}
+		return bson.Binary(bs), true, nil
+	case "$code":
+		code, ok := doc[0].Val.(string)
+		if !ok {
+			return invalid()
+		}
+		if keys("$code") {
+			return bson.Javascript(code), true, nil
+		}
+		if !keys("$code", "$scope") {
+			return invalid()
+		}
+		scope, ok := doc[1].Val.(Document)
+		if !ok {
+			return invalid()
+		}
+		val, err := fromExtJSON(scope)
+		if err != nil {
+			return nil, true, err
+		}
+		if _, ok := val.(Document); !ok {
+			return invalid()
+		}
+		return CodeWithScope{Code: code, Scope: val.(Document)}, true, nil
+	case "$timestamp":
+		sub, ok := doc[0].Val.(Document)
+		if !keys("$timestamp") || !ok || len(sub) != 2 {
+			return invalid()
+		}
+		var t, i uint64
+		for _, it := range sub {
+			n, ok := it.Val.(json.Number)
+			if !ok {
+				return invalid()
+			}
+			v, err := strconv.ParseUint(string(n), 10, 32)
+			if err != nil {
+				return invalid()
+			}
+			switch it.Key {
+			case "t":
+				t = v
+			case "i":
+				i = v
+			default:
+				return invalid()
+			}
+		}
+		return bson.Timestamp(int64(t<<32 | i)), true, nil
+	case "$regularExpression":
+		sub, ok := doc[0].Val.(Document)
+		if !keys("$regularExpression") || !ok || len(sub) != 2 {
+			return invalid()
+		}
+		var re bson.Regexp
+		for _, it := range sub {
+			s, ok := it.Val.(string)
+			if !ok {
+				return invalid()
+			}
+			switch it.Key {
+			case "pattern":
+				re.Pattern = s
+			case "options":
+				re.Options = sortOptions(s)
+			default:
+				return invalid()
+			}
+		}
+		return re, true, nil
+	case "$regex":
+		// 旧版的 {"$regex":...,"$options":...}；值不是字符串时是查询操作符，按普通文档处理
+		pattern, ok := doc[0].Val.(string)
+		if !ok || !keys("$regex", "$options") {
+			return nil, false, nil
+		}
+		options, ok := doc[1].Val.(string)
+		if !ok {
+			return nil, false, nil
+		}
+		return bson.Regexp{Pattern: pattern, Options: sortOptions(options)}, true, nil
+	case "$dbPointer":
+		sub, ok := doc[0].Val.(Document)
+		if !keys("$dbPointer") || !ok || len(sub) != 2 || sub[0].Key != "$ref" || sub[1].Key != "$id" {
+			return invalid()
+		}
+		ns, ok := sub[0].Val.(string)
+		if !ok {
+			return invalid()
+		}
+		id, ok := sub[1].Val.(Document)
+		if !ok || len(id) == 0 {
+			return invalid()
+		}
+		oid, isID, err := fromWrapper(id)
+		if err != nil || !isID || id[0].Key != "$oid" {
+			return invalid()
+		}
+		return bson.DBPointer{Name: ns, ObjectId: oid.(bson.ObjectId)}, true, nil
+	case "$date":
+		if !keys("$date") {
+			return invalid()
+		}
+		switch d := doc[0].Val.(type) {
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, d)
+			if err != nil {
+				return invalid()
+			}
+			return bson.UTCDateTime(t.UnixMilli()), true, nil
+		case json.Number:
+			n, err := strconv.ParseInt(string(d), 10, 64)
+			if err != nil {
+				return invalid()
+			}
+			return bson.UTCDateTime(n), true, nil
+		case Document:
+			if len(d) == 0 {
+				return invalid()
+			}
+			val, isLong, err := fromWrapper(d)
+			if err != nil || !isLong || d[0].Key != "$numberLong" {
+				return invalid()
+			}
+			return bson.UTCDateTime(val.(bson.Int64)), true, nil
+		}
+		return invalid()
+	case "$minKey", "$maxKey":
+		if n, ok := doc[0].Val.(json.Number); !keys(key) || !ok || n != "1" {
+			return invalid()
+		}
+		if key == "$minKey" {
+			return bson.MinKey{}, true, nil
+		}
+		return bson.MaxKey{}, true, nil
+	case "$undefined":
+		if b, ok := doc[0].Val.(bool); !keys("$undefined") || !ok || !b {
+			return invalid()
+		}
+		return bson.Undefined{}, true, nil
+	}
+	return nil, false, nil
+}
+
+func parseObjectID(s string) (bson.ObjectId, error) {
+	bs, err := hex.DecodeString(s)
+	if err != nil || len(bs) != 12 {
+		return nil, errors.New("invalid object id")
+	}
+	return bson.ObjectId(bs), nil
+}
+
+func parseDouble(s string) (float64, error) {
+	switch s {
+	case "NaN":
+		return math.NaN(), nil
+	case "Infinity":
+		return math.Inf(1), nil
+	case "-Infinity":
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
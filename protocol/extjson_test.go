@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func extDocument() Document {
+	return Document{
+		{Key: "_id", Val: bson.ObjectId{0x5f, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{Key: "s", Val: bson.String("a\"<b>")},
+		{Key: "i", Val: bson.Int32(-7)},
+		{Key: "l", Val: bson.Int64(1 << 40)},
+		{Key: "d", Val: bson.Float(2)},
+		{Key: "nz", Val: bson.Float(math.Copysign(0, -1))},
+		{Key: "inf", Val: bson.Float(math.Inf(-1))},
+		{Key: "big", Val: bson.Float(1.2345678901234568e+18)},
+		{Key: "t", Val: bson.Bool(true)},
+		{Key: "n", Val: bson.Null{}},
+		{Key: "at", Val: bson.UTCDateTime(1500000000123)},
+		{Key: "old", Val: bson.UTCDateTime(-1)},
+		{Key: "bin", Val: bson.Binary("hi")},
+		{Key: "ts", Val: bson.Timestamp(int64(5<<32 | 3))},
+		{Key: "re", Val: bson.Regexp{Pattern: "^a", Options: "i"}},
+		{Key: "ptr", Val: bson.DBPointer{Name: "db.c", ObjectId: bson.ObjectId{0x5f, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}}},
+		{Key: "js", Val: bson.Javascript("f()")},
+		{Key: "jss", Val: CodeWithScope{Code: "g()", Scope: Document{{Key: "x", Val: bson.Int32(1)}}}},
+		{Key: "sym", Val: bson.Symbol("s")},
+		{Key: "min", Val: bson.MinKey{}},
+		{Key: "max", Val: bson.MaxKey{}},
+		{Key: "u", Val: bson.Undefined{}},
+		{Key: "arr", Val: bson.Array{bson.Int32(1), Document{{Key: "k", Val: bson.String("v")}}}},
+	}
+}
+
+func TestExtJSON_Canonical(t *testing.T) {
+	doc := extDocument()
+	bs, err := MarshalExtJSON(doc, true)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"_id":{"$oid":"5f0000000000000000000001"},"s":"a\"<b>","i":{"$numberInt":"-7"},`+
+		`"l":{"$numberLong":"1099511627776"},"d":{"$numberDouble":"2.0"},"nz":{"$numberDouble":"-0.0"},`+
+		`"inf":{"$numberDouble":"-Infinity"},"big":{"$numberDouble":"1.2345678901234568E+18"},"t":true,"n":null,`+
+		`"at":{"$date":{"$numberLong":"1500000000123"}},"old":{"$date":{"$numberLong":"-1"}},`+
+		`"bin":{"$binary":{"base64":"aGk=","subType":"00"}},"ts":{"$timestamp":{"t":5,"i":3}},`+
+		`"re":{"$regularExpression":{"pattern":"^a","options":"i"}},`+
+		`"ptr":{"$dbPointer":{"$ref":"db.c","$id":{"$oid":"5f0000000000000000000002"}}},`+
+		`"js":{"$code":"f()"},"jss":{"$code":"g()","$scope":{"x":{"$numberInt":"1"}}},"sym":{"$symbol":"s"},`+
+		`"min":{"$minKey":1},"max":{"$maxKey":1},"u":{"$undefined":true},`+
+		`"arr":[{"$numberInt":"1"},{"k":"v"}]}`, string(bs))
+
+	// canonical 模式解析后完全还原
+	back, err := UnmarshalExtJSON(bs)
+	assert.NoError(t, err)
+	assert.Equal(t, math.Copysign(1, -1), math.Copysign(1, float64(back[5].Val.(bson.Float))))
+	again, err := MarshalExtJSON(back, true)
+	assert.NoError(t, err)
+	assert.Equal(t, string(bs), string(again))
+	wire, err := EncodeDocument(doc)
+	assert.NoError(t, err)
+	wire2, err := EncodeDocument(back)
+	assert.NoError(t, err)
+	assert.Equal(t, wire, wire2)
+}
+
+func TestExtJSON_Relaxed(t *testing.T) {
+	bs, err := MarshalExtJSON(extDocument()[1:12], false)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"s":"a\"<b>","i":-7,"l":1099511627776,"d":2.0,"nz":-0.0,"inf":{"$numberDouble":"-Infinity"},`+
+		`"big":1.2345678901234568E+18,"t":true,"n":null,"at":{"$date":"2017-07-14T02:40:00.123Z"},`+
+		`"old":{"$date":{"$numberLong":"-1"}}}`, string(bs))
+
+	back, err := UnmarshalExtJSON(bs)
+	assert.NoError(t, err)
+	assert.Equal(t, bson.Int32(-7), back[1].Val)
+	assert.Equal(t, bson.Int64(1<<40), back[2].Val)
+	assert.Equal(t, bson.Float(2), back[3].Val)
+	assert.Equal(t, bson.UTCDateTime(1500000000123), back[9].Val)
+
+	var wrapped struct {
+		Doc JSONDocument `json:"doc"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(`{"doc":{"a":{"$numberLong":"3"}}}`), &wrapped))
+	assert.Equal(t, JSONDocument{{Key: "a", Val: bson.Int64(3)}}, wrapped.Doc)
+	out, err := json.Marshal(wrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"doc":{"a":3}}`, string(out))
+}
+
+func TestExtJSON_Legacy(t *testing.T) {
+	doc, err := UnmarshalExtJSON([]byte(`{"b":{"$binary":"aGk=","$type":"00"},` +
+		`"r":{"$regex":"^a","$options":"mi"},"q":{"$regex":{"$regularExpression":{"pattern":"x","options":""}}},` +
+		`"d":{"$date":0}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.Binary("hi"), doc[0].Val)
+	assert.Equal(t, bson.Regexp{Pattern: "^a", Options: "im"}, doc[1].Val)
+	// 值不是字符串的 $regex 是查询操作符
+	assert.Equal(t, Document{{Key: "$regex", Val: bson.Regexp{Pattern: "x"}}}, doc[2].Val)
+	assert.Equal(t, bson.UTCDateTime(0), doc[3].Val)
+
+	for _, it := range []string{
+		`[1]`,
+		`{"a":1} {}`,
+		`{"a":{"$oid":"xyz"}}`,
+		`{"a":{"$numberInt":"3000000000"}}`,
+		`{"a":{"$date":{}}}`,
+		`{"a":{"$minKey":2}}`,
+	} {
+		_, err := UnmarshalExtJSON([]byte(it))
+		assert.Error(t, err, it)
+	}
+
+	_, err = MarshalExtJSON(Document{{Key: "c", Val: make(chan int)}}, false)
+	assert.Error(t, err)
+}
@@ -4,8 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"log"
-
-	"github.com/sbunce/bson"
 )
 
 type xwriter struct {
@@ -35,6 +33,23 @@ func (p *xwriter) writeInt32(v int32) *xwriter {
 	return p
 }
 
+func (p *xwriter) writeByte(v byte) *xwriter {
+	if err := p.buffer.WriteByte(v); err != nil {
+		panic(err)
+	}
+	p.wrote++
+	return p
+}
+
+func (p *xwriter) writeBytes(v []byte) *xwriter {
+	wrote, err := p.buffer.Write(v)
+	if err != nil {
+		panic(err)
+	}
+	p.wrote += wrote
+	return p
+}
+
 func (p *xwriter) writeString(v string) *xwriter {
 	wrote, err := p.buffer.WriteString(v)
 	if err != nil {
@@ -52,8 +67,7 @@ func (p *xwriter) writeDocument(doc Document) *xwriter {
 	if doc == nil {
 		return p
 	}
-	doc.MustEncode()
-	b, err := doc.Encode()
+	b, err := encodeDocument(doc)
 	if err != nil {
 		panic(err)
 	}
@@ -73,6 +87,14 @@ func newWriter(buffer *bytes.Buffer) *xwriter {
 	return &xwriter{buffer: buffer}
 }
 
+// checkOffset 检查 offset 之后是否还有 n 个字节，避免读取截断的消息时越界
+func checkOffset(bs []byte, offset, n int) error {
+	if offset < 0 || offset+n > len(bs) {
+		return &errMessageOffset{offset + n, len(bs)}
+	}
+	return nil
+}
+
 func readInt32(bs []byte, offset int) int32 {
 	return int32(binary.LittleEndian.Uint32(bs[offset:offset+4]))
 }
@@ -81,24 +103,11 @@ func readInt64(bs []byte, offset int) int64 {
 	return int64(binary.LittleEndian.Uint64(bs[offset:offset+8]))
 }
 
-func readString(bs []byte, offset int) string {
-	var i = offset
-	for {
-		if b := bs[i]; b == 0 {
-			break
-		}
-		i++
-	}
-	return string(bs[offset:i])
-}
-
 func readDocument(bs []byte, offset int) (Document, int, error) {
-	l := int(binary.LittleEndian.Uint32(bs[offset:offset+4]))
-	slice, err := bson.ReadSlice(bytes.NewReader(bs[offset:offset+l]))
-	if err != nil {
-		return nil, 0, err
+	if offset > len(bs) {
+		return nil, 0, errShortDocument
 	}
-	return slice, l, nil
+	return decodeDocument(bs[offset:], 0)
 }
 
 func ParseOpCode(bs []byte) OpCode {
@@ -118,6 +127,23 @@ func Load(d Document, key string) (interface{}, bool) {
 	return nil, false
 }
 
+// Store 返回设置了 key 的文档副本，key 不存在时追加到末尾
+func Store(d Document, key string, val interface{}) Document {
+	out := make(Document, 0, len(d)+1)
+	found := false
+	for _, p := range d {
+		if p.Key == key {
+			p.Val = val
+			found = true
+		}
+		out = append(out, p)
+	}
+	if !found {
+		out = append(out, Pair{Key: key, Val: val})
+	}
+	return out
+}
+
 func ToMap(d Document) map[string]interface{} {
 	c := make(map[string]interface{})
 	for _, p := range d {
@@ -64,10 +64,16 @@ func (p *OpCommand) Decode(bs []byte) error {
 		return &errMessageLength{int(v0.MessageLength), totals}
 	}
 	var offset = HeaderLength
-	v1 := readString(bs, offset)
-	offset += len(v1) + 1
-	v2 := readString(bs, offset)
-	offset += len(v2) + 1
+	v1, l, err := readCString(bs, offset)
+	if err != nil {
+		return err
+	}
+	offset += l
+	v2, l, err := readCString(bs, offset)
+	if err != nil {
+		return err
+	}
+	offset += l
 	v3, size, err := readDocument(bs, offset)
 	if err != nil {
 		return err
@@ -12,6 +12,10 @@ type OpDelete struct {
 	Selector           Document
 }
 
+func (p *OpDelete) TableName() (*TableName, bool) {
+	return ParseTableName(p.FullCollectionName)
+}
+
 func (p *OpDelete) Encode() ([]byte, error) {
 	bf := &bytes.Buffer{}
 	if _, err := p.Append(bf); err != nil {
@@ -44,6 +48,9 @@ func (p *OpDelete) Append(buffer *bytes.Buffer) (int, error) {
 	if _, err := cache.WriteTo(bf); err != nil {
 		return 0, err
 	}
+	if _, err := bf.WriteTo(buffer); err != nil {
+		return 0, err
+	}
 	return wrote, nil
 }
 
@@ -57,10 +64,19 @@ func (p *OpDelete) Decode(bs []byte) error {
 		return &errMessageLength{int(v0.MessageLength), totals}
 	}
 	offset := HeaderLength
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v1 := readInt32(bs, offset)
 	offset += 4
-	v2 := readString(bs, offset)
-	offset += len(v2) + 1
+	v2, l, err := readCString(bs, offset)
+	if err != nil {
+		return err
+	}
+	offset += l
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v3 := readInt32(bs, offset)
 	offset += 4
 	v4, size, err := readDocument(bs, offset)
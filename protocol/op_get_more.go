@@ -12,6 +12,10 @@ type OpGetMore struct {
 	CursorID           int64
 }
 
+func (p *OpGetMore) TableName() (*TableName, bool) {
+	return ParseTableName(p.FullCollectionName)
+}
+
 func (p *OpGetMore) Encode() ([]byte, error) {
 	bf := &bytes.Buffer{}
 	if _, err := p.Append(bf); err != nil {
@@ -60,12 +64,24 @@ func (p *OpGetMore) Decode(bs []byte) error {
 		return &errMessageLength{int(v0.MessageLength), totals}
 	}
 	offset := HeaderLength
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v1 := readInt32(bs, offset)
 	offset += 4
-	v2 := readString(bs, offset)
-	offset += len(v2) + 1
+	v2, l, err := readCString(bs, offset)
+	if err != nil {
+		return err
+	}
+	offset += l
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v3 := readInt32(bs, offset)
 	offset += 4
+	if err := checkOffset(bs, offset, 8); err != nil {
+		return err
+	}
 	v4 := readInt64(bs, offset)
 	offset += 8
 	if offset != totals {
@@ -40,6 +40,10 @@ func (p *OpInsert) Append(buffer *bytes.Buffer) (int, error) {
 	return wrote, nil
 }
 
+func (p *OpInsert) TableName() (*TableName, bool) {
+	return ParseTableName(p.FullCollectionName)
+}
+
 func (p *OpInsert) Encode() ([]byte, error) {
 	bf := &bytes.Buffer{}
 	if _, err := p.Append(bf); err != nil {
@@ -58,10 +62,16 @@ func (p *OpInsert) Decode(bs []byte) error {
 		return &errMessageLength{int(v0.MessageLength), totals}
 	}
 	offset := HeaderLength
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v1 := readInt32(bs, offset)
 	offset += 4
-	v2 := readString(bs, offset)
-	offset += len(v2) + 1
+	v2, l, err := readCString(bs, offset)
+	if err != nil {
+		return err
+	}
+	offset += l
 	v3 := make([]Document, 0)
 	for ; offset < totals; {
 		foo, size, err := readDocument(bs, offset)
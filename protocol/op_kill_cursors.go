@@ -58,12 +58,21 @@ func (p *OpKillCursors) Decode(bs []byte) error {
 		return &errMessageLength{int(v0.MessageLength), totals}
 	}
 	offset := HeaderLength
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v1 := readInt32(bs, offset)
 	offset += 4
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v2 := readInt32(bs, offset)
 	offset += 4
 	v3 := make([]int64, 0)
 	for ; offset < totals; {
+		if err := checkOffset(bs, offset, 8); err != nil {
+			return err
+		}
 		v3 = append(v3, readInt64(bs, offset))
 		offset += 8
 	}
@@ -0,0 +1,196 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const (
+	MsgFlagChecksumPresent uint32 = 1 << 0
+	MsgFlagMoreToCome      uint32 = 1 << 1
+	MsgFlagExhaustAllowed  uint32 = 1 << 16
+)
+
+const (
+	sectionKindBody     byte = 0
+	sectionKindSequence byte = 1
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// DocumentSequence OP_MSG 中 kind=1 的文档序列
+type DocumentSequence struct {
+	Identifier string
+	Documents  []Document
+}
+
+// OpMessage MongoDB 3.6+ 使用的 OP_MSG(2013)，OpMsg 为旧版的 1000
+type OpMessage struct {
+	*Op
+	FlagBits  uint32
+	Body      Document
+	Sequences []DocumentSequence
+	Checksum  uint32
+}
+
+func (p *OpMessage) Encode() ([]byte, error) {
+	bf := &bytes.Buffer{}
+	if _, err := p.Append(bf); err != nil {
+		return nil, err
+	}
+	return bf.Bytes(), nil
+}
+
+func (p *OpMessage) Append(buffer *bytes.Buffer) (int, error) {
+	cache := &bytes.Buffer{}
+	writer := newWriter(cache).
+		writeInt32(int32(p.FlagBits)).
+		writeByte(sectionKindBody).
+		writeDocument(p.Body)
+	for _, seq := range p.Sequences {
+		section := &bytes.Buffer{}
+		sw := newWriter(section).writeString(seq.Identifier)
+		for _, doc := range seq.Documents {
+			sw.writeDocument(doc)
+		}
+		size, err := sw.end()
+		if err != nil {
+			return 0, err
+		}
+		writer.writeByte(sectionKindSequence).
+			writeInt32(int32(size + 4)).
+			writeBytes(section.Bytes())
+	}
+	wrote, err := writer.end()
+	if err != nil {
+		return 0, err
+	}
+	checksum := p.FlagBits&MsgFlagChecksumPresent != 0
+	if checksum {
+		wrote += 4
+	}
+	old := p.OpHeader.MessageLength
+	wrote += HeaderLength
+	p.OpHeader.MessageLength = int32(wrote)
+	defer func() {
+		p.OpHeader.MessageLength = old
+	}()
+	bf := &bytes.Buffer{}
+	if _, err := p.OpHeader.Append(bf); err != nil {
+		return 0, err
+	}
+	if _, err := cache.WriteTo(bf); err != nil {
+		return 0, err
+	}
+	if checksum {
+		// 内容可能已被修改，重新计算校验和
+		sum := make([]byte, 4)
+		binary.LittleEndian.PutUint32(sum, crc32.Checksum(bf.Bytes(), castagnoli))
+		bf.Write(sum)
+	}
+	if _, err := bf.WriteTo(buffer); err != nil {
+		return 0, err
+	}
+	return wrote, nil
+}
+
+func (p *OpMessage) Decode(bs []byte) error {
+	v0 := &Header{}
+	if err := v0.Decode(bs); err != nil {
+		return err
+	}
+	totals := len(bs)
+	if int(v0.MessageLength) != totals {
+		return &errMessageLength{int(v0.MessageLength), totals}
+	}
+	offset := HeaderLength
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
+	v1 := uint32(readInt32(bs, offset))
+	offset += 4
+	end := totals
+	var v4 uint32
+	if v1&MsgFlagChecksumPresent != 0 {
+		end -= 4
+		if end < offset {
+			return &errMessageOffset{offset + 4, totals}
+		}
+		v4 = uint32(readInt32(bs, end))
+	}
+	var v2 Document
+	v3 := make([]DocumentSequence, 0)
+	for offset < end {
+		kind := bs[offset]
+		offset++
+		switch kind {
+		case sectionKindBody:
+			if v2 != nil {
+				return errBodySection
+			}
+			doc, size, err := readDocument(bs[:end], offset)
+			if err != nil {
+				return err
+			}
+			offset += size
+			v2 = doc
+		case sectionKindSequence:
+			if err := checkOffset(bs[:end], offset, 4); err != nil {
+				return err
+			}
+			size := int(readInt32(bs, offset))
+			limit := offset + size
+			if size < 5 || limit > end {
+				return &errMessageOffset{limit, end}
+			}
+			offset += 4
+			identifier, l, err := readCString(bs[:limit], offset)
+			if err != nil {
+				return err
+			}
+			offset += l
+			seq := DocumentSequence{Identifier: identifier}
+			for offset < limit {
+				// 序列中的文档不能越过 section 的边界
+				doc, l, err := readDocument(bs[:limit], offset)
+				if err != nil {
+					return err
+				}
+				offset += l
+				seq.Documents = append(seq.Documents, doc)
+			}
+			v3 = append(v3, seq)
+		default:
+			return &errSectionKind{kind}
+		}
+	}
+	if offset != end {
+		return &errMessageOffset{offset, end}
+	}
+	if v2 == nil {
+		return errBodySection
+	}
+	p.OpHeader = v0
+	p.FlagBits = v1
+	p.Body = v2
+	p.Sequences = v3
+	p.Checksum = v4
+	return nil
+}
+
+// Sequence 按 identifier 查找文档序列
+func (p *OpMessage) Sequence(identifier string) []Document {
+	for _, it := range p.Sequences {
+		if it.Identifier == identifier {
+			return it.Documents
+		}
+	}
+	return nil
+}
+
+func NewOpMessage() *OpMessage {
+	return &OpMessage{
+		Op: &Op{},
+	}
+}
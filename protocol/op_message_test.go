@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpMessage_Decode(t *testing.T) {
+	msg := NewOpMessage()
+	msg.OpHeader = &Header{OpCode: OpCodeMessage, RequestID: 7}
+	msg.FlagBits = MsgFlagChecksumPresent
+	msg.Body = Document{
+		{Key: "insert", Val: "users"},
+		{Key: "$db", Val: "app"},
+	}
+	msg.Sequences = []DocumentSequence{{
+		Identifier: "documents",
+		Documents: []Document{
+			{{Key: "name", Val: "alice"}},
+			{{Key: "name", Val: "bob"}},
+		},
+	}}
+	bs, err := msg.Encode()
+	assert.NoError(t, err)
+	assert.Equal(t, len(bs), int(readInt32(bs, 0)))
+
+	msg2 := NewOpMessage()
+	assert.NoError(t, msg2.Decode(bs))
+	assert.Equal(t, msg.FlagBits, msg2.FlagBits)
+	assert.Equal(t, "insert", msg2.Body[0].Key)
+	assert.Len(t, msg2.Sequence("documents"), 2)
+
+	cmd, ok := ParseCommand(msg2)
+	assert.True(t, ok)
+	assert.Equal(t, "insert", cmd.Name)
+	assert.Equal(t, "app", cmd.Database)
+	assert.Equal(t, "users", cmd.Collection())
+
+	bs2, err := msg2.Encode()
+	assert.NoError(t, err)
+	assert.Equal(t, bs, bs2)
+}
+
+func TestOpMessage_EmptyArray(t *testing.T) {
+	msg := NewOpMessage()
+	msg.OpHeader = &Header{OpCode: OpCodeMessage, ResponseTo: 7}
+	msg.Body = Document{
+		{Key: "cursor", Val: Document{
+			{Key: "firstBatch", Val: bson.Array{}},
+			{Key: "id", Val: int64(0)},
+		}},
+		{Key: "ok", Val: float64(1)},
+	}
+	bs, err := msg.Encode()
+	assert.NoError(t, err)
+
+	msg2 := NewOpMessage()
+	assert.NoError(t, msg2.Decode(bs))
+	cursor, _ := Load(msg2.Body, "cursor")
+	batch, ok := Load(cursor.(Document), "firstBatch")
+	assert.True(t, ok)
+	assert.Equal(t, bson.Array{}, batch)
+}
+
+func TestOpMessage_Truncated(t *testing.T) {
+	// 只有消息头的 OP_MSG
+	bs := []byte{0x10, 0, 0, 0, 0x01, 0, 0, 0, 0, 0, 0, 0, 0xdd, 0x07, 0, 0}
+	assert.Error(t, NewOpMessage().Decode(bs))
+
+	msg := NewOpMessage()
+	msg.OpHeader = &Header{OpCode: OpCodeMessage, RequestID: 7}
+	msg.FlagBits = MsgFlagChecksumPresent
+	msg.Body = Document{{Key: "insert", Val: "users"}}
+	msg.Sequences = []DocumentSequence{{Identifier: "documents", Documents: []Document{{{Key: "a", Val: int32(1)}}}}}
+	bs, err := msg.Encode()
+	assert.NoError(t, err)
+	for i := HeaderLength; i < len(bs); i++ {
+		// 修正消息头中的长度，只保留截断后的内容。不校验 checksum，截断在 section 边界时仍能解码
+		cut := append([]byte{}, bs[:i]...)
+		cut[0], cut[1], cut[2], cut[3] = byte(i), 0, 0, 0
+		assert.NotPanics(t, func() { NewOpMessage().Decode(cut) }, i)
+	}
+
+	// 必须有且只有一个 body
+	empty := NewOpMessage()
+	empty.OpHeader = &Header{OpCode: OpCodeMessage, RequestID: 8}
+	empty.Body = Document{}
+	bs, err = empty.Encode()
+	assert.NoError(t, err)
+	assert.NoError(t, NewOpMessage().Decode(bs))
+	noBody := append([]byte{}, bs[:HeaderLength+4]...)
+	noBody[0] = byte(len(noBody))
+	assert.Error(t, NewOpMessage().Decode(noBody))
+	twice := append(append([]byte{}, bs...), bs[HeaderLength+4:]...)
+	twice[0] = byte(len(twice))
+	assert.Error(t, NewOpMessage().Decode(twice))
+}
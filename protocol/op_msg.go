@@ -52,8 +52,11 @@ func (p *OpMsg) Decode(bs []byte) error {
 		return &errMessageLength{int(v0.MessageLength), totals}
 	}
 	var offset = HeaderLength
-	v1 := readString(bs, offset)
-	offset += len(v1) + 1
+	v1, l, err := readCString(bs, offset)
+	if err != nil {
+		return err
+	}
+	offset += l
 	if offset != totals {
 		return &errMessageOffset{offset, totals}
 	}
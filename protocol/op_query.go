@@ -2,7 +2,6 @@ package protocol
 
 import (
 	"bytes"
-	"strings"
 )
 
 type OpQuery struct {
@@ -16,11 +15,7 @@ type OpQuery struct {
 }
 
 func (p *OpQuery) TableName() (*TableName, bool) {
-	sp := strings.Split(p.FullCollectionName, ".")
-	if len(sp) == 2 {
-		return &TableName{sp[0], sp[1]}, true
-	}
-	return nil,false
+	return ParseTableName(p.FullCollectionName)
 }
 
 func (p *OpQuery) Encode() ([]byte, error) {
@@ -42,12 +37,24 @@ func (p *OpQuery) Decode(bs []byte) error {
 		return &errMessageLength{int(v0.MessageLength), totals}
 	}
 	offset := HeaderLength
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v1 := readInt32(bs, offset)
 	offset += 4
-	v2 := readString(bs, offset)
-	offset += len(v2) + 1
+	v2, l, err := readCString(bs, offset)
+	if err != nil {
+		return err
+	}
+	offset += l
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v3 := readInt32(bs, offset)
 	offset += 4
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v4 := readInt32(bs, offset)
 	offset += 4
 	v5, size, err := readDocument(bs, offset)
@@ -64,12 +64,24 @@ func (p *OpReply) Decode(bs []byte) error {
 		return &errMessageLength{int(v0.MessageLength), totals}
 	}
 	offset := HeaderLength
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v1 := readInt32(bs, offset)
 	offset += 4
+	if err := checkOffset(bs, offset, 8); err != nil {
+		return err
+	}
 	v2 := readInt64(bs, offset)
 	offset += 8
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v3 := readInt32(bs, offset)
 	offset += 4
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v4 := readInt32(bs, offset)
 	offset += 4
 	v5 := make([]Document, 0)
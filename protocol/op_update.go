@@ -44,6 +44,10 @@ func (p *OpUpdate) Append(buffer *bytes.Buffer) (int, error) {
 	return wrote, nil
 }
 
+func (p *OpUpdate) TableName() (*TableName, bool) {
+	return ParseTableName(p.FullCollectionName)
+}
+
 func (p *OpUpdate) Encode() ([]byte, error) {
 	bf := &bytes.Buffer{}
 	if _, err := p.Append(bf); err != nil {
@@ -62,10 +66,19 @@ func (p *OpUpdate) Decode(bs []byte) error {
 		return &errMessageLength{int(v0.MessageLength), totals}
 	}
 	offset := HeaderLength
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v1 := readInt32(bs, offset)
 	offset += 4
-	v2 := readString(bs, offset)
-	offset += len(v2) + 1
+	v2, l, err := readCString(bs, offset)
+	if err != nil {
+		return err
+	}
+	offset += l
+	if err := checkOffset(bs, offset, 4); err != nil {
+		return err
+	}
 	v3 := readInt32(bs, offset)
 	offset += 4
 	v4, size, err := readDocument(bs, offset)
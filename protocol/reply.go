@@ -0,0 +1,229 @@
+package protocol
+
+import (
+	"errors"
+
+	"github.com/sbunce/bson"
+)
+
+// 常用的服务端错误码
+const (
+	CodeInternalError    int32 = 1
+	CodeBadValue         int32 = 2
+	CodeHostUnreachable  int32 = 6
+	CodeUnauthorized     int32 = 13
+	CodeIllegalOperation int32 = 20
+	CodeShardKeyNotFound int32 = 61
+	CodeImmutableField   int32 = 66
+	CodeCommandNotFound  int32 = 59
+	CodeCursorNotFound   int32 = 43
+)
+
+// 旧版 OP_REPLY 的 QueryFailure 标志位
+const replyQueryFailure int32 = 2
+
+// CommandError 返回给客户端的命令错误，对应响应中的 errmsg、code、codeName 与 errorLabels
+type CommandError struct {
+	Code     int32
+	CodeName string
+	Message  string
+	Labels   []string
+}
+
+func (p *CommandError) Error() string {
+	return p.Message
+}
+
+// Document 转换为 ok: 0 的命令响应
+func (p *CommandError) Document() Document {
+	doc := Document{
+		{Key: "ok", Val: float64(0)},
+		{Key: "errmsg", Val: p.Message},
+		{Key: "code", Val: p.Code},
+		{Key: "codeName", Val: p.CodeName},
+	}
+	if len(p.Labels) > 0 {
+		labels := make(bson.Array, 0, len(p.Labels))
+		for _, it := range p.Labels {
+			labels = append(labels, it)
+		}
+		doc = append(doc, Pair{Key: "errorLabels", Val: labels})
+	}
+	return doc
+}
+
+// AsCommandError 从错误链中取出 CommandError，其他错误视为 InternalError
+func AsCommandError(err error) *CommandError {
+	var ce *CommandError
+	if errors.As(err, &ce) {
+		return ce
+	}
+	return &CommandError{Code: CodeInternalError, CodeName: "InternalError", Message: err.Error()}
+}
+
+// NewErrorReply 按请求的线协议格式构造错误响应，ResponseTo 指向请求。
+// 普通 OP_QUERY 与 OP_GET_MORE 使用带 QueryFailure 标志的 OP_REPLY，没有响应的旧版写操作返回 nil
+func NewErrorReply(req Message, err error) Message {
+	ce := AsCommandError(err)
+	if _, ok := ParseCommand(req); ok {
+		return NewCommandReply(req, ce.Document())
+	}
+	switch req.(type) {
+	case *OpQuery, *OpGetMore:
+	default:
+		return nil
+	}
+	reply := NewOpReply()
+	reply.OpHeader = &Header{OpCode: OpCodeReply, ResponseTo: req.Header().RequestID}
+	reply.ResponseFlags = replyQueryFailure
+	reply.NumberReturned = 1
+	reply.Documents = []Document{{
+		{Key: "$err", Val: ce.Message},
+		{Key: "code", Val: ce.Code},
+	}}
+	return reply
+}
+
+// ExpectsReply 旧版写操作、OP_KILL_CURSORS 以及带 moreToCome 的 OP_MSG 没有响应
+func ExpectsReply(msg Message) bool {
+	switch v := msg.(type) {
+	case *OpInsert, *OpUpdate, *OpDelete, *OpKillCursors, *OpReply, *OpCommandReply:
+		return false
+	case *OpMessage:
+		return v.FlagBits&MsgFlagMoreToCome == 0
+	}
+	return true
+}
+
+// IsReply 判断消息是否为服务端响应，OP_MSG 通过 ResponseTo 区分
+func IsReply(msg Message) bool {
+	switch msg.(type) {
+	case *OpReply, *OpCommandReply:
+		return true
+	case *OpMessage:
+		return msg.Header().ResponseTo != 0
+	}
+	return false
+}
+
+// ReplyResult 响应的结果摘要，Code 为 0 表示成功
+type ReplyResult struct {
+	Code     int32
+	CodeName string
+	Error    string
+	Returned int64
+	Affected int64
+	// CursorID 响应中的游标，0 表示游标已耗尽或没有游标
+	CursorID int64
+}
+
+// Summarize 统计响应中返回的文档数与写操作影响的文档数
+func Summarize(req, reply Message) ReplyResult {
+	var res ReplyResult
+	if v, ok := reply.(*OpReply); ok && v.ResponseFlags&replyQueryFailure != 0 {
+		res.Code = CodeInternalError
+		if len(v.Documents) > 0 {
+			if code := int32(number(v.Documents[0], "code")); code != 0 {
+				res.Code = code
+			}
+			res.Error = toString(load(v.Documents[0], "$err"))
+		}
+		return res
+	}
+	if _, isCmd := ParseCommand(req); !isCmd {
+		// 旧版查询的结果直接放在 OP_REPLY 的文档中
+		if v, ok := reply.(*OpReply); ok {
+			res.Returned = int64(v.NumberReturned)
+			res.CursorID = v.CursorID
+		}
+		return res
+	}
+	doc, ok := ReplyDocument(reply)
+	if !ok {
+		return res
+	}
+	if number(doc, "ok") != 1 {
+		res.Code = int32(number(doc, "code"))
+		res.CodeName = toString(load(doc, "codeName"))
+		res.Error = toString(load(doc, "errmsg"))
+		if res.Code == 0 {
+			res.Code = CodeInternalError
+		}
+		return res
+	}
+	if errs, ok := load(doc, "writeErrors").(bson.Array); ok && len(errs) > 0 {
+		switch first := errs[0].(type) {
+		case Document:
+			res.Code = int32(number(first, "code"))
+			res.Error = toString(load(first, "errmsg"))
+		case bson.Map:
+			res.Code = int32(toNumber(first["code"]))
+			res.Error = toString(first["errmsg"])
+		}
+	}
+	op, _, _ := Operation(req)
+	switch op {
+	case "insert", "update", "delete":
+		res.Affected = int64(number(doc, "n"))
+	case "findandmodify":
+		if last, ok := load(doc, "lastErrorObject").(Document); ok {
+			res.Affected = int64(number(last, "n"))
+		}
+		if v := load(doc, "value"); v != nil {
+			if _, isNull := v.(bson.Null); !isNull {
+				res.Returned = 1
+			}
+		}
+	case "count":
+		res.Returned = 1
+	case "distinct":
+		if arr, ok := load(doc, "values").(bson.Array); ok {
+			res.Returned = int64(len(arr))
+		}
+	default:
+		if cursor, ok := load(doc, "cursor").(Document); ok {
+			// 游标 id 可能超出 float64 的精度，不能经过 number 转换
+			switch id := load(cursor, "id").(type) {
+			case bson.Int64:
+				res.CursorID = int64(id)
+			case bson.Int32:
+				res.CursorID = int64(id)
+			}
+			for _, key := range []string{"firstBatch", "nextBatch"} {
+				if arr, ok := load(cursor, key).(bson.Array); ok {
+					res.Returned = int64(len(arr))
+				}
+			}
+		}
+	}
+	return res
+}
+
+func load(doc Document, key string) interface{} {
+	v, _ := Load(doc, key)
+	return v
+}
+
+func number(doc Document, key string) float64 {
+	return toNumber(load(doc, key))
+}
+
+func toNumber(v interface{}) float64 {
+	switch n := v.(type) {
+	case bson.Int32:
+		return float64(n)
+	case bson.Int64:
+		return float64(n)
+	case bson.Float:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	case int:
+		return float64(n)
+	}
+	return 0
+}
@@ -0,0 +1,35 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewErrorReply(t *testing.T) {
+	ce := &CommandError{Code: CodeUnauthorized, CodeName: "Unauthorized", Message: "denied"}
+
+	getMore := NewOpGetMore()
+	getMore.OpHeader = &Header{OpCode: OpCodeGetMore, RequestID: 9}
+	getMore.FullCollectionName = "db.coll"
+	getMore.CursorID = 42
+	// 旧版 getMore 需要响应，否则客户端会一直等待
+	assert.True(t, ExpectsReply(getMore))
+	reply, ok := NewErrorReply(getMore, ce).(*OpReply)
+	if assert.True(t, ok) {
+		assert.Equal(t, int32(9), reply.Header().ResponseTo)
+		assert.Equal(t, replyQueryFailure, reply.ResponseFlags)
+		res := Summarize(getMore, reply)
+		assert.Equal(t, CodeUnauthorized, res.Code)
+		assert.Equal(t, "denied", res.Error)
+	}
+
+	query := NewOpQuery()
+	query.OpHeader = &Header{OpCode: OpCodeQuery, RequestID: 10}
+	query.FullCollectionName = "db.coll"
+	assert.IsType(t, &OpReply{}, NewErrorReply(query, ce))
+
+	insert := NewOpInsert()
+	insert.OpHeader = &Header{OpCode: OpCodeInsert, RequestID: 11}
+	assert.Nil(t, NewErrorReply(insert, ce))
+}
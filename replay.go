@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/capture"
+	"github.com/jjeffcaii/mongo-proxy/secret"
+)
+
+// runReplay 在目标部署上重放抓包文件中的客户端请求，输出延迟分布以及与抓包响应不一致的错误
+func runReplay(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("replay", stderr)
+	file := fs.String("file", "", "capture file, rotated files next to it are replayed first")
+	target := fs.String("target", "", "address of the deployment to replay against")
+	speed := fs.Float64("speed", 1, "time scale, 1 keeps the recorded intervals, 0 sends as fast as possible")
+	concurrency := fs.Int("concurrency", 0, "maximum number of connections replayed at once, 0 for no limit")
+	username := fs.String("username", "", "authenticate every connection as this user")
+	passwordFrom := fs.String("password-from", "", "secret reference for the password, e.g. env:NAME or file:/path")
+	timeout := fs.Duration("timeout", 30*time.Second, "time to wait for each reply")
+	maxDiffs := fs.Int("max-diffs", 20, "number of differing replies to print")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *file == "" || *target == "" {
+		fmt.Fprintln(stderr, "replay: --file and --target are required")
+		return exitUsage
+	}
+	opts := capture.ReplayOptions{
+		Target:      *target,
+		Speed:       *speed,
+		Concurrency: *concurrency,
+		Username:    *username,
+		Timeout:     *timeout,
+		MaxDiffs:    *maxDiffs,
+	}
+	if *passwordFrom != "" {
+		password, err := secret.Lookup(*passwordFrom)
+		if err != nil {
+			fmt.Fprintln(stderr, "replay:", err)
+			return exitError
+		}
+		opts.Password = password
+	}
+	files, err := capture.Files(*file)
+	if err != nil {
+		fmt.Fprintln(stderr, "replay:", err)
+		return exitError
+	}
+	frames, err := capture.ReadFiles(files...)
+	if err != nil {
+		fmt.Fprintln(stderr, "replay:", err)
+		return exitError
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	report, err := capture.Replay(ctx, frames, opts)
+	if report == nil {
+		fmt.Fprintln(stderr, "replay:", err)
+		return exitError
+	}
+	report.Print(stdout)
+	if err != nil {
+		fmt.Fprintln(stderr, "replay: interrupted")
+		return exitError
+	}
+	if len(report.Errors) > 0 {
+		return exitError
+	}
+	return exitOK
+}
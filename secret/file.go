@@ -0,0 +1,55 @@
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fileEntry struct {
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+// Files 从文件读取密钥，去掉末尾的换行。文件不能被属主以外的用户访问，
+// 修改时间或大小变化后重新读取，可以直接覆盖文件完成轮换
+type Files struct {
+	mu    sync.Mutex
+	cache map[string]fileEntry
+}
+
+func NewFiles() *Files {
+	return &Files{cache: make(map[string]fileEntry)}
+}
+
+func (p *Files) Secret(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", errors.New("not a regular file")
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return "", fmt.Errorf("permissions %#o are too open, the file must not be accessible by group or others", perm)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if it, ok := p.cache[path]; ok && it.modTime.Equal(info.ModTime()) && it.size == info.Size() {
+		return it.value, nil
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimRight(string(bs), "\r\n")
+	if value == "" {
+		return "", errors.New("file is empty")
+	}
+	p.cache[path] = fileEntry{modTime: info.ModTime(), size: info.Size(), value: value}
+	return value, nil
+}
@@ -0,0 +1,193 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keystore 本地加密密钥库，文件内容为 JSON，每个值以 AES-256-GCM 加密并以名称作为附加数据，
+// 防止密文被挪到其他名称下使用。文件修改后下次读取时重新加载
+type Keystore struct {
+	Path string
+
+	aead    cipher.AEAD
+	mu      sync.Mutex
+	modTime time.Time
+	entries map[string]string
+}
+
+type keystoreFile struct {
+	Version int               `json:"version"`
+	Secrets map[string]string `json:"secrets"`
+}
+
+// NewKeystore key 为 32 字节的主密钥，文件不存在时视为空密钥库
+func NewKeystore(path string, key []byte) (*Keystore, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("keystore key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Keystore{Path: path, aead: aead}, nil
+}
+
+// LoadKey 读取 base64 编码的主密钥，优先使用环境变量 env，其次使用文件 path
+func LoadKey(env, path string) ([]byte, error) {
+	var encoded string
+	switch {
+	case env != "" && os.Getenv(env) != "":
+		encoded = os.Getenv(env)
+	case path != "":
+		v, err := NewFiles().Secret(path)
+		if err != nil {
+			return nil, fmt.Errorf("keystore key file %s: %w", path, err)
+		}
+		encoded = v
+	case env != "":
+		return nil, fmt.Errorf("keystore key: environment variable %s is not set", env)
+	default:
+		return nil, errors.New("keystore key is not configured")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("keystore key is not valid base64: %w", err)
+	}
+	return key, nil
+}
+
+// load 文件修改时间变化时重新读取，调用方持有 mu
+func (p *Keystore) load() error {
+	info, err := os.Stat(p.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		p.entries, p.modTime = map[string]string{}, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return fmt.Errorf("keystore %s: permissions %#o are too open, the file must not be accessible by group or others", p.Path, perm)
+	}
+	if p.entries != nil && info.ModTime().Equal(p.modTime) {
+		return nil
+	}
+	bs, err := os.ReadFile(p.Path)
+	if err != nil {
+		return err
+	}
+	var f keystoreFile
+	if err := json.Unmarshal(bs, &f); err != nil {
+		return fmt.Errorf("keystore %s: %w", p.Path, err)
+	}
+	if f.Version != 1 {
+		return fmt.Errorf("keystore %s: unsupported version %d", p.Path, f.Version)
+	}
+	if f.Secrets == nil {
+		f.Secrets = map[string]string{}
+	}
+	p.entries, p.modTime = f.Secrets, info.ModTime()
+	return nil
+}
+
+func (p *Keystore) Secret(name string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.load(); err != nil {
+		return "", err
+	}
+	sealed, ok := p.entries[name]
+	if !ok {
+		return "", fmt.Errorf("no secret named %q in keystore", name)
+	}
+	bs, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(bs) < p.aead.NonceSize() {
+		return "", fmt.Errorf("secret %q is corrupted", name)
+	}
+	n := p.aead.NonceSize()
+	plain, err := p.aead.Open(nil, bs[:n], bs[n:], []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("decrypt secret %q failed, wrong keystore key?", name)
+	}
+	return string(plain), nil
+}
+
+// Set 加密并保存 value，通过临时文件加重命名替换，正在读取的进程不会看到写了一半的文件
+func (p *Keystore) Set(name, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.load(); err != nil {
+		return err
+	}
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := p.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	entries := make(map[string]string, len(p.entries)+1)
+	for k, v := range p.entries {
+		entries[k] = v
+	}
+	entries[name] = base64.StdEncoding.EncodeToString(sealed)
+	if err := p.save(entries); err != nil {
+		return err
+	}
+	// 强制下次读取时重新加载
+	p.entries = nil
+	return nil
+}
+
+// Names 返回密钥库中的名称
+func (p *Keystore) Names() ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(p.entries))
+	for it := range p.entries {
+		out = append(out, it)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (p *Keystore) save(entries map[string]string) error {
+	bs, err := json.MarshalIndent(keystoreFile{Version: 1, Secrets: entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p.Path), ".keystore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(bs, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.Path)
+}
@@ -0,0 +1,98 @@
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Provider 按名称返回密钥的当前值，每次建立后端连接时调用，轮换后应返回新值
+type Provider interface {
+	Secret(name string) (string, error)
+}
+
+// ProviderFunc 将函数适配为 Provider
+type ProviderFunc func(name string) (string, error)
+
+func (p ProviderFunc) Secret(name string) (string, error) {
+	return p(name)
+}
+
+var (
+	mu        sync.RWMutex
+	providers = map[string]Provider{
+		"env":  Env{},
+		"file": NewFiles(),
+	}
+)
+
+// Register 注册 scheme 对应的 Provider，已存在时替换
+func Register(scheme string, provider Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers[scheme] = provider
+}
+
+// Schemes 返回已注册的 scheme
+func Schemes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := make([]string, 0, len(providers))
+	for it := range providers {
+		out = append(out, it)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ParseRef 拆分 "scheme:name" 形式的引用，如 env:MONGO_PASSWORD、file:/run/secrets/mongo、keystore:fallback
+func ParseRef(ref string) (scheme, name string, err error) {
+	scheme, name, ok := strings.Cut(ref, ":")
+	if !ok || scheme == "" || name == "" {
+		return "", "", fmt.Errorf("invalid secret reference %q, expected <scheme>:<name>", ref)
+	}
+	return scheme, name, nil
+}
+
+// Lookup 解析引用并从对应的 Provider 读取当前值
+func Lookup(ref string) (string, error) {
+	scheme, name, err := ParseRef(ref)
+	if err != nil {
+		return "", err
+	}
+	mu.RLock()
+	provider, ok := providers[scheme]
+	mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unknown secret provider %q, expected one of %s", scheme, strings.Join(Schemes(), ", "))
+	}
+	v, err := provider.Secret(name)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %w", ref, err)
+	}
+	return v, nil
+}
+
+// Func 返回每次调用都重新读取 ref 的函数，用作 handle.Upstream.Secret
+func Func(ref string) func() (string, error) {
+	return func() (string, error) {
+		return Lookup(ref)
+	}
+}
+
+// Env 从环境变量读取，变量未设置或为空时返回错误
+type Env struct{}
+
+func (Env) Secret(name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", errors.New("environment variable is not set")
+	}
+	if v == "" {
+		return "", errors.New("environment variable is empty")
+	}
+	return v, nil
+}
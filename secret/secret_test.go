@@ -0,0 +1,72 @@
+package secret
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookup(t *testing.T) {
+	t.Setenv("SECRET_TEST_PASSWORD", "pw1")
+	v, err := Lookup("env:SECRET_TEST_PASSWORD")
+	assert.NoError(t, err)
+	assert.Equal(t, "pw1", v)
+	_, err = Lookup("env:SECRET_TEST_MISSING")
+	assert.ErrorContains(t, err, "not set")
+	_, err = Lookup("vault:x")
+	assert.ErrorContains(t, err, `unknown secret provider "vault"`)
+	_, err = Lookup("nope")
+	assert.Error(t, err)
+}
+
+func TestFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	assert.NoError(t, os.WriteFile(path, []byte("pw1\n"), 0o644))
+	files := NewFiles()
+	_, err := files.Secret(path)
+	assert.ErrorContains(t, err, "too open")
+
+	assert.NoError(t, os.Chmod(path, 0o600))
+	v, err := files.Secret(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "pw1", v)
+
+	// 覆盖文件即完成轮换
+	assert.NoError(t, os.WriteFile(path, []byte("pw-rotated\n"), 0o600))
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	v, err = files.Secret(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "pw-rotated", v)
+}
+
+func TestKeystore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	key := make([]byte, 32)
+	ks, err := NewKeystore(path, key)
+	assert.NoError(t, err)
+	_, err = ks.Secret("primary")
+	assert.Error(t, err)
+
+	assert.NoError(t, ks.Set("primary", "pw1"))
+	assert.NoError(t, ks.Set("fallback", "pw2"))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// 另一个实例读取同一文件，模拟代理进程
+	reader, _ := NewKeystore(path, key)
+	v, err := reader.Secret("primary")
+	assert.NoError(t, err)
+	assert.Equal(t, "pw1", v)
+	names, _ := reader.Names()
+	assert.Equal(t, []string{"fallback", "primary"}, names)
+
+	wrong := make([]byte, 32)
+	wrong[0] = 1
+	other, _ := NewKeystore(path, wrong)
+	_, err = other.Secret("primary")
+	assert.ErrorContains(t, err, "wrong keystore key")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/admin"
+	"github.com/jjeffcaii/mongo-proxy/config"
+	"github.com/jjeffcaii/mongo-proxy/logging"
+	"github.com/jjeffcaii/mongo-proxy/metrics"
+	"github.com/jjeffcaii/mongo-proxy/server"
+)
+
+// configFlag 注册 --config，默认取环境变量 MONGO_PROXY_CONFIG
+func configFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", os.Getenv("MONGO_PROXY_CONFIG"), "configuration file (YAML or JSON), defaults to $MONGO_PROXY_CONFIG")
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("mongo-proxy "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+// parseFlags 解析失败返回 exitUsage，-h 返回 exitOK
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected arguments: %v\n", fs.Args())
+		return exitUsage, false
+	}
+	return 0, true
+}
+
+func runServe(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("serve", stderr)
+	path := configFlag(fs)
+	interval := fs.Duration("watch", 2*time.Second, "interval for checking the configuration file for changes, 0 disables")
+	grace := fs.Duration("shutdown-timeout", 30*time.Second, "time to wait for client connections to finish on SIGINT/SIGTERM")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	srv, err := startServer(*path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	logger := logging.Default()
+	cfg := srv.Config()
+	if cfg.Metrics.Listen != "" {
+		go func() {
+			if err := metrics.Serve(cfg.Metrics.Listen); err != nil {
+				logger.Error("metrics server stopped", "err", err)
+			}
+		}()
+	}
+	if cfg.Admin.Listen != "" {
+		go func() {
+			// 管理接口可以断开连接，应只监听本地或配置 token
+			s := admin.NewServer()
+			s.Token = cfg.Admin.Token
+			s.Router = srv.Router
+			if *path != "" {
+				s.Reload = srv.Reload
+			}
+			if err := s.ListenAndServe(cfg.Admin.Listen); err != nil {
+				logger.Error("admin server stopped", "err", err)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	go srv.Watch(*interval, stop)
+	logger.Info("proxy server start", "config", *path)
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+	signal.Stop(quit)
+	close(stop)
+	logger.Info("shutting down", "signal", sig.String(), "active", srv.Active(), "timeout", *grace)
+	ctx, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("shutdown did not complete cleanly", "err", err)
+		return exitError
+	}
+	logger.Info("proxy server stopped")
+	return exitOK
+}
+
+// startServer 加载配置并开始监听，未指定配置文件时使用与早期版本一致的默认配置
+func startServer(path string) (*server.Server, error) {
+	srv := server.New(path)
+	if path != "" {
+		return srv, srv.Reload()
+	}
+	return srv, srv.Apply(config.Default())
+}
+
+func runCheckConfig(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("check-config", stderr)
+	path := configFlag(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *path == "" {
+		fmt.Fprintln(stderr, "check-config: --config is required")
+		return exitUsage
+	}
+	cfg, err := config.Load(*path)
+	if err == nil {
+		err = server.Check(cfg)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	fmt.Fprintf(stdout, "%s: ok (%d listeners, %d backends, %d middlewares)\n",
+		*path, len(cfg.Listeners), len(cfg.Backends), len(cfg.Middlewares))
+	return exitOK
+}
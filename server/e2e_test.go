@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/capture"
+	"github.com/jjeffcaii/mongo-proxy/config"
+	"github.com/jjeffcaii/mongo-proxy/fake"
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func startFake(t *testing.T, wire int32) *fake.Server {
+	srv := fake.New()
+	srv.MaxWireVersion = wire
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// TestForwardWithFallback 官方驱动经过代理访问两个内存后端，主库查询为空时由回退后端应答
+func TestForwardWithFallback(t *testing.T) {
+	// OP_QUERY 形式的 find 才会触发回退
+	primary := startFake(t, 5)
+	fallback := startFake(t, 5)
+	fallback.AddUser("admin", "pw")
+	assert.NoError(t, fallback.Insert("app", "users", protocol.Document{{Key: "_id", Val: int32(7)}, {Key: "name", Val: "archived"}}))
+
+	srv := New("")
+	defer srv.Close()
+	assert.NoError(t, srv.Apply(&config.Config{
+		Listeners: []config.Listener{{Name: "app", Addr: "127.0.0.1:0", Backend: "primary"}},
+		Backends: []config.Backend{
+			{Name: "primary", Addr: primary.Addr()},
+			{Name: "fallback", URI: "mongodb://admin:pw@" + fallback.Addr()},
+		},
+		Fallback: &config.Fallback{Backend: "fallback"},
+	}))
+
+	ctx := context.Background()
+	opts := options.Client().
+		ApplyURI("mongodb://" + srv.Addr("app").String() + "/?directConnection=true").
+		SetServerSelectionTimeout(3 * time.Second)
+	client, err := mongo.Connect(ctx, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Disconnect(ctx)
+	users := client.Database("app").Collection("users")
+
+	_, err = users.InsertOne(ctx, bson.M{"_id": 1, "name": "live"})
+	assert.NoError(t, err)
+	assert.Len(t, primary.Documents("app", "users"), 1)
+
+	var doc bson.M
+	assert.NoError(t, users.FindOne(ctx, bson.M{"name": "live"}).Decode(&doc))
+	assert.Equal(t, "live", doc["name"])
+
+	doc = nil
+	assert.NoError(t, users.FindOne(ctx, bson.M{"_id": 7}).Decode(&doc))
+	assert.Equal(t, "archived", doc["name"])
+}
+
+// TestCaptureReplay 经过代理认证并读写，抓包中包含成对的请求与响应且认证载荷已隐去；
+// 在另一个后端上重放时游标 id 被替换，只有预先存在的文档造成的写错误与抓包不同
+func TestCaptureReplay(t *testing.T) {
+	backend := startFake(t, 13)
+	backend.AddUser("app", "pw")
+	path := filepath.Join(t.TempDir(), "traffic.cap")
+
+	srv := New("")
+	defer srv.Close()
+	assert.NoError(t, srv.Apply(&config.Config{
+		Listeners:   []config.Listener{{Name: "app", Addr: "127.0.0.1:0", Backend: "primary"}},
+		Backends:    []config.Backend{{Name: "primary", Addr: backend.Addr()}},
+		Middlewares: []config.Middleware{{Name: "capture", Options: map[string]interface{}{"path": path}}},
+	}))
+
+	ctx := context.Background()
+	opts := options.Client().
+		ApplyURI("mongodb://app:pw@" + srv.Addr("app").String() + "/?directConnection=true").
+		SetServerSelectionTimeout(3 * time.Second)
+	client, err := mongo.Connect(ctx, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	users := client.Database("app").Collection("users")
+	_, err = users.InsertMany(ctx, []interface{}{bson.M{"_id": 1}, bson.M{"_id": 2}, bson.M{"_id": 3}})
+	assert.NoError(t, err)
+	cur, err := users.Find(ctx, bson.M{}, options.Find().SetBatchSize(2))
+	if assert.NoError(t, err) {
+		var docs []bson.M
+		assert.NoError(t, cur.All(ctx, &docs))
+		assert.Len(t, docs, 3)
+	}
+	client.Disconnect(ctx)
+
+	files, err := capture.Files(path)
+	assert.NoError(t, err)
+	frames, err := capture.ReadFiles(files...)
+	assert.NoError(t, err)
+	var in, out, redacted int
+	for _, frame := range frames {
+		if frame.Direction == capture.In {
+			in++
+		} else {
+			out++
+		}
+		if frame.Redacted {
+			redacted++
+			assert.NotContains(t, string(frame.Data), "n=app,r=")
+		}
+		_, err = protocol.Decode(frame.Data)
+		assert.NoError(t, err)
+	}
+	assert.NotZero(t, in)
+	assert.Equal(t, in, out)
+	assert.NotZero(t, redacted)
+
+	target := startFake(t, 13)
+	target.AddUser("app", "pw")
+	assert.NoError(t, target.Insert("app", "users", protocol.Document{{Key: "_id", Val: int32(3)}}))
+	report, err := capture.Replay(ctx, frames, capture.ReplayOptions{
+		Target:   target.Addr(),
+		Speed:    0,
+		Username: "app",
+		Password: "pw",
+		Timeout:  3 * time.Second,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, report.Errors)
+	assert.NotZero(t, report.Skipped)
+	assert.Equal(t, 1, report.Commands["getmore"].Count)
+	assert.Zero(t, report.Total.Errors)
+	if assert.Equal(t, 1, report.Mismatches) {
+		assert.Equal(t, "insert", report.Diffs[0].Command)
+		assert.Equal(t, int32(11000), report.Diffs[0].Replayed.Code)
+	}
+	assert.Len(t, target.Documents("app", "users"), 3)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jjeffcaii/mongo-proxy/config"
+)
+
+// limiter 统计所有监听上的客户端连接，限制随配置重新加载立即生效，已建立的连接不会被断开
+type limiter struct {
+	mu      sync.Mutex
+	total   int
+	clients map[string]int
+}
+
+func clientHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// acquire 超出限制时返回错误，否则返回连接结束时调用的 release
+func (p *limiter) acquire(addr net.Addr, limits config.Limits) (func(), error) {
+	host := clientHost(addr)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if limits.MaxConnections > 0 && p.total >= limits.MaxConnections {
+		return nil, fmt.Errorf("too many connections, limit is %d", limits.MaxConnections)
+	}
+	if limits.MaxPerClient > 0 && p.clients[host] >= limits.MaxPerClient {
+		return nil, fmt.Errorf("too many connections from %s, limit is %d", host, limits.MaxPerClient)
+	}
+	if p.clients == nil {
+		p.clients = make(map[string]int)
+	}
+	p.total++
+	p.clients[host]++
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.total--
+		if p.clients[host]--; p.clients[host] <= 0 {
+			delete(p.clients, host)
+		}
+	}, nil
+}
+
+func (p *limiter) active() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.total
+}
@@ -0,0 +1,457 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/audit"
+	"github.com/jjeffcaii/mongo-proxy/capture"
+	"github.com/jjeffcaii/mongo-proxy/config"
+	"github.com/jjeffcaii/mongo-proxy/logging"
+	"github.com/jjeffcaii/mongo-proxy/middleware"
+)
+
+// instance 配置中一个中间件条目构建的结果，perConn 非空时每个客户端连接创建一个新实例。
+// closer 为审计文件、抓包文件等需要释放的资源
+type instance struct {
+	spec    config.Middleware
+	shared  interface{}
+	perConn func() interface{}
+	closer  io.Closer
+}
+
+func (p *instance) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	return p.closer.Close()
+}
+
+// closeUnused 关闭 list 中不在 keep 里的实例，用于重新加载后释放旧实例，或丢弃校验失败时新建的实例
+func closeUnused(list, keep []*instance) {
+	for _, it := range list {
+		used := false
+		for _, k := range keep {
+			if it == k {
+				used = true
+				break
+			}
+		}
+		if used {
+			continue
+		}
+		if err := it.Close(); err != nil {
+			logging.Default().Warn("close middleware failed", "middleware", it.spec.Name, "err", err)
+		}
+	}
+}
+
+// attach 将中间件注册在客户端连接上，实现了哪个接口就注册到哪条链
+func (p *instance) attach(ctx api.Context) {
+	v := p.shared
+	if p.perConn != nil {
+		v = p.perConn()
+	}
+	if it, ok := v.(api.Middleware); ok {
+		ctx.Use(it)
+	}
+	if it, ok := v.(api.ResponseMiddleware); ok {
+		ctx.UseResponse(it)
+	}
+	if it, ok := v.(api.Tap); ok {
+		ctx.UseTap(it)
+	}
+}
+
+type factory func(opts map[string]interface{}) (*instance, error)
+
+var factories = map[string]factory{
+	"firewall": newFirewall,
+	"slowlog":  newSlowLog,
+	"audit":    newAudit,
+	"tenant":   newTenant,
+	"mask":     newMask,
+	"encrypt":  newEncrypt,
+	"capture":  newCapture,
+}
+
+// Middlewares 返回可以在配置中使用的中间件名称
+func Middlewares() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checks 打开文件的中间件只校验选项时使用，check-config 不能创建审计或抓包文件
+var checks = map[string]func(opts map[string]interface{}) error{
+	"audit":   checkAudit,
+	"capture": checkCapture,
+}
+
+// buildMiddlewares 按配置构建中间件，与 previous 中名称和选项都相同的条目沿用原实例，
+// 保留慢查询统计、审计文件等状态。check 为 true 时打开文件的中间件只校验选项，不出现在结果中
+func buildMiddlewares(specs []config.Middleware, previous []*instance, check bool) ([]*instance, []string) {
+	used := make([]bool, len(previous))
+	reuse := func(spec config.Middleware) *instance {
+		for i, it := range previous {
+			if !used[i] && it.spec.Name == spec.Name && reflect.DeepEqual(it.spec.Options, spec.Options) {
+				used[i] = true
+				return it
+			}
+		}
+		return nil
+	}
+	var problems []string
+	out := make([]*instance, 0, len(specs))
+	for i, spec := range specs {
+		if it := reuse(spec); it != nil {
+			out = append(out, it)
+			continue
+		}
+		fn, ok := factories[spec.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("middlewares[%d].name: unknown middleware %q, expected one of %s",
+				i, spec.Name, strings.Join(Middlewares(), ", ")))
+			continue
+		}
+		if fn, ok := checks[spec.Name]; ok && check {
+			if err := fn(spec.Options); err != nil {
+				problems = append(problems, fmt.Sprintf("middlewares[%d].options: %v", i, err))
+			}
+			continue
+		}
+		it, err := fn(spec.Options)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("middlewares[%d].options: %v", i, err))
+			continue
+		}
+		it.spec = spec
+		out = append(out, it)
+	}
+	return out, problems
+}
+
+// checkDir 确认文件所在的目录存在，不创建文件
+func checkDir(path string) error {
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("path: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("path: %s is not a directory", filepath.Dir(path))
+	}
+	return nil
+}
+
+// decodeOptions 通过 JSON 将 options 解码为中间件的选项结构，未知字段视为错误
+func decodeOptions(opts map[string]interface{}, out interface{}) error {
+	if len(opts) == 0 {
+		return nil
+	}
+	bs, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(out); err != nil {
+		return errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return nil
+}
+
+type firewallRule struct {
+	Name       string   `json:"name"`
+	Action     string   `json:"action"`
+	Commands   []string `json:"commands"`
+	Namespaces []string `json:"namespaces"`
+	Operators  []string `json:"operators"`
+	Users      []string `json:"users"`
+	Collscan   bool     `json:"collscan"`
+	Indexed    []string `json:"indexed"`
+	Message    string   `json:"message"`
+}
+
+type firewallOptions struct {
+	// Defaults 为 nil 或 true 时在 Rules 之后追加 DefaultFirewallRules
+	Defaults *bool          `json:"defaults"`
+	Rules    []firewallRule `json:"rules"`
+}
+
+func newFirewall(opts map[string]interface{}) (*instance, error) {
+	var o firewallOptions
+	if err := decodeOptions(opts, &o); err != nil {
+		return nil, err
+	}
+	fw := middleware.NewFirewall()
+	for i, it := range o.Rules {
+		rule := middleware.FirewallRule{
+			Name:       it.Name,
+			Commands:   it.Commands,
+			Namespaces: it.Namespaces,
+			Operators:  it.Operators,
+			Users:      it.Users,
+			Collscan:   it.Collscan,
+			Indexed:    it.Indexed,
+			Message:    it.Message,
+		}
+		switch it.Action {
+		case "", "deny":
+			fw.Deny(rule)
+		case "allow":
+			fw.Allow(rule)
+		default:
+			return nil, fmt.Errorf("rules[%d].action: unknown action %q, expected allow or deny", i, it.Action)
+		}
+	}
+	if o.Defaults == nil || *o.Defaults {
+		fw.Rules = append(fw.Rules, middleware.DefaultFirewallRules()...)
+	}
+	return &instance{shared: fw}, nil
+}
+
+type slowLogOptions struct {
+	Threshold config.Duration `json:"threshold"`
+}
+
+func newSlowLog(opts map[string]interface{}) (*instance, error) {
+	o := slowLogOptions{Threshold: config.Duration(100 * time.Millisecond)}
+	if err := decodeOptions(opts, &o); err != nil {
+		return nil, err
+	}
+	if o.Threshold < 0 {
+		return nil, errors.New("threshold: must not be negative")
+	}
+	log := middleware.NewSlowLog(time.Duration(o.Threshold))
+	return &instance{perConn: func() interface{} {
+		return middleware.NewSlowTimer(log)
+	}}, nil
+}
+
+type auditOptions struct {
+	// Path 为空或 "-" 时写到标准输出
+	Path string `json:"path"`
+	// MaxBytes 大于 0 时按大小轮转，轮转后的文件全部保留
+	MaxBytes int64 `json:"maxBytes"`
+}
+
+func parseAudit(opts map[string]interface{}) (auditOptions, error) {
+	var o auditOptions
+	if err := decodeOptions(opts, &o); err != nil {
+		return o, err
+	}
+	if o.MaxBytes < 0 {
+		return o, errors.New("maxBytes: must not be negative")
+	}
+	return o, nil
+}
+
+func checkAudit(opts map[string]interface{}) error {
+	o, err := parseAudit(opts)
+	if err != nil || o.Path == "" || o.Path == "-" {
+		return err
+	}
+	return checkDir(o.Path)
+}
+
+func newAudit(opts map[string]interface{}) (*instance, error) {
+	o, err := parseAudit(opts)
+	if err != nil {
+		return nil, err
+	}
+	var sink audit.Sink
+	if o.Path == "" || o.Path == "-" {
+		sink = audit.NewWriterSink(os.Stdout)
+	} else {
+		fs, err := audit.NewFileSink(o.Path, o.MaxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("path: %w", err)
+		}
+		sink = fs
+	}
+	logger := audit.NewLogger(sink)
+	return &instance{closer: logger, perConn: func() interface{} {
+		return audit.NewAuditor(logger)
+	}}, nil
+}
+
+type captureOptions struct {
+	Path       string `json:"path"`
+	MaxBytes   int64  `json:"maxBytes"`
+	MaxBackups int    `json:"maxBackups"`
+	// Sample 抓取的连接比例，默认抓取全部连接
+	Sample *float64 `json:"sample"`
+	// Redact 为 nil 或 true 时隐去认证信息
+	Redact *bool `json:"redact"`
+}
+
+func parseCapture(opts map[string]interface{}) (captureOptions, error) {
+	var o captureOptions
+	if err := decodeOptions(opts, &o); err != nil {
+		return o, err
+	}
+	if o.Path == "" {
+		return o, errors.New("path: is required")
+	}
+	if o.Sample != nil && (*o.Sample <= 0 || *o.Sample > 1) {
+		return o, errors.New("sample: must be greater than 0 and at most 1")
+	}
+	if o.MaxBytes < 0 || o.MaxBackups < 0 {
+		return o, errors.New("maxBytes and maxBackups must not be negative")
+	}
+	return o, nil
+}
+
+func checkCapture(opts map[string]interface{}) error {
+	o, err := parseCapture(opts)
+	if err != nil {
+		return err
+	}
+	return checkDir(o.Path)
+}
+
+func newCapture(opts map[string]interface{}) (*instance, error) {
+	o, err := parseCapture(opts)
+	if err != nil {
+		return nil, err
+	}
+	w, err := capture.NewWriter(o.Path, o.MaxBytes, o.MaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("path: %w", err)
+	}
+	c := capture.New(w)
+	if o.Sample != nil {
+		c.Sample = *o.Sample
+	}
+	if o.Redact != nil {
+		c.Redact = *o.Redact
+	}
+	return &instance{shared: c, closer: w}, nil
+}
+
+type tenantOptions struct {
+	// Tenants 用户名到租户 ID 的映射
+	Tenants map[string]string `json:"tenants"`
+}
+
+func newTenant(opts map[string]interface{}) (*instance, error) {
+	var o tenantOptions
+	if err := decodeOptions(opts, &o); err != nil {
+		return nil, err
+	}
+	if len(o.Tenants) == 0 {
+		return nil, errors.New("tenants: at least one tenant is required")
+	}
+	for user, tenant := range o.Tenants {
+		// 前缀为 "<租户ID>_"，租户 ID 中含有 _ 时不同租户的库名会重叠
+		if tenant == "" || strings.Contains(tenant, "_") {
+			return nil, fmt.Errorf("tenants.%s: invalid tenant %q, must be non-empty and must not contain _", user, tenant)
+		}
+	}
+	tenants := middleware.TenantMap(o.Tenants)
+	return &instance{perConn: func() interface{} {
+		return middleware.NewTenantRewriter(tenants)
+	}}, nil
+}
+
+var maskMethods = map[string]middleware.MaskMethod{
+	"redact":   middleware.MaskRedact,
+	"hash":     middleware.MaskHash,
+	"truncate": middleware.MaskTruncate,
+	"tokenize": middleware.MaskTokenize,
+}
+
+type maskField struct {
+	Path   string `json:"path"`
+	Method string `json:"method"`
+	Keep   int    `json:"keep"`
+}
+
+type maskRule struct {
+	Namespace string      `json:"namespace"`
+	Roles     []string    `json:"roles"`
+	Fields    []maskField `json:"fields"`
+}
+
+type maskOptions struct {
+	// Key 用于 hash 与 tokenize 的 HMAC 密钥
+	Key   string              `json:"key"`
+	Roles map[string][]string `json:"roles"`
+	Rules []maskRule          `json:"rules"`
+}
+
+func newMask(opts map[string]interface{}) (*instance, error) {
+	var o maskOptions
+	if err := decodeOptions(opts, &o); err != nil {
+		return nil, err
+	}
+	m := middleware.NewMasker(middleware.RoleMap(o.Roles), []byte(o.Key))
+	for i, rule := range o.Rules {
+		fields := make([]middleware.MaskField, 0, len(rule.Fields))
+		for j, it := range rule.Fields {
+			if it.Path == "" {
+				return nil, fmt.Errorf("rules[%d].fields[%d].path: is required", i, j)
+			}
+			method, ok := maskMethods[it.Method]
+			if it.Method == "" {
+				method, ok = middleware.MaskRedact, true
+			}
+			if !ok {
+				return nil, fmt.Errorf("rules[%d].fields[%d].method: unknown method %q", i, j, it.Method)
+			}
+			if (method == middleware.MaskHash || method == middleware.MaskTokenize) && o.Key == "" {
+				return nil, fmt.Errorf("rules[%d].fields[%d].method: %s requires key", i, j, it.Method)
+			}
+			fields = append(fields, middleware.MaskField{Path: it.Path, Method: method, Keep: it.Keep})
+		}
+		m.Mask(rule.Namespace, rule.Roles, fields...)
+	}
+	return &instance{shared: m}, nil
+}
+
+type encryptField struct {
+	Namespace     string `json:"namespace"`
+	Path          string `json:"path"`
+	KeyID         string `json:"keyId"`
+	Deterministic bool   `json:"deterministic"`
+}
+
+type encryptOptions struct {
+	KeyFile string         `json:"keyFile"`
+	Fields  []encryptField `json:"fields"`
+}
+
+func newEncrypt(opts map[string]interface{}) (*instance, error) {
+	var o encryptOptions
+	if err := decodeOptions(opts, &o); err != nil {
+		return nil, err
+	}
+	if o.KeyFile == "" {
+		return nil, errors.New("keyFile: is required")
+	}
+	keys, err := middleware.LoadKeyFile(o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("keyFile: %w", err)
+	}
+	enc := middleware.NewEncryptor(keys)
+	for i, it := range o.Fields {
+		if _, err := keys.Key(it.KeyID); err != nil {
+			return nil, fmt.Errorf("fields[%d].keyId: %w", i, err)
+		}
+		enc.Encrypt(it.Namespace, it.Path, it.KeyID, it.Deterministic)
+	}
+	return &instance{shared: enc}, nil
+}
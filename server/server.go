@@ -0,0 +1,414 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jjeffcaii/mongo-proxy/admin"
+	"github.com/jjeffcaii/mongo-proxy/api"
+	"github.com/jjeffcaii/mongo-proxy/config"
+	"github.com/jjeffcaii/mongo-proxy/handle"
+	"github.com/jjeffcaii/mongo-proxy/logging"
+	"github.com/jjeffcaii/mongo-proxy/secret"
+)
+
+// state 一份生效的配置及由它构建的对象，连接建立时取当前的 state，之后不再变化
+type state struct {
+	cfg         *config.Config
+	upstreams   map[string]handle.Upstream
+	router      *handle.Router
+	middlewares []*instance
+	commands    *admin.Commands
+}
+
+type listener struct {
+	spec     config.Listener
+	endpoint api.Endpoint
+}
+
+// Server 按配置启动监听并处理客户端连接。Apply 可以在运行中替换配置：
+// 新增的监听立即启动，移除的监听停止接受新连接，已建立的连接继续使用建立时的后端与中间件，
+// 但被替换的审计与抓包中间件会关闭文件，这些连接之后不再写入。
+// 连接池大小、管理接口与指标的监听地址只在首次使用时生效
+type Server struct {
+	// Path 配置文件路径，Reload 与 Watch 从这里读取
+	Path string
+
+	mu        sync.Mutex
+	state     atomic.Pointer[state]
+	listeners map[string]*listener
+	limiter   limiter
+	modTime   time.Time
+	data      []byte
+}
+
+func New(path string) *Server {
+	return &Server{Path: path, listeners: make(map[string]*listener)}
+}
+
+// Config 返回当前生效的配置
+func (p *Server) Config() *config.Config {
+	if st := p.state.Load(); st != nil {
+		return st.cfg
+	}
+	return nil
+}
+
+// Router 返回当前的路由器，没有配置 routing 时为 nil
+func (p *Server) Router() *handle.Router {
+	if st := p.state.Load(); st != nil {
+		return st.router
+	}
+	return nil
+}
+
+// Reload 重新读取 Path 并应用，失败时保留当前配置
+func (p *Server) Reload() error {
+	if p.Path == "" {
+		return errors.New("no config file to reload")
+	}
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.Parse(data, config.Format(p.Path))
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.Path, err)
+	}
+	if err := p.Apply(cfg); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.data, p.modTime = data, info.ModTime()
+	p.mu.Unlock()
+	return nil
+}
+
+// Apply 校验并应用配置，构建失败或新监听无法启动时不做任何修改
+func (p *Server) Apply(cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	next, err := p.build(cfg, false)
+	if err != nil {
+		return err
+	}
+	var current []*instance
+	if st := p.state.Load(); st != nil {
+		current = st.middlewares
+	}
+	if cfg.Log.Level != "" || cfg.Log.Format != "" {
+		level := slog.LevelInfo
+		if cfg.Log.Level != "" {
+			level, _ = logging.ParseLevel(cfg.Log.Level)
+		}
+		logging.SetDefault(logging.New(os.Stderr, level, cfg.Log.Format == "json"))
+	}
+
+	// 先打开所有新的端口，任何一个失败都放弃本次配置
+	started := make(map[string]net.Listener)
+	for _, it := range cfg.Listeners {
+		if old, ok := p.listeners[it.Name]; ok && old.spec.Addr == it.Addr {
+			continue
+		}
+		l, err := net.Listen("tcp", it.Addr)
+		if err != nil {
+			for _, opened := range started {
+				opened.Close()
+			}
+			closeUnused(next.middlewares, current)
+			return fmt.Errorf("listener %s: %w", it.Name, err)
+		}
+		started[it.Name] = l
+	}
+
+	p.state.Store(next)
+	p.applyFallback(next)
+	// 不再使用的审计、抓包等中间件需要关闭，否则同一路径上会有两个写入者
+	closeUnused(current, next.middlewares)
+
+	logger := logging.Default()
+	for name, it := range p.listeners {
+		spec, ok := cfg.Listener(name)
+		if ok && spec.Addr == it.spec.Addr {
+			it.spec = spec
+			continue
+		}
+		if err := it.endpoint.Close(); err != nil {
+			logger.Warn("close listener failed", "listener", name, "err", err)
+		}
+		delete(p.listeners, name)
+		logger.Info("listener stopped", "listener", name, "addr", it.spec.Addr)
+	}
+	for _, spec := range cfg.Listeners {
+		l, ok := started[spec.Name]
+		if !ok {
+			continue
+		}
+		name := spec.Name
+		it := &listener{spec: spec, endpoint: api.NewListenerProxy(l, api.WithLogger(logger))}
+		p.listeners[name] = it
+		go func() {
+			if err := it.endpoint.Serve(func(ctx api.Context) { p.serve(name, ctx) }); err != nil {
+				logger.Error("listener stopped", "listener", name, "err", err)
+			}
+		}()
+		logger.Info("listener started", "listener", name, "addr", l.Addr().String(), "mode", spec.Mode)
+	}
+	return nil
+}
+
+// build 构建后端、路由与中间件，未改变的中间件沿用当前实例。check 为 true 时不打开审计与抓包文件
+func (p *Server) build(cfg *config.Config, check bool) (*state, error) {
+	next := &state{cfg: cfg, upstreams: make(map[string]handle.Upstream, len(cfg.Backends))}
+	lookup, err := secrets(cfg.Secrets)
+	if err != nil {
+		return nil, &config.ValidationError{Problems: []string{err.Error()}}
+	}
+	var problems []string
+	upstreams := make([]handle.Upstream, 0, len(cfg.Backends))
+	for i, it := range cfg.Backends {
+		b, err := it.Resolve()
+		if err != nil {
+			return nil, err
+		}
+		u := handle.Upstream{Name: b.Name, Addr: b.Addr, Username: b.Username, Password: b.Password, MaxConns: b.MaxConns}
+		if ref := b.PasswordFrom; ref != "" {
+			u.Secret = func() (string, error) { return lookup(ref) }
+			// 启动与重新加载时确认密钥可读，避免到建立连接时才发现
+			if _, err := u.Secret(); err != nil {
+				problems = append(problems, fmt.Sprintf("backends[%d].passwordFrom: %v", i, err))
+			}
+		}
+		next.upstreams[u.Name] = u
+		upstreams = append(upstreams, u)
+	}
+	if cfg.Routing != nil {
+		table := handle.NewRoutingTable(cfg.Routing.Default)
+		for _, it := range cfg.Routing.Routes {
+			table.Add(it.Database, it.Collection, it.Backend)
+		}
+		next.router = handle.NewRouter(table, upstreams...)
+	}
+	var previous []*instance
+	if st := p.state.Load(); st != nil {
+		previous = st.middlewares
+	}
+	middlewares, more := buildMiddlewares(cfg.Middlewares, previous, check)
+	if problems = append(problems, more...); len(problems) > 0 {
+		closeUnused(middlewares, previous)
+		return nil, &config.ValidationError{Problems: problems}
+	}
+	next.middlewares = middlewares
+	if len(cfg.Admin.Users) > 0 {
+		next.commands = admin.NewCommands(cfg.Admin.Users...)
+		next.commands.Router = next.router
+		next.commands.Backends = upstreams
+	}
+	return next, nil
+}
+
+func (p *Server) applyFallback(st *state) {
+	fb := st.cfg.Fallback
+	if fb == nil {
+		handle.SetFallback(handle.FallbackConfig{})
+		return
+	}
+	u := st.upstreams[fb.Backend]
+	handle.SetFallback(handle.FallbackConfig{
+		Enabled:  fb.IsEnabled(),
+		Addr:     u.Addr,
+		Username: u.Username,
+		Password: u.Password,
+		Secret:   u.Secret,
+	})
+}
+
+// secrets 返回读取密码引用的函数，keystore 引用使用配置中的密钥库，其余交给已注册的提供者
+func secrets(cfg config.Secrets) (func(ref string) (string, error), error) {
+	if cfg.Keystore == nil {
+		return secret.Lookup, nil
+	}
+	env := cfg.Keystore.KeyEnv
+	if env == "" && cfg.Keystore.KeyFile == "" {
+		env = config.DefaultKeystoreKeyEnv
+	}
+	key, err := secret.LoadKey(env, cfg.Keystore.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("secrets.keystore: %w", err)
+	}
+	ks, err := secret.NewKeystore(cfg.Keystore.Path, key)
+	if err != nil {
+		return nil, fmt.Errorf("secrets.keystore: %w", err)
+	}
+	return func(ref string) (string, error) {
+		scheme, name, err := secret.ParseRef(ref)
+		if err != nil || scheme != "keystore" {
+			return secret.Lookup(ref)
+		}
+		v, err := ks.Secret(name)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", ref, err)
+		}
+		return v, nil
+	}, nil
+}
+
+// serve 处理一个客户端连接，使用连接建立时的配置
+func (p *Server) serve(name string, ctx api.Context) {
+	st := p.state.Load()
+	spec, ok := st.cfg.Listener(name)
+	if !ok {
+		return
+	}
+	release, err := p.limiter.acquire(ctx.RemoteAddr(), st.cfg.Limits)
+	if err != nil {
+		ctx.Logger().Warn("connection rejected", "listener", name, "err", err)
+		return
+	}
+	defer release()
+	if st.commands != nil {
+		ctx.Use(st.commands)
+	}
+	for _, it := range st.middlewares {
+		it.attach(ctx)
+	}
+	switch spec.Mode {
+	case config.ModeRouter:
+		st.router.Handle(ctx)
+	default:
+		(&handle.Forwarder{Primary: st.upstreams[spec.Backend]}).Handle(ctx)
+	}
+}
+
+// Addr 返回监听实际使用的地址，未启动时返回 nil
+func (p *Server) Addr(name string) net.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	it, ok := p.listeners[name]
+	if !ok {
+		return nil
+	}
+	if a, ok := it.endpoint.(interface{ Addr() net.Addr }); ok {
+		return a.Addr()
+	}
+	return nil
+}
+
+// Watch 在收到 SIGHUP 或配置文件内容变化时重新加载，阻塞直到 stop 关闭
+func (p *Server) Watch(interval time.Duration, stop <-chan struct{}) {
+	logger := logging.Default()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if interval > 0 && p.Path != "" {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	reload := func(reason string) {
+		if err := p.Reload(); err != nil {
+			logger.Error("reload configuration failed, keeping current configuration", "reason", reason, "err", err)
+			return
+		}
+		logger.Info("configuration reloaded", "reason", reason, "path", p.Path)
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			reload("SIGHUP")
+		case <-tick:
+			if p.changed() {
+				reload("file changed")
+			}
+		}
+	}
+}
+
+// changed 修改时间变化且内容与上次加载的不同时返回 true，编辑器只保存不修改时不会触发重新加载
+func (p *Server) changed() bool {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if info.ModTime().Equal(p.modTime) {
+		return false
+	}
+	// 加载失败时同样记录修改时间，文件再次修改前不重复尝试
+	p.modTime = info.ModTime()
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return false
+	}
+	return !bytes.Equal(data, p.data)
+}
+
+// Check 校验配置并构建中间件，不启动监听、不创建文件，也不修改当前配置
+func Check(cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	st, err := (&Server{}).build(cfg, true)
+	if err != nil {
+		return err
+	}
+	closeUnused(st.middlewares, nil)
+	return nil
+}
+
+// Active 返回正在处理的客户端连接数
+func (p *Server) Active() int {
+	return p.limiter.active()
+}
+
+// Shutdown 停止所有监听并等待已建立的连接结束，ctx 结束时断开剩余的客户端连接
+func (p *Server) Shutdown(ctx context.Context) error {
+	err := p.Close()
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+	for p.Active() > 0 {
+		select {
+		case <-ctx.Done():
+			for _, it := range api.Conns("client") {
+				api.Kill(it.ID)
+			}
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return err
+}
+
+// Close 停止所有监听，已建立的连接不受影响
+func (p *Server) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var errs []error
+	for name, it := range p.listeners {
+		errs = append(errs, it.endpoint.Close())
+		delete(p.listeners, name)
+	}
+	return errors.Join(errs...)
+}
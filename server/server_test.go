@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jjeffcaii/mongo-proxy/audit"
+	"github.com/jjeffcaii/mongo-proxy/config"
+	"github.com/jjeffcaii/mongo-proxy/handle"
+	"github.com/stretchr/testify/assert"
+)
+
+func testConfig() *config.Config {
+	return &config.Config{
+		Listeners: []config.Listener{{Name: "a", Addr: "127.0.0.1:0", Backend: "primary"}},
+		Backends:  []config.Backend{{Name: "primary", Addr: "127.0.0.1:27017"}},
+		Middlewares: []config.Middleware{
+			{Name: "slowlog", Options: map[string]interface{}{"threshold": "10ms"}},
+			{Name: "firewall"},
+		},
+	}
+}
+
+func TestApply(t *testing.T) {
+	srv := New("")
+	defer srv.Close()
+	cfg := testConfig()
+	assert.NoError(t, srv.Apply(cfg))
+	addr := srv.Addr("a")
+	if !assert.NotNil(t, addr) {
+		return
+	}
+	slowlog := srv.state.Load().middlewares[0]
+	assert.Equal(t, "", handle.Fallback().Addr)
+
+	// 未改变的监听与中间件保持不变，新增的监听立即启动
+	next := testConfig()
+	next.Listeners = append(next.Listeners, config.Listener{Name: "b", Addr: "127.0.0.1:0", Backend: "primary"})
+	next.Middlewares[1].Options = map[string]interface{}{"defaults": false}
+	assert.NoError(t, srv.Apply(next))
+	assert.Equal(t, addr, srv.Addr("a"))
+	assert.NotNil(t, srv.Addr("b"))
+	assert.Same(t, slowlog, srv.state.Load().middlewares[0])
+
+	// 选项错误时保留当前配置
+	bad := testConfig()
+	bad.Listeners = nil
+	bad.Listeners = append(bad.Listeners, next.Listeners...)
+	bad.Middlewares = []config.Middleware{{Name: "slowlog", Options: map[string]interface{}{"thresold": "1s"}}}
+	err := srv.Apply(bad)
+	assert.ErrorContains(t, err, `middlewares[0].options: unknown field "thresold"`)
+	assert.Len(t, srv.Config().Listeners, 2)
+
+	// 移除的监听停止接受新连接
+	assert.NoError(t, srv.Apply(testConfig()))
+	assert.Nil(t, srv.Addr("b"))
+	conn, err := net.Dial("tcp", addr.String())
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+listeners:
+  - name: a
+    addr: 127.0.0.1:0
+    backend: primary
+backends:
+  - name: primary
+    addr: 127.0.0.1:27017
+  - name: fallback
+    uri: mongodb://admin:pw@127.0.0.1:27018
+fallback:
+  backend: fallback
+`), 0o644))
+	srv := New(path)
+	defer srv.Close()
+	assert.NoError(t, srv.Reload())
+	assert.Equal(t, handle.FallbackConfig{Enabled: true, Addr: "127.0.0.1:27018", Username: "admin", Password: "pw"}, handle.Fallback())
+	assert.False(t, srv.changed())
+
+	assert.NoError(t, os.WriteFile(path, []byte("listeners: []\n"), 0o644))
+	assert.ErrorContains(t, srv.Reload(), "listeners: at least one listener is required")
+	assert.NotNil(t, srv.Addr("a"))
+}
+
+func TestApply_CloseMiddlewares(t *testing.T) {
+	srv := New("")
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	cfg := testConfig()
+	cfg.Middlewares = append(cfg.Middlewares, config.Middleware{Name: "audit", Options: map[string]interface{}{"path": path}})
+	assert.NoError(t, srv.Apply(cfg))
+	old := srv.state.Load().middlewares[2].closer.(*audit.Logger)
+	assert.NoError(t, old.Log(&audit.Record{Command: "find"}))
+
+	// 选项改变后旧的审计文件被关闭，不会与新实例同时写入
+	next := testConfig()
+	next.Middlewares = append(next.Middlewares, config.Middleware{Name: "audit", Options: map[string]interface{}{
+		"path": path, "maxBytes": 1 << 20,
+	}})
+	assert.NoError(t, srv.Apply(next))
+	assert.Error(t, old.Log(&audit.Record{Command: "find"}))
+	current := srv.state.Load().middlewares[2].closer.(*audit.Logger)
+	assert.NoError(t, current.Log(&audit.Record{Command: "insert"}))
+
+	// 校验失败时新建的实例被关闭，当前实例不受影响
+	bad := testConfig()
+	bad.Middlewares = append(bad.Middlewares,
+		config.Middleware{Name: "audit", Options: map[string]interface{}{"path": filepath.Join(t.TempDir(), "other.log")}},
+		config.Middleware{Name: "unknown"},
+	)
+	assert.Error(t, srv.Apply(bad))
+	assert.NoError(t, current.Log(&audit.Record{Command: "update"}))
+
+	bs, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	_, err = audit.Verify(bytes.NewReader(bs), "")
+	assert.NoError(t, err)
+}
+
+func TestCheck_NoFiles(t *testing.T) {
+	// check-config 只校验选项，不创建审计与抓包文件
+	dir := t.TempDir()
+	cfg := testConfig()
+	cfg.Middlewares = append(cfg.Middlewares,
+		config.Middleware{Name: "audit", Options: map[string]interface{}{"path": filepath.Join(dir, "audit.log")}},
+		config.Middleware{Name: "capture", Options: map[string]interface{}{"path": filepath.Join(dir, "traffic.cap")}},
+	)
+	assert.NoError(t, Check(cfg))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	cfg.Middlewares[len(cfg.Middlewares)-2].Options["maxBytes"] = -1
+	cfg.Middlewares[len(cfg.Middlewares)-1].Options["path"] = filepath.Join(dir, "missing", "traffic.cap")
+	err = Check(cfg)
+	assert.ErrorContains(t, err, "maxBytes: must not be negative")
+	assert.ErrorContains(t, err, "no such file or directory")
+}
+
+func TestLimiter(t *testing.T) {
+	var l limiter
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	limits := config.Limits{MaxPerClient: 1}
+	release, err := l.acquire(client, limits)
+	assert.NoError(t, err)
+	_, err = l.acquire(&net.TCPAddr{IP: client.IP, Port: 5001}, limits)
+	assert.Error(t, err)
+	release()
+	_, err = l.acquire(client, limits)
+	assert.NoError(t, err)
+}
+
+func TestPasswordFrom(t *testing.T) {
+	cfg := testConfig()
+	cfg.Backends[0].Username = "app"
+	cfg.Backends[0].PasswordFrom = "env:SERVER_TEST_PASSWORD"
+	assert.ErrorContains(t, Check(cfg), "backends[0].passwordFrom: secret env:SERVER_TEST_PASSWORD: environment variable is not set")
+
+	t.Setenv("SERVER_TEST_PASSWORD", "pw1")
+	st, err := (&Server{}).build(cfg, false)
+	assert.NoError(t, err)
+	t.Setenv("SERVER_TEST_PASSWORD", "pw2")
+	v, err := st.upstreams["primary"].Secret()
+	assert.NoError(t, err)
+	assert.Equal(t, "pw2", v)
+}
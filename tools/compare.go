@@ -0,0 +1,272 @@
+package tools
+
+import (
+	"bytes"
+	"math"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/sbunce/bson"
+)
+
+// typeOrder MongoDB 跨类型比较时的顺序
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case bson.MinKey:
+		return 1
+	case nil, bson.Null, bson.Undefined:
+		return 2
+	case bson.Int32, bson.Int64, bson.Float, protocol.Decimal128, int, int32, int64, float64:
+		return 3
+	case bson.String, bson.Symbol, string:
+		return 4
+	case protocol.Document, bson.Map:
+		return 5
+	case bson.Array, []interface{}:
+		return 6
+	case bson.Binary, protocol.Binary, []byte:
+		return 7
+	case bson.ObjectId:
+		return 8
+	case bson.Bool, bool:
+		return 9
+	case bson.UTCDateTime:
+		return 10
+	case bson.Timestamp:
+		return 11
+	case bson.Regexp:
+		return 12
+	case bson.MaxKey:
+		return 100
+	}
+	return 50
+}
+
+// Number 将数值类型统一转换为 float64
+func Number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case bson.Int32:
+		return float64(n), true
+	case bson.Int64:
+		return float64(n), true
+	case bson.Float:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case protocol.Decimal128:
+		// 超出 double 精度的 Decimal128 只能近似比较
+		return n.Float64(), true
+	}
+	return 0, false
+}
+
+func integer(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case bson.Int32:
+		return int64(n), true
+	case bson.Int64:
+		return int64(n), true
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+// String 返回字符串类型的值
+func String(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case bson.String:
+		return string(s), true
+	case bson.Symbol:
+		return string(s), true
+	case string:
+		return s, true
+	}
+	return "", false
+}
+
+// Compare 按 MongoDB 的 BSON 比较规则比较两个值，返回 -1、0 或 1
+func Compare(a, b interface{}) int {
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		return sign(ta - tb)
+	}
+	switch ta {
+	case 3:
+		if x, ok := integer(a); ok {
+			if y, ok := integer(b); ok {
+				return compareInt64(x, y)
+			}
+		}
+		x, _ := Number(a)
+		y, _ := Number(b)
+		switch {
+		case math.IsNaN(x) && math.IsNaN(y):
+			return 0
+		case math.IsNaN(x) || x < y:
+			return -1
+		case math.IsNaN(y) || x > y:
+			return 1
+		}
+		return 0
+	case 4:
+		x, _ := String(a)
+		y, _ := String(b)
+		return strings.Compare(x, y)
+	case 5:
+		x, _ := AsDocument(a)
+		y, _ := AsDocument(b)
+		return compareDocument(x, y)
+	case 6:
+		x, y := toArray(a), toArray(b)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := Compare(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return sign(len(x) - len(y))
+	case 7:
+		x, y := toBytes(a), toBytes(b)
+		if len(x) != len(y) {
+			return sign(len(x) - len(y))
+		}
+		if c := sign(int(binarySubtype(a)) - int(binarySubtype(b))); c != 0 {
+			return c
+		}
+		return bytes.Compare(x, y)
+	case 8:
+		return bytes.Compare(a.(bson.ObjectId), b.(bson.ObjectId))
+	case 9:
+		x, y := toBool(a), toBool(b)
+		if x == y {
+			return 0
+		} else if !x {
+			return -1
+		}
+		return 1
+	case 10:
+		return compareInt64(int64(a.(bson.UTCDateTime)), int64(b.(bson.UTCDateTime)))
+	case 11:
+		x, y := uint64(a.(bson.Timestamp)), uint64(b.(bson.Timestamp))
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case 12:
+		x, y := a.(bson.Regexp), b.(bson.Regexp)
+		if c := strings.Compare(x.Pattern, y.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(x.Options, y.Options)
+	}
+	return 0
+}
+
+// Equal 判断两个值在 BSON 语义下是否相等，数值类型不区分 int32/int64/double
+func Equal(a, b interface{}) bool {
+	return Compare(a, b) == 0
+}
+
+func compareDocument(x, y protocol.Document) int {
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if c := typeOrder(x[i].Val) - typeOrder(y[i].Val); c != 0 {
+			return sign(c)
+		}
+		if c := strings.Compare(x[i].Key, y[i].Key); c != 0 {
+			return c
+		}
+		if c := Compare(x[i].Val, y[i].Val); c != 0 {
+			return c
+		}
+	}
+	return sign(len(x) - len(y))
+}
+
+func compareInt64(x, y int64) int {
+	if x < y {
+		return -1
+	} else if x > y {
+		return 1
+	}
+	return 0
+}
+
+func sign(v int) int {
+	if v < 0 {
+		return -1
+	} else if v > 0 {
+		return 1
+	}
+	return 0
+}
+
+// AsDocument 将嵌套文档统一转换为 Document，数组中的文档会被解码为 bson.Map
+func AsDocument(v interface{}) (protocol.Document, bool) {
+	switch d := v.(type) {
+	case protocol.Document:
+		return d, true
+	case bson.Map:
+		doc := make(protocol.Document, 0, len(d))
+		for k, v := range d {
+			doc = append(doc, protocol.Pair{Key: k, Val: v})
+		}
+		return doc, true
+	}
+	return nil, false
+}
+
+func toArray(v interface{}) []interface{} {
+	switch a := v.(type) {
+	case bson.Array:
+		return a
+	case []interface{}:
+		return a
+	}
+	return nil
+}
+
+func toBytes(v interface{}) []byte {
+	switch b := v.(type) {
+	case bson.Binary:
+		return b
+	case []byte:
+		return b
+	case protocol.Binary:
+		return b.Data
+	}
+	return nil
+}
+
+func binarySubtype(v interface{}) byte {
+	if b, ok := v.(protocol.Binary); ok {
+		return b.Subtype
+	}
+	return protocol.BinaryGeneric
+}
+
+func toBool(v interface{}) bool {
+	switch b := v.(type) {
+	case bson.Bool:
+		return bool(b)
+	case bool:
+		return b
+	}
+	return false
+}
+
+// Comparable 两个值属于同一类型时返回 true，$gt、$lt 等比较运算只在同类型之间生效
+func Comparable(a, b interface{}) bool {
+	return typeOrder(a) == typeOrder(b)
+}
@@ -0,0 +1,50 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+)
+
+// RotateFile 将 path 重命名为 path.1，已有的备份依次后移，path.1 始终是最新的备份。
+// maxBackups 大于 0 时删除超出数量的最旧备份，为 0 时保留所有备份
+func RotateFile(path string, maxBackups int) error {
+	n := 0
+	for {
+		if _, err := os.Stat(backupName(path, n+1)); err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return err
+		}
+		n++
+	}
+	if maxBackups > 0 {
+		for ; n >= maxBackups; n-- {
+			if err := os.Remove(backupName(path, n)); err != nil {
+				return err
+			}
+		}
+	}
+	for i := n; i > 0; i-- {
+		if err := os.Rename(backupName(path, i), backupName(path, i+1)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(path, backupName(path, 1))
+}
+
+// Backups 按从新到旧的顺序返回 path 已有的备份
+func Backups(path string) []string {
+	out := make([]string, 0)
+	for i := 1; ; i++ {
+		name := backupName(path, i)
+		if _, err := os.Stat(name); err != nil {
+			return out
+		}
+		out = append(out, name)
+	}
+}
+
+func backupName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
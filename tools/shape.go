@@ -0,0 +1,63 @@
+package tools
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/sbunce/bson"
+)
+
+// Shape 将查询条件中的字面值替换为 "?"，只保留字段名与操作符，
+// 用于日志脱敏以及按查询形状聚合。数组只保留不同形状的元素，因此 $in 的长度不影响结果
+func Shape(v interface{}) string {
+	var b strings.Builder
+	writeShape(&b, v)
+	return b.String()
+}
+
+func writeShape(b *strings.Builder, v interface{}) {
+	switch d := v.(type) {
+	case protocol.Document:
+		b.WriteByte('{')
+		for i, it := range d {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strconv.Quote(it.Key))
+			b.WriteByte(':')
+			writeShape(b, it.Val)
+		}
+		b.WriteByte('}')
+	case bson.Map:
+		// bson.Map 没有顺序，按字段名排序保证同一形状输出一致
+		keys := make([]string, 0, len(d))
+		for k := range d {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		doc := make(protocol.Document, 0, len(d))
+		for _, k := range keys {
+			doc = append(doc, protocol.Pair{Key: k, Val: d[k]})
+		}
+		writeShape(b, doc)
+	case bson.Array:
+		b.WriteByte('[')
+		seen := make(map[string]bool, len(d))
+		for _, it := range d {
+			s := Shape(it)
+			if seen[s] {
+				continue
+			}
+			if len(seen) > 0 {
+				b.WriteByte(',')
+			}
+			seen[s] = true
+			b.WriteString(s)
+		}
+		b.WriteByte(']')
+	default:
+		b.WriteString(`"?"`)
+	}
+}
@@ -1,6 +1,10 @@
 package tools
 
 import (
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/jjeffcaii/mongo-proxy/protocol"
 	"github.com/sbunce/bson"
 )
@@ -95,6 +99,8 @@ func LookupBinary(doc protocol.Document, key string) []byte {
 			switch v := p.Val.(type) {
 			case bson.Binary:
 				return v
+			case protocol.Binary:
+				return v.Data
 			case []byte:
 				return v
 			}
@@ -120,3 +126,132 @@ func LookupInt32(doc protocol.Document, key string) int32 {
 	}
 	return 0
 }
+
+// 以下按类型查找字段，字段不存在或类型不符时 ok 为 false
+
+// LookupBinarySubtype 查找二进制字段及其子类型
+func LookupBinarySubtype(doc protocol.Document, key string) (subtype byte, data []byte, ok bool) {
+	v, _ := protocol.Load(doc, key)
+	switch b := v.(type) {
+	case bson.Binary:
+		return protocol.BinaryGeneric, b, true
+	case []byte:
+		return protocol.BinaryGeneric, b, true
+	case protocol.Binary:
+		return b.Subtype, b.Data, true
+	}
+	return 0, nil, false
+}
+
+// LookupUUID 查找子类型为 0x03 或 0x04 的 UUID，返回 8-4-4-4-12 形式
+func LookupUUID(doc protocol.Document, key string) (string, bool) {
+	v, _ := protocol.Load(doc, key)
+	if b, ok := v.(protocol.Binary); ok {
+		return b.UUID()
+	}
+	return "", false
+}
+
+func LookupObjectID(doc protocol.Document, key string) (bson.ObjectId, bool) {
+	v, _ := protocol.Load(doc, key)
+	id, ok := v.(bson.ObjectId)
+	return id, ok && len(id) == 12
+}
+
+// LookupTime 查找 UTC 时间字段
+func LookupTime(doc protocol.Document, key string) (time.Time, bool) {
+	v, _ := protocol.Load(doc, key)
+	switch t := v.(type) {
+	case bson.UTCDateTime:
+		return time.UnixMilli(int64(t)).UTC(), true
+	case time.Time:
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// LookupTimestamp 查找内部时间戳，t 为秒，i 为同一秒内的序号
+func LookupTimestamp(doc protocol.Document, key string) (t, i uint32, ok bool) {
+	v, _ := protocol.Load(doc, key)
+	if ts, ok := v.(bson.Timestamp); ok {
+		t, i = protocol.Timestamp(ts)
+		return t, i, true
+	}
+	return 0, 0, false
+}
+
+func LookupDecimal128(doc protocol.Document, key string) (protocol.Decimal128, bool) {
+	v, _ := protocol.Load(doc, key)
+	d, ok := v.(protocol.Decimal128)
+	return d, ok
+}
+
+func LookupRegex(doc protocol.Document, key string) (bson.Regexp, bool) {
+	v, _ := protocol.Load(doc, key)
+	re, ok := v.(bson.Regexp)
+	return re, ok
+}
+
+func LookupDBPointer(doc protocol.Document, key string) (bson.DBPointer, bool) {
+	v, _ := protocol.Load(doc, key)
+	ptr, ok := v.(bson.DBPointer)
+	return ptr, ok
+}
+
+// LookupJavascript 查找 JavaScript 代码，带作用域时同时返回作用域
+func LookupJavascript(doc protocol.Document, key string) (code string, scope protocol.Document, ok bool) {
+	v, _ := protocol.Load(doc, key)
+	switch c := v.(type) {
+	case bson.Javascript:
+		return string(c), nil, true
+	case protocol.CodeWithScope:
+		return c.Code, c.Scope, true
+	case bson.JavascriptScope:
+		scope, _ = AsDocument(c.Scope)
+		return c.Javascript, scope, true
+	}
+	return "", nil, false
+}
+
+// LookupMinKey 与 LookupMaxKey 判断字段是否为 MinKey 或 MaxKey
+func LookupMinKey(doc protocol.Document, key string) bool {
+	v, _ := protocol.Load(doc, key)
+	_, ok := v.(bson.MinKey)
+	return ok
+}
+
+func LookupMaxKey(doc protocol.Document, key string) bool {
+	v, _ := protocol.Load(doc, key)
+	_, ok := v.(bson.MaxKey)
+	return ok
+}
+
+// Lookup 按 "a.b.0.c" 形式的路径查找值，支持嵌套文档与数组下标
+func Lookup(doc protocol.Document, path string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		switch v := cur.(type) {
+		case protocol.Document:
+			val, ok := protocol.Load(v, key)
+			if !ok {
+				return nil, false
+			}
+			cur = val
+		case bson.Map:
+			val, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			cur = val
+		case bson.Array:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			cur = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
@@ -0,0 +1,103 @@
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Exporter 接收已结束的 Span
+type Exporter interface {
+	Export(span *Span) error
+}
+
+// MemoryExporter 将 Span 保存在内存中，用于测试
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+func (p *MemoryExporter) Export(span *Span) error {
+	p.mu.Lock()
+	p.spans = append(p.spans, span)
+	p.mu.Unlock()
+	return nil
+}
+
+// Spans 按结束顺序返回已导出的 Span
+func (p *MemoryExporter) Spans() []*Span {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Span(nil), p.spans...)
+}
+
+// Find 返回第一个名称匹配的 Span
+func (p *MemoryExporter) Find(name string) *Span {
+	for _, it := range p.Spans() {
+		if it.Name == name {
+			return it
+		}
+	}
+	return nil
+}
+
+func (p *MemoryExporter) Reset() {
+	p.mu.Lock()
+	p.spans = nil
+	p.mu.Unlock()
+}
+
+// WriterExporter 每个 Span 输出一行 JSON
+type WriterExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+// NewStdoutExporter 输出到标准输出
+func NewStdoutExporter() *WriterExporter {
+	return NewWriterExporter(os.Stdout)
+}
+
+type spanRecord struct {
+	TraceID    string                 `json:"traceId"`
+	SpanID     string                 `json:"spanId"`
+	ParentID   string                 `json:"parentId,omitempty"`
+	Name       string                 `json:"name"`
+	Start      time.Time              `json:"start"`
+	DurationUs int64                  `json:"durationUs"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+func (p *WriterExporter) Export(span *Span) error {
+	rec := spanRecord{
+		TraceID:    span.Context.TraceID.String(),
+		SpanID:     span.Context.SpanID.String(),
+		Name:       span.Name,
+		Start:      span.StartTime,
+		DurationUs: span.Duration().Microseconds(),
+		Attributes: span.Attributes,
+		Error:      span.Error,
+	}
+	if span.Parent.IsValid() {
+		rec.ParentID = span.Parent.String()
+	}
+	bs, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err = p.w.Write(append(bs, '\n'))
+	return err
+}
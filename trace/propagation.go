@@ -0,0 +1,87 @@
+package trace
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/jjeffcaii/mongo-proxy/tools"
+)
+
+// Traceparent 按 W3C Trace Context 格式输出，如 00-<trace-id>-<span-id>-01
+func (p SpanContext) Traceparent() string {
+	flags := "00"
+	if p.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", p.TraceID, p.SpanID, flags)
+}
+
+// ParseTraceparent 解析 W3C traceparent，全零的 id 视为无效
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// 版本 00 只允许 4 段，更高版本可以追加字段
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// FromComment 从命令的 comment 中提取链路上下文，支持以下形式：
+// "00-…-…-01"、"traceparent=00-…-…-01" 或混在其他文本中以空白、逗号、分号分隔，
+// 以及 {traceparent: "00-…-…-01"} 形式的文档
+func FromComment(comment interface{}) (SpanContext, bool) {
+	if doc, ok := tools.AsDocument(comment); ok {
+		v, _ := protocol.Load(doc, "traceparent")
+		comment = v
+	}
+	s, ok := tools.String(comment)
+	if !ok {
+		return SpanContext{}, false
+	}
+	for _, token := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == ',' || r == ';'
+	}) {
+		for _, prefix := range []string{"traceparent=", "traceparent:"} {
+			token = strings.TrimPrefix(token, prefix)
+		}
+		if sc, ok := ParseTraceparent(token); ok {
+			return sc, true
+		}
+	}
+	return SpanContext{}, false
+}
+
+// Extract 从请求的 comment 中提取链路上下文，旧版查询使用 $comment
+func Extract(msg protocol.Message) (SpanContext, bool) {
+	if cmd, ok := protocol.ParseCommand(msg); ok {
+		v, _ := protocol.Load(cmd.Args, "comment")
+		return FromComment(v)
+	}
+	if q, ok := msg.(*protocol.OpQuery); ok {
+		v, _ := protocol.Load(q.Query, "$comment")
+		return FromComment(v)
+	}
+	return SpanContext{}, false
+}
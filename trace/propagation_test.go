@@ -0,0 +1,59 @@
+package trace
+
+import (
+	"testing"
+
+	"github.com/jjeffcaii/mongo-proxy/protocol"
+	"github.com/sbunce/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromComment(t *testing.T) {
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	for _, comment := range []interface{}{
+		bson.String(tp),
+		bson.String("checkout; traceparent=" + tp),
+		protocol.Document{{Key: "traceparent", Val: bson.String(tp)}},
+		bson.Map{"traceparent": bson.String(tp)},
+	} {
+		sc, ok := FromComment(comment)
+		if assert.True(t, ok, "%v", comment) {
+			assert.Equal(t, tp, sc.Traceparent())
+		}
+	}
+	for _, bad := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, ok := FromComment(bson.String(bad))
+		assert.False(t, ok, bad)
+	}
+}
+
+func TestSpanExport(t *testing.T) {
+	exporter := NewMemoryExporter()
+	tracer := NewTracer(exporter)
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	root := tracer.Start("request", parent)
+	root.Child("backend").SetAttribute("net.peer", "127.0.0.1:27017").End()
+	root.End()
+	// 上游未采样时不导出
+	assert.Empty(t, exporter.Spans())
+
+	root = tracer.Start("request", SpanContext{})
+	child := root.Child("backend")
+	child.End()
+	root.End()
+	root.End()
+	spans := exporter.Spans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, root.Context.TraceID, child.Context.TraceID)
+	assert.Equal(t, root.Context.SpanID, child.Parent)
+
+	var nilSpan *Span
+	assert.Nil(t, nilSpan.Child("x"))
+	nilSpan.SetAttribute("k", 1).End()
+}
@@ -0,0 +1,184 @@
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// TraceID 16 字节的链路 id
+type TraceID [16]byte
+
+func (p TraceID) String() string {
+	return hex.EncodeToString(p[:])
+}
+
+func (p TraceID) IsValid() bool {
+	return p != TraceID{}
+}
+
+// SpanID 8 字节的 span id
+type SpanID [8]byte
+
+func (p SpanID) String() string {
+	return hex.EncodeToString(p[:])
+}
+
+func (p SpanID) IsValid() bool {
+	return p != SpanID{}
+}
+
+// SpanContext 跨进程传播的链路上下文
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (p SpanContext) IsValid() bool {
+	return p.TraceID.IsValid() && p.SpanID.IsValid()
+}
+
+// Span 一段有起止时间的操作，所有方法对 nil 安全，未启用追踪时调用方无需判断
+type Span struct {
+	Name       string
+	Context    SpanContext
+	Parent     SpanID
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes map[string]interface{}
+	// Error 非空表示操作失败
+	Error string
+
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+// SetAttribute 设置属性，Span 结束后的修改被忽略
+func (p *Span) SetAttribute(key string, value interface{}) *Span {
+	if p == nil {
+		return p
+	}
+	p.mu.Lock()
+	if !p.ended {
+		p.Attributes[key] = value
+	}
+	p.mu.Unlock()
+	return p
+}
+
+// Attribute 返回属性值
+func (p *Span) Attribute(key string) interface{} {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Attributes[key]
+}
+
+// SetError 标记操作失败，err 为 nil 时不做处理
+func (p *Span) SetError(err error) *Span {
+	if p == nil || err == nil {
+		return p
+	}
+	p.mu.Lock()
+	if !p.ended {
+		p.Error = err.Error()
+	}
+	p.mu.Unlock()
+	return p
+}
+
+// Child 以当前时间开始一个子 Span
+func (p *Span) Child(name string) *Span {
+	return p.ChildAt(name, time.Now())
+}
+
+// ChildAt 以指定时间开始一个子 Span
+func (p *Span) ChildAt(name string, start time.Time) *Span {
+	if p == nil {
+		return nil
+	}
+	return p.tracer.StartAt(name, p.Context, start)
+}
+
+// End 结束 Span 并交给导出器，重复调用只生效一次
+func (p *Span) End() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.ended {
+		p.mu.Unlock()
+		return
+	}
+	p.ended = true
+	p.EndTime = time.Now()
+	p.mu.Unlock()
+	if p.Context.Sampled {
+		p.tracer.export(p)
+	}
+}
+
+// Duration 返回 Span 的耗时，未结束时为 0
+func (p *Span) Duration() time.Duration {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.ended {
+		return 0
+	}
+	return p.EndTime.Sub(p.StartTime)
+}
+
+// Tracer 创建 Span 并在结束时交给 Exporter
+type Tracer struct {
+	Exporter Exporter
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{Exporter: exporter}
+}
+
+// Start 以当前时间开始一个 Span，parent 无效时开始新的链路
+func (p *Tracer) Start(name string, parent SpanContext) *Span {
+	return p.StartAt(name, parent, time.Now())
+}
+
+// StartAt 以指定时间开始一个 Span
+func (p *Tracer) StartAt(name string, parent SpanContext, start time.Time) *Span {
+	if p == nil {
+		return nil
+	}
+	span := &Span{
+		Name:       name,
+		StartTime:  start,
+		Attributes: make(map[string]interface{}),
+		tracer:     p,
+	}
+	if parent.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.Parent = parent.SpanID
+	} else {
+		rand.Read(span.Context.TraceID[:])
+		span.Context.Sampled = true
+	}
+	rand.Read(span.Context.SpanID[:])
+	return span
+}
+
+func (p *Tracer) export(span *Span) {
+	if p.Exporter == nil {
+		return
+	}
+	if err := p.Exporter.Export(span); err != nil {
+		log.Printf("[trace] export span %s failed: %v", span.Name, err)
+	}
+}
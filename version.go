@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// version 发布时通过 -ldflags "-X main.version=v1.2.3" 设置
+var version = "dev"
+
+func runVersion(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("version", stderr)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	revision, modified := "unknown", false
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, it := range info.Settings {
+			switch it.Key {
+			case "vcs.revision":
+				revision = it.Value
+			case "vcs.modified":
+				modified = it.Value == "true"
+			}
+		}
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	fmt.Fprintf(stdout, "mongo-proxy %s (revision %s, %s %s/%s)\n", version, revision, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return exitOK
+}